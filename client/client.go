@@ -15,13 +15,17 @@ type Client struct {
 	*AuthedClient
 }
 
-// New initializes an API client for the specified host
+// New initializes an API client for the specified host. The auth key is sent as a bearer token.
 func New(host string, authKey string) *Client {
+	if authKey != "" {
+		authKey = "Bearer " + authKey
+	}
 	ac := NewAuthedClient(authKey, host)
 	return &Client{ac}
 }
 
-// TorrentDelete will delete the torrent matching the info_hash provided
+// TorrentDelete will soft delete the torrent matching the info_hash provided. It can be
+// restored until it is hard deleted
 func (c *Client) TorrentDelete(ih store.InfoHash) error {
 	_, err := c.Exec(Opts{
 		Method: "DELETE",
@@ -18,6 +18,7 @@ import (
 var (
 	host   = "http://localhost:34100"
 	server *http.Server
+	tkr    *tracker.Tracker
 	ihStr  = "ff503e9ca036f1647c2dfc1337b163e2c54f13f8"
 )
 
@@ -30,6 +31,17 @@ func TestClient_Torrent(t *testing.T) {
 
 }
 
+func TestClient_UserAdd(t *testing.T) {
+	c := New(host, api.DefaultAuthKey)
+	// Users sent without multipliers, as older clients do, must still earn credit
+	user := store.User{UserID: 9001, Passkey: "client00000000000000"}
+	require.NoError(t, c.UserAdd(user))
+	var added store.User
+	require.NoError(t, tkr.UserGet(&added, user.Passkey))
+	require.Equal(t, 1.0, added.UploadMultiplier())
+	require.Equal(t, 1.0, added.DownloadMultiplier())
+}
+
 func TestClient_Ping(t *testing.T) {
 	c := New(host, api.DefaultAuthKey)
 	require.NoError(t, c.Ping())
@@ -37,10 +49,12 @@ func TestClient_Ping(t *testing.T) {
 
 func TestMain(m *testing.M) {
 	ctx := context.Background()
-	tkr, err := tracker.NewTestTracker()
+	var err error
+	tkr, err = tracker.NewTestTracker()
 	if err != nil {
 		log.Fatalf("Failed to init tracker: %s", err)
 	}
+	tkr.APIKey = api.DefaultAuthKey
 	handler := tracker.NewAPIHandler(tkr)
 	parsedHost, err := url.Parse(host)
 	if err != nil {
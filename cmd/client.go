@@ -193,7 +193,7 @@ var userAddCmd = &cobra.Command{
 		if passkey == "" {
 			passkey = util.NewPasskey()
 		}
-		var user store.User
+		user := store.User{MultiUp: 1, MultiDn: 1}
 		user.Passkey = passkey
 		user.UserID = uint32(idVal)
 		if err := c.UserAdd(user); err != nil {
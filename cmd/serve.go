@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/leighmacdonald/mika/config"
 	"github.com/leighmacdonald/mika/geo"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/leighmacdonald/mika/tracker"
 	"github.com/leighmacdonald/mika/util"
@@ -20,24 +21,107 @@ var serveCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		ctx := context.Background()
 
+		// The torrent store is opened first so persisted config values can be applied
+		// before any options are read
+		ts, err := store.NewTorrentStore(
+			config.GetString(config.StoreTorrentType),
+			config.GetStoreConfig(config.Torrent))
+		if err != nil {
+			log.Fatalf("Failed to setup torrent store: %s", err)
+		}
+		if config.GetBool(config.TrackerPersistConfig) {
+			if err := tracker.LoadPersistedConfig(ts); err != nil {
+				log.Fatalf("Failed to load persisted config: %s", err)
+			}
+		}
 		opts := tracker.NewDefaultOpts()
 		opts.GeodbEnabled = config.GetBool(config.GeodbEnabled)
+		opts.GeodbCacheSize = config.GetInt(config.GeodbCacheSize)
+		opts.GeodbCacheTTL = config.GetDuration(config.GeodbCacheTTL)
+		opts.GeodbUpdateInterval = config.GetDuration(config.GeodbUpdateInterval)
 		opts.BatchInterval = config.GetDuration(config.TrackerBatchUpdateInterval)
 		opts.ReaperInterval = config.GetDuration(config.TrackerReaperInterval)
+		opts.ReaperMultiplier = config.GetInt(config.TrackerReaperMultiplier)
+		opts.ReaperDryRun = config.GetBool(config.TrackerReaperDryRun)
+		opts.TorrentPruneInterval = config.GetDuration(config.TrackerTorrentPruneInterval)
+		opts.TorrentPruneAge = config.GetDuration(config.TrackerTorrentPruneAge)
+		opts.TorrentPruneDryRun = config.GetBool(config.TrackerTorrentPruneDryRun)
+		opts.IgnoreRepeatedStarted = config.GetBool(config.TrackerIgnoreRepeatedStarted)
 		opts.AnnInterval = config.GetDuration(config.TrackerAnnounceInterval)
 		opts.AnnIntervalMin = config.GetDuration(config.TrackerAnnounceIntervalMin)
+		opts.AnnIntervalScale = config.GetString(config.TrackerAnnounceIntervalScale)
+		opts.AnnIntervalScalePeers = config.GetInt(config.TrackerAnnounceIntervalScalePeers)
+		opts.AnnIntervalMax = config.GetDuration(config.TrackerAnnounceIntervalMax)
+		opts.AnnIntervalJitter = config.GetFloat64(config.TrackerAnnounceIntervalJitter)
+		opts.MaxPeers = config.GetInt(config.TrackerMaxPeers)
 		opts.AllowNonRoutable = config.GetBool(config.TrackerAllowNonRoutable)
 		opts.AutoRegister = config.GetBool(config.TrackerAutoRegister)
+		opts.RejectMissingPort = config.GetBool(config.TrackerRejectMissingPort)
+		opts.IPv6 = config.GetBool(config.TrackerIPv6)
+		opts.IPv6Only = config.GetBool(config.TrackerIPv6Only)
+		if opts.IPv6Only && !config.GetBool(config.TrackerIPv6) {
+			log.Fatalf("%s requires %s to be enabled", config.TrackerIPv6Only, config.TrackerIPv6)
+		}
 		opts.Public = config.GetBool(config.TrackerPublic)
 		opts.TorrentCacheEnabled = config.GetBool(config.StoreTorrentCache)
 		opts.PeerCacheEnabled = config.GetBool(config.StorePeersCache)
 		opts.UserCacheEnabled = config.GetBool(config.StoreUsersCache)
-		ts, err := store.NewTorrentStore(
-			config.GetString(config.StoreTorrentType),
-			config.GetStoreConfig(config.Torrent))
-		if err != nil {
-			log.Fatalf("Failed to setup torrent store: %s", err)
+		opts.UserStatsWriteBehind = config.GetBool(config.StoreUsersStatsWriteBehind)
+		opts.StatsEnabled = config.GetBool(config.TrackerStatsEnabled)
+		opts.BonusEnabled = config.GetBool(config.TrackerBonusEnabled)
+		opts.BonusRate = config.GetFloat64(config.TrackerBonusRate)
+		opts.HNRThreshold = config.GetDuration(config.TrackerHNRThreshold)
+		opts.ClassMultiUp = config.GetFloat64Map(config.TrackerClassMultiUp)
+		opts.ClassMultiDn = config.GetFloat64Map(config.TrackerClassMultiDn)
+		opts.ClassAnnIntervals = config.GetDurationMap(config.TrackerClassAnnounceInterval)
+		opts.DenyListReason = config.GetString(config.TrackerDenyListReason)
+		opts.AllowedUsersReason = config.GetString(config.TrackerAllowedUsersReason)
+		opts.UnauthorizedReason = config.GetString(config.TrackerUnauthorizedReason)
+		opts.ClientReason = config.GetString(config.TrackerClientReason)
+		opts.AllowEmptyWhitelist = config.GetBool(config.TrackerAllowEmptyWhitelist)
+		opts.FailureStatusOK = config.GetBool(config.TrackerFailureStatusOK)
+		opts.MinRatio = config.GetFloat64(config.TrackerMinRatio)
+		opts.LowRatioMessage = config.GetString(config.TrackerLowRatioMessage)
+		opts.RatioRefreshInterval = config.GetDuration(config.TrackerRatioRefreshInterval)
+		opts.PasskeyHeader = config.GetString(config.TrackerPasskeyHeader)
+		opts.PasskeyHTTPS = config.GetString(config.TrackerPasskeyHTTPS)
+		opts.TrustedProxies = config.GetStringSlice(config.TrackerTrustedProxies)
+		opts.PasskeyLengths = config.GetIntSlice(config.TrackerPasskeyLengths)
+		opts.StoreDegradedMode = config.GetBool(config.TrackerStoreDegradedMode)
+		opts.DegradedInterval = config.GetDuration(config.TrackerDegradedInterval)
+		opts.BreakerThreshold = config.GetInt(config.TrackerStoreBreakerThreshold)
+		opts.BreakerProbeInterval = config.GetDuration(config.TrackerStoreBreakerProbeInterval)
+		opts.NormalizeResponses = config.GetBool(config.TrackerNormalizeResponses)
+		opts.ResponsePadSize = config.GetInt(config.TrackerResponsePadSize)
+		opts.ScrapeIncludeName = config.GetBool(config.TrackerScrapeIncludeName)
+		opts.MaxURLLength = config.GetInt(config.TrackerMaxURLLength)
+		opts.AcceptHexInfoHash = config.GetBool(config.TrackerAcceptHexInfoHash)
+		opts.MemoryMapMaxSize = config.GetInt(config.TrackerMemoryMapMaxSize)
+		opts.MaxAnnouncesPerInfoHash = config.GetInt(config.TrackerMaxAnnouncesPerInfoHash)
+		opts.PeerIDMatch = config.GetString(config.TrackerPeerIDMatch)
+		opts.DuplicatePeerID = config.GetString(config.TrackerDuplicatePeerID)
+		opts.CompletedCheck = config.GetString(config.TrackerCompletedCheck)
+		opts.CompletedTolerance = config.GetFloat64(config.TrackerCompletedTolerance)
+		opts.AnnounceHistorySize = config.GetInt(config.TrackerAnnounceHistorySize)
+		opts.AnnounceHistoryMaxAge = config.GetDuration(config.TrackerAnnounceHistoryMaxAge)
+		opts.AnnounceJitterMin = config.GetDuration(config.TrackerAnnounceJitterMin)
+		opts.AnnounceJitterMax = config.GetDuration(config.TrackerAnnounceJitterMax)
+		opts.RateLimitRate = config.GetFloat64(config.TrackerRateLimitRate)
+		opts.RateLimitBurst = config.GetInt(config.TrackerRateLimitBurst)
+		opts.SeedersGetLeechersOnly = config.GetBool(config.TrackerSeedersGetLeechersOnly)
+		opts.ExcludeOwnPeers = config.GetBool(config.TrackerExcludeOwnPeers)
+		opts.PreferLocalPeers = config.GetBool(config.TrackerPreferLocalPeers)
+		opts.CompactPeerList = config.GetBool(config.TrackerCompactPeerList)
+		opts.RedactPeerIPs = config.GetBool(config.APIRedactPeerIPs)
+		opts.APIKey = config.GetString(config.APIKey)
+		if opts.APIKey == "" {
+			log.Printf("No %s set, the admin API is unauthenticated", config.APIKey)
 		}
+		opts.APIMetricsNoAuth = config.GetBool(config.APIMetricsNoAuth)
+		opts.APIMetricsTopTorrents = config.GetInt(config.APIMetricsTopTorrents)
+		opts.AuditLogSize = config.GetInt(config.APIAuditLogSize)
+		opts.MaxPageLimit = config.GetInt(config.APIMaxPageLimit)
+		opts.PersistConfig = config.GetBool(config.TrackerPersistConfig)
 		opts.Torrents = ts
 		p, err2 := store.NewPeerStore(config.GetString(config.StorePeersType),
 			config.GetStoreConfig(config.Peers))
@@ -53,9 +137,22 @@ var serveCmd = &cobra.Command{
 		opts.Users = u
 		var geodb geo.Provider
 		if config.GetBool(config.GeodbEnabled) {
-			geodb, err = geo.New(config.GetString(config.GeodbPath))
-			if err != nil {
-				log.Fatalf("Could not validate geo database. You may need to run ./mika updategeo")
+			geoPath := config.GetString(config.GeodbPath)
+			if !geo.Exists(geoPath) {
+				key := config.GetString(config.GeodbAPIKey)
+				if key == "" {
+					log.Fatalf("No geo database found at %s and no %s set to download it", geoPath, config.GeodbAPIKey)
+				}
+				log.Printf("No geo database found, downloading it to %s", geoPath)
+				if err := geo.DownloadDB(geoPath, key); err != nil {
+					log.Fatalf("Failed to download geo database: %s", err)
+				}
+			}
+			var opened bool
+			geodb, opened = geo.Open(geoPath)
+			if !opened {
+				log.Printf("Running without geo lookups. You may need to run ./mika updategeo")
+				opts.GeodbEnabled = false
 			}
 		} else {
 			geodb = &geo.DummyProvider{}
@@ -66,6 +163,13 @@ var serveCmd = &cobra.Command{
 			log.Fatalf("Failed to initialize tracker: %s", err)
 		}
 		_ = tkr.LoadWhitelist()
+		metrics.SetAnnounceSampleRate(config.GetInt(config.TrackerAnnounceTimeSampleRate))
+		if err := tkr.LoadDenyList(); err != nil {
+			log.Fatalf("Failed to load info_hash denylist: %s", err)
+		}
+		if err := tkr.LoadAllowedUsers(); err != nil {
+			log.Fatalf("Failed to load torrent allowed users: %s", err)
+		}
 
 		btOpts := tracker.DefaultHTTPOpts()
 		btOpts.ListenAddr = config.GetString(config.TrackerListen)
@@ -80,7 +184,25 @@ var serveCmd = &cobra.Command{
 		apiServer := tracker.NewHTTPServer(apiOpts)
 
 		go tkr.PeerReaper()
+		if tkr.TorrentPruneInterval > 0 {
+			go tkr.TorrentPruner()
+		}
+		if tkr.RatioRefreshInterval > 0 {
+			go tkr.RatioRefresher()
+		}
+		if tkr.GeodbUpdateInterval > 0 {
+			go tkr.GeodbUpdater()
+		}
 		go tkr.StatWorker()
+		if influxURL := config.GetString(config.APIMetricsInfluxURL); influxURL != "" {
+			tkr.StartInfluxPusher(influxURL, config.GetDuration(config.APIMetricsInfluxInterval))
+		}
+		if persistInterval := config.GetDuration(config.APIMetricsPersistInterval); persistInterval > 0 {
+			if err := tkr.LoadMetrics(); err != nil {
+				log.Printf("Failed to load persisted metrics: %s", err)
+			}
+			tkr.StartMetricsPersister(persistInterval)
+		}
 
 		go func() {
 			if err := btServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -94,9 +216,20 @@ var serveCmd = &cobra.Command{
 			}
 		}()
 
-		util.WaitForSignal(ctx, func(ctx context.Context) error {
-			if err := apiServer.Shutdown(ctx); err != nil {
-				log.Fatalf("Error closing servers gracefully; %s", err)
+		reloadCtx, stopReload := context.WithCancel(ctx)
+		go util.WaitForReload(reloadCtx, func() {
+			if err := tkr.ReloadConfig(); err != nil {
+				log.Printf("Failed to reload config: %s", err)
+			}
+		})
+
+		util.WaitForSignalTimeout(ctx, config.GetDuration(config.TrackerDrainTimeout), func(ctx context.Context) error {
+			stopReload()
+			if err := tracker.ShutdownHTTPServers(ctx, btServer, apiServer); err != nil {
+				log.Printf("Requests still in-flight after the drain timeout were dropped: %s", err)
+			}
+			if err := tkr.ShutdownMetrics(ctx); err != nil {
+				log.Printf("Metrics jobs did not stop cleanly: %s", err)
 			}
 			return nil
 		})
@@ -9,6 +9,7 @@ import (
 	"github.com/spf13/viper"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -53,16 +54,44 @@ const (
 	// TrackerTLS enables TLS for the tracker component
 	// true|false
 	TrackerTLS Key = "tracker_tls"
-	// TrackerIPv6 enables ipv6 peers
+	// TrackerIPv6 enables ipv6 peers, sent to ipv6 clients in the peers6 key. Enabled by default.
 	// true|false
 	TrackerIPv6 Key = "tracker_ipv6"
-	// TrackerIPv6Only disables ipv4 peers
+	// TrackerIPv6Only disables ipv4 peers, rejecting ipv4 announces and only returning peers6.
+	// Requires TrackerIPv6
 	// true|false
 	TrackerIPv6Only Key = "tracker_ipv6_only"
 	// TrackerReaperInterval defines how often we do a sweep of active swarms looking for stale
 	// peers that can be removed.
 	// 60s|1m
 	TrackerReaperInterval Key = "tracker_reaper_interval"
+	// TrackerReaperMultiplier is how many reaper intervals a peer can go without announcing
+	// before it is reaped
+	// eg: 4
+	TrackerReaperMultiplier Key = "tracker_reaper_multiplier"
+	// TrackerReaperDryRun will log the peers that would be reaped without removing them
+	// from the swarms
+	// true|false
+	TrackerReaperDryRun Key = "tracker_reaper_dry_run"
+	// TrackerTorrentPruneInterval defines how often auto registered torrents without any
+	// activity are pruned. 0 disables the pruner
+	// 0|1h
+	TrackerTorrentPruneInterval Key = "tracker_torrent_prune_interval"
+	// TrackerTorrentPruneAge is how long an auto registered torrent must have no peers and
+	// no announces before it is pruned
+	// 720h
+	TrackerTorrentPruneAge Key = "tracker_torrent_prune_age"
+	// TrackerTorrentPruneDryRun will log the torrents that would be pruned without deleting them
+	// true|false
+	TrackerTorrentPruneDryRun Key = "tracker_torrent_prune_dry_run"
+	// TrackerIgnoreRepeatedStarted treats a started event from a peer that is already active in
+	// the swarm as a regular announce. Some buggy clients send started on every announce.
+	// true|false
+	TrackerIgnoreRepeatedStarted Key = "tracker_ignore_repeated_started"
+	// TrackerAnnounceTimeSampleRate sets how often announce times are recorded for
+	// metrics, 1 in N announces. Higher values reduce overhead under heavy load
+	// eg: 1, 10, 100
+	TrackerAnnounceTimeSampleRate Key = "tracker_announce_time_sample_rate"
 	// TrackerAnnounceInterval defines how often peers should announce. The lower this is
 	// the more load on your system you can expect
 	// 60s|1m
@@ -70,19 +99,254 @@ const (
 	// TrackerAnnounceIntervalMin is the minimum interval a client is allowed
 	// 60s|1m
 	TrackerAnnounceIntervalMin Key = "tracker_announce_interval_min"
-	// TrackerHNRThreshold is how much time must pass before we mark a peer as Hit-N-Run
-	// 1d|12h|60m
+	// TrackerAnnounceIntervalScale raises the announce interval of large swarms to reduce their
+	// load. linear adds one base interval for every tracker_announce_interval_scale_peers peers,
+	// log adds one base interval each time the swarm doubles past that size.
+	// none|linear|log
+	TrackerAnnounceIntervalScale Key = "tracker_announce_interval_scale"
+	// TrackerAnnounceIntervalScalePeers is the swarm size used by the scaling curve
+	// eg: 1000
+	TrackerAnnounceIntervalScalePeers Key = "tracker_announce_interval_scale_peers"
+	// TrackerAnnounceIntervalMax caps scaled intervals. It is limited to 240s so peers announce
+	// before they expire.
+	// 240s|4m
+	TrackerAnnounceIntervalMax Key = "tracker_announce_interval_max"
+	// TrackerAnnounceIntervalJitter randomly raises or lowers the interval and min interval of
+	// each announce response by up to this percentage so clients don't re-announce in step.
+	// The interval never drops below TrackerAnnounceIntervalMin. 0 disables the jitter.
+	// eg: 10
+	TrackerAnnounceIntervalJitter Key = "tracker_announce_interval_jitter"
+	// TrackerHNRThreshold is how long a user must seed a torrent they downloaded from before
+	// leaving its swarm. Leaving sooner records a hit and run, which is cleared once the user
+	// seeds the torrent for this long within a single session. Requires tracker_stats_enabled.
+	// 0 disables hit and run tracking.
+	// eg: 24h
 	TrackerHNRThreshold Key = "tracker_hnr_threshold"
 	// TrackerBatchUpdateInterval defines how often we sync user stats to the back store
 	TrackerBatchUpdateInterval Key = "tracker_batch_update_interval"
 	// TrackerAllowNonRoutable defines whether we allow peers who are using non-public/routable addresses
 	TrackerAllowNonRoutable Key = "tracker_allow_non_routable"
-
+	// TrackerAllowClientIP accepts the ip, ipv4 and ipv6 announce params. The address must match
+	// the connection unless the announce came through one of tracker_trusted_proxies.
+	// true|false
 	TrackerAllowClientIP Key = "tracker_allow_client_ip"
 
+	// TrackerRejectMissingPort will reject announces which do not include a port, or send
+	// a port of 0. By default these peers are accepted but are never handed out to other peers
+	// true|false
+	TrackerRejectMissingPort Key = "tracker_reject_missing_port"
+
+	// TrackerDenyListReason is the failure reason sent to clients announcing a info_hash
+	// that has been added to the denylist
+	// eg: "Torrent has been removed"
+	TrackerDenyListReason Key = "tracker_denylist_reason"
+	// TrackerAllowedUsersReason is the failure reason sent to users announcing a torrent which
+	// is restricted to a list of allowed users they are not on
+	// eg: "You are not allowed to access this torrent"
+	TrackerAllowedUsersReason Key = "tracker_allowed_users_reason"
+	// TrackerUnauthorizedReason is the failure reason sent to announces and scrapes made to a
+	// private tracker without a valid passkey. Ignored in public mode.
+	// eg: "Invalid passkey"
+	TrackerUnauthorizedReason Key = "tracker_unauthorized_reason"
+	// TrackerClientReason is the failure reason sent to clients which are not on the whitelist
+	// eg: "Client not whitelisted"
+	TrackerClientReason Key = "tracker_client_reason"
+	// TrackerAllowEmptyWhitelist allows every client while the client whitelist is empty.
+	// When disabled an empty whitelist rejects all clients.
+	TrackerAllowEmptyWhitelist Key = "tracker_allow_empty_whitelist"
+	// TrackerFailureStatusOK sends failure responses with a HTTP 200 status, which is the
+	// default. When disabled the tracker error code is used as the status, which some clients
+	// treat as a connection error without displaying the failure reason.
+	// true|false
+	TrackerFailureStatusOK Key = "tracker_failure_status_ok"
+	// TrackerMinRatio is the ratio users must keep to receive peers while leeching. Their
+	// announces are still accounted so they can seed back up. 0 disables the check.
+	// eg: 0.5
+	TrackerMinRatio Key = "tracker_min_ratio"
+	// TrackerLowRatioMessage is the warning message sent to leechers below the minimum ratio
+	// eg: "Your ratio is too low to download, seed your torrents to restore access"
+	TrackerLowRatioMessage Key = "tracker_low_ratio_message"
+	// TrackerRatioRefreshInterval is how often the cached ratios used by the minimum ratio check
+	// are recomputed for users whose stats were flushed. 0 disables caching ratios.
+	// 60s|1m
+	TrackerRatioRefreshInterval Key = "tracker_ratio_refresh_interval"
+
+	// TrackerPasskeyHeader is the name of a request header which clients can use to send their
+	// passkey instead of including it in the URL path. The path takes precedence when both are
+	// present. Empty disables header authentication.
+	// eg: X-Passkey
+	TrackerPasskeyHeader Key = "tracker_passkey_header"
+
+	// TrackerPasskeyHTTPS sets how requests sending a passkey over plain HTTP are handled. warn
+	// logs them and enforce rejects them. Requests from tracker_trusted_proxies with a
+	// X-Forwarded-Proto of https count as HTTPS.
+	// off|warn|enforce
+	TrackerPasskeyHTTPS Key = "tracker_passkey_https"
+
+	// TrackerTrustedProxies lists the IPs or CIDR ranges of reverse proxies in front of the
+	// tracker. Their X-Real-IP or X-Forwarded-For header is used as the client IP and their
+	// X-Forwarded-Proto header is used to tell if the client used HTTPS. These headers are
+	// ignored on requests from any other address.
+	// eg: [127.0.0.1, 10.0.0.0/8]
+	TrackerTrustedProxies Key = "tracker_trusted_proxies"
+
+	// TrackerPasskeyLengths is the set of passkey lengths accepted. Passkeys of any other
+	// length are rejected without a store lookup. Multiple lengths are useful when migrating
+	// users from another tracker. An empty list accepts passkeys of any length.
+	// eg: [20, 32]
+	TrackerPasskeyLengths Key = "tracker_passkey_lengths"
+
+	// TrackerStoreDegradedMode will respond to announces using cached data when the backing
+	// stores are unavailable instead of returning an error to the client
+	// true|false
+	TrackerStoreDegradedMode Key = "tracker_store_degraded_mode"
+	// TrackerDegradedInterval is the announce interval sent to clients in degraded responses
+	// eg: 300s, 10m
+	TrackerDegradedInterval Key = "tracker_degraded_interval"
+	// TrackerStoreBreakerThreshold is the count of consecutive store failures after which
+	// announces are answered in degraded mode without calling the store. Requires degraded
+	// mode, 0 disables the breaker.
+	// eg: 10
+	TrackerStoreBreakerThreshold Key = "tracker_store_breaker_threshold"
+	// TrackerStoreBreakerProbeInterval is how often a single announce is sent to the store
+	// while the breaker is open to check if it has recovered
+	// eg: 30s
+	TrackerStoreBreakerProbeInterval Key = "tracker_store_breaker_probe_interval"
+
+	// TrackerNormalizeResponses makes announce responses always use the same sorted set of keys
+	// so they are harder to fingerprint
+	// true|false
+	TrackerNormalizeResponses Key = "tracker_normalize_responses"
+	// TrackerResponsePadSize pads normalized announce responses up to a multiple of this many
+	// bytes, 0 disables padding
+	// eg: 0, 256, 512
+	TrackerResponsePadSize Key = "tracker_response_pad_size"
+	// TrackerScrapeIncludeName adds the torrents release name to scrape responses as the name
+	// extension key. Ignored for public trackers.
+	// true|false
+	TrackerScrapeIncludeName Key = "tracker_scrape_include_name"
+
+	// TrackerMaxURLLength rejects announces with a URL (path and query) longer than this many
+	// bytes before parsing them, 0 disables the limit. They are always sent a 414 status,
+	// regardless of TrackerFailureStatusOK.
+	// eg: 2048
+	TrackerMaxURLLength Key = "tracker_max_url_length"
+	// TrackerAcceptHexInfoHash accepts announce and scrape info_hashes sent as 40 character hex,
+	// in any case, by broken clients instead of the raw 20 bytes
+	// true|false
+	TrackerAcceptHexInfoHash Key = "tracker_accept_hex_info_hash"
+
+	// TrackerMemoryMapMaxSize caps the number of entries each in-memory per passkey or per peer
+	// map (rate limiters, dedup windows) may hold. The least recently used entries are evicted
+	// past this size.
+	// eg: 100000
+	TrackerMemoryMapMaxSize Key = "tracker_memory_map_max_size"
+
+	// TrackerAnnounceJitterMin and TrackerAnnounceJitterMax bound a random delay added to
+	// announces from a passkey and IP which re-announce before the minimum announce interval.
+	// This slows down peer list harvesting without rejecting the announce. A max of 0 disables it.
+	// eg: 500ms
+	TrackerAnnounceJitterMin Key = "tracker_announce_jitter_min"
+	TrackerAnnounceJitterMax Key = "tracker_announce_jitter_max"
+
+	// TrackerRateLimitRate is the number of announces per minute allowed for each passkey, or
+	// client IP on public trackers, once the burst is used up. Announces over the limit are
+	// rejected. 0 disables rate limiting.
+	// eg: 6
+	TrackerRateLimitRate Key = "tracker_rate_limit_rate"
+	// TrackerRateLimitBurst is the number of announces allowed in quick succession before the
+	// rate limit applies
+	// eg: 10
+	TrackerRateLimitBurst Key = "tracker_rate_limit_burst"
+
+	// TrackerPeerIDMatch sets how announces from clients which omit their peer_id are matched
+	// to their existing peer. key uses the key param, ip_port uses the client IP and port and any
+	// tries both. Matching is limited to the passkey and info_hash of the announce.
+	// none|key|ip_port|any
+	TrackerPeerIDMatch Key = "tracker_peer_id_match"
+	// TrackerDuplicatePeerID sets what happens when a user announces with a peer_id already active
+	// on the torrent under another user. allow updates the existing peer, reject refuses the
+	// announce, flag allows it but adds an audit log entry and separate keys peers by user.
+	// allow|reject|flag|separate
+	TrackerDuplicatePeerID Key = "tracker_duplicate_peer_id"
+	// TrackerCompletedCheck sets what happens to completed events reporting less downloaded
+	// than the torrent size allows for. warn counts the snatch but adds an audit log entry,
+	// reject refuses the announce so the snatch is not counted.
+	// off|warn|reject
+	TrackerCompletedCheck Key = "tracker_completed_check"
+	// TrackerCompletedTolerance is the fraction of the torrent size a completed event may be
+	// short by, allowing for clients which resumed partially downloaded data
+	// eg: 0.1
+	TrackerCompletedTolerance Key = "tracker_completed_tolerance"
+
+	// TrackerAnnounceHistorySize is the number of recent announces kept in memory for each user
+	// for debugging through GET /user/pk/:passkey/announces. 0 disables the history.
+	TrackerAnnounceHistorySize Key = "tracker_announce_history_size"
+	// TrackerAnnounceHistoryMaxAge is how long announces are kept in the history
+	// eg: 1h
+	TrackerAnnounceHistoryMaxAge Key = "tracker_announce_history_max_age"
+
+	// TrackerMaxAnnouncesPerInfoHash limits how many announces for the same torrent are processed
+	// at once. Announces over the limit are told to retry shortly. 0 disables the limit.
+	// eg: 50
+	TrackerMaxAnnouncesPerInfoHash Key = "tracker_max_announces_per_info_hash"
+
 	// TrackerMaxPeers sets the max number of peers to return on an announce
 	TrackerMaxPeers Key = "tracker_max_peers"
 
+	// TrackerSeedersGetLeechersOnly only sends leechers to seeding peers since seeders have no
+	// use for each other. A seeder in a swarm of only seeders receives an empty peer list.
+	// Leechers always receive both seeders and leechers.
+	// true|false
+	TrackerSeedersGetLeechersOnly Key = "tracker_seeders_get_leechers_only"
+	// TrackerExcludeOwnPeers leaves every peer belonging to the announcing user out of their peer
+	// list, not only the announcing peer, so users running several clients on a torrent aren't
+	// sent their own clients.
+	// true|false
+	TrackerExcludeOwnPeers Key = "tracker_exclude_own_peers"
+	// TrackerPreferLocalPeers picks the peers in the announcing peer's country first when a swarm
+	// has more peers than are sent, reducing cross-continent traffic. Requires geodb_enabled.
+	// true|false
+	TrackerPreferLocalPeers Key = "tracker_prefer_local_peers"
+
+	// TrackerCompactPeerList sends compact peers as a list with a string for each peer rather
+	// than the single string defined by BEP 23. Only enable this for clients which need it.
+	// true|false
+	TrackerCompactPeerList Key = "tracker_compact_peer_list"
+
+	// TrackerPersistConfig saves config values changed through the admin API into the torrent
+	// store. Saved values are loaded at startup, overriding those set in the config file.
+	// true|false
+	TrackerPersistConfig Key = "tracker_persist_config"
+
+	// TrackerDrainTimeout is how long in-flight requests are given to complete on shutdown
+	// before their connections are closed. New connections are refused while draining.
+	// eg: 10s
+	TrackerDrainTimeout Key = "tracker_drain_timeout"
+
+	// TrackerStatsEnabled enables the accounting of user, torrent and peer traffic. When disabled
+	// the tracker only maintains swarm membership, suitable for a public tracker.
+	// true|false
+	TrackerStatsEnabled Key = "tracker_stats_enabled"
+	// TrackerBonusEnabled enables accrual of bonus points for users who are seeding
+	// true|false
+	TrackerBonusEnabled Key = "tracker_bonus_enabled"
+	// TrackerBonusRate is the amount of bonus points earned per hour of seeding a single torrent
+	// 1.0|0.25
+	TrackerBonusRate Key = "tracker_bonus_rate"
+
+	// TrackerClassMultiUp and TrackerClassMultiDn map user classes to multipliers applied to
+	// the upload and download amounts credited to users of that class, on top of any
+	// torrent multipliers. Classes not listed use 1.0.
+	// eg: {vip: 1.5, power_user: 1.1}
+	TrackerClassMultiUp Key = "tracker_class_multi_up"
+	TrackerClassMultiDn Key = "tracker_class_multi_dn"
+	// TrackerClassAnnounceInterval maps user classes to the base announce interval sent to users
+	// of that class, eg: a shorter interval for fresher peer lists. Classes not listed use
+	// tracker_announce_interval. The min interval and interval scaling still apply.
+	// eg: {vip: 15s, staff: 15s}
+	TrackerClassAnnounceInterval Key = "tracker_class_announce_interval"
+
 	// APIListen sets the host and port that the admin API should bind to
 	// localhost:34001
 	APIListen Key = "api_listen"
@@ -95,8 +359,38 @@ const (
 	// APIIPv6Only disabled ipv4 to the admin interface
 	// true|false
 	APIIPv6Only Key = "api_ipv6_only"
-	// APIKey Basic key authentication token for API calls
+	// APIKey is the token API calls must send as a bearer token in the Authorization header.
+	// Empty disables authentication.
 	APIKey Key = "api_key"
+	// APIMetricsNoAuth allows GET /metrics without the api key for scrapers which can't send it
+	// true|false
+	APIMetricsNoAuth Key = "api_metrics_no_auth"
+	// APIRedactPeerIPs hides peer IP addresses in API responses listing peers
+	// true|false
+	APIRedactPeerIPs Key = "api_redact_peer_ips"
+	// APIAuditLogSize is the number of torrent and user deletions retained in the audit log
+	// eg: 1000
+	APIAuditLogSize Key = "api_audit_log_size"
+	// APIMaxPageLimit is the most results list endpoints return in one page. Larger limits
+	// requested by clients are reduced to it.
+	// eg: 1000
+	APIMaxPageLimit Key = "api_max_page_limit"
+	// APIMetricsInfluxURL is an InfluxDB write endpoint metrics are pushed to in line protocol.
+	// Empty disables pushing.
+	// eg: http://localhost:8086/write?db=mika
+	APIMetricsInfluxURL Key = "api_metrics_influx_url"
+	// APIMetricsInfluxInterval is how often metrics are pushed to InfluxDB
+	// eg: 10s
+	APIMetricsInfluxInterval Key = "api_metrics_influx_interval"
+	// APIMetricsPersistInterval is how often the monotonic metric counters are saved to the
+	// torrent store so they survive restarts. 0 disables persisting them.
+	// eg: 1m
+	APIMetricsPersistInterval Key = "api_metrics_persist_interval"
+	// APIMetricsTopTorrents adds t_torrent_seeders and t_torrent_leechers gauges labelled by
+	// info_hash for this many of the largest swarms. Each torrent adds two series so keep it
+	// small. Requires tracker_stats_enabled. 0 disables the per torrent metrics.
+	// eg: 25
+	APIMetricsTopTorrents Key = "api_metrics_top_torrents"
 	// StoreTorrentType sets the backing store type to be used for torrents
 	// memory|redis|postgres|mysql|http
 	StoreTorrentType Key = "store_torrent_type"
@@ -144,6 +438,10 @@ const (
 	StoreUsersProperties Key = "store_users_properties"
 	// StoreUsersCache enabled the in-memory cache
 	StoreUsersCache Key = "store_users_cache"
+	// StoreUsersStatsWriteBehind accumulates user stat updates in memory and only writes them
+	// to the store on each batch update. Pending stats are still included when reading users via the API.
+	// true|false
+	StoreUsersStatsWriteBehind Key = "store_users_stats_write_behind"
 
 	// StorePeersType sets the backing store type to be used for peers
 	// memory|redis|postgres|mysql|http
@@ -174,9 +472,20 @@ const (
 	// GeodbAPIKey is the MaxMind.com API key used to download the database
 	// XXXXXXXXXXXXXXXX
 	GeodbAPIKey Key = "geodb_api_key"
-	// GeodbEnabled toggles use of the geo database
+	// GeodbEnabled toggles use of the geo database. A missing database is downloaded at
+	// startup, which requires GeodbAPIKey.
 	// true|false
 	GeodbEnabled Key = "geodb_enabled"
+	// GeodbCacheSize is the maximum number of IP locations kept in memory, 0 disables the cache
+	// 10000
+	GeodbCacheSize Key = "geodb_cache_size"
+	// GeodbCacheTTL is how long a cached IP location is used before it is looked up again
+	// 1h
+	GeodbCacheTTL Key = "geodb_cache_ttl"
+	// GeodbUpdateInterval is how often a fresh geo database is downloaded and swapped in,
+	// requires GeodbAPIKey. 0 disables the updates
+	// 168h
+	GeodbUpdateInterval Key = "geodb_update_interval"
 )
 
 // StoreConfig provides a common config struct for backing stores
@@ -261,11 +570,70 @@ func GetInt(key Key) int {
 	return viper.GetInt(string(key))
 }
 
+// GetStringSlice enforces use of our consts for config keys
+func GetStringSlice(key Key) []string {
+	return viper.GetStringSlice(string(key))
+}
+
+// GetIntSlice enforces use of our consts for config keys
+func GetIntSlice(key Key) []int {
+	return viper.GetIntSlice(string(key))
+}
+
+// GetFloat64 enforces use of our consts for config keys
+func GetFloat64(key Key) float64 {
+	return viper.GetFloat64(string(key))
+}
+
+// GetFloat64Map enforces use of our consts for config keys. Values which are not numbers are
+// skipped. Keys are lowercase as viper does not preserve their case.
+func GetFloat64Map(key Key) map[string]float64 {
+	values := make(map[string]float64)
+	for k, v := range viper.GetStringMap(string(key)) {
+		switch n := v.(type) {
+		case float64:
+			values[k] = n
+		case int:
+			values[k] = float64(n)
+		case string:
+			f, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				log.Warnf("Invalid number for %s.%s: %s", key, k, n)
+				continue
+			}
+			values[k] = f
+		default:
+			log.Warnf("Invalid number for %s.%s: %v", key, k, v)
+		}
+	}
+	return values
+}
+
+// GetDurationMap enforces use of our consts for config keys. Values which are not valid
+// durations are skipped. Keys are lowercase as viper does not preserve their case.
+func GetDurationMap(key Key) map[string]time.Duration {
+	values := make(map[string]time.Duration)
+	for k, v := range viper.GetStringMapString(string(key)) {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Warnf("Invalid duration for %s.%s: %s", key, k, v)
+			continue
+		}
+		values[k] = d
+	}
+	return values
+}
+
 // GetDuration enforces use of our consts for config keys
 func GetDuration(key Key) time.Duration {
 	return viper.GetDuration(string(key))
 }
 
+// Set overrides the value of a config key, taking precedence over the config file and ENV
+func Set(key Key, value interface{}) {
+	viper.Set(string(key), value)
+}
+
 // Read reads in config file and ENV variables if set.
 func Read(cfgFile string) error {
 	// Find home directory.
@@ -296,6 +664,44 @@ func Read(cfgFile string) error {
 
 }
 
+// WriteKeys updates the keys in the config file read by Read, leaving the other values in the
+// file as they are. The file is rewritten by viper so comments and ordering are lost.
+func WriteKeys(values map[Key]interface{}) error {
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		return consts.ErrInvalidConfig
+	}
+	return writeKeys(path, values)
+}
+
+func writeKeys(path string, values map[Key]interface{}) error {
+	// A separate instance only holds the file contents, so defaults, env and overridden
+	// values are not written out
+	file := viper.New()
+	file.SetConfigFile(path)
+	if err := file.ReadInConfig(); err != nil {
+		return err
+	}
+	for k, v := range values {
+		file.Set(string(k), v)
+	}
+	return file.WriteConfig()
+}
+
+// Reload re-reads the config file found by Read, such as after the operator edited it. Values
+// overridden with Set, eg: persisted config values, still take precedence over the file.
+func Reload() error {
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+	level := GetString(GeneralLogLevel)
+	if _, err := log.ParseLevel(level); err != nil {
+		return err
+	}
+	setupLogger(level, GetBool(GeneralLogColour))
+	return nil
+}
+
 func setupLogger(levelStr string, colour bool) {
 	log.SetFormatter(&log.TextFormatter{
 		ForceColors:      colour,
@@ -318,20 +724,86 @@ func init() {
 	viper.SetDefault(string(TrackerPublic), false)
 	viper.SetDefault(string(TrackerListen), "0.0.0.0:34000")
 	viper.SetDefault(string(TrackerTLS), false)
-	viper.SetDefault(string(TrackerIPv6), false)
+	viper.SetDefault(string(TrackerIPv6), true)
 	viper.SetDefault(string(TrackerIPv6Only), false)
 	viper.SetDefault(string(TrackerReaperInterval), "300s")
+	viper.SetDefault(string(TrackerReaperMultiplier), 4)
+	viper.SetDefault(string(TrackerReaperDryRun), false)
+	viper.SetDefault(string(TrackerTorrentPruneInterval), "0s")
+	viper.SetDefault(string(TrackerTorrentPruneAge), "720h")
+	viper.SetDefault(string(TrackerTorrentPruneDryRun), false)
+	viper.SetDefault(string(TrackerIgnoreRepeatedStarted), true)
+	viper.SetDefault(string(TrackerAnnounceTimeSampleRate), 1)
 	viper.SetDefault(string(TrackerAnnounceInterval), "30s")
 	viper.SetDefault(string(TrackerAnnounceIntervalMin), "10s")
-	viper.SetDefault(string(TrackerHNRThreshold), "6h")
+	viper.SetDefault(string(TrackerAnnounceIntervalScale), "none")
+	viper.SetDefault(string(TrackerAnnounceIntervalScalePeers), 1000)
+	viper.SetDefault(string(TrackerAnnounceIntervalMax), "240s")
+	viper.SetDefault(string(TrackerAnnounceIntervalJitter), 0)
+	viper.SetDefault(string(TrackerHNRThreshold), 0)
 	viper.SetDefault(string(TrackerBatchUpdateInterval), "30s")
 	viper.SetDefault(string(TrackerAllowNonRoutable), false)
 	viper.SetDefault(string(TrackerAllowClientIP), false)
+	viper.SetDefault(string(TrackerRejectMissingPort), false)
+	viper.SetDefault(string(TrackerDenyListReason), "Torrent has been removed")
+	viper.SetDefault(string(TrackerAllowedUsersReason), "You are not allowed to access this torrent")
+	viper.SetDefault(string(TrackerUnauthorizedReason), "Invalid passkey")
+	viper.SetDefault(string(TrackerClientReason), "Client not whitelisted")
+	viper.SetDefault(string(TrackerAllowEmptyWhitelist), false)
+	viper.SetDefault(string(TrackerFailureStatusOK), true)
+	viper.SetDefault(string(TrackerMinRatio), 0.0)
+	viper.SetDefault(string(TrackerLowRatioMessage), "Your ratio is too low to download, seed your torrents to restore access")
+	viper.SetDefault(string(TrackerRatioRefreshInterval), "60s")
+	viper.SetDefault(string(TrackerPasskeyHeader), "")
+	viper.SetDefault(string(TrackerPasskeyHTTPS), "off")
+	viper.SetDefault(string(TrackerTrustedProxies), []string{})
+	viper.SetDefault(string(TrackerPasskeyLengths), []int{20})
+	viper.SetDefault(string(TrackerStoreDegradedMode), false)
+	viper.SetDefault(string(TrackerDegradedInterval), "300s")
+	viper.SetDefault(string(TrackerStoreBreakerThreshold), 0)
+	viper.SetDefault(string(TrackerStoreBreakerProbeInterval), "30s")
+	viper.SetDefault(string(TrackerNormalizeResponses), false)
+	viper.SetDefault(string(TrackerResponsePadSize), 0)
+	viper.SetDefault(string(TrackerScrapeIncludeName), false)
+	viper.SetDefault(string(TrackerMaxURLLength), 2048)
+	viper.SetDefault(string(TrackerAcceptHexInfoHash), false)
+	viper.SetDefault(string(TrackerMemoryMapMaxSize), 100000)
+	viper.SetDefault(string(TrackerSeedersGetLeechersOnly), false)
+	viper.SetDefault(string(TrackerExcludeOwnPeers), false)
+	viper.SetDefault(string(TrackerPreferLocalPeers), false)
+	viper.SetDefault(string(TrackerCompactPeerList), false)
+	viper.SetDefault(string(TrackerMaxAnnouncesPerInfoHash), 0)
+	viper.SetDefault(string(TrackerPeerIDMatch), "none")
+	viper.SetDefault(string(TrackerDuplicatePeerID), "allow")
+	viper.SetDefault(string(TrackerCompletedCheck), "off")
+	viper.SetDefault(string(TrackerCompletedTolerance), 0.1)
+	viper.SetDefault(string(TrackerAnnounceHistorySize), 0)
+	viper.SetDefault(string(TrackerAnnounceHistoryMaxAge), "1h")
+	viper.SetDefault(string(TrackerAnnounceJitterMin), "0s")
+	viper.SetDefault(string(TrackerAnnounceJitterMax), "0s")
+	viper.SetDefault(string(TrackerRateLimitRate), 0.0)
+	viper.SetDefault(string(TrackerRateLimitBurst), 10)
+	viper.SetDefault(string(TrackerPersistConfig), false)
+	viper.SetDefault(string(TrackerDrainTimeout), "5s")
+	viper.SetDefault(string(TrackerStatsEnabled), true)
+	viper.SetDefault(string(TrackerBonusEnabled), false)
+	viper.SetDefault(string(TrackerBonusRate), 1.0)
+	viper.SetDefault(string(TrackerClassMultiUp), map[string]float64{})
+	viper.SetDefault(string(TrackerClassMultiDn), map[string]float64{})
+	viper.SetDefault(string(TrackerClassAnnounceInterval), map[string]string{})
 
 	viper.SetDefault(string(APIListen), "0.0.0.0:34001")
 	viper.SetDefault(string(APITLS), false)
 	viper.SetDefault(string(APIIPv6), false)
 	viper.SetDefault(string(APIIPv6Only), false)
+	viper.SetDefault(string(APIRedactPeerIPs), false)
+	viper.SetDefault(string(APIMetricsNoAuth), false)
+	viper.SetDefault(string(APIAuditLogSize), 1000)
+	viper.SetDefault(string(APIMaxPageLimit), 1000)
+	viper.SetDefault(string(APIMetricsInfluxURL), "")
+	viper.SetDefault(string(APIMetricsInfluxInterval), "10s")
+	viper.SetDefault(string(APIMetricsPersistInterval), "0s")
+	viper.SetDefault(string(APIMetricsTopTorrents), 0)
 
 	viper.SetDefault(string(StoreTorrentType), "memory")
 	viper.SetDefault(string(StoreTorrentHost), "")
@@ -356,8 +828,12 @@ func init() {
 	viper.SetDefault(string(StoreUsersPassword), "")
 	viper.SetDefault(string(StoreUsersDatabase), "")
 	viper.SetDefault(string(StoreUsersProperties), "")
+	viper.SetDefault(string(StoreUsersStatsWriteBehind), false)
 
 	viper.SetDefault(string(GeodbEnabled), false)
 	viper.SetDefault(string(GeodbAPIKey), "")
 	viper.SetDefault(string(GeodbPath), "./")
+	viper.SetDefault(string(GeodbCacheSize), 10000)
+	viper.SetDefault(string(GeodbCacheTTL), "1h")
+	viper.SetDefault(string(GeodbUpdateInterval), "0s")
 }
@@ -2,8 +2,13 @@ package config
 
 import (
 	"github.com/leighmacdonald/mika/consts"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestRead(t *testing.T) {
@@ -30,3 +35,26 @@ func TestStoreConfig_DSN(t *testing.T) {
 		"test:pass@tcp(localhost:5432)/db?arg1=foo&arg2=bar",
 		c.DSN())
 }
+
+func TestWriteKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-config")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	path := filepath.Join(dir, "mika.yaml")
+	const body = "tracker_max_peers: 50\ntracker_listen: \":34000\"\ntracker_announce_interval: 30s\n"
+	require.NoError(t, ioutil.WriteFile(path, []byte(body), 0600))
+
+	require.NoError(t, writeKeys(path, map[Key]interface{}{
+		TrackerMaxPeers:         75,
+		TrackerAnnounceInterval: "90s",
+	}))
+	file := viper.New()
+	file.SetConfigFile(path)
+	require.NoError(t, file.ReadInConfig())
+	require.Equal(t, 75, file.GetInt(string(TrackerMaxPeers)))
+	require.Equal(t, 90*time.Second, file.GetDuration(string(TrackerAnnounceInterval)))
+	require.Equal(t, ":34000", file.GetString(string(TrackerListen)), "Unrelated key not kept")
+	require.False(t, file.IsSet(string(TrackerReaperInterval)), "Default value written")
+
+	require.Error(t, writeKeys(filepath.Join(dir, "missing.yaml"), map[Key]interface{}{TrackerMaxPeers: 1}))
+}
@@ -32,4 +32,6 @@ var (
 	ErrInvalidClient = errors.New("invalid torrent client")
 	// ErrBadResponseCode is returned when a HTTP request returns a non 200 code
 	ErrBadResponseCode = errors.New("bad response code returned")
+	// ErrConflict is returned when trying to update a record that was modified since it was read
+	ErrConflict = errors.New("record was modified by another update")
 )
@@ -1,5 +1,7 @@
 package consts
 
+import "strings"
+
 // AnnounceType is valid announce event values
 type AnnounceType string
 
@@ -13,9 +15,10 @@ const (
 	ANNOUNCE AnnounceType = ""
 )
 
-// ParseAnnounceType returns the AnnounceType from a string
+// ParseAnnounceType returns the AnnounceType from a string. Missing, empty, "none" and
+// unknown events are all treated as a regular periodic announce.
 func ParseAnnounceType(t string) AnnounceType {
-	switch t {
+	switch strings.ToLower(t) {
 	case "started":
 		return STARTED
 	case "stopped":
@@ -24,6 +27,8 @@ func ParseAnnounceType(t string) AnnounceType {
 		return COMPLETED
 	case "paused":
 		return PAUSED
+	case "", "none":
+		return ANNOUNCE
 	default:
 		return ANNOUNCE
 	}
@@ -39,6 +39,9 @@ type (
 	okMsg struct {
 		Message string `json:"message"`
 	}
+	countMsg struct {
+		Count int `json:"count"`
+	}
 )
 
 func errResponse(c *gin.Context, code int, msg string) {
@@ -255,6 +258,33 @@ func (s *ServerExample) torrentSync(c *gin.Context) {
 	c.AbortWithStatus(http.StatusOK)
 }
 
+// getTorrents returns the torrents matching the info_hashes in the body, including deleted
+// torrents which the client filters out itself
+func (s *ServerExample) getTorrents(c *gin.Context) {
+	var hashes []string
+	if err := c.BindJSON(&hashes); err != nil {
+		errResponse(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	req := make([]store.InfoHash, len(hashes))
+	for i, h := range hashes {
+		if err := store.InfoHashFromHex(&req[i], h); err != nil {
+			errResponse(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	torrents, err := s.Torrents.GetMany(req, true)
+	if err != nil {
+		errResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	resp := make([]store.Torrent, 0, len(torrents))
+	for _, t := range torrents {
+		resp = append(resp, t)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
 func (s *ServerExample) peersSync(c *gin.Context) {
 	var batch map[string]store.PeerStats
 	if err := c.BindJSON(&batch); err != nil {
@@ -357,10 +387,35 @@ func (s *ServerExample) peersGet(c *gin.Context) {
 }
 
 func (s *ServerExample) peersReap(c *gin.Context) {
-	s.Peers.Reap()
+	// Peers which have not announced in 10 minutes are treated as gone
+	s.Peers.Reap(time.Now().Add(-time.Minute*10), false)
 	okResponse(c, "reaped")
 }
 
+// countResponse responds with the result of a store Count call
+func countResponse(c *gin.Context, count int, err error) {
+	if err != nil {
+		errResponse(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, countMsg{count})
+}
+
+func (s *ServerExample) getUserCount(c *gin.Context) {
+	count, err := s.Users.Count()
+	countResponse(c, count, err)
+}
+
+func (s *ServerExample) getTorrentCount(c *gin.Context) {
+	count, err := s.Torrents.Count()
+	countResponse(c, count, err)
+}
+
+func (s *ServerExample) peersCount(c *gin.Context) {
+	count, err := s.Peers.Count()
+	countResponse(c, count, err)
+}
+
 // New returns an example HTTP server implementation to test against and learn from
 // Set the Authorization header to the Auth
 func New(listenAddr string, pathPrefix string, authKey string) *http.Server {
@@ -427,6 +482,8 @@ func New(listenAddr string, pathPrefix string, authKey string) *http.Server {
 	s.Router.GET(pathPrefix+"/api/user/pk/:passkey", s.getUserByPasskey)
 	// UserStore.GetByID
 	s.Router.GET(pathPrefix+"/api/user/id/:user_id", s.getUserByID)
+	// UserStore.Count
+	s.Router.GET(pathPrefix+"/api/users/count", s.getUserCount)
 
 	// TorrentStore implementations
 
@@ -444,6 +501,10 @@ func New(listenAddr string, pathPrefix string, authKey string) *http.Server {
 	s.Router.DELETE(pathPrefix+"/api/torrent/:info_hash", s.deleteTorrent)
 	// TorrentStore.Sync
 	s.Router.POST(pathPrefix+"/api/torrent/sync", s.torrentSync)
+	// TorrentStore.Count
+	s.Router.GET(pathPrefix+"/api/torrents/count", s.getTorrentCount)
+	// TorrentStore.GetMany
+	s.Router.POST(pathPrefix+"/api/torrents/get", s.getTorrents)
 
 	// PeerStore implementations
 
@@ -459,6 +520,8 @@ func New(listenAddr string, pathPrefix string, authKey string) *http.Server {
 	s.Router.GET(pathPrefix+"/api/peers/swarm/:info_hash/:count", s.peersGetN)
 	// PeerStore.Get
 	s.Router.GET(pathPrefix+"/api/peer/:info_hash/:peer_id", s.peersGet)
+	// PeerStore.Count
+	s.Router.GET(pathPrefix+"/api/peers/count", s.peersCount)
 
 	return &http.Server{
 		Addr:           s.Addr,
@@ -32,6 +32,7 @@ func extractZip(data []byte, dest string, filename string) error {
 				return err
 			}
 		} else {
+			modified := f.Modified
 			if err := os.MkdirAll(filepath.Dir(path), f.Mode()); err != nil {
 				return err
 			}
@@ -49,6 +50,10 @@ func extractZip(data []byte, dest string, filename string) error {
 			if err != nil {
 				return err
 			}
+			// Keep the entries timestamp so the build date of the database can be determined
+			if err := os.Chtimes(path, modified, modified); err != nil {
+				return err
+			}
 		}
 		return nil
 	}
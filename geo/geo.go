@@ -20,6 +20,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const (
@@ -40,9 +41,19 @@ const (
 // Provider defines our interface for querying geo location data stores
 type Provider interface {
 	GetLocation(ip net.IP) Location
+	Metadata() Metadata
 	Close()
 }
 
+// Metadata describes the currently loaded database
+type Metadata struct {
+	// BuildDate is the release date of the location database
+	BuildDate time.Time `json:"build_date"`
+	// ASNRecords is the number of autonomous system records loaded for each address family
+	ASNRecords4 int `json:"asn_records4"`
+	ASNRecords6 int `json:"asn_records6"`
+}
+
 // DummyProvider is used when we dont want to use this feature. It will always return 0, 0
 type DummyProvider struct{}
 
@@ -54,6 +65,11 @@ func (d *DummyProvider) DownloadDB(_ string, _ string) error {
 // Close does nothing for the dummy provider
 func (d *DummyProvider) Close() {}
 
+// Metadata always returns empty metadata for the dummy provider
+func (d *DummyProvider) Metadata() Metadata {
+	return Metadata{}
+}
+
 // GetLocation will always return 0, 0 coordinates
 func (d *DummyProvider) GetLocation(_ net.IP) Location {
 	return defaultLocation()
@@ -179,8 +195,11 @@ func DownloadDB(outputPath string, apiKey string) error {
 	if apiKey == "" {
 		return errors.New("invalid maxmind api key")
 	}
-	var exitErr error
-	var wg sync.WaitGroup
+	var (
+		exitErr error
+		errMu   sync.Mutex
+		wg      sync.WaitGroup
+	)
 	for _, u := range []dlParam{
 		{dbName: geoDatabaseASN4, fileName: geoDatabaseASNFile4},
 		{dbName: geoDatabaseASN6, fileName: geoDatabaseASNFile6},
@@ -191,6 +210,11 @@ func DownloadDB(outputPath string, apiKey string) error {
 		go func() {
 			if err := dl(req); err != nil {
 				log.Errorf("Failed to download geo database: %s", err.Error())
+				errMu.Lock()
+				if exitErr == nil {
+					exitErr = err
+				}
+				errMu.Unlock()
 			}
 			wg.Done()
 		}()
@@ -199,6 +223,24 @@ func DownloadDB(outputPath string, apiKey string) error {
 	return exitErr
 }
 
+// Install moves the files of a database downloaded into srcPath over the files in dstPath.
+// Databases already opened from dstPath keep reading the replaced files until they are closed.
+func Install(srcPath string, dstPath string) error {
+	files, err := ioutil.ReadDir(srcPath)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read downloaded geo database")
+	}
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if err := os.Rename(filepath.Join(srcPath, f.Name()), filepath.Join(dstPath, f.Name())); err != nil {
+			return errors.Wrapf(err, "Failed to install %s", f.Name())
+		}
+	}
+	return nil
+}
+
 // deg2rad converts degrees to radians
 func deg2rad(d float64) float64 {
 	return d * pi / 180.0
@@ -316,6 +358,7 @@ func (ellipsoid ellipsoid) calculateBearing(lat1, lon1, lat2, lon2 float64) (dis
 type DB struct {
 	sync.RWMutex
 	db        *ip2location.DB
+	buildDate time.Time
 	ellipsoid ellipsoid
 	asn4      []asnRecord
 	asn6      []asnRecord
@@ -334,6 +377,12 @@ func New(path string) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The extracted file keeps the modification time of the archive entry which is
+	// set to the date the database was built
+	var buildDate time.Time
+	if fi, err := os.Stat(filepath.Join(path, geoDatabaseLocationFile)); err == nil {
+		buildDate = fi.ModTime()
+	}
 	var (
 		records4 []asnRecord
 		records6 []asnRecord
@@ -341,6 +390,7 @@ func New(path string) (*DB, error) {
 	for i, asnFileName := range []string{geoDatabaseASNFile4, geoDatabaseASNFile6} {
 		asnFile, err1 := os.Open(filepath.Join(path, asnFileName))
 		if err1 != nil {
+			db.Close()
 			return nil, err1
 		}
 		reader := csv.NewReader(asnFile)
@@ -350,7 +400,12 @@ func New(path string) (*DB, error) {
 				break
 			}
 			if err2 != nil {
-				log.Fatalf("Failed to read csv row: %s", err2.Error())
+				_ = asnFile.Close()
+				db.Close()
+				return nil, errors.Wrapf(err2, "Failed to read csv row from %s", asnFileName)
+			}
+			if len(row) < 5 {
+				continue
 			}
 			_, cidr, err2 := net.ParseCIDR(row[2])
 			if err2 != nil {
@@ -366,10 +421,12 @@ func New(path string) (*DB, error) {
 				records6 = append(records6, asnRecord{net: cidr, ASN: uint32(asNum), AS: row[4]})
 			}
 		}
+		_ = asnFile.Close()
 	}
 	return &DB{
-		RWMutex: sync.RWMutex{},
-		db:      db,
+		RWMutex:   sync.RWMutex{},
+		db:        db,
+		buildDate: buildDate,
 		ellipsoid: ellipsoid{
 			ellipse{6378137.0, 298.257223563}, // WGS84, because why not
 			kilometer,
@@ -380,11 +437,53 @@ func New(path string) (*DB, error) {
 	}, nil
 }
 
+// Exists returns true if all of the database files are present in path. It does not check
+// that they can be opened.
+func Exists(path string) bool {
+	for _, name := range []string{geoDatabaseLocationFile, geoDatabaseASNFile4, geoDatabaseASNFile6} {
+		if !util.Exists(filepath.Join(path, name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Open attempts to open the database at path using New. If the database cannot be opened
+// a warning is logged and a DummyProvider is returned instead so that the tracker can keep
+// running without location data. The returned bool is only true when the real database
+// was opened.
+func Open(path string) (provider Provider, opened bool) {
+	defer func() {
+		// Corrupt database files can cause the parser to panic, treat them as any other error
+		if r := recover(); r != nil {
+			log.Warnf("Geo database at %s is corrupt, disabling geo lookups: %v", path, r)
+			provider, opened = &DummyProvider{}, false
+		}
+	}()
+	db, err := New(path)
+	if err != nil {
+		log.Warnf("Failed to open geo database at %s, disabling geo lookups: %s", path, err)
+		return &DummyProvider{}, false
+	}
+	return db, true
+}
+
 // Close close the underlying memory mapped file
 func (db *DB) Close() {
 	db.db.Close()
 }
 
+// Metadata returns the build date and record counts of the loaded database
+func (db *DB) Metadata() Metadata {
+	db.RLock()
+	defer db.RUnlock()
+	return Metadata{
+		BuildDate:   db.buildDate,
+		ASNRecords4: len(db.asn4),
+		ASNRecords6: len(db.asn6),
+	}
+}
+
 // GetLocation returns the geo location of the input IP addr
 func (db *DB) GetLocation(ip net.IP) Location {
 	const invalidErr = "Invalid IP address."
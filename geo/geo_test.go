@@ -5,6 +5,7 @@ import (
 	"github.com/leighmacdonald/mika/util"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"math"
 	"net"
 	"os"
@@ -114,3 +115,34 @@ func TestMain(m *testing.M) {
 	_ = config.Read("mika_testing")
 	os.Exit(m.Run())
 }
+
+func TestExists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-geo")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	require.False(t, Exists(dir))
+	for _, name := range []string{geoDatabaseLocationFile, geoDatabaseASNFile4} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), nil, 0600))
+	}
+	require.False(t, Exists(dir), "Partial database exists")
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, geoDatabaseASNFile6), nil, 0600))
+	require.True(t, Exists(dir))
+}
+
+func TestOpenFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-geo")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	for _, name := range []string{geoDatabaseLocationFile, geoDatabaseASNFile4, geoDatabaseASNFile6} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte("\x00corrupt\"\n,,"), 0600))
+	}
+	provider, opened := Open(dir)
+	require.False(t, opened, "Corrupt database opened")
+	require.IsType(t, &DummyProvider{}, provider)
+	require.Equal(t, defaultLocation(), provider.GetLocation(net.ParseIP("45.136.241.10")))
+
+	// Missing files fall back the same way
+	provider, opened = Open(filepath.Join(dir, "missing"))
+	require.False(t, opened)
+	require.IsType(t, &DummyProvider{}, provider)
+}
@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Histogram is a snapshot of a cumulative histogram in the prometheus format. Counts[i] is
+// the number of observations less than or equal to Bounds[i].
+type Histogram struct {
+	Bounds []float64
+	Counts []int64
+	Count  int64
+	Sum    float64
+}
+
+// Prometheus returns the histogram in the prometheus text format with a _bucket line per
+// bound followed by the +Inf bucket, _sum and _count
+func (h Histogram) Prometheus(name string) string {
+	var out strings.Builder
+	for i, bound := range h.Bounds {
+		out.WriteString(fmt.Sprintf("%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), h.Counts[i]))
+	}
+	out.WriteString(fmt.Sprintf("%s_bucket{le=\"+Inf\"} %d\n", name, h.Count))
+	out.WriteString(fmt.Sprintf("%s_sum %s\n", name, formatFloat(h.Sum)))
+	out.WriteString(fmt.Sprintf("%s_count %d\n", name, h.Count))
+	return out.String()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
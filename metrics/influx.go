@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// Influx formats the metrics as a single InfluxDB line protocol point using the same field
+// names as the prometheus output. Integer fields carry the i suffix so they are stored as
+// integers rather than floats.
+func (m RuntimeMetrics) Influx(measurement string, tags map[string]string, ts time.Time) string {
+	var out strings.Builder
+	out.WriteString(influxMeasurementEscaper.Replace(measurement))
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	// Sorted tags are recommended by influx for the best write performance
+	sort.Strings(keys)
+	for _, k := range keys {
+		if tags[k] == "" {
+			// Empty tag values are invalid
+			continue
+		}
+		out.WriteString(fmt.Sprintf(",%s=%s", influxTagEscaper.Replace(k), influxTagEscaper.Replace(tags[k])))
+	}
+	v := reflect.ValueOf(m)
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		if t.Field(i).Tag.Get("prom") == "-" {
+			// Labelled series don't fit the single point, they are only sent to prometheus
+			continue
+		}
+		if i == 0 {
+			out.WriteString(" ")
+		} else {
+			out.WriteString(",")
+		}
+		name := influxTagEscaper.Replace(t.Field(i).Tag.Get("prom"))
+		f := v.Field(i)
+		if h, ok := f.Interface().(Histogram); ok {
+			// Influx has no histogram type, the buckets are left to prometheus
+			out.WriteString(fmt.Sprintf("%s_count=%di,%s_sum=%s", name, h.Count, name, formatFloat(h.Sum)))
+			continue
+		}
+		out.WriteString(name)
+		out.WriteString("=")
+		switch f.Kind() {
+		case reflect.Float32, reflect.Float64:
+			out.WriteString(formatFloat(f.Float()))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			out.WriteString(strconv.FormatUint(f.Uint(), 10) + "i")
+		default:
+			out.WriteString(strconv.FormatInt(f.Int(), 10) + "i")
+		}
+	}
+	out.WriteString(fmt.Sprintf(" %d\n", ts.UnixNano()))
+	return out.String()
+}
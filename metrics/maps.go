@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	boundedMapEntriesMu sync.RWMutex
+	boundedMapEntries   map[string]int64
+)
+
+// SetBoundedMapEntries replaces the entry counts reported for each of the in-memory tracking
+// maps, keyed by the map name
+func SetBoundedMapEntries(entries map[string]int64) {
+	boundedMapEntriesMu.Lock()
+	boundedMapEntries = entries
+	boundedMapEntriesMu.Unlock()
+}
+
+func getBoundedMapEntries() map[string]int64 {
+	boundedMapEntriesMu.RLock()
+	defer boundedMapEntriesMu.RUnlock()
+	entries := make(map[string]int64, len(boundedMapEntries))
+	for name, count := range boundedMapEntries {
+		entries[name] = count
+	}
+	return entries
+}
+
+// boundedMapGauges returns the t_bounded_map_entries gauge labelled by map in the prometheus
+// text format
+func boundedMapGauges(entries map[string]int64) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out strings.Builder
+	out.WriteString(fmt.Sprintf("# HELP t_bounded_map_entries %s\n", promHelp["t_bounded_map_entries"]))
+	out.WriteString("# TYPE t_bounded_map_entries gauge\n")
+	for _, name := range names {
+		out.WriteString(fmt.Sprintf("t_bounded_map_entries{map=\"%s\"} %d\n", name, entries[name]))
+	}
+	return out.String()
+}
@@ -6,8 +6,8 @@ import (
 	"runtime"
 	"runtime/debug"
 	"strings"
-	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var promHelp = map[string]string{
@@ -45,12 +45,35 @@ var promHelp = map[string]string{
 	"t_cache_torrents":              "t_cache_torrents is the total count of cached torrents",
 	"t_cache_users":                 "t_cache_users is the total count of cached users",
 	"t_cache_peers":                 "t_cache_peers is the total count of cached peers",
+	"t_torrents":                    "t_torrents is the count of torrents in the backing store",
+	"t_users":                       "t_users is the count of users in the backing store",
+	"t_peers":                       "t_peers is the count of peers in the backing store",
 	"t_ann_total":                   "t_ann_total is the total count of announces",
 	"t_ann_status_ok":               "t_ann_status_ok is the total count of successful announces",
 	"t_ann_status_unauthorized":     "t_ann_status_unauthorized is the total count of unauthorized users requests",
 	"t_ann_status_invalid_infohash": "t_ann_status_invalid_infohash is the total count of invalid info hash requests",
 	"t_ann_status_malformed":        "t_ann_status_malformed is the total count of malformed queries",
-	"t_ann_time_ns":                 "t_ann_time_ns is the average time it takes to fulfill a successful announce in nanoseconds",
+	"t_ann_time_seconds":            "t_ann_time_seconds is the distribution of the time it takes to fulfill a successful announce",
+	"t_ann_status_rate_limited":     "t_ann_status_rate_limited is the total count of announces rejected for exceeding the per passkey or IP rate limit",
+	"t_ann_status_busy":             "t_ann_status_busy is the total count of announces turned away because their torrent hit the concurrent announce limit",
+	"t_ann_status_degraded":         "t_ann_status_degraded is the total count of announces answered in degraded mode due to store errors",
+	"t_peers_reaped":                "t_peers_reaped is the total count of expired peers removed from their swarms by the reaper",
+	"t_reaper_dry_run_peers":        "t_reaper_dry_run_peers is the total count of peers the reaper would have removed in dry-run mode",
+	"t_pruned_torrents":             "t_pruned_torrents is the total count of inactive auto registered torrents removed by the pruner",
+	"t_pruner_dry_run_torrents":     "t_pruner_dry_run_torrents is the total count of torrents the pruner would have removed in dry-run mode",
+	"t_ann_repeated_started":        "t_ann_repeated_started is the total count of started events received from already active peers",
+	"t_ann_repeated_completed":      "t_ann_repeated_completed is the total count of completed events from peers already seeding, which are not counted as snatches",
+	"t_ann_delayed":                 "t_ann_delayed is the total count of announces delayed for arriving before the minimum announce interval",
+	"t_ann_low_ratio":               "t_ann_low_ratio is the total count of leech announces sent no peers because the user is below the minimum ratio",
+	"t_ann_implausible_completed":   "t_ann_implausible_completed is the total count of completed events reporting much less downloaded than the torrent size",
+	"t_ann_duplicate_peer_id":       "t_ann_duplicate_peer_id is the total count of announces using a peer_id active under another user",
+	"t_bounded_map_entries":         "t_bounded_map_entries is the number of entries held in each in-memory tracking map",
+	"t_bounded_map_evictions":       "t_bounded_map_evictions is the total count of entries evicted from full in-memory tracking maps",
+	"t_geo_cache_hits":              "t_geo_cache_hits is the total count of geo lookups served from the cache",
+	"t_geo_cache_misses":            "t_geo_cache_misses is the total count of geo lookups sent to the geo database",
+	"t_store_failures":              "t_store_failures is the total count of store calls which failed with an error other than a missing torrent or peer",
+	"t_store_breaker_state":         "t_store_breaker_state is the state of the store circuit breaker, 0 closed, 1 half-open, 2 open",
+	"t_store_breaker_trips":         "t_store_breaker_trips is the total count of times the store circuit breaker has opened",
 }
 
 var (
@@ -58,47 +81,202 @@ var (
 	PeersTotalCached    int64
 	UsersTotalCached    int64
 
+	// TorrentsTotal, UsersTotal and PeersTotal are the authoritative counts from the stores
+	TorrentsTotal int64
+	UsersTotal    int64
+	PeersTotal    int64
+
 	AnnounceTotal                 int64
 	AnnounceStatusOK              int64
 	AnnounceStatusUnauthorized    int64
 	AnnounceStatusInvalidInfoHash int64
 	AnnounceStatusMalformed       int64
-	execLock                      *sync.Mutex
-	AnnounceExecTimesNs           []int64
+	AnnounceStatusDegraded        int64
+	AnnounceStatusBusy            int64
+	AnnounceStatusRateLimited     int64
+	PeersReaped                   int64
+	ReaperDryRunPeers             int64
+	PrunedTorrents                int64
+	PrunerDryRunTorrents          int64
+	AnnounceRepeatedStarted       int64
+	AnnounceRepeatedCompleted     int64
+	AnnounceDelayed               int64
+	AnnounceDuplicatePeerID       int64
+	AnnounceLowRatio              int64
+	AnnounceImplausibleCompleted  int64
+	BoundedMapEvictions           int64
+	GeoCacheHits                  int64
+	GeoCacheMisses                int64
+	StoreFailures                 int64
+	StoreBreakerState             int64
+	StoreBreakerTrips             int64
+
+	// announceSampleRate records 1 in N announce times, 1 records all of them
+	announceSampleRate int64 = 1
+	announceSeq        uint64
+	announceExecTimes  [execShardCount]execShard
 )
 
+// persistedCounters are the monotonic counters which can be saved to the store so they
+// survive restarts, keyed by metric name
+var persistedCounters = map[string]*int64{
+	"t_ann_total":                   &AnnounceTotal,
+	"t_ann_status_ok":               &AnnounceStatusOK,
+	"t_ann_status_unauthorized":     &AnnounceStatusUnauthorized,
+	"t_ann_status_invalid_infohash": &AnnounceStatusInvalidInfoHash,
+	"t_ann_status_malformed":        &AnnounceStatusMalformed,
+	"t_ann_status_degraded":         &AnnounceStatusDegraded,
+	"t_ann_status_busy":             &AnnounceStatusBusy,
+	"t_ann_status_rate_limited":     &AnnounceStatusRateLimited,
+	"t_peers_reaped":                &PeersReaped,
+	"t_reaper_dry_run_peers":        &ReaperDryRunPeers,
+	"t_pruned_torrents":             &PrunedTorrents,
+	"t_pruner_dry_run_torrents":     &PrunerDryRunTorrents,
+	"t_ann_repeated_started":        &AnnounceRepeatedStarted,
+	"t_ann_repeated_completed":      &AnnounceRepeatedCompleted,
+	"t_ann_delayed":                 &AnnounceDelayed,
+	"t_ann_duplicate_peer_id":       &AnnounceDuplicatePeerID,
+	"t_ann_low_ratio":               &AnnounceLowRatio,
+	"t_ann_implausible_completed":   &AnnounceImplausibleCompleted,
+	"t_bounded_map_evictions":       &BoundedMapEvictions,
+	"t_geo_cache_hits":              &GeoCacheHits,
+	"t_geo_cache_misses":            &GeoCacheMisses,
+	"t_store_failures":              &StoreFailures,
+	"t_store_breaker_trips":         &StoreBreakerTrips,
+}
+
+// Counters returns the current values of the persisted counters keyed by metric name
+func Counters() map[string]int64 {
+	values := make(map[string]int64, len(persistedCounters))
+	for name, counter := range persistedCounters {
+		values[name] = atomic.LoadInt64(counter)
+	}
+	return values
+}
+
+// RestoreCounters adds previously persisted values to the counters. It should be called once
+// at startup. Unknown metric names are ignored.
+func RestoreCounters(values map[string]int64) {
+	for name, value := range values {
+		if counter, found := persistedCounters[name]; found {
+			atomic.AddInt64(counter, value)
+		}
+	}
+}
+
+// execShardCount is the number of shards announce times are spread across to reduce
+// contention between concurrent announces
+const execShardCount = 16
+
+// announceTimeBounds are the upper bounds in nanoseconds of the announce time histogram buckets
+var announceTimeBounds = [...]int64{
+	int64(time.Millisecond),
+	5 * int64(time.Millisecond),
+	10 * int64(time.Millisecond),
+	50 * int64(time.Millisecond),
+	100 * int64(time.Millisecond),
+	500 * int64(time.Millisecond),
+}
+
+// execShard accumulates announce times for a subset of announces. With 6 buckets it fills
+// exactly one cache line so neighbouring shards don't contend with each other. Buckets hold
+// the count of times falling between the previous bound and their own, they are made
+// cumulative when read.
+type execShard struct {
+	sum     int64
+	count   int64
+	buckets [len(announceTimeBounds)]int64
+}
+
+// SetAnnounceSampleRate sets the rate at which announce times are recorded, 1 in N.
+// Values less than 1 will record all announce times.
+func SetAnnounceSampleRate(n int) {
+	if n < 1 {
+		n = 1
+	}
+	atomic.StoreInt64(&announceSampleRate, int64(n))
+}
+
+// AddAnnounceTime records the time taken to complete an announce in nanoseconds, subject
+// to the configured sample rate. Sampled times are weighted by the rate so the histogram
+// counts still estimate the total number of announces.
 func AddAnnounceTime(t int64) {
-	execLock.Lock()
-	AnnounceExecTimesNs = append(AnnounceExecTimesNs, t)
-	execLock.Unlock()
+	seq := atomic.AddUint64(&announceSeq, 1)
+	rate := uint64(atomic.LoadInt64(&announceSampleRate))
+	if seq%rate != 0 {
+		return
+	}
+	shard := &announceExecTimes[(seq/rate)%execShardCount]
+	weight := int64(rate)
+	atomic.AddInt64(&shard.sum, t*weight)
+	atomic.AddInt64(&shard.count, weight)
+	for i, bound := range announceTimeBounds {
+		if t <= bound {
+			atomic.AddInt64(&shard.buckets[i], weight)
+			break
+		}
+	}
 }
 
-func avgExecTime() int64 {
-	execLock.Lock()
-	var t int64
-	var avg int64
-	for _, v := range AnnounceExecTimesNs {
-		t += v
+// announceTimes combines the shards into a histogram of the announce times recorded since
+// startup, in seconds
+func announceTimes() Histogram {
+	h := Histogram{
+		Bounds: make([]float64, len(announceTimeBounds)),
+		Counts: make([]int64, len(announceTimeBounds)),
+	}
+	var sum int64
+	for i := range announceExecTimes {
+		shard := &announceExecTimes[i]
+		sum += atomic.LoadInt64(&shard.sum)
+		h.Count += atomic.LoadInt64(&shard.count)
+		for b := range shard.buckets {
+			h.Counts[b] += atomic.LoadInt64(&shard.buckets[b])
+		}
 	}
-	s := int64(len(AnnounceExecTimesNs))
-	if s > 0 {
-		avg = t / s
-		AnnounceExecTimesNs = nil
+	for b, bound := range announceTimeBounds {
+		h.Bounds[b] = time.Duration(bound).Seconds()
+		if b > 0 {
+			h.Counts[b] += h.Counts[b-1]
+		}
 	}
-	execLock.Unlock()
-	return avg
+	h.Sum = time.Duration(sum).Seconds()
+	return h
 }
 
 type RuntimeMetrics struct {
 	TorrentsTotalCached           int64 `prom:"t_cache_torrents" prom_type:"counter"`
 	UsersTotalCached              int64 `prom:"t_cache_users" prom_type:"counter"`
 	PeersTotalCached              int64 `prom:"t_cache_peers" prom_type:"counter"`
-	AnnounceTotal                 int64 `prom:"t_ann_total" prom_type:"gauge"`
-	AnnounceStatusOK              int64 `prom:"t_ann_status_ok" prom_type:"gauge"`
-	AnnounceStatusUnauthorized    int64 `prom:"t_ann_status_unauthorized" prom_type:"gauge"`
-	AnnounceStatusInvalidInfoHash int64 `prom:"t_ann_status_invalid_infohash" prom_type:"gauge"`
-	AnnounceStatusMalformed       int64 `prom:"t_ann_status_malformed" prom_type:"gauge"`
-	AnnounceExecTimesNsAvg        int64 `prom:"t_ann_time_ns" prom_type:"gauge"`
+	TorrentsTotal                 int64 `prom:"t_torrents" prom_type:"gauge"`
+	UsersTotal                    int64 `prom:"t_users" prom_type:"gauge"`
+	PeersTotal                    int64 `prom:"t_peers" prom_type:"gauge"`
+	AnnounceTotal                 int64 `prom:"t_ann_total" prom_type:"counter"`
+	AnnounceStatusOK              int64 `prom:"t_ann_status_ok" prom_type:"counter"`
+	AnnounceStatusUnauthorized    int64 `prom:"t_ann_status_unauthorized" prom_type:"counter"`
+	AnnounceStatusInvalidInfoHash int64 `prom:"t_ann_status_invalid_infohash" prom_type:"counter"`
+	AnnounceStatusMalformed       int64 `prom:"t_ann_status_malformed" prom_type:"counter"`
+	AnnounceStatusDegraded        int64 `prom:"t_ann_status_degraded" prom_type:"counter"`
+	AnnounceStatusBusy            int64 `prom:"t_ann_status_busy" prom_type:"counter"`
+	AnnounceStatusRateLimited     int64 `prom:"t_ann_status_rate_limited" prom_type:"counter"`
+	PeersReaped                   int64 `prom:"t_peers_reaped" prom_type:"counter"`
+	ReaperDryRunPeers             int64 `prom:"t_reaper_dry_run_peers" prom_type:"counter"`
+	PrunedTorrents                int64 `prom:"t_pruned_torrents" prom_type:"counter"`
+	PrunerDryRunTorrents          int64 `prom:"t_pruner_dry_run_torrents" prom_type:"counter"`
+	AnnounceRepeatedStarted       int64 `prom:"t_ann_repeated_started" prom_type:"counter"`
+	AnnounceRepeatedCompleted     int64 `prom:"t_ann_repeated_completed" prom_type:"counter"`
+	AnnounceDelayed               int64 `prom:"t_ann_delayed" prom_type:"counter"`
+	AnnounceDuplicatePeerID       int64 `prom:"t_ann_duplicate_peer_id" prom_type:"counter"`
+	AnnounceLowRatio              int64 `prom:"t_ann_low_ratio" prom_type:"counter"`
+	AnnounceImplausibleCompleted  int64 `prom:"t_ann_implausible_completed" prom_type:"counter"`
+	BoundedMapEvictions           int64 `prom:"t_bounded_map_evictions" prom_type:"counter"`
+	GeoCacheHits                  int64 `prom:"t_geo_cache_hits" prom_type:"counter"`
+	GeoCacheMisses                int64 `prom:"t_geo_cache_misses" prom_type:"counter"`
+	StoreFailures                 int64 `prom:"t_store_failures" prom_type:"counter"`
+	StoreBreakerState             int64 `prom:"t_store_breaker_state" prom_type:"gauge"`
+	StoreBreakerTrips             int64 `prom:"t_store_breaker_trips" prom_type:"counter"`
+
+	AnnounceTime Histogram `prom:"t_ann_time_seconds" prom_type:"histogram"`
 
 	// GC stats
 	NumGC      int64 `prom:"num_gc" prom_type:"gauge"`
@@ -135,6 +313,11 @@ type RuntimeMetrics struct {
 	GCNum          uint32  `prom:"gc_num" prom_type:""`
 	GCNumForced    uint32  `prom:"gc_num_forced" prom_type:""`
 	GCCPUFraction  float64 `prom:"gc_cpu_fraction" prom_type:"gauge"`
+
+	// TopTorrents are written as the per torrent t_torrent_seeders and t_torrent_leechers gauges
+	TopTorrents []TorrentSwarm `prom:"-"`
+	// BoundedMapEntries are written as the t_bounded_map_entries gauge labelled by map
+	BoundedMapEntries map[string]int64 `prom:"-"`
 }
 
 func (m RuntimeMetrics) String() string {
@@ -144,10 +327,19 @@ func (m RuntimeMetrics) String() string {
 	for i := 0; i < v.NumField(); i++ {
 		field := t.Field(i)
 		tagKey := field.Tag.Get("prom")
+		if tagKey == "-" {
+			continue
+		}
 		out.WriteString(fmt.Sprintf("# HELP %s %s\n", tagKey, promHelp[tagKey]))
 		out.WriteString(fmt.Sprintf("# TYPE %s %s\n", tagKey, field.Tag.Get("prom_type")))
+		if h, ok := v.Field(i).Interface().(Histogram); ok {
+			out.WriteString(h.Prometheus(tagKey))
+			continue
+		}
 		out.WriteString(fmt.Sprintf("%s %v\n", tagKey, v.Field(i).Interface()))
 	}
+	out.WriteString(torrentGauges(m.TopTorrents))
+	out.WriteString(boundedMapGauges(m.BoundedMapEntries))
 	return out.String()
 }
 
@@ -163,12 +355,34 @@ func Get() RuntimeMetrics {
 	m.TorrentsTotalCached = atomic.LoadInt64(&TorrentsTotalCached)
 	m.UsersTotalCached = atomic.LoadInt64(&UsersTotalCached)
 	m.PeersTotalCached = atomic.LoadInt64(&PeersTotalCached)
-	m.AnnounceTotal = atomic.SwapInt64(&AnnounceTotal, 0)
-	m.AnnounceStatusOK = atomic.SwapInt64(&AnnounceStatusOK, 0)
-	m.AnnounceStatusUnauthorized = atomic.SwapInt64(&AnnounceStatusUnauthorized, 0)
-	m.AnnounceStatusInvalidInfoHash = atomic.SwapInt64(&AnnounceStatusInvalidInfoHash, 0)
-	m.AnnounceStatusMalformed = atomic.SwapInt64(&AnnounceStatusMalformed, 0)
-	m.AnnounceExecTimesNsAvg = avgExecTime()
+	m.TorrentsTotal = atomic.LoadInt64(&TorrentsTotal)
+	m.UsersTotal = atomic.LoadInt64(&UsersTotal)
+	m.PeersTotal = atomic.LoadInt64(&PeersTotal)
+	m.AnnounceTotal = atomic.LoadInt64(&AnnounceTotal)
+	m.AnnounceStatusOK = atomic.LoadInt64(&AnnounceStatusOK)
+	m.AnnounceStatusUnauthorized = atomic.LoadInt64(&AnnounceStatusUnauthorized)
+	m.AnnounceStatusInvalidInfoHash = atomic.LoadInt64(&AnnounceStatusInvalidInfoHash)
+	m.AnnounceStatusMalformed = atomic.LoadInt64(&AnnounceStatusMalformed)
+	m.AnnounceStatusDegraded = atomic.LoadInt64(&AnnounceStatusDegraded)
+	m.AnnounceStatusBusy = atomic.LoadInt64(&AnnounceStatusBusy)
+	m.AnnounceStatusRateLimited = atomic.LoadInt64(&AnnounceStatusRateLimited)
+	m.AnnounceTime = announceTimes()
+	m.PeersReaped = atomic.LoadInt64(&PeersReaped)
+	m.ReaperDryRunPeers = atomic.LoadInt64(&ReaperDryRunPeers)
+	m.PrunedTorrents = atomic.LoadInt64(&PrunedTorrents)
+	m.PrunerDryRunTorrents = atomic.LoadInt64(&PrunerDryRunTorrents)
+	m.AnnounceRepeatedStarted = atomic.LoadInt64(&AnnounceRepeatedStarted)
+	m.AnnounceRepeatedCompleted = atomic.LoadInt64(&AnnounceRepeatedCompleted)
+	m.AnnounceDelayed = atomic.LoadInt64(&AnnounceDelayed)
+	m.AnnounceDuplicatePeerID = atomic.LoadInt64(&AnnounceDuplicatePeerID)
+	m.AnnounceLowRatio = atomic.LoadInt64(&AnnounceLowRatio)
+	m.AnnounceImplausibleCompleted = atomic.LoadInt64(&AnnounceImplausibleCompleted)
+	m.BoundedMapEvictions = atomic.LoadInt64(&BoundedMapEvictions)
+	m.GeoCacheHits = atomic.LoadInt64(&GeoCacheHits)
+	m.GeoCacheMisses = atomic.LoadInt64(&GeoCacheMisses)
+	m.StoreFailures = atomic.LoadInt64(&StoreFailures)
+	m.StoreBreakerState = atomic.LoadInt64(&StoreBreakerState)
+	m.StoreBreakerTrips = atomic.LoadInt64(&StoreBreakerTrips)
 	m.NumGC = gc.NumGC
 	m.PauseTotal = gc.PauseTotal.Milliseconds()
 
@@ -200,10 +414,8 @@ func Get() RuntimeMetrics {
 	m.GCCPUFraction = mem.GCCPUFraction
 
 	m.GoRoutines = runtime.NumGoroutine()
+	m.TopTorrents = getTopTorrents()
+	m.BoundedMapEntries = getBoundedMapEntries()
 
 	return m
 }
-
-func init() {
-	execLock = &sync.Mutex{}
-}
@@ -1,8 +1,15 @@
 package metrics
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMetrics_String(t *testing.T) {
@@ -11,3 +18,123 @@ func TestMetrics_String(t *testing.T) {
 	s := m.String()
 	require.True(t, len(s) > 100)
 }
+
+func TestAnnounceStatusMonotonic(t *testing.T) {
+	atomic.AddInt64(&AnnounceTotal, 3)
+	atomic.AddInt64(&AnnounceStatusOK, 2)
+	first := Get()
+	second := Get()
+	require.Equal(t, first.AnnounceTotal, second.AnnounceTotal, "Counter reset on read")
+	require.Equal(t, first.AnnounceStatusOK, second.AnnounceStatusOK, "Counter reset on read")
+	require.GreaterOrEqual(t, second.AnnounceTotal, int64(3))
+	require.Contains(t, second.String(), "# TYPE t_ann_status_ok counter\n")
+}
+
+func TestAnnounceTimeSampling(t *testing.T) {
+	defer SetAnnounceSampleRate(1)
+	before := announceTimes()
+	SetAnnounceSampleRate(10)
+	r := rand.New(rand.NewSource(1))
+	var sum int64
+	count := 100000
+	for i := 0; i < count; i++ {
+		v := 1000 + r.Int63n(1000)
+		sum += v
+		AddAnnounceTime(v)
+	}
+	after := announceTimes()
+	require.Equal(t, int64(count), after.Count-before.Count, "Sampled times not weighted")
+	require.InEpsilon(t, time.Duration(sum).Seconds(), after.Sum-before.Sum, 0.02)
+}
+
+func TestAnnounceTimeHistogram(t *testing.T) {
+	before := announceTimes()
+	for _, d := range []time.Duration{
+		500 * time.Microsecond, time.Millisecond, 3 * time.Millisecond, 200 * time.Millisecond, time.Second,
+	} {
+		AddAnnounceTime(d.Nanoseconds())
+	}
+	h := announceTimes()
+	require.Equal(t, []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5}, h.Bounds)
+	var delta []int64
+	for i := range h.Counts {
+		delta = append(delta, h.Counts[i]-before.Counts[i])
+	}
+	require.Equal(t, []int64{2, 3, 3, 3, 3, 4}, delta, "Buckets not cumulative")
+	require.Equal(t, before.Count+5, h.Count)
+	require.InDelta(t, 1.2045, h.Sum-before.Sum, 0.0001)
+
+	out := Get().String()
+	require.Contains(t, out, "# TYPE t_ann_time_seconds histogram\n")
+	require.Contains(t, out, fmt.Sprintf("t_ann_time_seconds_bucket{le=\"0.005\"} %d\n", h.Counts[1]))
+	require.Contains(t, out, fmt.Sprintf("t_ann_time_seconds_bucket{le=\"+Inf\"} %d\n", h.Count))
+	require.Regexp(t, `t_ann_time_seconds_sum [0-9.]+\n`, out)
+	require.Contains(t, out, fmt.Sprintf("t_ann_time_seconds_count %d\n", h.Count))
+}
+
+// lockedExecTimes is the previous mutex based implementation, used as a baseline
+// for BenchmarkAddAnnounceTime
+type lockedExecTimes struct {
+	sync.Mutex
+	times []int64
+}
+
+func (l *lockedExecTimes) add(t int64) {
+	l.Lock()
+	l.times = append(l.times, t)
+	l.Unlock()
+}
+
+func BenchmarkAddAnnounceTime(b *testing.B) {
+	b.Run("locked", func(b *testing.B) {
+		var l lockedExecTimes
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				l.add(1000)
+			}
+		})
+	})
+	for _, rate := range []int{1, 10} {
+		b.Run(fmt.Sprintf("sharded_%d", rate), func(b *testing.B) {
+			SetAnnounceSampleRate(rate)
+			defer SetAnnounceSampleRate(1)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					AddAnnounceTime(1000)
+				}
+			})
+		})
+	}
+}
+
+func TestMetrics_Influx(t *testing.T) {
+	m := Get()
+	ts := time.Unix(1600000000, 0)
+	line := m.Influx("mika", map[string]string{"role": "tracker", "host": "tracker 1,a=b", "empty": ""}, ts)
+	// measurement,tags fields timestamp
+	require.Regexp(t, `^mika,host=tracker\\ 1\\,a\\=b,role=tracker [a-z0-9_]+=[0-9.]+i?(,[a-z0-9_]+=[0-9.]+i?)* 1600000000000000000\n$`, line)
+	require.Contains(t, line, fmt.Sprintf("go_routines=%di", m.GoRoutines))
+	require.Contains(t, line, fmt.Sprintf("t_torrents=%di", m.TorrentsTotal))
+	require.Regexp(t, `gc_cpu_fraction=[0-9.]+( |,)`, line, "Floats must not have the integer suffix")
+	require.Contains(t, line, fmt.Sprintf("t_ann_time_seconds_count=%di,", m.AnnounceTime.Count))
+	// Every field is written once except the histogram which writes its count and sum and the
+	// top torrents and bounded map entries which are only sent to prometheus, the tags account
+	// for the other 3 equals signs
+	require.Equal(t, reflect.TypeOf(m).NumField()-1, strings.Count(line, "=")-3)
+}
+
+func TestMetrics_TopTorrents(t *testing.T) {
+	defer SetTopTorrents(nil)
+	require.NotContains(t, Get().String(), "t_torrent_seeders")
+	SetTopTorrents([]TorrentSwarm{
+		{InfoHash: "aaaa", Seeders: 10, Leechers: 2},
+		{InfoHash: "bbbb", Seeders: 3, Leechers: 4},
+	})
+	m := Get()
+	require.Len(t, m.TopTorrents, 2)
+	s := m.String()
+	require.Contains(t, s, "# TYPE t_torrent_seeders gauge\n")
+	require.Contains(t, s, "t_torrent_seeders{info_hash=\"aaaa\"} 10\n")
+	require.Contains(t, s, "t_torrent_leechers{info_hash=\"bbbb\"} 4\n")
+	require.NotContains(t, m.Influx("mika", nil, time.Now()), "aaaa")
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// TorrentSwarm is the size of the swarm of a single torrent
+type TorrentSwarm struct {
+	InfoHash string
+	Seeders  int64
+	Leechers int64
+}
+
+var (
+	topTorrentsMu sync.RWMutex
+	topTorrents   []TorrentSwarm
+)
+
+// SetTopTorrents replaces the torrents reported by the per torrent seeders and leechers
+// gauges. Each torrent adds a series, so callers should bound the number passed.
+func SetTopTorrents(swarms []TorrentSwarm) {
+	topTorrentsMu.Lock()
+	topTorrents = swarms
+	topTorrentsMu.Unlock()
+}
+
+func getTopTorrents() []TorrentSwarm {
+	topTorrentsMu.RLock()
+	defer topTorrentsMu.RUnlock()
+	swarms := make([]TorrentSwarm, len(topTorrents))
+	copy(swarms, topTorrents)
+	return swarms
+}
+
+// torrentGauges returns the t_torrent_seeders and t_torrent_leechers gauges labelled by
+// info_hash in the prometheus text format
+func torrentGauges(swarms []TorrentSwarm) string {
+	if len(swarms) == 0 {
+		return ""
+	}
+	var out strings.Builder
+	out.WriteString("# HELP t_torrent_seeders t_torrent_seeders is the number of seeders of the most active torrents.\n")
+	out.WriteString("# TYPE t_torrent_seeders gauge\n")
+	for _, s := range swarms {
+		out.WriteString(fmt.Sprintf("t_torrent_seeders{info_hash=\"%s\"} %d\n", s.InfoHash, s.Seeders))
+	}
+	out.WriteString("# HELP t_torrent_leechers t_torrent_leechers is the number of leechers of the most active torrents.\n")
+	out.WriteString("# TYPE t_torrent_leechers gauge\n")
+	for _, s := range swarms {
+		out.WriteString(fmt.Sprintf("t_torrent_leechers{info_hash=\"%s\"} %d\n", s.InfoHash, s.Leechers))
+	}
+	return out.String()
+}
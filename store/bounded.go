@@ -0,0 +1,159 @@
+package store
+
+import (
+	"container/list"
+	"github.com/leighmacdonald/mika/metrics"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BoundedMap is a string keyed map used for per passkey or per peer in-memory state such
+// as rate limiters and dedup windows. It holds at most maxSize entries, evicting the least
+// recently used entry to make room, so its memory use is bounded regardless of user churn.
+//
+// Entries older than the ttl are treated as missing. They are removed when accessed, when
+// they reach the back of the eviction order, or in bulk by Prune.
+type BoundedMap struct {
+	mu      sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	items   map[string]*list.Element
+	// order has the most recently used entry at the front
+	order *list.List
+	now   func() time.Time
+}
+
+type boundedEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// NewBoundedMap returns a map holding at most maxSize entries which expire ttl after they
+// were last set. A maxSize or ttl of 0 disables the respective limit.
+func NewBoundedMap(maxSize int, ttl time.Duration) *BoundedMap {
+	return &BoundedMap{
+		maxSize: maxSize,
+		ttl:     ttl,
+		items:   make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// Get returns the value for key, marking it as recently used
+func (m *BoundedMap) Get(key string) (interface{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, found := m.get(key)
+	if !found {
+		return nil, false
+	}
+	return e.value, true
+}
+
+// Set inserts or replaces the value for key, resetting its ttl
+func (m *BoundedMap) Set(key string, value interface{}) {
+	m.mu.Lock()
+	m.set(key, value)
+	m.mu.Unlock()
+}
+
+// Update atomically replaces the value for key with the result of fn. found is false and
+// value nil when there is no current value.
+func (m *BoundedMap) Update(key string, fn func(value interface{}, found bool) interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, found := m.get(key)
+	if !found {
+		m.set(key, fn(nil, false))
+		return
+	}
+	m.set(key, fn(e.value, true))
+}
+
+// Delete removes the value for key
+func (m *BoundedMap) Delete(key string) {
+	m.mu.Lock()
+	if el, found := m.items[key]; found {
+		m.remove(el)
+	}
+	m.mu.Unlock()
+}
+
+// Clear removes all entries
+func (m *BoundedMap) Clear() {
+	m.mu.Lock()
+	for el := m.order.Back(); el != nil; {
+		prev := el.Prev()
+		m.remove(el)
+		el = prev
+	}
+	m.mu.Unlock()
+}
+
+// Len returns the current number of entries, including any expired ones not yet removed
+func (m *BoundedMap) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.items)
+}
+
+// Prune removes all expired entries returning the count removed
+func (m *BoundedMap) Prune() int {
+	if m.ttl <= 0 {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	removed := 0
+	for el := m.order.Back(); el != nil; {
+		prev := el.Prev()
+		if now.After(el.Value.(*boundedEntry).expires) {
+			m.remove(el)
+			removed++
+		}
+		el = prev
+	}
+	return removed
+}
+
+func (m *BoundedMap) get(key string) (*boundedEntry, bool) {
+	el, found := m.items[key]
+	if !found {
+		return nil, false
+	}
+	e := el.Value.(*boundedEntry)
+	if m.ttl > 0 && m.now().After(e.expires) {
+		m.remove(el)
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return e, true
+}
+
+func (m *BoundedMap) set(key string, value interface{}) {
+	var expires time.Time
+	if m.ttl > 0 {
+		expires = m.now().Add(m.ttl)
+	}
+	if el, found := m.items[key]; found {
+		e := el.Value.(*boundedEntry)
+		e.value = value
+		e.expires = expires
+		m.order.MoveToFront(el)
+		return
+	}
+	if m.maxSize > 0 && len(m.items) >= m.maxSize {
+		m.remove(m.order.Back())
+		atomic.AddInt64(&metrics.BoundedMapEvictions, 1)
+	}
+	m.items[key] = m.order.PushFront(&boundedEntry{key: key, value: value, expires: expires})
+}
+
+func (m *BoundedMap) remove(el *list.Element) {
+	m.order.Remove(el)
+	delete(m.items, el.Value.(*boundedEntry).key)
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"fmt"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBoundedMap(t *testing.T) {
+	evictions := atomic.LoadInt64(&metrics.BoundedMapEvictions)
+	m := NewBoundedMap(3, 0)
+	for i := 0; i < 3; i++ {
+		m.Set(fmt.Sprintf("key%d", i), i)
+	}
+	require.Equal(t, 3, m.Len())
+	require.Equal(t, evictions, atomic.LoadInt64(&metrics.BoundedMapEvictions), "Evicted before cap")
+
+	// key0 is the oldest entry but is still in use so key1 is evicted instead
+	v, found := m.Get("key0")
+	require.True(t, found)
+	require.Equal(t, 0, v)
+	m.Set("key3", 3)
+	require.Equal(t, 3, m.Len())
+	require.Equal(t, evictions+1, atomic.LoadInt64(&metrics.BoundedMapEvictions))
+	_, found = m.Get("key1")
+	require.False(t, found, "Least recently used entry not evicted")
+	for _, k := range []string{"key0", "key2", "key3"} {
+		_, found := m.Get(k)
+		require.True(t, found, "Active entry evicted: %s", k)
+	}
+
+	// Updating an existing entry never evicts
+	m.Update("key2", func(value interface{}, found bool) interface{} {
+		require.True(t, found)
+		return value.(int) + 10
+	})
+	v, _ = m.Get("key2")
+	require.Equal(t, 12, v)
+	require.Equal(t, evictions+1, atomic.LoadInt64(&metrics.BoundedMapEvictions))
+
+	m.Delete("key0")
+	require.Equal(t, 2, m.Len())
+}
+
+func TestBoundedMapTTL(t *testing.T) {
+	now := time.Now()
+	m := NewBoundedMap(0, time.Minute)
+	m.now = func() time.Time { return now }
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Set("c", 3)
+	require.Equal(t, 3, m.Len())
+
+	now = now.Add(45 * time.Second)
+	// Setting resets the ttl, reading does not
+	m.Set("a", 1)
+	_, found := m.Get("b")
+	require.True(t, found)
+
+	now = now.Add(30 * time.Second)
+	_, found = m.Get("b")
+	require.False(t, found, "Expired entry returned")
+	require.Equal(t, 1, m.Prune())
+	require.Equal(t, 1, m.Len())
+	_, found = m.Get("a")
+	require.True(t, found)
+}
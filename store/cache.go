@@ -2,6 +2,7 @@ package store
 
 import (
 	"github.com/leighmacdonald/mika/metrics"
+	"math"
 	"sync"
 	"sync/atomic"
 )
@@ -47,9 +48,12 @@ func NewPeerCache() *PeerCache {
 // Add inserts a torrent into the cache
 func (cache *TorrentCache) Set(t Torrent) {
 	cache.Lock()
+	_, found := cache.torrents[t.InfoHash]
 	cache.torrents[t.InfoHash] = t
 	cache.Unlock()
-	atomic.AddInt64(&metrics.TorrentsTotalCached, 1)
+	if !found {
+		atomic.AddInt64(&metrics.TorrentsTotalCached, 1)
+	}
 }
 
 func (cache *TorrentCache) Update(infoHash InfoHash, stats TorrentStats) {
@@ -72,8 +76,10 @@ func (cache *TorrentCache) Delete(ih InfoHash, dropRow bool) {
 	cache.Lock()
 	defer cache.Unlock()
 	if dropRow {
-		delete(cache.torrents, ih)
-		atomic.AddInt64(&metrics.TorrentsTotalCached, -1)
+		if _, found := cache.torrents[ih]; found {
+			delete(cache.torrents, ih)
+			atomic.AddInt64(&metrics.TorrentsTotalCached, -1)
+		}
 	} else {
 		t, found := cache.torrents[ih]
 		if !found {
@@ -149,6 +155,14 @@ func (cache *PeerCache) Get(peer *Peer, infoHash InfoHash, peerID PeerID) bool {
 	return true
 }
 
+// Swarm returns the cached swarm for the info_hash if one exists
+func (cache *PeerCache) Swarm(infoHash InfoHash) (Swarm, bool) {
+	cache.RLock()
+	swarm, found := cache.swarms[infoHash]
+	cache.RUnlock()
+	return swarm, found
+}
+
 func (cache *PeerCache) Delete(infoHash InfoHash, peerID PeerID) {
 	cache.RLock()
 	_, found := cache.swarms[infoHash]
@@ -161,3 +175,104 @@ func (cache *PeerCache) Delete(infoHash InfoHash, peerID PeerID) {
 	cache.RUnlock()
 	atomic.AddInt64(&metrics.PeersTotalCached, -1)
 }
+
+// UserStatsCache is a write-behind cache which accumulates user stat deltas in memory until
+// they are flushed to the UserStore. Adding stats for a known passkey only takes the shared
+// read lock and updates the totals atomically, the write lock is only needed to insert a new
+// passkey or to swap out the pending stats when flushing.
+type UserStatsCache struct {
+	*sync.RWMutex
+	pending map[string]*pendingUserStats
+}
+
+type pendingUserStats struct {
+	uploaded   uint64
+	downloaded uint64
+	bonus      uint64 // float64 bits
+	announces  uint32
+}
+
+// NewUserStatsCache configures and returns a new, empty, UserStatsCache
+func NewUserStatsCache() *UserStatsCache {
+	return &UserStatsCache{
+		RWMutex: &sync.RWMutex{},
+		pending: make(map[string]*pendingUserStats),
+	}
+}
+
+// Add accumulates the stats for the user into the pending totals
+func (cache *UserStatsCache) Add(passkey string, stats UserStats) {
+	cache.RLock()
+	p, found := cache.pending[passkey]
+	if !found {
+		cache.RUnlock()
+		cache.Lock()
+		p, found = cache.pending[passkey]
+		if !found {
+			p = &pendingUserStats{}
+			cache.pending[passkey] = p
+		}
+		cache.Unlock()
+		// Flush could run between the locks, so start over to not lose the update
+		cache.Add(passkey, stats)
+		return
+	}
+	atomic.AddUint64(&p.uploaded, stats.Uploaded)
+	atomic.AddUint64(&p.downloaded, stats.Downloaded)
+	atomic.AddUint32(&p.announces, stats.Announces)
+	if stats.Bonus != 0 {
+		for {
+			old := atomic.LoadUint64(&p.bonus)
+			if atomic.CompareAndSwapUint64(&p.bonus, old, math.Float64bits(math.Float64frombits(old)+stats.Bonus)) {
+				break
+			}
+		}
+	}
+	cache.RUnlock()
+}
+
+// Pending returns the stats not yet flushed for the user
+func (cache *UserStatsCache) Pending(passkey string) (UserStats, bool) {
+	cache.RLock()
+	p, found := cache.pending[passkey]
+	var stats UserStats
+	if found {
+		stats = p.load()
+	}
+	cache.RUnlock()
+	return stats, found
+}
+
+// Merge applies any pending stats to the user
+func (cache *UserStatsCache) Merge(user *User) {
+	stats, found := cache.Pending(user.Passkey)
+	if !found {
+		return
+	}
+	user.Uploaded += stats.Uploaded
+	user.Downloaded += stats.Downloaded
+	user.Announces += stats.Announces
+	user.Bonus += stats.Bonus
+}
+
+// Flush removes and returns all of the pending stats so they can be synced to the UserStore
+func (cache *UserStatsCache) Flush() map[string]UserStats {
+	cache.Lock()
+	pending := cache.pending
+	cache.pending = make(map[string]*pendingUserStats, len(pending))
+	cache.Unlock()
+	batch := make(map[string]UserStats, len(pending))
+	for passkey, p := range pending {
+		batch[passkey] = p.load()
+	}
+	return batch
+}
+
+func (p *pendingUserStats) load() UserStats {
+	return UserStats{
+		Uploaded:   atomic.LoadUint64(&p.uploaded),
+		Downloaded: atomic.LoadUint64(&p.downloaded),
+		Announces:  atomic.LoadUint32(&p.announces),
+		Bonus:      math.Float64frombits(atomic.LoadUint64(&p.bonus)),
+	}
+}
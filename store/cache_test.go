@@ -0,0 +1,74 @@
+package store
+
+import (
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTorrentCacheCount(t *testing.T) {
+	cache := NewTorrentCache()
+	start := atomic.LoadInt64(&metrics.TorrentsTotalCached)
+	cached := GenerateTestTorrent()
+	cache.Set(cached)
+	cache.Update(cached.InfoHash, TorrentStats{Announces: 1})
+	require.Equal(t, start+1, atomic.LoadInt64(&metrics.TorrentsTotalCached), "Update counted twice")
+	cache.Delete(GenerateTestTorrent().InfoHash, true)
+	require.Equal(t, start+1, atomic.LoadInt64(&metrics.TorrentsTotalCached), "Uncached torrent was counted")
+	cache.Delete(cached.InfoHash, true)
+	cache.Delete(cached.InfoHash, true)
+	require.Equal(t, start, atomic.LoadInt64(&metrics.TorrentsTotalCached))
+}
+
+func TestUserStatsCache(t *testing.T) {
+	cache := NewUserStatsCache()
+	passkeys := []string{"aaaaaaaaaaaaaaaaaaaa", "bbbbbbbbbbbbbbbbbbbb", "cccccccccccccccccccc"}
+	totals := make(map[string]UserStats)
+	var totalsMu sync.Mutex
+	flush := func() {
+		totalsMu.Lock()
+		for pk, s := range cache.Flush() {
+			total := totals[pk]
+			total.Uploaded += s.Uploaded
+			total.Downloaded += s.Downloaded
+			total.Announces += s.Announces
+			total.Bonus += s.Bonus
+			totals[pk] = total
+		}
+		totalsMu.Unlock()
+	}
+	const workers, adds = 8, 1000
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			for i := 0; i < adds; i++ {
+				cache.Add(passkeys[(w+i)%len(passkeys)], UserStats{Uploaded: 2, Downloaded: 1, Announces: 1, Bonus: 0.5})
+				if w == 0 && i%100 == 0 {
+					flush()
+				}
+			}
+			wg.Done()
+		}(w)
+	}
+	wg.Wait()
+	user := User{Passkey: passkeys[0], Uploaded: 10}
+	cache.Merge(&user)
+	pending, found := cache.Pending(passkeys[0])
+	require.True(t, found)
+	require.Equal(t, 10+pending.Uploaded, user.Uploaded)
+	flush()
+	_, found = cache.Pending(passkeys[0])
+	require.False(t, found)
+	var sum UserStats
+	for _, s := range totals {
+		sum.Uploaded += s.Uploaded
+		sum.Downloaded += s.Downloaded
+		sum.Announces += s.Announces
+		sum.Bonus += s.Bonus
+	}
+	require.Equal(t, UserStats{Uploaded: workers * adds * 2, Downloaded: workers * adds,
+		Announces: workers * adds, Bonus: workers * adds * 0.5}, sum)
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ClientVersion is a client version as a list of numeric components, most significant first
+type ClientVersion []int
+
+// Compare returns -1, 0 or 1 if v is older, the same as, or newer than other. Missing
+// trailing components count as 0 so 4.5 and 4.5.0 are the same version.
+func (v ClientVersion) Compare(other ClientVersion) int {
+	for i := 0; i < len(v) || i < len(other); i++ {
+		a, b := 0, 0
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(other) {
+			b = other[i]
+		}
+		if a < b {
+			return -1
+		}
+		if a > b {
+			return 1
+		}
+	}
+	return 0
+}
+
+// String returns the dotted representation of the version
+func (v ClientVersion) String() string {
+	parts := make([]string, len(v))
+	for i, c := range v {
+		parts[i] = strconv.Itoa(c)
+	}
+	return strings.Join(parts, ".")
+}
+
+// ParseVersion parses a dotted version string such as 4.5.0
+func ParseVersion(s string) (ClientVersion, error) {
+	var v ClientVersion
+	for _, part := range strings.Split(s, ".") {
+		c, err := strconv.Atoi(part)
+		if err != nil || c < 0 {
+			return nil, fmt.Errorf("invalid version: %s", s)
+		}
+		v = append(v, c)
+	}
+	return v, nil
+}
+
+// versionExtractors decode the version characters of azureus style peer ids for clients which
+// do not use the common one character per component encoding, keyed by client code
+var versionExtractors = map[string]func(v string) (ClientVersion, bool){
+	"TR": transmissionVersion,
+	// uTorrent and its variants use the last character for the build type
+	"UT": func(v string) (ClientVersion, bool) { return azureusVersion(v[:3]) },
+	"UM": func(v string) (ClientVersion, bool) { return azureusVersion(v[:3]) },
+	"UE": func(v string) (ClientVersion, bool) { return azureusVersion(v[:3]) },
+}
+
+// ParseClientVersion extracts the client version encoded in a peer id. Azureus style ids
+// (-qB4500-) and mainline style ids (M7-4-3--) are supported.
+func ParseClientVersion(pid PeerID) (ClientVersion, bool) {
+	if pid[0] == '-' && pid[7] == '-' {
+		code, version := string(pid[1:3]), string(pid[3:7])
+		if extract, found := versionExtractors[code]; found {
+			return extract(version)
+		}
+		return azureusVersion(version)
+	}
+	if pid[0] == 'M' && pid[1] >= '0' && pid[1] <= '9' {
+		return mainlineVersion(string(pid[1:8]))
+	}
+	return nil, false
+}
+
+// azureusVersion decodes one version component per character, using letters for values
+// over 9 eg: 46A0 is 4.6.10.0
+func azureusVersion(v string) (ClientVersion, bool) {
+	version := make(ClientVersion, len(v))
+	for i, c := range strings.ToUpper(v) {
+		switch {
+		case c >= '0' && c <= '9':
+			version[i] = int(c - '0')
+		case c >= 'A' && c <= 'Z':
+			version[i] = int(c-'A') + 10
+		default:
+			return nil, false
+		}
+	}
+	return version, true
+}
+
+// transmissionVersion decodes transmission ids. Before 4.0 the minor version used two
+// digits (-TR2940- is 2.94), from 4.0 each component is a single digit (-TR4050- is 4.0.5).
+// The last character marks beta and development builds.
+func transmissionVersion(v string) (ClientVersion, bool) {
+	version, ok := azureusVersion(v[:3])
+	if !ok {
+		return nil, false
+	}
+	if version[0] < 4 {
+		return ClientVersion{version[0], version[1]*10 + version[2]}, true
+	}
+	return version, true
+}
+
+// mainlineVersion decodes dash separated version numbers eg: 7-10-5-
+func mainlineVersion(v string) (ClientVersion, bool) {
+	var version ClientVersion
+	for _, part := range strings.Split(strings.TrimRight(v, "-"), "-") {
+		c, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		version = append(version, c)
+	}
+	return version, true
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseClientVersion(t *testing.T) {
+	cases := []struct {
+		peerID  string
+		version string
+		ok      bool
+	}{
+		{"-qB4500-u-rGseINmloG", "4.5.0.0", true},
+		{"-qB46A0-u-rGseINmloG", "4.6.10.0", true},
+		{"-TR2940-u-rGseINmloG", "2.94", true},
+		{"-TR4050-u-rGseINmloG", "4.0.5", true},
+		{"-UT355W-u-rGseINmloG", "3.5.5", true},
+		{"M7-10-5-u-rGseINmloG", "7.10.5", true},
+		{"-qB4.50-u-rGseINmloG", "", false},
+		{"XBT054d-u-rGseINmloG", "", false},
+	}
+	for _, tc := range cases {
+		v, ok := ParseClientVersion(PeerIDFromString(tc.peerID))
+		require.Equal(t, tc.ok, ok, tc.peerID)
+		if tc.ok {
+			require.Equal(t, tc.version, v.String(), tc.peerID)
+		}
+	}
+}
+
+func TestWhiteListClientVersionAllowed(t *testing.T) {
+	wl := WhiteListClient{ClientPrefix: "-qB", ClientName: "qBittorrent", MinVersion: "4.5"}
+	require.False(t, wl.VersionAllowed(PeerIDFromString("-qB4170-u-rGseINmloG")))
+	require.True(t, wl.VersionAllowed(PeerIDFromString("-qB4500-u-rGseINmloG")))
+	require.True(t, wl.VersionAllowed(PeerIDFromString("-qB5000-u-rGseINmloG")))
+	wl.MinVersion = ""
+	require.True(t, wl.VersionAllowed(PeerIDFromString("-qB4170-u-rGseINmloG")))
+	_, err := ParseVersion("4.x")
+	require.Error(t, err)
+}
@@ -17,7 +17,9 @@ import (
 	"github.com/leighmacdonald/mika/store"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"net/http"
 	"strings"
+	"time"
 )
 
 const (
@@ -49,6 +51,61 @@ func (ts TorrentStore) Update(torrent store.Torrent) error {
 	panic("implement me")
 }
 
+// Count returns the number of torrents not marked as deleted
+func (ts TorrentStore) Count() (int, error) {
+	var resp struct {
+		Count int `json:"count"`
+	}
+	if _, err := ts.Exec(client.Opts{Method: "GET", Path: "/api/torrents/count", Recv: &resp}); err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// List fetches a page of torrents not marked as deleted, ordered by info_hash
+func (ts TorrentStore) List(limit int, offset int) ([]store.Torrent, error) {
+	var torrents []store.Torrent
+	_, err := ts.Exec(client.Opts{
+		Method: "GET",
+		Path:   fmt.Sprintf("/api/torrents?limit=%d&offset=%d", limit, offset),
+		Recv:   &torrents,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return torrents, nil
+}
+
+// Ping checks the API is reachable using the count endpoint, which every implementation
+// of the API already provides
+func (ts TorrentStore) Ping() error {
+	_, err := ts.Count()
+	return err
+}
+
+// Inactive fetches the info_hashes of auto registered torrents without any peers which have
+// not been announced since olderThan
+func (ts TorrentStore) Inactive(olderThan time.Time) ([]store.InfoHash, error) {
+	var resp []string
+	_, err := ts.Exec(client.Opts{
+		Method: "GET",
+		Path:   fmt.Sprintf("/api/torrent/inactive?older_than=%d", olderThan.Unix()),
+		Recv:   &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var inactive []store.InfoHash
+	for _, ihStr := range resp {
+		var ih store.InfoHash
+		if err := store.InfoHashFromHex(&ih, ihStr); err != nil {
+			return nil, err
+		}
+		inactive = append(inactive, ih)
+	}
+	return inactive, nil
+}
+
 // Sync batch updates the backing store with the new TorrentStats provided
 func (ts TorrentStore) Sync(batch map[store.InfoHash]store.TorrentStats, cache *store.TorrentCache) error {
 	req := make(map[string]store.TorrentStats)
@@ -115,6 +172,141 @@ func (ts TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	return wl, nil
 }
 
+// WhiteListPage fetches a page of whitelisted clients ordered by prefix
+func (ts TorrentStore) WhiteListPage(offset int, limit int) ([]store.WhiteListClient, int, error) {
+	wl, err := ts.WhiteListGetAll()
+	if err != nil {
+		return nil, 0, err
+	}
+	page, total := store.WhiteListPage(wl, offset, limit)
+	return page, total, nil
+}
+
+// ConfigGetAll fetches all persisted runtime config values
+func (ts TorrentStore) ConfigGetAll() (map[string]string, error) {
+	values := make(map[string]string)
+	if _, err := ts.Exec(client.Opts{Method: "GET", Path: "/api/config", Recv: &values}); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// ConfigSet persists a runtime config value
+func (ts TorrentStore) ConfigSet(key string, value string) error {
+	_, err := ts.Exec(client.Opts{
+		Method: "POST",
+		Path:   "/api/config",
+		JSON:   map[string]string{key: value},
+	})
+	return err
+}
+
+// MetricsGetAll fetches the persisted metric counters
+func (ts TorrentStore) MetricsGetAll() (map[string]int64, error) {
+	values := make(map[string]int64)
+	if _, err := ts.Exec(client.Opts{Method: "GET", Path: "/api/metrics", Recv: &values}); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// MetricsSet persists the metric counters
+func (ts TorrentStore) MetricsSet(values map[string]int64) error {
+	_, err := ts.Exec(client.Opts{
+		Method: "POST",
+		Path:   "/api/metrics",
+		JSON:   values,
+	})
+	return err
+}
+
+// DenyListAdd will insert a new info_hash into the list of denied torrents
+func (ts TorrentStore) DenyListAdd(entry store.DenyListInfoHash) error {
+	_, err := ts.Exec(client.Opts{
+		Method: "POST",
+		Path:   "/api/denylist/infohash",
+		JSON: map[string]string{
+			"info_hash": entry.InfoHash.String(),
+			"reason":    entry.Reason,
+		},
+	})
+	return err
+}
+
+// DenyListDelete removes a info_hash from the list of denied torrents
+func (ts TorrentStore) DenyListDelete(ih store.InfoHash) error {
+	_, err := ts.Exec(client.Opts{
+		Method: "DELETE",
+		Path:   fmt.Sprintf("/api/denylist/infohash/%s", ih.String()),
+	})
+	return err
+}
+
+// DenyListGetAll fetches all denied info_hashes
+func (ts TorrentStore) DenyListGetAll() ([]store.DenyListInfoHash, error) {
+	var resp []map[string]string
+	_, err := ts.Exec(client.Opts{
+		Method: "GET",
+		Path:   "/api/denylist/infohash",
+		Recv:   &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var dl []store.DenyListInfoHash
+	for _, entry := range resp {
+		var ih store.InfoHash
+		if err := store.InfoHashFromHex(&ih, entry["info_hash"]); err != nil {
+			return nil, err
+		}
+		dl = append(dl, store.DenyListInfoHash{InfoHash: ih, Reason: entry["reason"]})
+	}
+	return dl, nil
+}
+
+// DenyListPage fetches a page of denied info_hashes ordered by info_hash
+func (ts TorrentStore) DenyListPage(offset int, limit int) ([]store.DenyListInfoHash, int, error) {
+	dl, err := ts.DenyListGetAll()
+	if err != nil {
+		return nil, 0, err
+	}
+	page, total := store.DenyListPage(dl, offset, limit)
+	return page, total, nil
+}
+
+// AllowedUserAdd grants the user access to the torrent
+func (ts TorrentStore) AllowedUserAdd(entry store.TorrentAllowedUser) error {
+	_, err := ts.Exec(client.Opts{
+		Method: "POST",
+		Path:   fmt.Sprintf("/api/torrent/%s/allowed_users", entry.InfoHash.String()),
+		JSON:   map[string]uint32{"user_id": entry.UserID},
+	})
+	return err
+}
+
+// AllowedUserDelete revokes a users access to the torrent
+func (ts TorrentStore) AllowedUserDelete(entry store.TorrentAllowedUser) error {
+	_, err := ts.Exec(client.Opts{
+		Method: "DELETE",
+		Path:   fmt.Sprintf("/api/torrent/%s/allowed_users/%d", entry.InfoHash.String(), entry.UserID),
+	})
+	return err
+}
+
+// AllowedUsersGetAll fetches the allowed users of every torrent
+func (ts TorrentStore) AllowedUsersGetAll() ([]store.TorrentAllowedUser, error) {
+	var allowed []store.TorrentAllowedUser
+	_, err := ts.Exec(client.Opts{
+		Method: "GET",
+		Path:   "/api/torrent/allowed_users",
+		Recv:   &allowed,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allowed, nil
+}
+
 // Add adds a new torrent to the HTTP API backing store
 func (ts TorrentStore) Add(t store.Torrent) error {
 	_, err := ts.Exec(client.Opts{
@@ -161,6 +353,32 @@ func (ts TorrentStore) Get(t *store.Torrent, hash store.InfoHash, deletedOk bool
 	return nil
 }
 
+// GetMany returns the torrents matching the infohashes keyed by infohash
+func (ts TorrentStore) GetMany(hashes []store.InfoHash, deletedOk bool) (map[store.InfoHash]store.Torrent, error) {
+	req := make([]string, len(hashes))
+	for i, hash := range hashes {
+		req[i] = hash.String()
+	}
+	var resp []store.Torrent
+	_, err := ts.Exec(client.Opts{
+		Method: "POST",
+		Path:   "/api/torrents/get",
+		JSON:   req,
+		Recv:   &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	torrents := make(map[store.InfoHash]store.Torrent, len(resp))
+	for _, t := range resp {
+		if t.IsDeleted && !deletedOk {
+			continue
+		}
+		torrents[t.InfoHash] = t
+	}
+	return torrents, nil
+}
+
 // Close will close all the remaining http connections
 func (ts TorrentStore) Close() error {
 	ts.CloseIdleConnections()
@@ -176,6 +394,24 @@ func (ps PeerStore) Name() string {
 	return driverName
 }
 
+// Count returns the number of peers across all swarms
+func (ps PeerStore) Count() (int, error) {
+	var resp struct {
+		Count int `json:"count"`
+	}
+	if _, err := ps.Exec(client.Opts{Method: "GET", Path: "/api/peers/count", Recv: &resp}); err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// Ping checks the API is reachable using the count endpoint, which every implementation
+// of the API already provides
+func (ps PeerStore) Ping() error {
+	_, err := ps.Count()
+	return err
+}
+
 // Sync batch updates the backing store with the new PeerStats provided
 func (ps PeerStore) Sync(batch map[store.PeerHash]store.PeerStats, cache *store.PeerCache) error {
 	rb := make(map[string]store.PeerStats)
@@ -191,10 +427,44 @@ func (ps PeerStore) Sync(batch map[store.PeerHash]store.PeerStats, cache *store.
 }
 
 // Reap will loop through the peers removing any stale entries from active swarms
-func (ps PeerStore) Reap(cache *store.PeerCache) {
+func (ps PeerStore) Reap(expiry time.Time, dryRun bool) []store.Peer {
 	panic("implement me")
 }
 
+// GetActive returns a page of the currently active peers across all torrents
+func (ps PeerStore) GetActive(offset int, limit int) ([]store.Peer, int, error) {
+	var resp struct {
+		Total   int          `json:"total"`
+		Results []store.Peer `json:"results"`
+	}
+	_, err := ps.Exec(client.Opts{
+		Method: "GET",
+		Path:   fmt.Sprintf("/api/peers/active?offset=%d&limit=%d", offset, limit),
+		Recv:   &resp,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Results, resp.Total, nil
+}
+
+// GetActiveByUser returns a page of the users peers active in any torrent
+func (ps PeerStore) GetActiveByUser(userID uint32, offset int, limit int) ([]store.Peer, int, error) {
+	var resp struct {
+		Total   int          `json:"total"`
+		Results []store.Peer `json:"results"`
+	}
+	_, err := ps.Exec(client.Opts{
+		Method: "GET",
+		Path:   fmt.Sprintf("/api/peers/user/%d?offset=%d&limit=%d", userID, offset, limit),
+		Recv:   &resp,
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Results, resp.Total, nil
+}
+
 // Add inserts a peer into the active swarm for the torrent provided
 func (ps PeerStore) Add(ih store.InfoHash, p store.Peer) error {
 	_, err := ps.Exec(client.Opts{
@@ -281,6 +551,24 @@ func (u *UserStore) Name() string {
 	return driverName
 }
 
+// Count returns the number of users
+func (u *UserStore) Count() (int, error) {
+	var resp struct {
+		Count int `json:"count"`
+	}
+	if _, err := u.Exec(client.Opts{Method: "GET", Path: "/api/users/count", Recv: &resp}); err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// Ping checks the API is reachable using the count endpoint, which every implementation
+// of the API already provides
+func (u *UserStore) Ping() error {
+	_, err := u.Count()
+	return err
+}
+
 // Sync batch updates the backing store with the new UserStats provided
 func (u *UserStore) Sync(batch map[string]store.UserStats, cache *store.UserCache) error {
 	_, err := u.Exec(client.Opts{
@@ -291,6 +579,19 @@ func (u *UserStore) Sync(batch map[string]store.UserStats, cache *store.UserCach
 	return err
 }
 
+// AdjustUser adds the signed deltas to the users totals, clamping them at zero
+func (u *UserStore) AdjustUser(userID uint32, upDelta int64, downDelta int64) error {
+	_, err := u.Exec(client.Opts{
+		Method: "POST",
+		Path:   fmt.Sprintf("/api/user/%d/adjust", userID),
+		JSON: map[string]int64{
+			"uploaded_delta":   upDelta,
+			"downloaded_delta": downDelta,
+		},
+	})
+	return err
+}
+
 // Add will add a new user to the backing store
 func (u *UserStore) Add(user store.User) error {
 	_, err := u.Exec(client.Opts{
@@ -305,19 +606,22 @@ func (u *UserStore) Add(user store.User) error {
 	return nil
 }
 
-// GetByPasskey will lookup and return the user via their passkey used as an identifier
-// The errors returned for this method should be very generic and not reveal any info
-// that could possibly help attackers gain any insight. All error cases MUST
-// return ErrUnauthorized.
+// GetByPasskey will lookup and return the user via their passkey used as an identifier.
+// Unknown passkeys return consts.ErrInvalidUser so they can be told apart from store failures.
 func (u *UserStore) GetByPasskey(usr *store.User, passkey string) error {
 	if len(passkey) != 20 {
 		return consts.ErrUnauthorized
 	}
-	_, err := u.Exec(client.Opts{
+	// Remote users without multipliers get the default of 1
+	*usr = store.User{MultiUp: 1, MultiDn: 1}
+	resp, err := u.Exec(client.Opts{
 		Method: "GET",
 		Path:   fmt.Sprintf("/api/user/pk/%s", passkey),
 		Recv:   usr,
 	})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return consts.ErrInvalidUser
+	}
 	if err != nil {
 		log.Errorf("Failed to make api call to backing http api: %s", err)
 		return consts.ErrUnauthorized
@@ -334,11 +638,15 @@ func (u *UserStore) GetByID(user *store.User, userID uint32) error {
 	if userID == 0 {
 		return consts.ErrUnauthorized
 	}
-	_, err := u.Exec(client.Opts{
+	*user = store.User{MultiUp: 1, MultiDn: 1}
+	resp, err := u.Exec(client.Opts{
 		Method: "GET",
 		Path:   fmt.Sprintf("/api/user/id/%d", userID),
 		Recv:   user,
 	})
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return consts.ErrInvalidUser
+	}
 	if err != nil {
 		return errors.Wrapf(err, "Failed to fetch user from backing store api")
 	}
@@ -358,6 +666,39 @@ func (u *UserStore) Delete(_ store.User) error {
 	panic("implement me")
 }
 
+// HNRAdd records a hit and run, replacing any existing record for the user and torrent
+func (u *UserStore) HNRAdd(hnr store.HNR) error {
+	_, err := u.Exec(client.Opts{
+		Method: "POST",
+		Path:   fmt.Sprintf("/api/user/%d/hnr", hnr.UserID),
+		JSON:   hnr,
+	})
+	return err
+}
+
+// HNRDelete clears the hit and run of the user on the torrent
+func (u *UserStore) HNRDelete(userID uint32, ih store.InfoHash) error {
+	_, err := u.Exec(client.Opts{
+		Method: "DELETE",
+		Path:   fmt.Sprintf("/api/user/%d/hnr/%s", userID, ih.String()),
+	})
+	return err
+}
+
+// HNRGetByUser fetches the hit and runs of the user ordered by info_hash
+func (u *UserStore) HNRGetByUser(userID uint32) ([]store.HNR, error) {
+	var hnrs []store.HNR
+	_, err := u.Exec(client.Opts{
+		Method: "GET",
+		Path:   fmt.Sprintf("/api/user/%d/hnr", userID),
+		Recv:   &hnrs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hnrs, nil
+}
+
 // Close will close all the remaining http connections
 func (u *UserStore) Close() error {
 	u.CloseIdleConnections()
@@ -13,6 +13,7 @@ import (
 	"github.com/leighmacdonald/mika/consts"
 	log "github.com/sirupsen/logrus"
 	"sync"
+	"time"
 )
 
 var (
@@ -72,9 +73,9 @@ func AddUserDriver(name string, driver UserDriver) {
 type UserStore interface {
 	// Add will add a new user to the backing store
 	Add(u User) error
-	// GetByPasskey returns a user matching the passkey
+	// GetByPasskey returns a user matching the passkey, or consts.ErrInvalidUser if there is none
 	GetByPasskey(user *User, passkey string) error
-	// GetByID returns a user matching the userId
+	// GetByID returns a user matching the userId, or consts.ErrInvalidUser if there is none
 	GetByID(user *User, userID uint32) error
 	// Delete removes a user from the backing store
 	Delete(user User) error
@@ -84,6 +85,20 @@ type UserStore interface {
 	Close() error
 	// Sync batch updates the backing store with the new UserStats provided
 	Sync(b map[string]UserStats) error
+	// AdjustUser atomically adds the signed deltas to the users uploaded and downloaded
+	// totals, clamping each at zero. consts.ErrInvalidUser is returned for unknown users.
+	AdjustUser(userID uint32, upDelta int64, downDelta int64) error
+	// HNRAdd records a hit and run, replacing any existing record for the user and torrent
+	HNRAdd(hnr HNR) error
+	// HNRDelete clears the hit and run of the user on the torrent. Deleting a record which
+	// does not exist is not an error.
+	HNRDelete(userID uint32, ih InfoHash) error
+	// HNRGetByUser fetches the hit and runs of the user ordered by info_hash
+	HNRGetByUser(userID uint32) ([]HNR, error)
+	// Count returns the number of users in the backing store
+	Count() (int, error)
+	// Ping checks the backing store is reachable
+	Ping() error
 	// Name returns the name of the data store type
 	Name() string
 }
@@ -98,7 +113,11 @@ type TorrentStore interface {
 	Delete(ih InfoHash, dropRow bool) error
 	// Get returns the Torrent matching the infohash
 	Get(torrent *Torrent, hash InfoHash, deletedOk bool) error
-	// Update will update certain parameters within the torrent
+	// GetMany returns the torrents matching the infohashes keyed by infohash. Unknown torrents
+	// and, unless deletedOk is set, deleted torrents are left out.
+	GetMany(hashes []InfoHash, deletedOk bool) (map[InfoHash]Torrent, error)
+	// Update will update certain parameters within the torrent. If the Version of the torrent
+	// does not match the currently stored version consts.ErrConflict is returned.
 	Update(torrent Torrent) error
 	// Close will cleanup and close the underlying storage driver if necessary
 	Close() error
@@ -108,8 +127,46 @@ type TorrentStore interface {
 	WhiteListAdd(client WhiteListClient) error
 	// WhiteListGetAll fetches all known whitelisted clients
 	WhiteListGetAll() ([]WhiteListClient, error)
+	// WhiteListPage fetches a page of whitelisted clients ordered by prefix along with
+	// the total number of whitelisted clients
+	WhiteListPage(offset int, limit int) ([]WhiteListClient, int, error)
+	// DenyListAdd will insert a new info_hash into the list of denied torrents
+	DenyListAdd(entry DenyListInfoHash) error
+	// DenyListDelete removes a info_hash from the list of denied torrents
+	DenyListDelete(ih InfoHash) error
+	// DenyListGetAll fetches all denied info_hashes
+	DenyListGetAll() ([]DenyListInfoHash, error)
+	// DenyListPage fetches a page of denied info_hashes ordered by info_hash along with
+	// the total number of denied info_hashes
+	DenyListPage(offset int, limit int) ([]DenyListInfoHash, int, error)
+	// AllowedUserAdd grants the user access to the torrent, restricting the torrent to its
+	// allowed users
+	AllowedUserAdd(entry TorrentAllowedUser) error
+	// AllowedUserDelete revokes a users access to the torrent, returning consts.ErrInvalidUser
+	// if the user was not allowed
+	AllowedUserDelete(entry TorrentAllowedUser) error
+	// AllowedUsersGetAll fetches the allowed users of every torrent
+	AllowedUsersGetAll() ([]TorrentAllowedUser, error)
+	// ConfigGetAll fetches all persisted runtime config values keyed by their config key
+	ConfigGetAll() (map[string]string, error)
+	// ConfigSet persists a runtime config value, replacing any existing value for the key
+	ConfigSet(key string, value string) error
+	// MetricsGetAll fetches the persisted metric counters keyed by metric name
+	MetricsGetAll() (map[string]int64, error)
+	// MetricsSet persists the metric counters, replacing any existing values
+	MetricsSet(values map[string]int64) error
 	// Sync batch updates the backing store with the new TorrentStats provided
 	Sync(b map[InfoHash]TorrentStats) error
+	// Count returns the number of torrents in the backing store, excluding deleted torrents
+	Count() (int, error)
+	// List fetches a page of torrents not marked as deleted, ordered by info_hash
+	List(limit int, offset int) ([]Torrent, error)
+	// Ping checks the backing store is reachable
+	Ping() error
+	// Inactive fetches the info_hashes of auto registered torrents which have not been announced
+	// since olderThan. The stat counters aren't updated when stats are disabled so the caller
+	// must check the peer store before treating them as idle.
+	Inactive(olderThan time.Time) ([]InfoHash, error)
 	// Conn returns the underlying connection, if any
 	Conn() interface{}
 	// Name returns the name of the data store type
@@ -128,10 +185,22 @@ type PeerStore interface {
 	GetN(ih InfoHash, limit int) (Swarm, error)
 	// Get will fetch the peer from the swarm if it exists
 	Get(peer *Peer, ih InfoHash, id PeerID) error
+	// GetActive fetches a page of peers that are active in any swarm, ordered by info_hash and
+	// peer_id, along with the total number of active peers. Peers stay active until reaped
+	GetActive(offset int, limit int) ([]Peer, int, error)
+	// GetActiveByUser fetches a page of the users peers that are active in any swarm, ordered
+	// by info_hash and peer_id, along with the total number of active peers for the user
+	GetActiveByUser(userID uint32, offset int, limit int) ([]Peer, int, error)
 	// Close will cleanup and close the underlying storage driver if necessary
 	Close() error
-	// Reap will loop through the peers removing any stale entries from active swarms
-	Reap() []PeerHash
+	// Reap will loop through the peers removing and returning any which have not announced
+	// since the expiry time. A peer which announces while being reaped must not be removed.
+	// When dryRun is true the stale peers are only returned and not removed.
+	Reap(expiry time.Time, dryRun bool) []Peer
+	// Count returns the number of peers across all swarms in the backing store
+	Count() (int, error)
+	// Ping checks the backing store is reachable
+	Ping() error
 	// Sync batch updates the backing store with the new PeerStats provided
 	Sync(b map[PeerHash]PeerStats) error
 	// Name returns the name of the data store type
@@ -4,6 +4,7 @@ import (
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/store"
 	"sync"
+	"time"
 )
 
 const (
@@ -15,6 +16,10 @@ type TorrentStore struct {
 	sync.RWMutex
 	torrents  map[store.InfoHash]store.Torrent
 	whitelist []store.WhiteListClient
+	denylist  map[store.InfoHash]store.DenyListInfoHash
+	allowed   map[store.TorrentAllowedUser]bool
+	config    map[string]string
+	metrics   map[string]int64
 }
 
 func (ts *TorrentStore) Name() string {
@@ -22,11 +27,17 @@ func (ts *TorrentStore) Name() string {
 }
 
 func (ts *TorrentStore) Update(torrent store.Torrent) error {
-	var orig store.Torrent
-	if err := ts.Get(&orig, torrent.InfoHash, true); err != nil {
-		return err
-	}
 	ts.Lock()
+	orig, found := ts.torrents[torrent.InfoHash]
+	if !found {
+		ts.Unlock()
+		return consts.ErrInvalidInfoHash
+	}
+	if orig.Version != torrent.Version {
+		ts.Unlock()
+		return consts.ErrConflict
+	}
+	torrent.Version++
 	ts.torrents[torrent.InfoHash] = torrent
 	ts.Unlock()
 	return nil
@@ -38,6 +49,10 @@ func NewTorrentStore() *TorrentStore {
 		RWMutex:   sync.RWMutex{},
 		torrents:  map[store.InfoHash]store.Torrent{},
 		whitelist: []store.WhiteListClient{},
+		denylist:  map[store.InfoHash]store.DenyListInfoHash{},
+		allowed:   map[store.TorrentAllowedUser]bool{},
+		config:    map[string]string{},
+		metrics:   map[string]int64{},
 	}
 }
 
@@ -49,6 +64,9 @@ func (ts *TorrentStore) Add(t store.Torrent) error {
 	if found {
 		return consts.ErrDuplicate
 	}
+	if t.AnnouncedOn.IsZero() {
+		t.AnnouncedOn = time.Now()
+	}
 	ts.Lock()
 	ts.torrents[t.InfoHash] = t
 	ts.Unlock()
@@ -56,11 +74,20 @@ func (ts *TorrentStore) Add(t store.Torrent) error {
 }
 
 // Delete will mark a torrent as deleted in the backing store.
-// NOTE the memory store always permanently deletes the torrent
-func (ts *TorrentStore) Delete(ih store.InfoHash, _ bool) error {
+// If dropRow is true, it will permanently remove the torrent from the store
+func (ts *TorrentStore) Delete(ih store.InfoHash, dropRow bool) error {
 	ts.Lock()
-	delete(ts.torrents, ih)
-	ts.Unlock()
+	defer ts.Unlock()
+	if dropRow {
+		delete(ts.torrents, ih)
+		return nil
+	}
+	t, found := ts.torrents[ih]
+	if !found {
+		return consts.ErrInvalidInfoHash
+	}
+	t.IsDeleted = true
+	ts.torrents[ih] = t
 	return nil
 }
 
@@ -80,11 +107,59 @@ func (ts *TorrentStore) Sync(b map[store.InfoHash]store.TorrentStats) error {
 		t.Seeders += stats.Seeders
 		t.Leechers += stats.Leechers
 		t.Announces += stats.Announces
+		if stats.Announces > 0 {
+			t.AnnouncedOn = time.Now()
+		}
 		ts.torrents[ih] = t
 	}
 	return nil
 }
 
+// Inactive fetches the info_hashes of auto registered torrents which have not been announced
+// since olderThan
+func (ts *TorrentStore) Inactive(olderThan time.Time) ([]store.InfoHash, error) {
+	ts.RLock()
+	defer ts.RUnlock()
+	var inactive []store.InfoHash
+	for ih, t := range ts.torrents {
+		if t.AutoRegistered && t.AnnouncedOn.Before(olderThan) {
+			inactive = append(inactive, ih)
+		}
+	}
+	return inactive, nil
+}
+
+// Count returns the number of torrents not marked as deleted
+func (ts *TorrentStore) Count() (int, error) {
+	ts.RLock()
+	defer ts.RUnlock()
+	count := 0
+	for _, t := range ts.torrents {
+		if !t.IsDeleted {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// List fetches a page of torrents not marked as deleted, ordered by info_hash
+func (ts *TorrentStore) List(limit int, offset int) ([]store.Torrent, error) {
+	ts.RLock()
+	torrents := make([]store.Torrent, 0, len(ts.torrents))
+	for _, t := range ts.torrents {
+		if !t.IsDeleted {
+			torrents = append(torrents, t)
+		}
+	}
+	ts.RUnlock()
+	return store.TorrentPage(torrents, offset, limit), nil
+}
+
+// Ping always succeeds, the memory store has no connection to lose
+func (ts *TorrentStore) Ping() error {
+	return nil
+}
+
 // Conn always returns nil for in-memory store
 func (ts *TorrentStore) Conn() interface{} {
 	return nil
@@ -120,6 +195,121 @@ func (ts *TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	return wl, nil
 }
 
+// WhiteListPage fetches a page of whitelisted clients ordered by prefix
+func (ts *TorrentStore) WhiteListPage(offset int, limit int) ([]store.WhiteListClient, int, error) {
+	ts.RLock()
+	defer ts.RUnlock()
+	wl, total := store.WhiteListPage(ts.whitelist, offset, limit)
+	return wl, total, nil
+}
+
+// DenyListAdd will insert a new info_hash into the list of denied torrents
+func (ts *TorrentStore) DenyListAdd(entry store.DenyListInfoHash) error {
+	ts.Lock()
+	ts.denylist[entry.InfoHash] = entry
+	ts.Unlock()
+	return nil
+}
+
+// DenyListDelete removes a info_hash from the list of denied torrents
+func (ts *TorrentStore) DenyListDelete(ih store.InfoHash) error {
+	ts.Lock()
+	defer ts.Unlock()
+	if _, found := ts.denylist[ih]; !found {
+		return consts.ErrInvalidInfoHash
+	}
+	delete(ts.denylist, ih)
+	return nil
+}
+
+// DenyListGetAll fetches all denied info_hashes
+func (ts *TorrentStore) DenyListGetAll() ([]store.DenyListInfoHash, error) {
+	ts.RLock()
+	var dl []store.DenyListInfoHash
+	for _, entry := range ts.denylist {
+		dl = append(dl, entry)
+	}
+	ts.RUnlock()
+	return dl, nil
+}
+
+// DenyListPage fetches a page of denied info_hashes ordered by info_hash
+func (ts *TorrentStore) DenyListPage(offset int, limit int) ([]store.DenyListInfoHash, int, error) {
+	dl, _ := ts.DenyListGetAll()
+	page, total := store.DenyListPage(dl, offset, limit)
+	return page, total, nil
+}
+
+// AllowedUserAdd grants the user access to the torrent
+func (ts *TorrentStore) AllowedUserAdd(entry store.TorrentAllowedUser) error {
+	ts.Lock()
+	ts.allowed[entry] = true
+	ts.Unlock()
+	return nil
+}
+
+// AllowedUserDelete revokes a users access to the torrent
+func (ts *TorrentStore) AllowedUserDelete(entry store.TorrentAllowedUser) error {
+	ts.Lock()
+	defer ts.Unlock()
+	if !ts.allowed[entry] {
+		return consts.ErrInvalidUser
+	}
+	delete(ts.allowed, entry)
+	return nil
+}
+
+// AllowedUsersGetAll fetches the allowed users of every torrent
+func (ts *TorrentStore) AllowedUsersGetAll() ([]store.TorrentAllowedUser, error) {
+	ts.RLock()
+	var allowed []store.TorrentAllowedUser
+	for entry := range ts.allowed {
+		allowed = append(allowed, entry)
+	}
+	ts.RUnlock()
+	return allowed, nil
+}
+
+// ConfigGetAll fetches all persisted runtime config values
+func (ts *TorrentStore) ConfigGetAll() (map[string]string, error) {
+	ts.RLock()
+	defer ts.RUnlock()
+	values := make(map[string]string, len(ts.config))
+	for k, v := range ts.config {
+		values[k] = v
+	}
+	return values, nil
+}
+
+// ConfigSet persists a runtime config value
+func (ts *TorrentStore) ConfigSet(key string, value string) error {
+	ts.Lock()
+	ts.config[key] = value
+	ts.Unlock()
+	return nil
+}
+
+// MetricsGetAll fetches the persisted metric counters
+func (ts *TorrentStore) MetricsGetAll() (map[string]int64, error) {
+	ts.RLock()
+	defer ts.RUnlock()
+	values := make(map[string]int64, len(ts.metrics))
+	for k, v := range ts.metrics {
+		values[k] = v
+	}
+	return values, nil
+}
+
+// MetricsSet persists the metric counters
+func (ts *TorrentStore) MetricsSet(values map[string]int64) error {
+	ts.Lock()
+	for k, v := range values {
+		ts.metrics[k] = v
+	}
+	ts.Unlock()
+	return nil
+}
+
 // Close will delete/free all the underlying torrent data
 func (ts *TorrentStore) Close() error {
 	ts.Lock()
@@ -129,6 +319,19 @@ func (ts *TorrentStore) Close() error {
 }
 
 // Get returns the Torrent matching the infohash
+// GetMany returns the torrents matching the infohashes keyed by infohash
+func (ts *TorrentStore) GetMany(hashes []store.InfoHash, deletedOk bool) (map[store.InfoHash]store.Torrent, error) {
+	torrents := make(map[store.InfoHash]store.Torrent, len(hashes))
+	ts.RLock()
+	defer ts.RUnlock()
+	for _, hash := range hashes {
+		if t, found := ts.torrents[hash]; found && (deletedOk || !t.IsDeleted) {
+			torrents[hash] = t
+		}
+	}
+	return torrents, nil
+}
+
 func (ts *TorrentStore) Get(torrent *store.Torrent, hash store.InfoHash, deletedOk bool) error {
 	ts.RLock()
 	t, found := ts.torrents[hash]
@@ -176,18 +379,18 @@ func (ps *PeerStore) Sync(b map[store.PeerHash]store.PeerStats) error {
 }
 
 // Reap will loop through the swarms removing any stale entries from active swarms
-func (ps *PeerStore) Reap() []store.PeerHash {
-	var peerHashes []store.PeerHash
+func (ps *PeerStore) Reap(expiry time.Time, dryRun bool) []store.Peer {
+	var peers []store.Peer
 	ps.Lock()
 	for k := range ps.swarms {
 		swarm, ok := ps.swarms[k]
 		if !ok {
 			continue
 		}
-		peerHashes = append(peerHashes, swarm.ReapExpired(k)...)
+		peers = append(peers, swarm.ReapExpired(k, expiry, dryRun)...)
 	}
 	ps.Unlock()
-	return peerHashes
+	return peers
 }
 
 // Get will fetch the peer from the swarm if it exists
@@ -245,15 +448,88 @@ func (ps *PeerStore) Delete(ih store.InfoHash, p store.PeerID) error {
 	return nil
 }
 
+// GetActive fetches a page of peers that are active in any swarm
+func (ps *PeerStore) GetActive(offset int, limit int) ([]store.Peer, int, error) {
+	var peers []store.Peer
+	ps.RLock()
+	for ih, swarm := range ps.swarms {
+		swarm.RLock()
+		for _, p := range swarm.Peers {
+			p.InfoHash = ih
+			peers = append(peers, p)
+		}
+		swarm.RUnlock()
+	}
+	ps.RUnlock()
+	page, total := store.PeerPage(peers, offset, limit)
+	return page, total, nil
+}
+
+// GetActiveByUser fetches a page of the users peers that are active in any swarm
+func (ps *PeerStore) GetActiveByUser(userID uint32, offset int, limit int) ([]store.Peer, int, error) {
+	var peers []store.Peer
+	ps.RLock()
+	for ih, swarm := range ps.swarms {
+		swarm.RLock()
+		for _, p := range swarm.Peers {
+			if p.UserID != userID {
+				continue
+			}
+			p.InfoHash = ih
+			peers = append(peers, p)
+		}
+		swarm.RUnlock()
+	}
+	ps.RUnlock()
+	page, total := store.PeerPage(peers, offset, limit)
+	return page, total, nil
+}
+
+// Count returns the number of peers across all swarms
+func (ps *PeerStore) Count() (int, error) {
+	count := 0
+	ps.RLock()
+	for _, swarm := range ps.swarms {
+		swarm.RLock()
+		count += len(swarm.Peers)
+		swarm.RUnlock()
+	}
+	ps.RUnlock()
+	return count, nil
+}
+
+// Ping always succeeds, the memory store has no connection to lose
+func (ps *PeerStore) Ping() error {
+	return nil
+}
+
 // GetN will fetch swarms for a torrents active swarm up to N users
-func (ps *PeerStore) GetN(ih store.InfoHash, _ int) (store.Swarm, error) {
+func (ps *PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
 	ps.RLock()
 	p, found := ps.swarms[ih]
 	ps.RUnlock()
 	if !found {
 		return store.Swarm{}, consts.ErrInvalidTorrentID
 	}
-	return p, nil
+	p.RLock()
+	defer p.RUnlock()
+	if limit <= 0 || len(p.Peers) <= limit {
+		return p, nil
+	}
+	swarm := store.Swarm{
+		// Sized up front so large swarms don't repeatedly grow the map while copying
+		Peers:    make(map[store.PeerID]store.Peer, limit),
+		Seeders:  p.Seeders,
+		Leechers: p.Leechers,
+		RWMutex:  &sync.RWMutex{},
+	}
+	for peerID, peer := range p.Peers {
+		if len(swarm.Peers) == limit {
+			break
+		}
+		swarm.Peers[peerID] = peer
+	}
+	return swarm, nil
 }
 
 type torrentDriver struct{}
@@ -274,6 +550,9 @@ func (pd peerDriver) New(_ interface{}) (store.PeerStore, error) {
 type UserStore struct {
 	sync.RWMutex
 	users map[string]store.User
+	// passkeys indexes the passkey of each user by user_id
+	passkeys map[uint32]string
+	hnrs     map[uint32]map[store.InfoHash]store.HNR
 }
 
 func (u *UserStore) Name() string {
@@ -288,19 +567,24 @@ func (u *UserStore) Update(user store.User, oldPasskey string) error {
 	if oldPasskey != "" {
 		key = oldPasskey
 	}
-	_, found := u.users[key]
+	existing, found := u.users[key]
 	if !found {
 		return consts.ErrInvalidUser
 	}
+	delete(u.passkeys, existing.UserID)
+	delete(u.users, key)
 	u.users[user.Passkey] = user
+	u.passkeys[user.UserID] = user.Passkey
 	return nil
 }
 
 // NewUserStore instantiates a new in-memory user store
 func NewUserStore() *UserStore {
 	return &UserStore{
-		RWMutex: sync.RWMutex{},
-		users:   map[string]store.User{},
+		RWMutex:  sync.RWMutex{},
+		users:    map[string]store.User{},
+		passkeys: map[uint32]string{},
+		hnrs:     map[uint32]map[store.InfoHash]store.HNR{},
 	}
 }
 
@@ -317,37 +601,67 @@ func (u *UserStore) Sync(b map[string]store.UserStats) error {
 		user.Announces += stats.Announces
 		user.Downloaded += stats.Downloaded
 		user.Uploaded += stats.Uploaded
+		user.Bonus += stats.Bonus
 		u.users[passkey] = user
 	}
 	return nil
 }
 
+// adjustTotal adds the signed delta to total, clamping the result at zero
+func adjustTotal(total uint64, delta int64) uint64 {
+	if delta < 0 && uint64(-delta) > total {
+		return 0
+	}
+	return uint64(int64(total) + delta)
+}
+
+// AdjustUser adds the signed deltas to the users totals, clamping them at zero
+func (u *UserStore) AdjustUser(userID uint32, upDelta int64, downDelta int64) error {
+	u.Lock()
+	defer u.Unlock()
+	passkey, found := u.passkeys[userID]
+	if !found {
+		return consts.ErrInvalidUser
+	}
+	user := u.users[passkey]
+	user.Uploaded = adjustTotal(user.Uploaded, upDelta)
+	user.Downloaded = adjustTotal(user.Downloaded, downDelta)
+	u.users[passkey] = user
+	return nil
+}
+
+// Count returns the number of users
+func (u *UserStore) Count() (int, error) {
+	u.RLock()
+	defer u.RUnlock()
+	return len(u.users), nil
+}
+
+// Ping always succeeds, the memory store has no connection to lose
+func (u *UserStore) Ping() error {
+	return nil
+}
+
 // Add will add a new user to the backing store
 func (u *UserStore) Add(usr store.User) error {
-	u.RLock()
-	for _, existing := range u.users {
-		if existing.UserID == usr.UserID {
-			u.RUnlock()
-			return consts.ErrDuplicate
-		}
-	}
-	u.RUnlock()
 	u.Lock()
+	defer u.Unlock()
+	if _, found := u.passkeys[usr.UserID]; found {
+		return consts.ErrDuplicate
+	}
 	u.users[usr.Passkey] = usr
-	u.Unlock()
+	u.passkeys[usr.UserID] = usr.Passkey
 	return nil
 }
 
-// GetByPasskey will lookup and return the user via their passkey used as an identifier
-// The errors returned for this method should be very generic and not reveal any info
-// that could possibly help attackers gain any insight. All error cases MUST
-// return ErrUnauthorized.
+// GetByPasskey will lookup and return the user via their passkey used as an identifier.
+// Unknown passkeys return consts.ErrInvalidUser so they can be told apart from store failures.
 func (u *UserStore) GetByPasskey(usr *store.User, passkey string) error {
 	u.RLock()
 	user, found := u.users[passkey]
 	u.RUnlock()
 	if !found {
-		return consts.ErrUnauthorized
+		return consts.ErrInvalidUser
 	}
 	*usr = user
 	return nil
@@ -357,28 +671,65 @@ func (u *UserStore) GetByPasskey(usr *store.User, passkey string) error {
 func (u *UserStore) GetByID(user *store.User, userID uint32) error {
 	u.RLock()
 	defer u.RUnlock()
-	for _, usr := range u.users {
-		if usr.UserID == userID {
-			*user = usr
-			return nil
-		}
+	passkey, found := u.passkeys[userID]
+	if !found {
+		return consts.ErrInvalidUser
 	}
-	return consts.ErrUnauthorized
+	*user = u.users[passkey]
+	return nil
 }
 
 // Delete removes a user from the backing store
 func (u *UserStore) Delete(user store.User) error {
 	u.Lock()
+	if existing, found := u.users[user.Passkey]; found {
+		delete(u.passkeys, existing.UserID)
+	}
 	delete(u.users, user.Passkey)
 	u.Unlock()
 	return nil
 }
 
+// HNRAdd records a hit and run, replacing any existing record for the user and torrent
+func (u *UserStore) HNRAdd(hnr store.HNR) error {
+	u.Lock()
+	if _, found := u.hnrs[hnr.UserID]; !found {
+		u.hnrs[hnr.UserID] = map[store.InfoHash]store.HNR{}
+	}
+	u.hnrs[hnr.UserID][hnr.InfoHash] = hnr
+	u.Unlock()
+	return nil
+}
+
+// HNRDelete clears the hit and run of the user on the torrent
+func (u *UserStore) HNRDelete(userID uint32, ih store.InfoHash) error {
+	u.Lock()
+	delete(u.hnrs[userID], ih)
+	if len(u.hnrs[userID]) == 0 {
+		delete(u.hnrs, userID)
+	}
+	u.Unlock()
+	return nil
+}
+
+// HNRGetByUser fetches the hit and runs of the user ordered by info_hash
+func (u *UserStore) HNRGetByUser(userID uint32) ([]store.HNR, error) {
+	u.RLock()
+	hnrs := make([]store.HNR, 0, len(u.hnrs[userID]))
+	for _, hnr := range u.hnrs[userID] {
+		hnrs = append(hnrs, hnr)
+	}
+	u.RUnlock()
+	store.SortHNRs(hnrs)
+	return hnrs, nil
+}
+
 // Close will delete/free the underlying memory store
 func (u *UserStore) Close() error {
 	u.Lock()
 	defer u.Unlock()
 	u.users = make(map[string]store.User)
+	u.hnrs = make(map[uint32]map[store.InfoHash]store.HNR)
 	return nil
 }
 
@@ -8,7 +8,9 @@ BEGIN
            Enabled      as is_deleted,
            Downloaded   as downloaded,
            Uploaded     as uploaded,
-           0            as announces
+           0            as announces,
+           1.0          as multi_up,
+           1.0          as multi_dn
     FROM users
     WHERE torrent_pass = in_passkey;
 end;
@@ -22,7 +24,85 @@ BEGIN
            Enabled      as is_deleted,
            Downloaded   as downloaded,
            Uploaded     as uploaded,
-           0            as announces
+           0            as announces,
+           1.0          as multi_up,
+           1.0          as multi_dn
     FROM users
     WHERE `ID` = in_user_id;
 end;
+
+-- ALLOWED USERS
+-- gazelle has no equivalent so the allowed users of restricted torrents are kept in their own table
+CREATE TABLE IF NOT EXISTS torrent_allowed_user
+(
+    info_hash binary(20)   not null,
+    user_id   int unsigned not null,
+    primary key (info_hash, user_id)
+);
+
+DROP PROCEDURE IF EXISTS allowed_user_all;
+CREATE PROCEDURE allowed_user_all()
+BEGIN
+    SELECT info_hash, user_id
+    FROM torrent_allowed_user;
+end;
+
+DROP PROCEDURE IF EXISTS allowed_user_add;
+CREATE PROCEDURE allowed_user_add(IN in_info_hash binary(20),
+                                  IN in_user_id int)
+BEGIN
+    INSERT IGNORE INTO torrent_allowed_user (info_hash, user_id)
+    VALUES (in_info_hash, in_user_id);
+end;
+
+DROP PROCEDURE IF EXISTS allowed_user_delete;
+CREATE PROCEDURE allowed_user_delete(IN in_info_hash binary(20),
+                                     IN in_user_id int)
+BEGIN
+    DELETE
+    FROM torrent_allowed_user
+    WHERE info_hash = in_info_hash
+      AND user_id = in_user_id;
+end;
+
+-- HIT AND RUNS
+-- gazelle has no equivalent so the tracker keeps its own hit and run records
+CREATE TABLE IF NOT EXISTS user_hnr
+(
+    user_id    int unsigned not null,
+    info_hash  binary(20)   not null,
+    seed_time  int unsigned default 0 not null,
+    created_on datetime     not null,
+    primary key (user_id, info_hash)
+);
+
+DROP PROCEDURE IF EXISTS hnr_add;
+CREATE PROCEDURE hnr_add(IN in_user_id int,
+                         IN in_info_hash binary(20),
+                         IN in_seed_time int,
+                         IN in_created_on datetime)
+BEGIN
+    INSERT INTO user_hnr (user_id, info_hash, seed_time, created_on)
+    VALUES (in_user_id, in_info_hash, in_seed_time, in_created_on)
+    ON DUPLICATE KEY UPDATE seed_time  = in_seed_time,
+                            created_on = in_created_on;
+end;
+
+DROP PROCEDURE IF EXISTS hnr_delete;
+CREATE PROCEDURE hnr_delete(IN in_user_id int,
+                            IN in_info_hash binary(20))
+BEGIN
+    DELETE
+    FROM user_hnr
+    WHERE user_id = in_user_id
+      AND info_hash = in_info_hash;
+end;
+
+DROP PROCEDURE IF EXISTS hnr_by_user;
+CREATE PROCEDURE hnr_by_user(IN in_user_id int)
+BEGIN
+    SELECT user_id, info_hash, seed_time, created_on
+    FROM user_hnr
+    WHERE user_id = in_user_id
+    ORDER BY info_hash;
+end;
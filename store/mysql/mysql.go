@@ -38,9 +38,26 @@ func (u *UserStore) Name() string {
 	return driverName
 }
 
+// Count returns the number of users
+func (u *UserStore) Count() (int, error) {
+	var total int
+	if err := u.db.Get(&total, `CALL user_count()`); err != nil {
+		return 0, errors.Wrap(err, "Failed to count users")
+	}
+	return total, nil
+}
+
+// Ping checks the database is reachable
+func (u *UserStore) Ping() error {
+	if err := u.db.Ping(); err != nil {
+		return errors.Wrap(err, "Failed to ping user store")
+	}
+	return nil
+}
+
 // Sync batch updates the backing store with the new UserStats provided
 func (u *UserStore) Sync(b map[string]store.UserStats) error {
-	const q = `CALL user_update_stats(?, ?, ?, ?)`
+	const q = `CALL user_update_stats(?, ?, ?, ?, ?)`
 	// TODO use ctx for timeout
 	ctx := context.Background()
 	tx, err := u.db.BeginTx(ctx, nil)
@@ -52,7 +69,7 @@ func (u *UserStore) Sync(b map[string]store.UserStats) error {
 		return errors.Wrap(err, "Failed to prepare user Sync() tx")
 	}
 	for passkey, stats := range b {
-		_, err := stmt.Exec(passkey, stats.Announces, stats.Uploaded, stats.Downloaded)
+		_, err := stmt.Exec(passkey, stats.Announces, stats.Uploaded, stats.Downloaded, stats.Bonus)
 		if err != nil {
 			if err := tx.Rollback(); err != nil {
 				log.Errorf("Failed to roll back user Sync() tx")
@@ -67,21 +84,39 @@ func (u *UserStore) Sync(b map[string]store.UserStats) error {
 	return nil
 }
 
+// AdjustUser adds the signed deltas to the users totals, clamping them at zero
+func (u *UserStore) AdjustUser(userID uint32, upDelta int64, downDelta int64) error {
+	const q = `CALL user_adjust(?, ?, ?)`
+	res, err := u.db.Exec(q, userID, upDelta, downDelta)
+	if err != nil {
+		return errors.Wrap(err, "Failed to adjust user")
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Failed to adjust user")
+	}
+	if rows == 0 {
+		// MySQL reports 0 rows when the values are unchanged, such as a clamped total already at 0
+		var user store.User
+		return u.GetByID(&user, userID)
+	}
+	return nil
+}
+
 // Add will add a new user to the backing store
 func (u *UserStore) Add(user store.User) error {
-	const q = `CALL user_add(?, ?, ?, ?, ?, ?, ?)`
+	const q = `CALL user_add(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	_, err := u.db.Exec(q, user.UserID, user.Passkey, user.DownloadEnabled,
-		user.IsDeleted, user.Downloaded, user.Uploaded, user.Announces)
+		user.IsDeleted, user.Downloaded, user.Uploaded, user.Announces, user.Bonus, user.Class,
+		user.MultiUp, user.MultiDn)
 	if err != nil {
 		return errors.Wrap(err, "Failed to add user to store")
 	}
 	return nil
 }
 
-// GetByPasskey will lookup and return the user via their passkey used as an identifier
-// The errors returned for this method should be very generic and not reveal any info
-// that could possibly help attackers gain any insight. All error cases MUST
-// return ErrUnauthorized.
+// GetByPasskey will lookup and return the user via their passkey used as an identifier.
+// Unknown passkeys return consts.ErrInvalidUser so they can be told apart from store failures.
 func (u *UserStore) GetByPasskey(user *store.User, passkey string) error {
 	const q = `CALL user_by_passkey(?)`
 	if err := u.db.Get(user, q, passkey); err != nil {
@@ -119,15 +154,43 @@ func (u *UserStore) Delete(user store.User) error {
 }
 
 func (u *UserStore) Update(user store.User, oldPasskey string) error {
-	const q = `CALL user_update(?, ?, ?, ?, ?, ?, ?, ?)`
+	const q = `CALL user_update(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	if _, err := u.db.Exec(q, user.UserID, user.Passkey, user.DownloadEnabled,
-		user.IsDeleted, user.Downloaded, user.Uploaded, user.Announces,
-		oldPasskey); err != nil {
+		user.IsDeleted, user.Downloaded, user.Uploaded, user.Announces, user.Bonus,
+		user.Class, user.MultiUp, user.MultiDn, oldPasskey); err != nil {
 		return errors.Wrapf(err, "Failed to update user")
 	}
 	return nil
 }
 
+// HNRAdd records a hit and run, replacing any existing record for the user and torrent
+func (u *UserStore) HNRAdd(hnr store.HNR) error {
+	const q = `CALL hnr_add(?, ?, ?, ?)`
+	if _, err := u.db.Exec(q, hnr.UserID, hnr.InfoHash.Bytes(), hnr.SeedTime, hnr.CreatedOn); err != nil {
+		return errors.Wrap(err, "Failed to insert hnr")
+	}
+	return nil
+}
+
+// HNRDelete clears the hit and run of the user on the torrent
+func (u *UserStore) HNRDelete(userID uint32, ih store.InfoHash) error {
+	const q = `CALL hnr_delete(?, ?)`
+	if _, err := u.db.Exec(q, userID, ih.Bytes()); err != nil {
+		return errors.Wrap(err, "Failed to delete hnr")
+	}
+	return nil
+}
+
+// HNRGetByUser fetches the hit and runs of the user ordered by info_hash
+func (u *UserStore) HNRGetByUser(userID uint32) ([]store.HNR, error) {
+	hnrs := []store.HNR{}
+	const q = `CALL hnr_by_user(?)`
+	if err := u.db.Select(&hnrs, q, userID); err != nil {
+		return nil, errors.Wrap(err, "Failed to select hnrs")
+	}
+	return hnrs, nil
+}
+
 // Close will close the underlying database connection and clear the local caches
 func (u *UserStore) Close() error {
 	return u.db.Close()
@@ -142,6 +205,32 @@ func (s *TorrentStore) Name() string {
 	return driverName
 }
 
+// Count returns the number of torrents not marked as deleted
+func (s *TorrentStore) Count() (int, error) {
+	var total int
+	if err := s.db.Get(&total, `CALL torrent_count()`); err != nil {
+		return 0, errors.Wrap(err, "Failed to count torrents")
+	}
+	return total, nil
+}
+
+// List fetches a page of torrents not marked as deleted, ordered by info_hash
+func (s *TorrentStore) List(limit int, offset int) ([]store.Torrent, error) {
+	var torrents []store.Torrent
+	if err := s.db.Select(&torrents, `CALL torrent_page(?, ?)`, offset, limit); err != nil {
+		return nil, errors.Wrap(err, "Failed to select torrents")
+	}
+	return torrents, nil
+}
+
+// Ping checks the database is reachable
+func (s *TorrentStore) Ping() error {
+	if err := s.db.Ping(); err != nil {
+		return errors.Wrap(err, "Failed to ping torrent store")
+	}
+	return nil
+}
+
 func (s *TorrentStore) Update(torrent store.Torrent) error {
 	const q = `
 		UPDATE 
@@ -156,11 +245,17 @@ func (s *TorrentStore) Update(torrent store.Torrent) error {
 		    reason = ?,
 		    multi_up = ?,
 		    multi_dn = ?,
-		    announces = ?
+		    freeleech = ?,
+		    announces = ?,
+		    release_name = ?,
+		    size = ?,
+		    max_peers = ?,
+		    restricted = ?,
+		    version = (version + 1)
 		WHERE
-			info_hash = ?
+			info_hash = ? AND version = ?
 			`
-	_, err := s.db.Exec(q,
+	res, err := s.db.Exec(q,
 		torrent.InfoHash.Bytes(),
 		torrent.Snatches,
 		torrent.Uploaded,
@@ -170,11 +265,24 @@ func (s *TorrentStore) Update(torrent store.Torrent) error {
 		torrent.Reason,
 		torrent.MultiUp,
 		torrent.MultiDn,
+		torrent.Freeleech,
 		torrent.Announces,
-		torrent.InfoHash.Bytes())
+		torrent.ReleaseName,
+		torrent.Size,
+		torrent.MaxPeers,
+		torrent.Restricted,
+		torrent.InfoHash.Bytes(),
+		torrent.Version)
+	if err != nil {
+		return errors.Wrap(err, "Failed to update torrent")
+	}
+	rows, err := res.RowsAffected()
 	if err != nil {
 		return errors.Wrap(err, "Failed to update torrent")
 	}
+	if rows != 1 {
+		return consts.ErrConflict
+	}
 	return nil
 }
 
@@ -211,6 +319,16 @@ func (s *TorrentStore) Sync(b map[store.InfoHash]store.TorrentStats) error {
 	return nil
 }
 
+// Inactive fetches the info_hashes of auto registered torrents which have not been announced
+// since olderThan
+func (s *TorrentStore) Inactive(olderThan time.Time) ([]store.InfoHash, error) {
+	var inactive []store.InfoHash
+	if err := s.db.Select(&inactive, `CALL torrent_inactive(?)`, olderThan); err != nil {
+		return nil, errors.Wrap(err, "Failed to select inactive torrents")
+	}
+	return inactive, nil
+}
+
 // Conn returns the underlying database driver
 func (s *TorrentStore) Conn() interface{} {
 	return s.db
@@ -227,8 +345,8 @@ func (s *TorrentStore) WhiteListDelete(client store.WhiteListClient) error {
 
 // WhiteListAdd will insert a new client prefix into the allowed clients list
 func (s *TorrentStore) WhiteListAdd(client store.WhiteListClient) error {
-	const q = `CALL whitelist_add(?, ?)`
-	if _, err := s.db.Exec(q, client.ClientPrefix, client.ClientName); err != nil {
+	const q = `CALL whitelist_add(?, ?, ?, ?)`
+	if _, err := s.db.Exec(q, client.ClientPrefix, client.ClientName, client.MinVersion, client.MatchType); err != nil {
 		return errors.Wrap(err, "Failed to insert new whitelist entry")
 	}
 	return nil
@@ -244,6 +362,159 @@ func (s *TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	return wl, nil
 }
 
+// WhiteListPage fetches a page of whitelisted clients ordered by prefix
+func (s *TorrentStore) WhiteListPage(offset int, limit int) ([]store.WhiteListClient, int, error) {
+	var wl []store.WhiteListClient
+	var total int
+	if err := s.db.Get(&total, `CALL whitelist_count()`); err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to count client whitelists")
+	}
+	if err := s.db.Select(&wl, `CALL whitelist_page(?, ?)`, offset, limit); err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to select client whitelists")
+	}
+	return wl, total, nil
+}
+
+// DenyListAdd will insert a new info_hash into the list of denied torrents
+func (s *TorrentStore) DenyListAdd(entry store.DenyListInfoHash) error {
+	const q = `CALL denylist_add(?, ?)`
+	if _, err := s.db.Exec(q, entry.InfoHash.Bytes(), entry.Reason); err != nil {
+		return errors.Wrap(err, "Failed to insert new denylist entry")
+	}
+	return nil
+}
+
+// DenyListDelete removes a info_hash from the list of denied torrents
+func (s *TorrentStore) DenyListDelete(ih store.InfoHash) error {
+	const q = `CALL denylist_delete(?)`
+	if _, err := s.db.Exec(q, ih.Bytes()); err != nil {
+		return errors.Wrap(err, "Failed to delete denylist entry")
+	}
+	return nil
+}
+
+// ConfigGetAll fetches all persisted runtime config values
+func (s *TorrentStore) ConfigGetAll() (map[string]string, error) {
+	rows, err := s.db.Query(`CALL config_all()`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select config values")
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Errorf("failed to close query rows: %s", err)
+		}
+	}()
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch config value")
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// ConfigSet persists a runtime config value
+func (s *TorrentStore) ConfigSet(key string, value string) error {
+	if _, err := s.db.Exec(`CALL config_set(?, ?)`, key, value); err != nil {
+		return errors.Wrapf(err, "Failed to set config value: %s", key)
+	}
+	return nil
+}
+
+// MetricsGetAll fetches the persisted metric counters
+func (s *TorrentStore) MetricsGetAll() (map[string]int64, error) {
+	rows, err := s.db.Query(`CALL metrics_all()`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select metrics")
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Errorf("failed to close query rows: %s", err)
+		}
+	}()
+	values := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch metric")
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// MetricsSet persists the metric counters
+func (s *TorrentStore) MetricsSet(values map[string]int64) error {
+	for name, value := range values {
+		if _, err := s.db.Exec(`CALL metrics_set(?, ?)`, name, value); err != nil {
+			return errors.Wrapf(err, "Failed to set metric: %s", name)
+		}
+	}
+	return nil
+}
+
+// DenyListGetAll fetches all denied info_hashes
+func (s *TorrentStore) DenyListGetAll() ([]store.DenyListInfoHash, error) {
+	var dl []store.DenyListInfoHash
+	const q = `CALL denylist_all()`
+	if err := s.db.Select(&dl, q); err != nil {
+		return nil, errors.Wrap(err, "Failed to select denylist")
+	}
+	return dl, nil
+}
+
+// DenyListPage fetches a page of denied info_hashes ordered by info_hash
+func (s *TorrentStore) DenyListPage(offset int, limit int) ([]store.DenyListInfoHash, int, error) {
+	var dl []store.DenyListInfoHash
+	var total int
+	if err := s.db.Get(&total, `CALL denylist_count()`); err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to count denylist")
+	}
+	if err := s.db.Select(&dl, `CALL denylist_page(?, ?)`, offset, limit); err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to select denylist")
+	}
+	return dl, total, nil
+}
+
+// AllowedUserAdd grants the user access to the torrent
+func (s *TorrentStore) AllowedUserAdd(entry store.TorrentAllowedUser) error {
+	const q = `CALL allowed_user_add(?, ?)`
+	if _, err := s.db.Exec(q, entry.InfoHash.Bytes(), entry.UserID); err != nil {
+		return errors.Wrap(err, "Failed to insert allowed user")
+	}
+	return nil
+}
+
+// AllowedUserDelete revokes a users access to the torrent
+func (s *TorrentStore) AllowedUserDelete(entry store.TorrentAllowedUser) error {
+	const q = `CALL allowed_user_delete(?, ?)`
+	res, err := s.db.Exec(q, entry.InfoHash.Bytes(), entry.UserID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete allowed user")
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete allowed user")
+	}
+	if rows == 0 {
+		return consts.ErrInvalidUser
+	}
+	return nil
+}
+
+// AllowedUsersGetAll fetches the allowed users of every torrent
+func (s *TorrentStore) AllowedUsersGetAll() ([]store.TorrentAllowedUser, error) {
+	var allowed []store.TorrentAllowedUser
+	const q = `CALL allowed_user_all()`
+	if err := s.db.Select(&allowed, q); err != nil {
+		return nil, errors.Wrap(err, "Failed to select allowed users")
+	}
+	return allowed, nil
+}
+
 // Close will close the underlying mysql database connection
 func (s *TorrentStore) Close() error {
 	return s.db.Close()
@@ -254,7 +525,7 @@ func (s *TorrentStore) Get(t *store.Torrent, hash store.InfoHash, deletedOk bool
 	const q = `CALL torrent_by_infohash(?, ?)`
 	err := s.db.Get(t, q, hash.Bytes(), deletedOk)
 	if err != nil {
-		if err.Error() == "sql: no rows in result set" {
+		if err.Error() == ErrNoResults {
 			return consts.ErrInvalidInfoHash
 		}
 		return err
@@ -265,10 +536,41 @@ func (s *TorrentStore) Get(t *store.Torrent, hash store.InfoHash, deletedOk bool
 	return nil
 }
 
+// getManyBatchSize is the number of infohashes looked up per torrent_by_infohashes call, which
+// stays under the default cte_max_recursion_depth of 1000
+const getManyBatchSize = 500
+
+// GetMany returns the torrents matching the infohashes keyed by infohash
+func (s *TorrentStore) GetMany(hashes []store.InfoHash, deletedOk bool) (map[store.InfoHash]store.Torrent, error) {
+	torrents := make(map[store.InfoHash]store.Torrent, len(hashes))
+	for start := 0; start < len(hashes); start += getManyBatchSize {
+		end := start + getManyBatchSize
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		// Procedures can't take arrays so the infohashes are sent concatenated together
+		packed := make([]byte, 0, (end-start)*20)
+		for _, hash := range hashes[start:end] {
+			packed = append(packed, hash.Bytes()...)
+		}
+		var batch []store.Torrent
+		if err := s.db.Select(&batch, `CALL torrent_by_infohashes(?, ?)`, packed, deletedOk); err != nil {
+			return nil, errors.Wrap(err, "Failed to select torrents")
+		}
+		for _, t := range batch {
+			if t.IsDeleted && !deletedOk {
+				continue
+			}
+			torrents[t.InfoHash] = t
+		}
+	}
+	return torrents, nil
+}
+
 // Add inserts a new torrent into the backing store
 func (s *TorrentStore) Add(t store.Torrent) error {
-	const q = `CALL torrent_add(?)`
-	_, err := s.db.Exec(q, t.InfoHash.Bytes())
+	const q = `CALL torrent_add(?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(q, t.InfoHash.Bytes(), t.ReleaseName, t.Size, t.Freeleech, t.AutoRegistered)
 	if err != nil {
 		return err
 	}
@@ -284,8 +586,7 @@ func (s *TorrentStore) Delete(ih store.InfoHash, dropRow bool) error {
 		_, err = s.db.Exec(dropQ, ih.Bytes())
 	} else {
 		const updateQ = `CALL torrent_disable(?)`
-		_, err = s.db.NamedExec(updateQ, ih.Bytes())
-
+		_, err = s.db.Exec(updateQ, ih.Bytes())
 	}
 	if err != nil {
 		return err
@@ -304,7 +605,7 @@ func (ps *PeerStore) Name() string {
 
 // Sync batch updates the backing store with the new PeerStats provided
 func (ps *PeerStore) Sync(b map[store.PeerHash]store.PeerStats) error {
-	const q = `CALL peer_update_stats(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	const q = `CALL peer_update_stats(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	tx, err := ps.db.Begin()
 	if err != nil {
 		return errors.Wrap(err, "Failed to being user Sync() tx")
@@ -317,7 +618,7 @@ func (ps *PeerStore) Sync(b map[store.PeerHash]store.PeerStats) error {
 		sum := stats.Totals()
 		if _, err := stmt.Exec(ph.InfoHash().Bytes(), ph.PeerID().Bytes(),
 			sum.TotalDn, sum.TotalUp, len(stats.Hist), sum.LastAnn,
-			sum.SpeedDn, sum.SpeedUp, sum.SpeedDnMax, sum.SpeedUpMax); err != nil {
+			sum.SpeedDn, sum.SpeedUp, sum.SpeedDnMax, sum.SpeedUpMax, stats.Left, stats.Paused); err != nil {
 			if err := tx.Rollback(); err != nil {
 				log.Errorf("Failed to roll back peer Sync() tx")
 			}
@@ -330,22 +631,52 @@ func (ps *PeerStore) Sync(b map[store.PeerHash]store.PeerStats) error {
 	return nil
 }
 
-// Reap will loop through the peers removing any stale entries from active swarms
-// TODO fetch peer hashes for expired peers to flush local caches
-func (ps *PeerStore) Reap() []store.PeerHash {
-	var peerHashes []store.PeerHash
-	const q = `CALL peer_reap(?)`
-	rows, err := ps.db.Exec(q, time.Now().Add(-15*time.Minute))
+// Reap will loop through the peers removing any stale entries from active swarms. Each peer is
+// deleted only if it is still expired so peers announcing while being reaped are kept.
+func (ps *PeerStore) Reap(expiry time.Time, dryRun bool) []store.Peer {
+	expired, err := ps.expired(expiry)
 	if err != nil {
-		log.Errorf("Failed to reap peers: %s", err.Error())
+		log.Errorf("Failed to fetch expired peers: %s", err.Error())
 		return nil
 	}
-	count, err2 := rows.RowsAffected()
-	if err2 != nil {
-		log.Errorf("Failed to get reap count: %s", err2)
+	if dryRun {
+		return expired
 	}
-	log.Debugf("Reaped %d peers", count)
-	return peerHashes
+	var reaped []store.Peer
+	for _, p := range expired {
+		res, err := ps.db.Exec(`CALL peer_reap(?, ?, ?)`, p.InfoHash.Bytes(), p.PeerID.Bytes(), expiry)
+		if err != nil {
+			log.Errorf("Failed to reap peer: %s", err.Error())
+			continue
+		}
+		if count, err := res.RowsAffected(); err == nil && count > 0 {
+			reaped = append(reaped, p)
+		}
+	}
+	log.Debugf("Reaped %d peers", len(reaped))
+	return reaped
+}
+
+// expired returns all peers which have not announced since the expiry time
+func (ps *PeerStore) expired(expiry time.Time) ([]store.Peer, error) {
+	rows, err := ps.db.Query(`CALL peer_expired(?)`, expiry)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Errorf("failed to close query rows: %s", err)
+		}
+	}()
+	var peers []store.Peer
+	for rows.Next() {
+		var p store.Peer
+		if err := scanPeer(rows, &p); err != nil {
+			return nil, err
+		}
+		peers = append(peers, p)
+	}
+	return peers, nil
 }
 
 // Close will close the underlying database connection
@@ -399,21 +730,98 @@ func (ps *PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
 			log.Errorf("failed to close query rows: %s", err)
 		}
 	}()
-	var p store.Peer
-	var ip string
-
 	for rows.Next() {
-		if err := rows.Scan(&p.PeerID, &p.InfoHash, &p.UserID, &p.IPv6, &ip, &p.Port, &p.Downloaded, &p.Uploaded,
-			&p.Left, &p.TotalTime, &p.Announces, &p.SpeedUP, &p.SpeedDN, &p.SpeedUPMax, &p.SpeedDNMax,
-			&p.Location, &p.AnnounceLast, &p.AnnounceFirst, &p.CountryCode, &p.ASN, &p.AS, &p.CryptoLevel); err != nil {
+		var p store.Peer
+		if err := scanPeer(rows, &p); err != nil {
 			return swarm, err
 		}
-		p.IP = net.ParseIP(ip)
 		swarm.Add(p)
 	}
 	return swarm, nil
 }
 
+// Count returns the number of peers across all swarms
+func (ps *PeerStore) Count() (int, error) {
+	var total int
+	if err := ps.db.Get(&total, `CALL peer_count()`); err != nil {
+		return 0, errors.Wrap(err, "Failed to count peers")
+	}
+	return total, nil
+}
+
+// Ping checks the database is reachable
+func (ps *PeerStore) Ping() error {
+	if err := ps.db.Ping(); err != nil {
+		return errors.Wrap(err, "Failed to ping peer store")
+	}
+	return nil
+}
+
+// GetActive fetches a page of peers that are active in any swarm
+func (ps *PeerStore) GetActive(offset int, limit int) ([]store.Peer, int, error) {
+	var total int
+	if err := ps.db.Get(&total, `CALL peer_active_count()`); err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to count active peers")
+	}
+	rows, err := ps.db.Query(`CALL peer_active_page(?, ?)`, offset, limit)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to fetch active peers")
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Errorf("failed to close query rows: %s", err)
+		}
+	}()
+	var peers []store.Peer
+	for rows.Next() {
+		var p store.Peer
+		if err := scanPeer(rows, &p); err != nil {
+			return nil, 0, err
+		}
+		peers = append(peers, p)
+	}
+	return peers, total, nil
+}
+
+// GetActiveByUser fetches a page of the users peers that are active in any swarm
+func (ps *PeerStore) GetActiveByUser(userID uint32, offset int, limit int) ([]store.Peer, int, error) {
+	var total int
+	if err := ps.db.Get(&total, `CALL peer_user_active_count(?)`, userID); err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to count active user peers")
+	}
+	rows, err := ps.db.Query(`CALL peer_user_active_page(?, ?, ?)`, userID, offset, limit)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to fetch active user peers")
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Errorf("failed to close query rows: %s", err)
+		}
+	}()
+	var peers []store.Peer
+	for rows.Next() {
+		var p store.Peer
+		if err := scanPeer(rows, &p); err != nil {
+			return nil, 0, err
+		}
+		peers = append(peers, p)
+	}
+	return peers, total, nil
+}
+
+// scanPeer reads a peer row as returned by the peer_get_n, peer_expired & peer_active_page procedures
+func scanPeer(rows *sql.Rows, p *store.Peer) error {
+	var ip string
+	if err := rows.Scan(&p.PeerID, &p.InfoHash, &p.UserID, &p.IPv6, &ip, &p.Port, &p.Downloaded, &p.Uploaded,
+		&p.Left, &p.TotalTime, &p.Announces, &p.SpeedUP, &p.SpeedDN, &p.SpeedUPMax, &p.SpeedDNMax,
+		&p.Location, &p.AnnounceLast, &p.AnnounceFirst, &p.CountryCode, &p.ASN, &p.AS, &p.CryptoLevel,
+		&p.Paused); err != nil {
+		return err
+	}
+	p.IP = net.ParseIP(ip)
+	return nil
+}
+
 var (
 	connections   map[string]*sqlx.DB
 	connectionsMu *sync.RWMutex
@@ -1,9 +1,49 @@
 /* create schema mika collate utf8mb4_unicode_ci; */
 
+/*
+ Upgrading from versions which used a multi_dn of 0 for freeleech:
+   alter table torrent add freeleech tinyint(1) default 0 not null after multi_dn;
+   update torrent set freeleech = 1 where multi_dn = 0;
+
+ Upgrading from versions without user multipliers:
+   alter table users add multi_up decimal(5, 2) default 1.00 not null after class;
+   alter table users add multi_dn decimal(5, 2) default 1.00 not null after multi_up;
+
+ Upgrading from versions without hit and run tracking, create the user_hnr table and the
+ hnr_add, hnr_delete and hnr_by_user procedures below:
+   create table user_hnr
+   (
+       user_id    int unsigned              not null,
+       info_hash  binary(20)                not null,
+       seed_time  int unsigned    default 0 not null,
+       created_on datetime                  not null,
+       primary key (user_id, info_hash)
+   );
+
+ Upgrading from versions where torrents with allowed users were implicitly restricted:
+   alter table torrent add restricted tinyint(1) default 0 not null after max_peers;
+   update torrent set restricted = 1 where info_hash in (select info_hash from torrent_allowed_user);
+
+ Upgrading from versions without glob and regex whitelist entries, also recreate the
+ whitelist_add procedure below:
+   alter table whitelist modify client_prefix varchar(64) not null;
+   alter table whitelist add match_type varchar(10) default '' not null after min_version;
+
+ Upgrading from versions without batched torrent lookups, create the torrent_by_infohashes
+ procedure below.
+
+Upgrading from versions where new torrents could not be added as freeleech, recreate the
+ torrent_add procedure below.
+
+Upgrading from versions which stored left as a 32bit value, recreate the peer_update_stats
+ procedure below.
+*/
 DROP TABLE IF EXISTS torrent;
 create table torrent
 (
     info_hash        binary(20)                     not null,
+    release_name     varchar(255)      default ''   not null,
+    size             bigint unsigned   default 0    not null,
     total_uploaded   bigint unsigned   default 0    not null,
     total_downloaded bigint unsigned   default 0    not null,
     total_completed  smallint unsigned default 0    not null,
@@ -12,9 +52,15 @@ create table torrent
     reason           varchar(255)      default ''   not null,
     multi_up         decimal(5, 2)     default 1.00 not null,
     multi_dn         decimal(5, 2)     default 1.00 not null,
+    freeleech        tinyint(1)        default 0    not null,
     seeders          int               default 0    not null,
     leechers         int               default 0    not null,
     announces        int               default 0    not null,
+    max_peers        int               default 0    not null,
+    restricted       tinyint(1)        default 0    not null,
+    auto_registered  tinyint(1)        default 0    not null,
+    announced_on     datetime          default CURRENT_TIMESTAMP not null,
+    version          int unsigned      default 0    not null,
     constraint pk_torrent primary key (info_hash)
 );
 
@@ -28,9 +74,23 @@ create table users
     downloaded       bigint unsigned default 0 not null,
     uploaded         bigint unsigned default 0 not null,
     announces        int             default 0 not null,
+    bonus            double          default 0 not null,
+    class            varchar(32)     default '' not null,
+    multi_up         decimal(5, 2)   default 1.00 not null,
+    multi_dn         decimal(5, 2)   default 1.00 not null,
     constraint user_passkey_uindex unique (passkey)
 );
 
+DROP TABLE IF EXISTS user_hnr;
+create table user_hnr
+(
+    user_id    int unsigned              not null,
+    info_hash  binary(20)                not null,
+    seed_time  int unsigned    default 0 not null,
+    created_on datetime                  not null,
+    primary key (user_id, info_hash)
+);
+
 DROP TABLE IF EXISTS peers;
 create table peers
 (
@@ -58,14 +118,44 @@ create table peers
     as_name          varchar(255)              not null default '',
     agent            varchar(100)              not null,
     crypto_level     int unsigned    default 0 not null,
+    paused           boolean         default false not null,
     constraint peers_pk primary key (info_hash, peer_id)
 );
 
 DROP TABLE IF EXISTS whitelist;
 create table whitelist
 (
-    client_prefix char(8)     not null primary key,
-    client_name   varchar(20) not null
+    client_prefix varchar(64)            not null primary key,
+    client_name   varchar(20)            not null,
+    min_version   varchar(20) default '' not null,
+    match_type    varchar(10) default '' not null
+);
+
+DROP TABLE IF EXISTS denylist_infohash;
+create table denylist_infohash
+(
+    info_hash binary(20)              not null primary key,
+    reason    varchar(255) default '' not null
+);
+
+DROP TABLE IF EXISTS torrent_allowed_user;
+create table torrent_allowed_user
+(
+    info_hash binary(20)   not null,
+    user_id   int unsigned not null,
+    primary key (info_hash, user_id)
+);
+
+create table config
+(
+    config_key   varchar(255) not null primary key,
+    config_value text         not null
+);
+
+create table metrics
+(
+    metric_name  varchar(255) not null primary key,
+    metric_value bigint       not null
 );
 
 
@@ -79,7 +169,11 @@ BEGIN
            is_deleted,
            downloaded,
            uploaded,
-           announces
+           announces,
+           bonus,
+           class,
+           multi_up,
+           multi_dn
     FROM users
     WHERE passkey = in_passkey;
 end;
@@ -93,11 +187,22 @@ BEGIN
            is_deleted,
            downloaded,
            uploaded,
-           announces
+           announces,
+           bonus,
+           class,
+           multi_up,
+           multi_dn
     FROM users
     WHERE user_id = in_user_id;
 end;
 
+DROP PROCEDURE IF EXISTS user_count;
+CREATE PROCEDURE user_count()
+BEGIN
+    SELECT count(*)
+    FROM users;
+end;
+
 DROP PROCEDURE IF EXISTS user_delete;
 CREATE PROCEDURE user_delete(IN in_user_id int)
 BEGIN
@@ -113,12 +218,17 @@ CREATE PROCEDURE user_add(IN in_user_id int,
                           IN in_is_deleted bool,
                           IN in_downloaded bigint unsigned,
                           IN in_uploaded bigint unsigned,
-                          IN in_announces bigint)
+                          IN in_announces bigint,
+                          IN in_bonus double,
+                          IN in_class varchar(32),
+                          IN in_multi_up decimal(5, 2),
+                          IN in_multi_dn decimal(5, 2))
 BEGIN
     INSERT INTO users
-    (user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces)
+    (user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces, bonus, class,
+     multi_up, multi_dn)
     VALUES (in_user_id, in_passkey, in_download_enabled, in_is_deleted,
-            in_downloaded, in_uploaded, in_announces);
+            in_downloaded, in_uploaded, in_announces, in_bonus, in_class, in_multi_up, in_multi_dn);
 end;
 
 DROP PROCEDURE IF EXISTS user_update;
@@ -129,6 +239,10 @@ CREATE PROCEDURE user_update(IN in_user_id int,
                              IN in_downloaded bigint unsigned,
                              IN in_uploaded bigint unsigned,
                              IN in_announces bigint,
+                             IN in_bonus double,
+                             IN in_class varchar(32),
+                             IN in_multi_up decimal(5, 2),
+                             IN in_multi_dn decimal(5, 2),
                              IN in_old_passkey varchar(40))
 BEGIN
     UPDATE users
@@ -138,7 +252,11 @@ BEGIN
         is_deleted       = in_is_deleted,
         downloaded       = in_downloaded,
         uploaded         = in_uploaded,
-        announces        = in_announces
+        announces        = in_announces,
+        bonus            = in_bonus,
+        class            = in_class,
+        multi_up         = in_multi_up,
+        multi_dn         = in_multi_dn
     WHERE passkey = if(in_old_passkey = '', in_passkey, in_old_passkey);
 end;
 
@@ -146,15 +264,59 @@ DROP PROCEDURE IF EXISTS user_update_stats;
 CREATE PROCEDURE user_update_stats(IN in_passkey varchar(40),
                                    IN in_announces bigint,
                                    IN in_uploaded bigint,
-                                   IN in_downloaded bigint)
+                                   IN in_downloaded bigint,
+                                   IN in_bonus double)
 BEGIN
     UPDATE users
     SET announces  = (announces + in_announces),
         uploaded   = (uploaded + in_uploaded),
-        downloaded = (downloaded + in_downloaded)
+        downloaded = (downloaded + in_downloaded),
+        bonus      = (bonus + in_bonus)
     WHERE passkey = in_passkey;
 END;
 
+DROP PROCEDURE IF EXISTS user_adjust;
+CREATE PROCEDURE user_adjust(IN in_user_id int,
+                             IN in_uploaded bigint,
+                             IN in_downloaded bigint)
+BEGIN
+    UPDATE users
+    SET uploaded   = IF(in_uploaded < 0 AND uploaded < -in_uploaded, 0, uploaded + in_uploaded),
+        downloaded = IF(in_downloaded < 0 AND downloaded < -in_downloaded, 0, downloaded + in_downloaded)
+    WHERE user_id = in_user_id;
+END;
+
+DROP PROCEDURE IF EXISTS hnr_add;
+CREATE PROCEDURE hnr_add(IN in_user_id int,
+                         IN in_info_hash binary(20),
+                         IN in_seed_time int,
+                         IN in_created_on datetime)
+BEGIN
+    INSERT INTO user_hnr (user_id, info_hash, seed_time, created_on)
+    VALUES (in_user_id, in_info_hash, in_seed_time, in_created_on)
+    ON DUPLICATE KEY UPDATE seed_time  = in_seed_time,
+                            created_on = in_created_on;
+end;
+
+DROP PROCEDURE IF EXISTS hnr_delete;
+CREATE PROCEDURE hnr_delete(IN in_user_id int,
+                            IN in_info_hash binary(20))
+BEGIN
+    DELETE
+    FROM user_hnr
+    WHERE user_id = in_user_id
+      AND info_hash = in_info_hash;
+end;
+
+DROP PROCEDURE IF EXISTS hnr_by_user;
+CREATE PROCEDURE hnr_by_user(IN in_user_id int)
+BEGIN
+    SELECT user_id, info_hash, seed_time, created_on
+    FROM user_hnr
+    WHERE user_id = in_user_id
+    ORDER BY info_hash;
+end;
+
 -- END USERS
 
 -- TORRENTS
@@ -164,6 +326,8 @@ CREATE PROCEDURE torrent_by_infohash(IN in_info_hash binary(20),
                                      IN in_deleted bool)
 BEGIN
     SELECT info_hash,
+           release_name,
+           size,
            total_uploaded,
            total_downloaded,
            total_completed,
@@ -172,14 +336,92 @@ BEGIN
            reason,
            multi_up,
            multi_dn,
+           freeleech,
            seeders,
            leechers,
-           announces
+           announces,
+           max_peers,
+           restricted,
+           auto_registered,
+           announced_on,
+           version
     FROM torrent
     WHERE info_hash = in_info_hash
       AND is_deleted = in_deleted;
 end;
 
+-- in_info_hashes holds the 20 byte info_hashes concatenated together
+DROP PROCEDURE IF EXISTS torrent_by_infohashes;
+CREATE PROCEDURE torrent_by_infohashes(IN in_info_hashes blob,
+                                       IN in_deleted bool)
+BEGIN
+    WITH RECURSIVE offsets (pos) AS (SELECT 1
+                                     UNION ALL
+                                     SELECT pos + 20
+                                     FROM offsets
+                                     WHERE pos + 20 <= LENGTH(in_info_hashes))
+    SELECT info_hash,
+           release_name,
+           size,
+           total_uploaded,
+           total_downloaded,
+           total_completed,
+           is_deleted,
+           is_enabled,
+           reason,
+           multi_up,
+           multi_dn,
+           freeleech,
+           seeders,
+           leechers,
+           announces,
+           max_peers,
+           restricted,
+           auto_registered,
+           announced_on,
+           version
+    FROM torrent
+    WHERE info_hash IN (SELECT SUBSTRING(in_info_hashes, pos, 20) FROM offsets)
+      AND (is_deleted = false OR in_deleted);
+end;
+
+DROP PROCEDURE IF EXISTS torrent_count;
+CREATE PROCEDURE torrent_count()
+BEGIN
+    SELECT count(*)
+    FROM torrent
+    WHERE is_deleted = false;
+end;
+
+DROP PROCEDURE IF EXISTS torrent_page;
+CREATE PROCEDURE torrent_page(IN in_offset int, IN in_limit int)
+BEGIN
+    SELECT info_hash,
+           release_name,
+           size,
+           total_uploaded,
+           total_downloaded,
+           total_completed,
+           is_deleted,
+           is_enabled,
+           reason,
+           multi_up,
+           multi_dn,
+           freeleech,
+           seeders,
+           leechers,
+           announces,
+           max_peers,
+           restricted,
+           auto_registered,
+           announced_on,
+           version
+    FROM torrent
+    WHERE is_deleted = false
+    ORDER BY info_hash
+    LIMIT in_offset, in_limit;
+end;
+
 DROP PROCEDURE IF EXISTS torrent_delete;
 CREATE PROCEDURE torrent_delete(IN in_info_hash binary(20))
 BEGIN
@@ -197,10 +439,23 @@ BEGIN
 end;
 
 DROP PROCEDURE IF EXISTS torrent_add;
-CREATE PROCEDURE torrent_add(IN in_info_hash binary(20))
+CREATE PROCEDURE torrent_add(IN in_info_hash binary(20),
+                             IN in_release_name varchar(255),
+                             IN in_size bigint unsigned,
+                             IN in_freeleech bool,
+                             IN in_auto_registered bool)
 BEGIN
-    INSERT INTO torrent (info_hash)
-    VALUES (in_info_hash);
+    INSERT INTO torrent (info_hash, release_name, size, freeleech, auto_registered)
+    VALUES (in_info_hash, in_release_name, in_size, in_freeleech, in_auto_registered);
+end;
+
+DROP PROCEDURE IF EXISTS torrent_inactive;
+CREATE PROCEDURE torrent_inactive(IN in_older_than datetime)
+BEGIN
+    SELECT info_hash
+    FROM torrent
+    WHERE auto_registered = true
+      AND announced_on < in_older_than;
 end;
 
 DROP PROCEDURE IF EXISTS torrent_update_stats;
@@ -219,7 +474,8 @@ BEGIN
         announces        = (announces + in_announces),
         total_completed  = (total_completed + in_total_completed),
         seeders          = in_seeders,
-        leechers         = in_leechers
+        leechers         = in_leechers,
+        announced_on     = IF(in_announces > 0, NOW(), announced_on)
     WHERE info_hash = in_info_hash;
 END;
 
@@ -230,12 +486,30 @@ BEGIN
     FROM whitelist;
 end;
 
+DROP PROCEDURE IF EXISTS whitelist_page;
+CREATE PROCEDURE whitelist_page(IN in_offset int, IN in_limit int)
+BEGIN
+    SELECT *
+    FROM whitelist
+    ORDER BY client_prefix
+    LIMIT in_offset, in_limit;
+end;
+
+DROP PROCEDURE IF EXISTS whitelist_count;
+CREATE PROCEDURE whitelist_count()
+BEGIN
+    SELECT count(*)
+    FROM whitelist;
+end;
+
 DROP PROCEDURE IF EXISTS whitelist_add;
-CREATE PROCEDURE whitelist_add(IN in_client_prefix char(5),
-                               IN in_client_name varchar(255))
+CREATE PROCEDURE whitelist_add(IN in_client_prefix varchar(64),
+                               IN in_client_name varchar(255),
+                               IN in_min_version varchar(20),
+                               IN in_match_type varchar(10))
 BEGIN
-    INSERT INTO whitelist (client_prefix, client_name)
-    VALUES (in_client_prefix, in_client_name);
+    INSERT INTO whitelist (client_prefix, client_name, min_version, match_type)
+    VALUES (in_client_prefix, in_client_name, in_min_version, in_match_type);
 end;
 
 DROP PROCEDURE IF EXISTS whitelist_delete_by_prefix;
@@ -246,6 +520,102 @@ BEGIN
     WHERE client_prefix = in_client_prefix;
 end;
 
+DROP PROCEDURE IF EXISTS denylist_all;
+CREATE PROCEDURE denylist_all()
+BEGIN
+    SELECT info_hash, reason
+    FROM denylist_infohash;
+end;
+
+DROP PROCEDURE IF EXISTS denylist_page;
+CREATE PROCEDURE denylist_page(IN in_offset int, IN in_limit int)
+BEGIN
+    SELECT info_hash, reason
+    FROM denylist_infohash
+    ORDER BY info_hash
+    LIMIT in_offset, in_limit;
+end;
+
+DROP PROCEDURE IF EXISTS denylist_count;
+CREATE PROCEDURE denylist_count()
+BEGIN
+    SELECT count(*)
+    FROM denylist_infohash;
+end;
+
+DROP PROCEDURE IF EXISTS denylist_add;
+CREATE PROCEDURE denylist_add(IN in_info_hash binary(20),
+                              IN in_reason varchar(255))
+BEGIN
+    INSERT INTO denylist_infohash (info_hash, reason)
+    VALUES (in_info_hash, in_reason);
+end;
+
+DROP PROCEDURE IF EXISTS denylist_delete;
+CREATE PROCEDURE denylist_delete(IN in_info_hash binary(20))
+BEGIN
+    DELETE
+    FROM denylist_infohash
+    WHERE info_hash = in_info_hash;
+end;
+
+DROP PROCEDURE IF EXISTS allowed_user_all;
+CREATE PROCEDURE allowed_user_all()
+BEGIN
+    SELECT info_hash, user_id
+    FROM torrent_allowed_user;
+end;
+
+DROP PROCEDURE IF EXISTS allowed_user_add;
+CREATE PROCEDURE allowed_user_add(IN in_info_hash binary(20),
+                                  IN in_user_id int)
+BEGIN
+    INSERT IGNORE INTO torrent_allowed_user (info_hash, user_id)
+    VALUES (in_info_hash, in_user_id);
+end;
+
+DROP PROCEDURE IF EXISTS allowed_user_delete;
+CREATE PROCEDURE allowed_user_delete(IN in_info_hash binary(20),
+                                     IN in_user_id int)
+BEGIN
+    DELETE
+    FROM torrent_allowed_user
+    WHERE info_hash = in_info_hash
+      AND user_id = in_user_id;
+end;
+
+DROP PROCEDURE IF EXISTS config_all;
+CREATE PROCEDURE config_all()
+BEGIN
+    SELECT config_key, config_value
+    FROM config;
+end;
+
+DROP PROCEDURE IF EXISTS config_set;
+CREATE PROCEDURE config_set(IN in_config_key varchar(255),
+                            IN in_config_value text)
+BEGIN
+    INSERT INTO config (config_key, config_value)
+    VALUES (in_config_key, in_config_value)
+    ON DUPLICATE KEY UPDATE config_value = in_config_value;
+end;
+
+DROP PROCEDURE IF EXISTS metrics_all;
+CREATE PROCEDURE metrics_all()
+BEGIN
+    SELECT metric_name, metric_value
+    FROM metrics;
+end;
+
+DROP PROCEDURE IF EXISTS metrics_set;
+CREATE PROCEDURE metrics_set(IN in_metric_name varchar(255),
+                             IN in_metric_value bigint)
+BEGIN
+    INSERT INTO metrics (metric_name, metric_value)
+    VALUES (in_metric_name, in_metric_value)
+    ON DUPLICATE KEY UPDATE metric_value = in_metric_value;
+end;
+
 -- END TORRENTS
 
 -- PEERS
@@ -259,7 +629,9 @@ CREATE PROCEDURE peer_update_stats(IN in_info_hash binary(20),
                                    IN in_speed_dn bigint,
                                    IN in_speed_up bigint,
                                    IN in_speed_dn_max bigint,
-                                   IN in_speed_up_max bigint)
+                                   IN in_speed_up_max bigint,
+                                   IN in_total_left bigint unsigned,
+                                   IN in_paused boolean)
 BEGIN
     UPDATE
         peers
@@ -270,17 +642,52 @@ BEGIN
         speed_up         = in_speed_up,
         speed_dn         = in_speed_dn,
         speed_up_max     = GREATEST(speed_up_max, in_speed_up_max),
-        speed_dn_max     = GREATEST(speed_dn_max, in_speed_dn_max)
-
+        speed_dn_max     = GREATEST(speed_dn_max, in_speed_dn_max),
+        total_left       = in_total_left,
+        paused           = in_paused
     WHERE info_hash = in_info_hash
       AND peer_id = in_peer_id;
 END;
 
 DROP PROCEDURE IF EXISTS peer_reap;
-CREATE PROCEDURE peer_reap(IN in_expiry_time datetime)
+CREATE PROCEDURE peer_reap(IN in_info_hash binary(20),
+                           IN in_peer_id binary(20),
+                           IN in_expiry_time datetime)
 BEGIN
     DELETE
     FROM peers
+    WHERE info_hash = in_info_hash
+      AND peer_id = in_peer_id
+      AND announce_last <= in_expiry_time;
+end;
+
+DROP PROCEDURE IF EXISTS peer_expired;
+CREATE PROCEDURE peer_expired(IN in_expiry_time datetime)
+BEGIN
+    SELECT peer_id,
+           info_hash,
+           user_id,
+           ipv6,
+           if(ipv6 = false, INET_NTOA(addr_ip), INET6_NTOA(addr_ip)) as addr_ip,
+           addr_port,
+           total_downloaded,
+           total_uploaded,
+           total_left,
+           total_time,
+           total_announces,
+           speed_up,
+           speed_dn,
+           speed_up_max,
+           speed_dn_max,
+           ST_AsText(location)                                       as location,
+           announce_last,
+           announce_first,
+           country_code,
+           asn,
+           as_name,
+           crypto_level                                              as crypto_level,
+           paused                                                    as paused
+    FROM peers
     WHERE announce_last <= in_expiry_time;
 end;
 
@@ -360,7 +767,8 @@ BEGIN
            country_code,
            asn,
            as_name,
-           crypto_level                                              as crypto_level
+           crypto_level                                              as crypto_level,
+           paused                                                    as paused
     FROM peers
     WHERE info_hash = in_info_hash
       AND peer_id = in_peer_id;
@@ -390,9 +798,96 @@ BEGIN
            country_code,
            asn,
            as_name,
-           crypto_level                                              as crypto_level
+           crypto_level                                              as crypto_level,
+           paused                                                    as paused
     FROM peers
     WHERE info_hash = in_info_hash
     LIMIT in_limit;
 end;
+
+DROP PROCEDURE IF EXISTS peer_active_page;
+CREATE PROCEDURE peer_active_page(IN in_offset int, IN in_limit int)
+BEGIN
+    SELECT peer_id,
+           info_hash,
+           user_id,
+           ipv6,
+           if(ipv6 = false, INET_NTOA(addr_ip), INET6_NTOA(addr_ip)) as addr_ip,
+           addr_port,
+           total_downloaded,
+           total_uploaded,
+           total_left,
+           total_time,
+           total_announces,
+           speed_up,
+           speed_dn,
+           speed_up_max,
+           speed_dn_max,
+           ST_AsText(location)                                       as location,
+           announce_last,
+           announce_first,
+           country_code,
+           asn,
+           as_name,
+           crypto_level                                              as crypto_level,
+           paused                                                    as paused
+    FROM peers
+    ORDER BY info_hash, peer_id
+    LIMIT in_offset, in_limit;
+end;
+
+DROP PROCEDURE IF EXISTS peer_active_count;
+CREATE PROCEDURE peer_active_count()
+BEGIN
+    SELECT count(*)
+    FROM peers;
+end;
+
+DROP PROCEDURE IF EXISTS peer_user_active_page;
+CREATE PROCEDURE peer_user_active_page(IN in_user_id int unsigned, IN in_offset int, IN in_limit int)
+BEGIN
+    SELECT peer_id,
+           info_hash,
+           user_id,
+           ipv6,
+           if(ipv6 = false, INET_NTOA(addr_ip), INET6_NTOA(addr_ip)) as addr_ip,
+           addr_port,
+           total_downloaded,
+           total_uploaded,
+           total_left,
+           total_time,
+           total_announces,
+           speed_up,
+           speed_dn,
+           speed_up_max,
+           speed_dn_max,
+           ST_AsText(location)                                       as location,
+           announce_last,
+           announce_first,
+           country_code,
+           asn,
+           as_name,
+           crypto_level                                              as crypto_level,
+           paused                                                    as paused
+    FROM peers
+    WHERE user_id = in_user_id
+    ORDER BY info_hash, peer_id
+    LIMIT in_offset, in_limit;
+end;
+
+DROP PROCEDURE IF EXISTS peer_user_active_count;
+CREATE PROCEDURE peer_user_active_count(IN in_user_id int unsigned)
+BEGIN
+    SELECT count(*)
+    FROM peers
+    WHERE user_id = in_user_id;
+end;
+
+DROP PROCEDURE IF EXISTS peer_count;
+CREATE PROCEDURE peer_count()
+BEGIN
+    SELECT count(*)
+    FROM peers;
+end;
+
 -- END PEERS
\ No newline at end of file
@@ -3,8 +3,10 @@
 DROP TABLE IF EXISTS whitelist;
 create table whitelist
 (
-    client_prefix char(8)     not null primary key,
-    client_name   varchar(20) not null
+    client_prefix varchar(64)            not null primary key,
+    client_name   varchar(20)            not null,
+    min_version   varchar(20) default '' not null,
+    match_type    varchar(10) default '' not null
 );
 
 DROP PROCEDURE IF EXISTS whitelist_all;
@@ -19,14 +21,18 @@ CREATE OR REPLACE PROCEDURE user_by_passkey(
     IN in_passkey varchar(32)
 )
 BEGIN
-    SELECT id                             as user_id,
-           passkey                        as passkey,
-           can_download                   as download_enabled,
-           if(active = true, false, true) as is_deleted,
-           downloaded                     as downloaded,
-           uploaded                       as uploaded,
-           0                              as announces
+    SELECT users.id                             as user_id,
+           passkey                              as passkey,
+           can_download                         as download_enabled,
+           if(active = true, false, true)       as is_deleted,
+           downloaded                           as downloaded,
+           uploaded                             as uploaded,
+           0                                    as announces,
+           coalesce(`groups`.slug, '')          as class,
+           1.0                                  as multi_up,
+           1.0                                  as multi_dn
     FROM users
+             LEFT JOIN `groups` ON `groups`.id = users.group_id
     WHERE passkey = in_passkey collate utf8mb4_unicode_ci;
 end;
 
@@ -34,15 +40,25 @@ CREATE OR REPLACE PROCEDURE user_by_id(
     IN in_user_id int
 )
 BEGIN
-    SELECT `id`                           as user_id,
-           passkey                        as passkey,
-           can_download                   as download_enabled,
-           if(active = true, false, true) as is_deleted,
-           downloaded                     as downloaded,
-           uploaded                       as uploaded,
-           0                              as announces
+    SELECT users.id                             as user_id,
+           passkey                              as passkey,
+           can_download                         as download_enabled,
+           if(active = true, false, true)       as is_deleted,
+           downloaded                           as downloaded,
+           uploaded                             as uploaded,
+           0                                    as announces,
+           coalesce(`groups`.slug, '')          as class,
+           1.0                                  as multi_up,
+           1.0                                  as multi_dn
     FROM users
-    WHERE `id` = in_user_id;
+             LEFT JOIN `groups` ON `groups`.id = users.group_id
+    WHERE users.id = in_user_id;
+end;
+
+CREATE OR REPLACE PROCEDURE user_count()
+BEGIN
+    SELECT count(*)
+    FROM users;
 end;
 
 CREATE OR REPLACE PROCEDURE user_delete(IN in_user_id int)
@@ -95,6 +111,54 @@ BEGIN
     WHERE passkey = in_passkey collate utf8mb4_unicode_ci;
 END;
 
+CREATE OR REPLACE PROCEDURE user_adjust(IN in_user_id int,
+                                        IN in_uploaded bigint,
+                                        IN in_downloaded bigint)
+BEGIN
+    UPDATE users
+    SET uploaded   = IF(in_uploaded < 0 AND uploaded < -in_uploaded, 0, uploaded + in_uploaded),
+        downloaded = IF(in_downloaded < 0 AND downloaded < -in_downloaded, 0, downloaded + in_downloaded)
+    WHERE id = in_user_id;
+END;
+
+-- unit3d tracks hit and runs from its own history table, so the tracker keeps its own records
+CREATE TABLE IF NOT EXISTS user_hnr
+(
+    user_id    int unsigned not null,
+    info_hash  binary(20)   not null,
+    seed_time  int unsigned default 0 not null,
+    created_on datetime     not null,
+    primary key (user_id, info_hash)
+);
+
+CREATE OR REPLACE PROCEDURE hnr_add(IN in_user_id int,
+                                    IN in_info_hash binary(20),
+                                    IN in_seed_time int,
+                                    IN in_created_on datetime)
+BEGIN
+    INSERT INTO user_hnr (user_id, info_hash, seed_time, created_on)
+    VALUES (in_user_id, in_info_hash, in_seed_time, in_created_on)
+    ON DUPLICATE KEY UPDATE seed_time  = in_seed_time,
+                            created_on = in_created_on;
+end;
+
+CREATE OR REPLACE PROCEDURE hnr_delete(IN in_user_id int,
+                                       IN in_info_hash binary(20))
+BEGIN
+    DELETE
+    FROM user_hnr
+    WHERE user_id = in_user_id
+      AND info_hash = in_info_hash;
+end;
+
+CREATE OR REPLACE PROCEDURE hnr_by_user(IN in_user_id int)
+BEGIN
+    SELECT user_id, info_hash, seed_time, created_on
+    FROM user_hnr
+    WHERE user_id = in_user_id
+    ORDER BY info_hash;
+end;
+
 -- END USERS
 
 -- TORRENTS
@@ -103,6 +167,8 @@ CREATE OR REPLACE PROCEDURE torrent_by_infohash(IN in_info_hash binary(20),
                                                 IN in_deleted bool)
 BEGIN
     SELECT UNHEX(info_hash)          as info_hash,
+           name                      as release_name,
+           size                      as size,
            0                         as total_uploaded,
            0                         as total_downloaded,
            times_completed           as total_completed,
@@ -110,14 +176,74 @@ BEGIN
            true                      as is_enabled,
            'Invalid torrent'         as reason,
            if(doubleup = true, 2, 1) as multi_up,
-           if(free = true, 0, 1)     as multi_dn,
+           1                         as multi_dn,
+           free = true               as freeleech,
            seeders                   as seeders,
            leechers                  as leechers,
-           0                         as announces
+           0                         as announces,
+           false                     as restricted
     FROM torrents
     WHERE info_hash = HEX(in_info_hash);
 end;
 
+-- in_info_hashes holds the 20 byte info_hashes concatenated together
+CREATE OR REPLACE PROCEDURE torrent_by_infohashes(IN in_info_hashes blob,
+                                                  IN in_deleted bool)
+BEGIN
+    WITH RECURSIVE offsets (pos) AS (SELECT 1
+                                     UNION ALL
+                                     SELECT pos + 20
+                                     FROM offsets
+                                     WHERE pos + 20 <= LENGTH(in_info_hashes))
+    SELECT UNHEX(info_hash)          as info_hash,
+           name                      as release_name,
+           size                      as size,
+           0                         as total_uploaded,
+           0                         as total_downloaded,
+           times_completed           as total_completed,
+           false                     as is_deleted,
+           true                      as is_enabled,
+           'Invalid torrent'         as reason,
+           if(doubleup = true, 2, 1) as multi_up,
+           1                         as multi_dn,
+           free = true               as freeleech,
+           seeders                   as seeders,
+           leechers                  as leechers,
+           0                         as announces,
+           false                     as restricted
+    FROM torrents
+    WHERE info_hash IN (SELECT HEX(SUBSTRING(in_info_hashes, pos, 20)) FROM offsets);
+end;
+
+CREATE OR REPLACE PROCEDURE torrent_count()
+BEGIN
+    SELECT count(*)
+    FROM torrents;
+end;
+
+CREATE OR REPLACE PROCEDURE torrent_page(IN in_offset int, IN in_limit int)
+BEGIN
+    SELECT UNHEX(info_hash)          as info_hash,
+           name                      as release_name,
+           size                      as size,
+           0                         as total_uploaded,
+           0                         as total_downloaded,
+           times_completed           as total_completed,
+           false                     as is_deleted,
+           true                      as is_enabled,
+           'Invalid torrent'         as reason,
+           if(doubleup = true, 2, 1) as multi_up,
+           1                         as multi_dn,
+           free = true               as freeleech,
+           seeders                   as seeders,
+           leechers                  as leechers,
+           0                         as announces,
+           false                     as restricted
+    FROM torrents
+    ORDER BY info_hash
+    LIMIT in_offset, in_limit;
+end;
+
 CREATE OR REPLACE PROCEDURE torrent_delete(IN in_info_hash binary(20))
 BEGIN
     DELETE FROM torrents WHERE info_hash = HEX(in_info_hash);
@@ -128,12 +254,24 @@ BEGIN
     DELETE FROM torrents WHERE info_hash = HEX(in_info_hash);
 end;
 
-CREATE OR REPLACE PROCEDURE torrent_add(IN in_info_hash binary(20))
+CREATE OR REPLACE PROCEDURE torrent_add(IN in_info_hash binary(20),
+                                        IN in_release_name varchar(255),
+                                        IN in_size bigint unsigned,
+                                        IN in_freeleech bool,
+                                        IN in_auto_registered bool)
 BEGIN
     SIGNAL SQLSTATE '45000'
         SET MESSAGE_TEXT = 'not compatible';
 end;
 
+-- Torrents are never auto registered into unit3d so there is nothing to prune
+CREATE OR REPLACE PROCEDURE torrent_inactive(IN in_older_than datetime)
+BEGIN
+    SELECT UNHEX(info_hash) as info_hash
+    FROM torrents
+    WHERE false;
+end;
+
 CREATE OR REPLACE PROCEDURE torrent_update_stats(IN in_info_hash binary(20),
                                                  IN in_total_downloaded bigint unsigned,
                                                  IN in_total_uploaded bigint unsigned,
@@ -162,7 +300,9 @@ CREATE OR REPLACE PROCEDURE peer_update_stats(IN in_info_hash binary(20),
                                               IN in_speed_dn bigint,
                                               IN in_speed_up bigint,
                                               IN in_speed_dn_max bigint,
-                                              IN in_speed_up_max bigint)
+                                              IN in_speed_up_max bigint,
+                                              IN in_total_left bigint unsigned,
+                                              IN in_paused boolean)
 BEGIN
     UPDATE
         peers
@@ -172,14 +312,51 @@ BEGIN
         speed_up     = in_speed_up,
         speed_dn     = in_speed_dn,
         speed_up_max = GREATEST(speed_up_max, in_speed_up_max),
-        speed_dn_max = GREATEST(speed_dn_max, in_speed_dn_max)
+        speed_dn_max = GREATEST(speed_dn_max, in_speed_dn_max),
+        `left`       = in_total_left,
+        seeder       = in_total_left = 0
     WHERE info_hash = HEX(in_info_hash)
       AND peer_id = HEX(in_peer_id);
 END;
 
-CREATE OR REPLACE PROCEDURE peer_reap(IN in_expiry_time datetime)
+CREATE OR REPLACE PROCEDURE peer_reap(IN in_info_hash binary(20),
+                                      IN in_peer_id binary(20),
+                                      IN in_expiry_time datetime)
 BEGIN
-    DELETE FROM peers WHERE updated_at <= in_expiry_time;
+    DELETE
+    FROM peers
+    WHERE info_hash = HEX(in_info_hash)
+      AND peer_id = HEX(in_peer_id)
+      AND updated_at <= in_expiry_time;
+end;
+
+CREATE OR REPLACE PROCEDURE peer_expired(IN in_expiry_time datetime)
+BEGIN
+    SELECT UNHEX(peer_id)      as peer_id,
+           UNHEX(info_hash)    as info_hash,
+           user_id             as user_id,
+           ipv6                as ipv6,
+           ip                  as addr_ip,
+           port                as addr_port,
+           downloaded          as total_downloaded,
+           uploaded            as total_uploaded,
+           `left`              as total_left,
+           0                   as total_time,
+           0                   as total_announces,
+           speed_up            as speed_up,
+           speed_dn            as speed_dn,
+           speed_up_max        as speed_up_max,
+           speed_dn_max        as speed_dn_max,
+           ST_AsText(location) as location,
+           updated_at          as announce_last,
+           created_at          as announce_first,
+           country_code        as country_code,
+           asn                 as asn,
+           as_name             as as_name,
+           crypto_level        as crypto_level,
+           false               as paused
+    FROM peers
+    WHERE updated_at <= in_expiry_time;
 end;
 
 --  TODO what is actual uploaded/downloaded for
@@ -278,7 +455,8 @@ BEGIN
            country_code        as country_code,
            asn                 as asn,
            as_name             as as_name,
-           crypto_level        as crypto_level
+           crypto_level        as crypto_level,
+           false               as paused
     FROM peers
     WHERE info_hash = HEX(in_info_hash)
       and peer_id = HEX(in_peer_id);
@@ -307,10 +485,44 @@ BEGIN
            country_code        as country_code,
            asn                 as asn,
            as_name             as as_name,
-           crypto_level        as crypto_level
+           crypto_level        as crypto_level,
+           false               as paused
     FROM peers
     WHERE info_hash = HEX(in_info_hash)
     LIMIT in_limit;
 END;
 
--- END PEERS
\ No newline at end of file
+-- END PEERS
+
+-- ALLOWED USERS
+-- unit3d has no equivalent so the allowed users of restricted torrents are kept in their own table
+CREATE TABLE IF NOT EXISTS torrent_allowed_user
+(
+    info_hash binary(20)   not null,
+    user_id   int unsigned not null,
+    primary key (info_hash, user_id)
+);
+
+CREATE OR REPLACE PROCEDURE allowed_user_all()
+BEGIN
+    SELECT info_hash, user_id
+    FROM torrent_allowed_user;
+end;
+
+CREATE OR REPLACE PROCEDURE allowed_user_add(IN in_info_hash binary(20),
+                                             IN in_user_id int)
+BEGIN
+    INSERT IGNORE INTO torrent_allowed_user (info_hash, user_id)
+    VALUES (in_info_hash, in_user_id);
+end;
+
+CREATE OR REPLACE PROCEDURE allowed_user_delete(IN in_info_hash binary(20),
+                                                IN in_user_id int)
+BEGIN
+    DELETE
+    FROM torrent_allowed_user
+    WHERE info_hash = in_info_hash
+      AND user_id = in_user_id;
+end;
+
+-- END ALLOWED USERS
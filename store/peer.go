@@ -1,6 +1,7 @@
 package store
 
 import (
+	"bytes"
 	"database/sql/driver"
 	"fmt"
 	"github.com/leighmacdonald/mika/consts"
@@ -8,6 +9,7 @@ import (
 	"github.com/leighmacdonald/mika/util"
 	"github.com/pkg/errors"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -71,7 +73,7 @@ type Peer struct {
 	// Total amount downloaded as reported by client
 	Downloaded uint64 `db:"total_downloaded" redis:"total_downloaded" json:"total_downloaded"`
 	// Clients reported bytes left of the download
-	Left uint32 `db:"total_left" redis:"total_left" json:"total_left"`
+	Left uint64 `db:"total_left" redis:"total_left" json:"total_left"`
 	// Total active swarm participation time
 	TotalTime uint32 `db:"total_time" redis:"total_time" json:"total_time"`
 	// Current speed up, bytes/sec
@@ -107,14 +109,14 @@ type Peer struct {
 	//CreatedOn time.Time `db:"created_on" redis:"created_on" json:"created_on"`
 	//UpdatedOn time.Time `db:"updated_on" redis:"updated_on" json:"updated_on"`
 	CryptoLevel consts.CryptoLevel `db:"crypto_level" json:"crypto_level"`
-	Paused      bool
-	User        *User
+	// Paused is set for partial seeds which announced the paused event (BEP 21)
+	Paused bool `db:"paused" json:"paused"`
+	User   *User
 }
 
-// Expired checks if the peer last lost contact with us
-// TODO remove hard coded expiration time
-func (peer *Peer) Expired() bool {
-	return time.Since(peer.AnnounceLast).Seconds() > 300
+// Expired checks if the peer last lost contact with us before the expiry time
+func (peer *Peer) Expired(expiry time.Time) bool {
+	return peer.AnnounceLast.Before(expiry)
 }
 
 // IsNew checks if the peer is making its first announce request
@@ -127,6 +129,19 @@ func (peer *Peer) Valid() bool {
 	return peer.UserID > 0 && peer.Port >= 1024 && util.IsPrivateIP(peer.IP)
 }
 
+// PeerPage sorts the peers by info_hash and peer_id and returns the requested page of peers
+// along with the total number of peers. This is used by stores which cannot paginate natively.
+func PeerPage(peers []Peer, offset int, limit int) ([]Peer, int) {
+	sort.Slice(peers, func(i, j int) bool {
+		if c := bytes.Compare(peers[i].InfoHash[:], peers[j].InfoHash[:]); c != 0 {
+			return c < 0
+		}
+		return bytes.Compare(peers[i].PeerID[:], peers[j].PeerID[:]) < 0
+	})
+	start, end := pageBounds(offset, limit, len(peers))
+	return peers[start:end], len(peers)
+}
+
 // Swarm is a set of users participating in a torrent
 type Swarm struct {
 	Peers    map[PeerID]Peer
@@ -152,6 +167,13 @@ func (swarm Swarm) Remove(p PeerID) {
 	swarm.Unlock()
 }
 
+// Len returns the number of peers in the swarm
+func (swarm Swarm) Len() int {
+	swarm.RLock()
+	defer swarm.RUnlock()
+	return len(swarm.Peers)
+}
+
 // Add inserts a new peer into the swarm
 func (swarm Swarm) Add(p Peer) {
 	swarm.Lock()
@@ -174,23 +196,28 @@ func (swarm Swarm) UpdatePeer(peerID PeerID, stats PeerStats) (Peer, bool) {
 	}
 	peer.Announces += uint32(len(stats.Hist))
 	peer.Left = stats.Left
+	peer.Paused = stats.Paused
 	swarm.Peers[peerID] = peer
 	swarm.Unlock()
 	return peer, true
 }
 
-// ReapExpired will delete any peers from the swarm that are considered expired
-func (swarm Swarm) ReapExpired(infoHash InfoHash) []PeerHash {
+// ReapExpired will delete any peers from the swarm that have not announced since the expiry
+// time and return them. If dryRun is true the expired peers are returned without being deleted.
+func (swarm Swarm) ReapExpired(infoHash InfoHash, expiry time.Time, dryRun bool) []Peer {
 	swarm.Lock()
-	var peerHashes []PeerHash
+	var peers []Peer
 	for k, peer := range swarm.Peers {
-		if peer.Expired() {
-			delete(swarm.Peers, k)
-			peerHashes = append(peerHashes, NewPeerHash(infoHash, peer.PeerID))
+		if peer.Expired(expiry) {
+			if !dryRun {
+				delete(swarm.Peers, k)
+			}
+			peer.InfoHash = infoHash
+			peers = append(peers, peer)
 		}
 	}
 	swarm.Unlock()
-	return peerHashes
+	return peers
 }
 
 // Get will copy a peer into the peer pointer passed in if it exists.
@@ -222,6 +249,7 @@ func (swarm Swarm) Update(p Peer) error {
 func NewPeer(userID uint32, peerID PeerID, ip net.IP, port uint16) Peer {
 	return Peer{
 		IP:            ip,
+		IPv6:          ip.To4() == nil,
 		Port:          port,
 		AnnounceLast:  time.Now(),
 		AnnounceFirst: time.Now(),
@@ -238,16 +266,33 @@ type UpdateState struct {
 	InfoHash InfoHash
 	PeerID   PeerID
 	Passkey  string
+	// UserID is the id of the announcing user, used to record hit and runs
+	UserID uint32
+	// Class is the class of the announcing user, used to apply class multipliers
+	Class string
+	// MultiUp and MultiDn are the multipliers of the announcing user
+	MultiUp float64
+	MultiDn float64
 	// Total amount uploaded as reported by client
 	Uploaded uint64
 	// Total amount downloaded as reported by client
 	Downloaded uint64
 	// Clients reported bytes left of the download
-	Left uint32
+	Left uint64
 	// Timestamp is the time the new stats were announced
 	Timestamp time.Time
 	Event     consts.AnnounceType
-	Paused    bool
+	// Paused is true when the peer announced as a partial seed (BEP 21)
+	Paused bool
+	// WasPaused and PrevLeft are the state of the peer before this announce, used to
+	// reclassify peers moving between seeding and leeching
+	WasPaused bool
+	PrevLeft  uint64
+	// Joined is true when this announce added the peer to the swarm
+	Joined bool
+	// NoPrevState is true when the state of the peer before this announce is unknown, which
+	// happens for degraded announces of uncached peers. The swarm counts are left unchanged.
+	NoPrevState bool
 }
 
 type BTClient struct {
@@ -39,9 +39,13 @@ func (us UserStore) Update(user store.User, oldPasskey string) error {
 		    download_enabled = $4,
 		    downloaded = $5,
 		    uploaded = $6,
-		    announces = $7
+		    announces = $7,
+		    bonus = $8,
+		    class = $9,
+		    multi_up = $10,
+		    multi_dn = $11
 		WHERE
-			passkey = $8
+			passkey = $12
 	`
 	passkey := user.Passkey
 	if oldPasskey != "" {
@@ -49,13 +53,36 @@ func (us UserStore) Update(user store.User, oldPasskey string) error {
 	}
 	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
-	_, err := us.db.Exec(c, q, user.UserID, user.Passkey, user.IsDeleted, user.DownloadEnabled, user.Downloaded, user.Uploaded, user.Announces, passkey)
+	_, err := us.db.Exec(c, q, user.UserID, user.Passkey, user.IsDeleted, user.DownloadEnabled, user.Downloaded, user.Uploaded, user.Announces, user.Bonus, user.Class,
+		user.MultiUp, user.MultiDn, passkey)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to update user: %d", user.UserID)
 	}
 	return nil
 }
 
+// AdjustUser adds the signed deltas to the users totals, clamping them at zero
+func (us UserStore) AdjustUser(userID uint32, upDelta int64, downDelta int64) error {
+	const q = `
+		UPDATE
+			users
+		SET
+			uploaded = GREATEST(uploaded + $1, 0),
+			downloaded = GREATEST(downloaded + $2, 0)
+		WHERE
+			user_id = $3`
+	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	commandTag, err := us.db.Exec(c, q, upDelta, downDelta, userID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to adjust user")
+	}
+	if commandTag.RowsAffected() == 0 {
+		return consts.ErrInvalidUser
+	}
+	return nil
+}
+
 // Sync batch updates the backing store with the new UserStats provided
 func (us UserStore) Sync(batch map[string]store.UserStats) error {
 	const txName = "userSync"
@@ -65,9 +92,10 @@ func (us UserStore) Sync(batch map[string]store.UserStats) error {
 		SET
 			downloaded = (downloaded + $1),
 		    uploaded = (uploaded + $2),
-		    announces = (announces + $3)
+		    announces = (announces + $3),
+		    bonus = (bonus + $4)
 		WHERE
-			passkey = $4
+			passkey = $5
 `
 	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(time.Second*10))
 	defer cancel()
@@ -82,7 +110,7 @@ func (us UserStore) Sync(batch map[string]store.UserStats) error {
 	}
 
 	for passkey, stats := range batch {
-		if _, err := tx.Exec(c, txName, stats.Downloaded, stats.Uploaded, stats.Announces, passkey); err != nil {
+		if _, err := tx.Exec(c, txName, stats.Downloaded, stats.Uploaded, stats.Announces, stats.Bonus, passkey); err != nil {
 			return errors.Wrapf(err, "postgres.UserStore.Sync failed to Exec tx")
 		}
 	}
@@ -92,31 +120,52 @@ func (us UserStore) Sync(batch map[string]store.UserStats) error {
 	return nil
 }
 
+// Count returns the number of users
+func (us UserStore) Count() (int, error) {
+	var total int
+	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if err := us.db.QueryRow(c, `SELECT count(*) FROM users`).Scan(&total); err != nil {
+		return 0, errors.Wrap(err, "Failed to count users")
+	}
+	return total, nil
+}
+
+// Ping checks the database is reachable
+func (us UserStore) Ping() error {
+	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if err := us.db.Ping(c); err != nil {
+		return errors.Wrap(err, "Failed to ping user store")
+	}
+	return nil
+}
+
 // Add will add a new user to the backing store
 func (us UserStore) Add(user store.User) error {
 	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
 	const q = `
 		INSERT INTO users 
-		    (user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces) 
+		    (user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces, bonus, class,
+		     multi_up, multi_dn) 
 		VALUES
-		    ($1, $2, $3, $4, $5, $6, $7)`
+		    ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
 	_, err := us.db.Exec(c, q, user.UserID, user.Passkey, user.DownloadEnabled, user.IsDeleted,
-		user.Downloaded, user.Uploaded, user.Announces)
+		user.Downloaded, user.Uploaded, user.Announces, user.Bonus, user.Class, user.MultiUp, user.MultiDn)
 	if err != nil {
 		return errors.Wrap(err, "Failed to add user to store")
 	}
 	return nil
 }
 
-// GetByPasskey will lookup and return the user via their passkey used as an identifier
-// The errors returned for this method should be very generic and not reveal any info
-// that could possibly help attackers gain any insight. All error cases MUST
-// return ErrUnauthorized.
+// GetByPasskey will lookup and return the user via their passkey used as an identifier.
+// Unknown passkeys return consts.ErrInvalidUser so they can be told apart from store failures.
 func (us UserStore) GetByPasskey(user *store.User, passkey string) error {
 	const q = `
 		SELECT 
-		    user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces 
+		    user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces, bonus, class,
+		    multi_up, multi_dn 
 		FROM 
 		    users 
 		WHERE 
@@ -124,8 +173,11 @@ func (us UserStore) GetByPasskey(user *store.User, passkey string) error {
 	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
 	err := us.db.QueryRow(c, q, passkey).Scan(&user.UserID, &user.Passkey, &user.DownloadEnabled, &user.IsDeleted,
-		&user.Downloaded, &user.Uploaded, &user.Announces)
+		&user.Downloaded, &user.Uploaded, &user.Announces, &user.Bonus, &user.Class, &user.MultiUp, &user.MultiDn)
 	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return consts.ErrInvalidUser
+		}
 		return errors.Wrap(err, "Failed to fetch user by passkey")
 	}
 	return nil
@@ -135,7 +187,8 @@ func (us UserStore) GetByPasskey(user *store.User, passkey string) error {
 func (us UserStore) GetByID(user *store.User, userID uint32) error {
 	const q = `
 		SELECT 
-		    user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces 
+		    user_id, passkey, download_enabled, is_deleted, downloaded, uploaded, announces, bonus, class,
+		    multi_up, multi_dn 
 		FROM 
 		    users 
 		WHERE 
@@ -143,8 +196,11 @@ func (us UserStore) GetByID(user *store.User, userID uint32) error {
 	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
 	err := us.db.QueryRow(c, q, userID).Scan(&user.UserID, &user.Passkey, &user.DownloadEnabled, &user.IsDeleted,
-		&user.Downloaded, &user.Uploaded, &user.Announces)
+		&user.Downloaded, &user.Uploaded, &user.Announces, &user.Bonus, &user.Class, &user.MultiUp, &user.MultiDn)
 	if err != nil {
+		if err.Error() == "no rows in result set" {
+			return consts.ErrInvalidUser
+		}
 		return errors.Wrap(err, "Failed to fetch user by user_id")
 	}
 	return nil
@@ -165,6 +221,54 @@ func (us UserStore) Delete(user store.User) error {
 	return nil
 }
 
+// HNRAdd records a hit and run, replacing any existing record for the user and torrent
+func (us UserStore) HNRAdd(hnr store.HNR) error {
+	const q = `
+		INSERT INTO user_hnr (user_id, info_hash, seed_time, created_on) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, info_hash) DO UPDATE SET seed_time = $3, created_on = $4`
+	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if _, err := us.db.Exec(c, q, hnr.UserID, hnr.InfoHash.Bytes(), hnr.SeedTime, hnr.CreatedOn); err != nil {
+		return errors.Wrap(err, "Failed to insert hnr")
+	}
+	return nil
+}
+
+// HNRDelete clears the hit and run of the user on the torrent
+func (us UserStore) HNRDelete(userID uint32, ih store.InfoHash) error {
+	const q = `DELETE FROM user_hnr WHERE user_id = $1 AND info_hash = $2`
+	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if _, err := us.db.Exec(c, q, userID, ih.Bytes()); err != nil {
+		return errors.Wrap(err, "Failed to delete hnr")
+	}
+	return nil
+}
+
+// HNRGetByUser fetches the hit and runs of the user ordered by info_hash
+func (us UserStore) HNRGetByUser(userID uint32) ([]store.HNR, error) {
+	hnrs := []store.HNR{}
+	const q = `
+		SELECT info_hash::bytea, seed_time, created_on FROM user_hnr WHERE user_id = $1 ORDER BY info_hash`
+	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	rows, err := us.db.Query(c, q, userID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select hnrs")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b []byte
+		hnr := store.HNR{UserID: userID}
+		if err := rows.Scan(&b, &hnr.SeedTime, &hnr.CreatedOn); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch hnr")
+		}
+		copy(hnr.InfoHash[:], b)
+		hnrs = append(hnrs, hnr)
+	}
+	return hnrs, nil
+}
+
 // Close will close the underlying database connection and clear the local caches
 func (us UserStore) Close() error {
 	c, cancel := context.WithDeadline(us.ctx, time.Now().Add(15*time.Second))
@@ -197,18 +301,29 @@ func (ts TorrentStore) Update(torrent store.Torrent) error {
 		    reason = $7,
 		    multi_up = $8,
 		    multi_dn = $9,
-		    announces = $10
+		    announces = $10,
+		    release_name = $11,
+		    max_peers = $12,
+		    size = $13,
+		    freeleech = $14,
+		    restricted = $15,
+		    version = (version + 1)
 		WHERE
-			info_hash = $11
+			info_hash = $16 AND version = $17
 			`
 	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
-	_, err := ts.db.Exec(c, q, torrent.InfoHash.Bytes(), torrent.Snatches,
+	commandTag, err := ts.db.Exec(c, q, torrent.InfoHash.Bytes(), torrent.Snatches,
 		torrent.Uploaded, torrent.Downloaded, torrent.IsDeleted, torrent.IsEnabled,
-		torrent.Reason, torrent.MultiUp, torrent.MultiDn, torrent.Announces)
+		torrent.Reason, torrent.MultiUp, torrent.MultiDn, torrent.Announces, torrent.ReleaseName,
+		torrent.MaxPeers, torrent.Size, torrent.Freeleech, torrent.Restricted, torrent.InfoHash.Bytes(),
+		torrent.Version)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to update torrent: %s", torrent.InfoHash.String())
 	}
+	if commandTag.RowsAffected() != 1 {
+		return consts.ErrConflict
+	}
 	return nil
 }
 
@@ -225,7 +340,8 @@ func (ts TorrentStore) Sync(batch map[store.InfoHash]store.TorrentStats) error {
 		    total_completed = (total_completed + $3),
 		    total_downloaded = (total_downloaded + $4),
 		    total_uploaded = (total_uploaded + $5),
-		    announces = (announces + $6)
+		    announces = (announces + $6),
+		    announced_on = CASE WHEN $6 > 0 THEN now() ELSE announced_on END
 		WHERE
 			info_hash = $7
 `
@@ -253,6 +369,32 @@ func (ts TorrentStore) Sync(batch map[store.InfoHash]store.TorrentStats) error {
 	return nil
 }
 
+// Inactive fetches the info_hashes of auto registered torrents which have not been announced
+// since olderThan
+func (ts TorrentStore) Inactive(olderThan time.Time) ([]store.InfoHash, error) {
+	const q = `
+		SELECT info_hash::bytea FROM torrent
+		WHERE auto_registered = true AND announced_on < $1`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	rows, err := ts.db.Query(c, q, olderThan)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select inactive torrents")
+	}
+	defer rows.Close()
+	var inactive []store.InfoHash
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch inactive torrent")
+		}
+		var ih store.InfoHash
+		copy(ih[:], b)
+		inactive = append(inactive, ih)
+	}
+	return inactive, nil
+}
+
 // Conn returns the underlying database driver
 func (ts TorrentStore) Conn() interface{} {
 	return ts.db
@@ -260,11 +402,13 @@ func (ts TorrentStore) Conn() interface{} {
 
 // Add inserts a new torrent into the backing store
 func (ts TorrentStore) Add(t store.Torrent) error {
-	const q = `INSERT INTO torrent (info_hash) VALUES($1::bytea)`
+	const q = `
+		INSERT INTO torrent (info_hash, release_name, size, freeleech, auto_registered)
+		VALUES($1::bytea, $2, $3, $4, $5)`
 	//log.Println(t.InfoHash.Bytes())
 	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
-	commandTag, err := ts.db.Exec(c, q, t.InfoHash.Bytes())
+	commandTag, err := ts.db.Exec(c, q, t.InfoHash.Bytes(), t.ReleaseName, t.Size, t.Freeleech, t.AutoRegistered)
 	if err != nil {
 		return err
 	}
@@ -302,15 +446,16 @@ func (ts TorrentStore) Get(t *store.Torrent, ih store.InfoHash, deletedOk bool)
 	const q = `
 		SELECT 
 			info_hash::bytea, total_uploaded, total_downloaded, total_completed, 
-			is_deleted, is_enabled, reason, multi_up, multi_dn, announces, seeders, leechers
+			is_deleted, is_enabled, reason, multi_up, multi_dn, announces, seeders, leechers, version,
+			release_name, max_peers, size, freeleech, restricted, auto_registered, announced_on
 		FROM 
 		    torrent 
 		WHERE 
-		    info_hash = $1 AND is_deleted = false`
+		    info_hash = $1 AND (is_deleted = false OR $2)`
 	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
 	var b []byte
-	err := ts.db.QueryRow(c, q, ih.Bytes()).Scan(
+	err := ts.db.QueryRow(c, q, ih.Bytes(), deletedOk).Scan(
 		&b, // TODO implement pgx custom types to map automatically
 		&t.Uploaded,
 		&t.Downloaded,
@@ -323,6 +468,14 @@ func (ts TorrentStore) Get(t *store.Torrent, ih store.InfoHash, deletedOk bool)
 		&t.Announces,
 		&t.Seeders,
 		&t.Leechers,
+		&t.Version,
+		&t.ReleaseName,
+		&t.MaxPeers,
+		&t.Size,
+		&t.Freeleech,
+		&t.Restricted,
+		&t.AutoRegistered,
+		&t.AnnouncedOn,
 	)
 	copy(t.InfoHash[:], b)
 	if err != nil {
@@ -337,6 +490,44 @@ func (ts TorrentStore) Get(t *store.Torrent, ih store.InfoHash, deletedOk bool)
 	return nil
 }
 
+// GetMany returns the torrents matching the infohashes keyed by infohash
+func (ts TorrentStore) GetMany(hashes []store.InfoHash, deletedOk bool) (map[store.InfoHash]store.Torrent, error) {
+	const q = `
+		SELECT 
+			info_hash::bytea, total_uploaded, total_downloaded, total_completed, 
+			is_deleted, is_enabled, reason, multi_up, multi_dn, announces, seeders, leechers, version,
+			release_name, max_peers, size, freeleech, restricted, auto_registered, announced_on
+		FROM 
+		    torrent 
+		WHERE 
+		    info_hash = ANY($1) AND (is_deleted = false OR $2)`
+	keys := make([][]byte, len(hashes))
+	for i, hash := range hashes {
+		keys[i] = hash.Bytes()
+	}
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	rows, err := ts.db.Query(c, q, keys, deletedOk)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select torrents")
+	}
+	defer rows.Close()
+	torrents := make(map[store.InfoHash]store.Torrent, len(hashes))
+	for rows.Next() {
+		var b []byte
+		var t store.Torrent
+		if err := rows.Scan(&b, &t.Uploaded, &t.Downloaded, &t.Snatches, &t.IsDeleted, &t.IsEnabled,
+			&t.Reason, &t.MultiUp, &t.MultiDn, &t.Announces, &t.Seeders, &t.Leechers, &t.Version,
+			&t.ReleaseName, &t.MaxPeers, &t.Size, &t.Freeleech, &t.Restricted, &t.AutoRegistered,
+			&t.AnnouncedOn); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch torrent")
+		}
+		copy(t.InfoHash[:], b)
+		torrents[t.InfoHash] = t
+	}
+	return torrents, nil
+}
+
 // Close will close the underlying postgres database connection
 func (ts TorrentStore) Close() error {
 	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(15*time.Second))
@@ -361,10 +552,10 @@ func (ts TorrentStore) WhiteListDelete(client store.WhiteListClient) error {
 
 // WhiteListAdd will insert a new client prefix into the allowed clients list
 func (ts TorrentStore) WhiteListAdd(client store.WhiteListClient) error {
-	const q = `INSERT INTO whitelist (client_prefix, client_name) VALUES ($1, $2)`
+	const q = `INSERT INTO whitelist (client_prefix, client_name, min_version, match_type) VALUES ($1, $2, $3, $4)`
 	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
-	commandTag, err := ts.db.Exec(c, q, client.ClientPrefix, client.ClientName)
+	commandTag, err := ts.db.Exec(c, q, client.ClientPrefix, client.ClientName, client.MinVersion, client.MatchType)
 	if err != nil {
 		return errors.Wrap(err, "Failed to insert new whitelist entry")
 	}
@@ -377,7 +568,7 @@ func (ts TorrentStore) WhiteListAdd(client store.WhiteListClient) error {
 // WhiteListGetAll fetches all known whitelisted clients
 func (ts TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	var wl []store.WhiteListClient
-	const q = `SELECT client_prefix, client_name FROM whitelist`
+	const q = `SELECT client_prefix, client_name, min_version, match_type FROM whitelist`
 	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
 	rows, err := ts.db.Query(c, q)
@@ -387,7 +578,7 @@ func (ts TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	defer rows.Close()
 	for rows.Next() {
 		var client store.WhiteListClient
-		err = rows.Scan(&client.ClientPrefix, &client.ClientName)
+		err = rows.Scan(&client.ClientPrefix, &client.ClientName, &client.MinVersion, &client.MatchType)
 		if err != nil {
 			return nil, errors.Wrap(err, "Failed to fetch client whitelist")
 		}
@@ -396,6 +587,284 @@ func (ts TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 	return wl, nil
 }
 
+// Count returns the number of torrents not marked as deleted
+func (ts TorrentStore) Count() (int, error) {
+	var total int
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if err := ts.db.QueryRow(c, `SELECT count(*) FROM torrent WHERE is_deleted = false`).Scan(&total); err != nil {
+		return 0, errors.Wrap(err, "Failed to count torrents")
+	}
+	return total, nil
+}
+
+// List fetches a page of torrents not marked as deleted, ordered by info_hash
+func (ts TorrentStore) List(limit int, offset int) ([]store.Torrent, error) {
+	const q = `
+		SELECT 
+			info_hash::bytea, total_uploaded, total_downloaded, total_completed, 
+			is_deleted, is_enabled, reason, multi_up, multi_dn, announces, seeders, leechers, version,
+			release_name, max_peers, size, freeleech, restricted, auto_registered, announced_on
+		FROM 
+		    torrent 
+		WHERE 
+		    is_deleted = false
+		ORDER BY info_hash
+		LIMIT $1 OFFSET $2`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	rows, err := ts.db.Query(c, q, limit, offset)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select torrents")
+	}
+	defer rows.Close()
+	var torrents []store.Torrent
+	for rows.Next() {
+		var b []byte
+		var t store.Torrent
+		if err := rows.Scan(&b, &t.Uploaded, &t.Downloaded, &t.Snatches, &t.IsDeleted, &t.IsEnabled,
+			&t.Reason, &t.MultiUp, &t.MultiDn, &t.Announces, &t.Seeders, &t.Leechers, &t.Version,
+			&t.ReleaseName, &t.MaxPeers, &t.Size, &t.Freeleech, &t.Restricted, &t.AutoRegistered,
+			&t.AnnouncedOn); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch torrent")
+		}
+		copy(t.InfoHash[:], b)
+		torrents = append(torrents, t)
+	}
+	return torrents, nil
+}
+
+// Ping checks the database is reachable
+func (ts TorrentStore) Ping() error {
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if err := ts.db.Ping(c); err != nil {
+		return errors.Wrap(err, "Failed to ping torrent store")
+	}
+	return nil
+}
+
+// WhiteListPage fetches a page of whitelisted clients ordered by prefix
+func (ts TorrentStore) WhiteListPage(offset int, limit int) ([]store.WhiteListClient, int, error) {
+	var wl []store.WhiteListClient
+	var total int
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if err := ts.db.QueryRow(c, `SELECT count(*) FROM whitelist`).Scan(&total); err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to count client whitelists")
+	}
+	const q = `SELECT client_prefix, client_name, min_version, match_type FROM whitelist ORDER BY client_prefix LIMIT $1 OFFSET $2`
+	rows, err := ts.db.Query(c, q, limit, offset)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to select client whitelists")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var client store.WhiteListClient
+		if err := rows.Scan(&client.ClientPrefix, &client.ClientName, &client.MinVersion, &client.MatchType); err != nil {
+			return nil, 0, errors.Wrap(err, "Failed to fetch client whitelist")
+		}
+		wl = append(wl, client)
+	}
+	return wl, total, nil
+}
+
+// DenyListAdd will insert a new info_hash into the list of denied torrents
+func (ts TorrentStore) DenyListAdd(entry store.DenyListInfoHash) error {
+	const q = `INSERT INTO denylist_infohash (info_hash, reason) VALUES ($1, $2)`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if _, err := ts.db.Exec(c, q, entry.InfoHash.Bytes(), entry.Reason); err != nil {
+		return errors.Wrap(err, "Failed to insert new denylist entry")
+	}
+	return nil
+}
+
+// DenyListDelete removes a info_hash from the list of denied torrents
+func (ts TorrentStore) DenyListDelete(ih store.InfoHash) error {
+	const q = `DELETE FROM denylist_infohash WHERE info_hash = $1`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	commandTag, err := ts.db.Exec(c, q, ih.Bytes())
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete denylist entry")
+	}
+	if commandTag.RowsAffected() != 1 {
+		return consts.ErrInvalidInfoHash
+	}
+	return nil
+}
+
+// ConfigGetAll fetches all persisted runtime config values
+func (ts TorrentStore) ConfigGetAll() (map[string]string, error) {
+	values := make(map[string]string)
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	rows, err := ts.db.Query(c, `SELECT config_key, config_value FROM config`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select config values")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch config value")
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// ConfigSet persists a runtime config value
+func (ts TorrentStore) ConfigSet(key string, value string) error {
+	const q = `
+		INSERT INTO config (config_key, config_value) VALUES ($1, $2)
+		ON CONFLICT (config_key) DO UPDATE SET config_value = excluded.config_value`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if _, err := ts.db.Exec(c, q, key, value); err != nil {
+		return errors.Wrapf(err, "Failed to set config value: %s", key)
+	}
+	return nil
+}
+
+// MetricsGetAll fetches the persisted metric counters
+func (ts TorrentStore) MetricsGetAll() (map[string]int64, error) {
+	values := make(map[string]int64)
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	rows, err := ts.db.Query(c, `SELECT metric_name, metric_value FROM metrics`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select metrics")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch metric")
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// MetricsSet persists the metric counters
+func (ts TorrentStore) MetricsSet(values map[string]int64) error {
+	const q = `
+		INSERT INTO metrics (metric_name, metric_value) VALUES ($1, $2)
+		ON CONFLICT (metric_name) DO UPDATE SET metric_value = excluded.metric_value`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	for name, value := range values {
+		if _, err := ts.db.Exec(c, q, name, value); err != nil {
+			return errors.Wrapf(err, "Failed to set metric: %s", name)
+		}
+	}
+	return nil
+}
+
+// DenyListGetAll fetches all denied info_hashes
+func (ts TorrentStore) DenyListGetAll() ([]store.DenyListInfoHash, error) {
+	var dl []store.DenyListInfoHash
+	const q = `SELECT info_hash::bytea, reason FROM denylist_infohash`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	rows, err := ts.db.Query(c, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select denylist")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b []byte
+		var entry store.DenyListInfoHash
+		if err := rows.Scan(&b, &entry.Reason); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch denylist entry")
+		}
+		copy(entry.InfoHash[:], b)
+		dl = append(dl, entry)
+	}
+	return dl, nil
+}
+
+// DenyListPage fetches a page of denied info_hashes ordered by info_hash
+func (ts TorrentStore) DenyListPage(offset int, limit int) ([]store.DenyListInfoHash, int, error) {
+	var dl []store.DenyListInfoHash
+	var total int
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if err := ts.db.QueryRow(c, `SELECT count(*) FROM denylist_infohash`).Scan(&total); err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to count denylist")
+	}
+	const q = `SELECT info_hash::bytea, reason FROM denylist_infohash ORDER BY info_hash LIMIT $1 OFFSET $2`
+	rows, err := ts.db.Query(c, q, limit, offset)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to select denylist")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b []byte
+		var entry store.DenyListInfoHash
+		if err := rows.Scan(&b, &entry.Reason); err != nil {
+			return nil, 0, errors.Wrap(err, "Failed to fetch denylist entry")
+		}
+		copy(entry.InfoHash[:], b)
+		dl = append(dl, entry)
+	}
+	return dl, total, nil
+}
+
+// AllowedUserAdd grants the user access to the torrent
+func (ts TorrentStore) AllowedUserAdd(entry store.TorrentAllowedUser) error {
+	const q = `
+		INSERT INTO torrent_allowed_user (info_hash, user_id) VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if _, err := ts.db.Exec(c, q, entry.InfoHash.Bytes(), entry.UserID); err != nil {
+		return errors.Wrap(err, "Failed to insert allowed user")
+	}
+	return nil
+}
+
+// AllowedUserDelete revokes a users access to the torrent
+func (ts TorrentStore) AllowedUserDelete(entry store.TorrentAllowedUser) error {
+	const q = `DELETE FROM torrent_allowed_user WHERE info_hash = $1 AND user_id = $2`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	commandTag, err := ts.db.Exec(c, q, entry.InfoHash.Bytes(), entry.UserID)
+	if err != nil {
+		return errors.Wrap(err, "Failed to delete allowed user")
+	}
+	if commandTag.RowsAffected() != 1 {
+		return consts.ErrInvalidUser
+	}
+	return nil
+}
+
+// AllowedUsersGetAll fetches the allowed users of every torrent
+func (ts TorrentStore) AllowedUsersGetAll() ([]store.TorrentAllowedUser, error) {
+	var allowed []store.TorrentAllowedUser
+	const q = `SELECT info_hash::bytea, user_id FROM torrent_allowed_user`
+	c, cancel := context.WithDeadline(ts.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	rows, err := ts.db.Query(c, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to select allowed users")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b []byte
+		var entry store.TorrentAllowedUser
+		if err := rows.Scan(&b, &entry.UserID); err != nil {
+			return nil, errors.Wrap(err, "Failed to fetch allowed user")
+		}
+		copy(entry.InfoHash[:], b)
+		allowed = append(allowed, entry)
+	}
+	return allowed, nil
+}
+
 // PeerStore is the postgres backed implementation of store.PeerStore
 type PeerStore struct {
 	db  *pgx.Conn
@@ -416,9 +885,11 @@ func (ps PeerStore) Sync(batch map[store.PeerHash]store.PeerStats) error {
 			downloaded = (downloaded + $1),
 		    uploaded = (uploaded + $2),
 		    announces = (announces + $3),
-		    announce_last = $4
+		    announce_last = $4,
+		    total_left = $5,
+		    paused = $6
 		WHERE
-			peer_id = $5 AND info_hash = $6
+			peer_id = $7 AND info_hash = $8
 `
 	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(time.Second*10))
 	defer cancel()
@@ -435,7 +906,7 @@ func (ps PeerStore) Sync(batch map[store.PeerHash]store.PeerStats) error {
 	for peerHash, stats := range batch {
 		sum := stats.Totals()
 		if _, err := tx.Exec(c, txName, sum.TotalDn, sum.TotalUp, len(stats.Hist), sum.LastAnn,
-			peerHash.PeerID().Bytes(), peerHash.InfoHash().Bytes()); err != nil {
+			stats.Left, stats.Paused, peerHash.PeerID().Bytes(), peerHash.InfoHash().Bytes()); err != nil {
 			return errors.Wrapf(err, "postgres.PeerStore.Sync failed to Exec tx")
 		}
 	}
@@ -445,23 +916,35 @@ func (ps PeerStore) Sync(batch map[store.PeerHash]store.PeerStats) error {
 	return nil
 }
 
-// Reap will loop through the peers removing any stale entries from active swarms
-// TODO fetch peer hashes for expired peers to flush local caches
-func (ps PeerStore) Reap() []store.PeerHash {
-	// NOW() - INTERVAL '15 minutes'
-	var peerHashes []store.PeerHash
-	const q = `DELETE FROM peers WHERE announce_last < $1`
+// Reap will loop through the peers removing any stale entries from active swarms. The expiry
+// is checked by the delete itself so peers announcing while being reaped are kept.
+func (ps PeerStore) Reap(expiry time.Time, dryRun bool) []store.Peer {
+	const cols = `peer_id::bytea, info_hash::bytea, user_id, announce_last, total_left, paused`
+	q := `DELETE FROM peers WHERE announce_last < $1 RETURNING ` + cols
+	if dryRun {
+		q = `SELECT ` + cols + ` FROM peers WHERE announce_last < $1`
+	}
 	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
-	rows, err := ps.db.Exec(c, q, time.Now().Add(-(15 * time.Minute)))
+	rows, err := ps.db.Query(c, q, expiry)
 	if err != nil {
 		log.Errorf("failed to reap peers: %s", err.Error())
 		return nil
 	}
-	if rows.RowsAffected() > 0 {
-		log.Debugf("Reaped %d peers", rows.RowsAffected())
+	defer rows.Close()
+	var peers []store.Peer
+	for rows.Next() {
+		var p store.Peer
+		var pid, ih []byte
+		if err := rows.Scan(&pid, &ih, &p.UserID, &p.AnnounceLast, &p.Left, &p.Paused); err != nil {
+			log.Errorf("failed to scan expired peer: %s", err.Error())
+			return peers
+		}
+		copy(p.PeerID[:], pid)
+		copy(p.InfoHash[:], ih)
+		peers = append(peers, p)
 	}
-	return peerHashes
+	return peers
 }
 
 // Add insets the peer into the swarm of the torrent provided
@@ -471,6 +954,12 @@ func (ps PeerStore) Add(ih store.InfoHash, p store.Peer) error {
 	    (peer_id, info_hash, addr_ip, addr_port, location, user_id, announce_first, announce_last)
 	VALUES 
 	    ($1, $2, $3, $4::int, ST_MakePoint($6, $5), $7, $8, $9)
+	ON CONFLICT (info_hash, peer_id) DO UPDATE SET
+	    addr_ip = excluded.addr_ip,
+	    addr_port = excluded.addr_port,
+	    location = excluded.location,
+	    user_id = excluded.user_id,
+	    announce_last = excluded.announce_last
 	`
 	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(5*time.Second))
 	defer cancel()
@@ -500,7 +989,7 @@ func (ps PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
 	const q = `
 		SELECT 
 		    peer_id::bytea, info_hash::bytea, user_id, addr_ip, addr_port, downloaded, uploaded, 
-			announces, speed_up, speed_dn, speed_up_max, speed_dn_max, ST_x(location), ST_y(location)
+			announces, speed_up, speed_dn, speed_up_max, speed_dn_max, ST_x(location), ST_y(location), paused
 		FROM
 		    peers 
 		WHERE
@@ -518,7 +1007,8 @@ func (ps PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
 	for rows.Next() {
 		var p store.Peer
 		err = rows.Scan(&p.PeerID, &p.InfoHash, &p.UserID, &p.IP, &p.Port, &p.Downloaded, &p.Uploaded,
-			&p.Announces, &p.SpeedUP, &p.SpeedDN, &p.SpeedUPMax, &p.SpeedDNMax, &p.Location.Longitude, &p.Location.Latitude)
+			&p.Announces, &p.SpeedUP, &p.SpeedDN, &p.SpeedUPMax, &p.SpeedDNMax, &p.Location.Longitude, &p.Location.Latitude,
+			&p.Paused)
 		if err != nil {
 			return swarm, errors.Wrap(err, "failed to fetch N swarm from store")
 		}
@@ -530,6 +1020,82 @@ func (ps PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
 	return swarm, nil
 }
 
+// Count returns the number of peers across all swarms
+func (ps PeerStore) Count() (int, error) {
+	var total int
+	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if err := ps.db.QueryRow(c, `SELECT count(*) FROM peers`).Scan(&total); err != nil {
+		return 0, errors.Wrap(err, "Failed to count peers")
+	}
+	return total, nil
+}
+
+// Ping checks the database is reachable
+func (ps PeerStore) Ping() error {
+	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if err := ps.db.Ping(c); err != nil {
+		return errors.Wrap(err, "Failed to ping peer store")
+	}
+	return nil
+}
+
+// GetActive fetches a page of peers that are active in any swarm
+func (ps PeerStore) GetActive(offset int, limit int) ([]store.Peer, int, error) {
+	return ps.activePage(`true`, nil, offset, limit)
+}
+
+// GetActiveByUser fetches a page of the users peers that are active in any swarm
+func (ps PeerStore) GetActiveByUser(userID uint32, offset int, limit int) ([]store.Peer, int, error) {
+	return ps.activePage(`user_id = $1`, []interface{}{userID}, offset, limit)
+}
+
+// activePage returns a page of peers matching the where clause. The limit and offset are
+// appended to the args.
+func (ps PeerStore) activePage(where string, args []interface{}, offset int, limit int) ([]store.Peer, int, error) {
+	var peers []store.Peer
+	var total int
+	c, cancel := context.WithDeadline(ps.ctx, time.Now().Add(5*time.Second))
+	defer cancel()
+	if err := ps.db.QueryRow(c, `SELECT count(*) FROM peers WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, errors.Wrap(err, "failed to count active peers")
+	}
+	q := fmt.Sprintf(`
+		SELECT 
+		    peer_id::bytea, info_hash::bytea, user_id, addr_ip, addr_port, downloaded, uploaded, total_left,
+			announces, speed_up, speed_dn, speed_up_max, speed_dn_max, announce_last
+		FROM
+		    peers 
+		WHERE
+		      %s
+		ORDER BY 
+		    info_hash, peer_id
+		LIMIT 
+		    $%d 
+		OFFSET 
+		    $%d`, where, len(args)+1, len(args)+2)
+	rows, err := ps.db.Query(c, q, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to fetch active peers")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p store.Peer
+		var pid, ih []byte
+		err = rows.Scan(&pid, &ih, &p.UserID, &p.IP, &p.Port, &p.Downloaded, &p.Uploaded, &p.Left,
+			&p.Announces, &p.SpeedUP, &p.SpeedDN, &p.SpeedUPMax, &p.SpeedDNMax, &p.AnnounceLast)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "failed to scan active peer")
+		}
+		copy(p.PeerID[:], pid)
+		copy(p.InfoHash[:], ih)
+		p.IPv6 = p.IP.To4() == nil
+		peers = append(peers, p)
+	}
+	return peers, total, nil
+}
+
 // Get will fetch the peer from the swarm if it exists
 func (ps PeerStore) Get(p *store.Peer, ih store.InfoHash, peerID store.PeerID) error {
 	const q = `
@@ -7,10 +7,30 @@ EXCEPTION
     WHEN duplicate_object THEN null;
 END $$;
 
-
+-- Upgrading from versions which used a multi_dn of 0 for freeleech:
+--   alter table torrent add column freeleech bool default 'f' not null;
+--   update torrent set freeleech = 't' where multi_dn = 0;
+-- Upgrading from versions without user multipliers:
+--   alter table users add column multi_up decimal(5,2) default 1.00 not null;
+--   alter table users add column multi_dn decimal(5,2) default 1.00 not null;
+-- Upgrading from versions without hit and run tracking:
+--   create table user_hnr (user_id integer not null,
+--       info_hash bytea check (octet_length(info_hash) = 20) not null,
+--       seed_time integer default 0 not null, created_on timestamptz not null,
+--       primary key (user_id, info_hash));
+-- Upgrading from versions where torrents with allowed users were implicitly restricted:
+--   alter table torrent add column restricted bool default 'f' not null;
+--   update torrent set restricted = 't' where info_hash in (select info_hash from torrent_allowed_user);
+-- Upgrading from versions without glob and regex whitelist entries:
+--   alter table whitelist alter column client_prefix type varchar(64);
+--   alter table whitelist add column match_type varchar(10) default '' not null;
+-- Upgrading from versions which stored left as a 32bit value:
+--   alter table peers alter column total_left type bigint;
 create table torrent
 (
     info_hash bytea check (octet_length(info_hash) = 20) not null primary key,
+    release_name varchar(255) default '' not null,
+    size bigint default 0 not null,
     total_uploaded int default 0 not null,
     total_downloaded int default 0 not null,
     total_completed smallint default 0 not null,
@@ -19,9 +39,15 @@ create table torrent
     reason varchar(255) default '' not null,
     multi_up decimal(5,2) default 1.00 not null,
     multi_dn decimal(5,2) default 1.00 not null,
+    freeleech bool default 'f' not null,
     announces int default 0 not null,
     seeders int default 0 not null,
-    leechers int default 0 not null
+    leechers int default 0 not null,
+    max_peers int default 0 not null,
+    restricted bool default 'f' not null,
+    auto_registered bool default 'f' not null,
+    announced_on timestamp default now() not null,
+    version int default 0 not null
 );
 
 create table users
@@ -34,10 +60,23 @@ create table users
     downloaded bigint default 0 not null,
     uploaded bigint default 0 not null,
     announces int default 0 not null,
+    bonus double precision default 0 not null,
+    class varchar(32) default '' not null,
+    multi_up decimal(5,2) default 1.00 not null,
+    multi_dn decimal(5,2) default 1.00 not null,
     constraint user_passkey_uindex
         unique (passkey)
 );
 
+create table user_hnr
+(
+    user_id integer not null,
+    info_hash bytea check (octet_length(info_hash) = 20) not null,
+    seed_time integer default 0 not null,
+    created_on timestamptz not null,
+    primary key (user_id, info_hash)
+);
+
 create table peers
 (
     peer_id bytea  check (octet_length(peer_id) = 20) not null,
@@ -47,7 +86,7 @@ create table peers
     addr_port uint2 not null,
     downloaded int default 0 not null,
     uploaded int default 0 not null,
-    total_left int default 0 not null,
+    total_left bigint default 0 not null,
     total_time int default 0 not null,
     announces int default 0 not null,
     speed_up int default 0 not null,
@@ -57,12 +96,45 @@ create table peers
     location geometry not null,
     announce_first timestamptz not null,
     announce_last timestamptz not null,
+    paused bool default false not null,
     primary key (info_hash, peer_id)
 );
 
+-- Swarms are looked up by the info_hash prefix of the primary key, these cover the per user
+-- peer listings and the reaper
+create index if not exists peers_user_id_index on peers (user_id);
+create index if not exists peers_announce_last_index on peers (announce_last);
+
 create table whitelist
 (
-    client_prefix varchar(10) not null
+    client_prefix varchar(64) not null
         primary key,
-    client_name varchar(20) not null
+    client_name varchar(20) not null,
+    min_version varchar(20) default '' not null,
+    match_type varchar(10) default '' not null
+);
+
+create table denylist_infohash
+(
+    info_hash bytea check (octet_length(info_hash) = 20) not null primary key,
+    reason varchar(255) default '' not null
+);
+
+create table torrent_allowed_user
+(
+    info_hash bytea check (octet_length(info_hash) = 20) not null,
+    user_id integer not null,
+    primary key (info_hash, user_id)
+);
+
+create table config
+(
+    config_key varchar(255) not null primary key,
+    config_value text not null
+);
+
+create table metrics
+(
+    metric_name varchar(255) not null primary key,
+    metric_value bigint not null
 );
\ No newline at end of file
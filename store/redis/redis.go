@@ -23,10 +23,15 @@ const (
 
 const (
 	prefixWhitelist = "whitelist"
+	keyDenyList     = "denylist_infohash"
+	keyAllowedUsers = "torrent_allowed_user"
+	keyConfig       = "config"
+	keyMetrics      = "metrics"
 	prefixTorrent   = "t"
 	prefixPeer      = "p"
 	prefixUser      = "u"
 	prefixUserID    = "user_id_pk"
+	prefixHNR       = "hnr"
 )
 
 func whiteListKey(prefix string) string {
@@ -53,6 +58,29 @@ func userIDKey(userID uint32) string {
 	return fmt.Sprintf("%s:%d", prefixUserID, userID)
 }
 
+// hnrKey returns the hash holding the hit and runs of the user, keyed by info_hash
+func hnrKey(userID uint32) string {
+	return fmt.Sprintf("%s:%d", prefixHNR, userID)
+}
+
+// scanKeys returns all keys matching the pattern. SCAN is used instead of KEYS so the server
+// isn't blocked while iterating large key spaces.
+func scanKeys(c *redis.Client, match string) ([]string, error) {
+	var keys []string
+	var cursor uint64
+	for {
+		page, next, err := c.Scan(cursor, match, 1000).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
 // UserStore is the redis backed store.TorrentStore implementation
 type UserStore struct {
 	client *redis.Client
@@ -62,6 +90,37 @@ func (us UserStore) Name() string {
 	return driverName
 }
 
+// adjustUserScript adds signed deltas to a users totals, clamping them at zero. Running it as
+// a script keeps concurrent adjustments from interleaving.
+var adjustUserScript = redis.NewScript(`
+local passkey = redis.call("GET", KEYS[1])
+if not passkey then
+	return 0
+end
+local key = ARGV[1] .. ":" .. passkey
+if redis.call("EXISTS", key) == 0 then
+	return 0
+end
+for i, field in ipairs({"uploaded", "downloaded"}) do
+	if redis.call("HINCRBY", key, field, ARGV[i + 1]) < 0 then
+		redis.call("HSET", key, field, 0)
+	end
+end
+return 1
+`)
+
+// AdjustUser adds the signed deltas to the users totals, clamping them at zero
+func (us UserStore) AdjustUser(userID uint32, upDelta int64, downDelta int64) error {
+	found, err := adjustUserScript.Run(us.client, []string{userIDKey(userID)}, prefixUser, upDelta, downDelta).Int()
+	if err != nil {
+		return errors.Wrap(err, "Failed to adjust user")
+	}
+	if found == 0 {
+		return consts.ErrInvalidUser
+	}
+	return nil
+}
+
 // Sync batch updates the backing store with the new UserStats provided
 // TODO leverage cache layer so we can pipeline the updates w/o query first
 func (us UserStore) Sync(b map[string]store.UserStats) error {
@@ -73,6 +132,7 @@ func (us UserStore) Sync(b map[string]store.UserStats) error {
 		var downloaded uint64
 		var uploaded uint64
 		var announces uint32
+		var bonus float64
 		downloadedStr, found := old["downloaded"]
 		if found {
 			downloaded = util.StringToUInt64(downloadedStr, 0)
@@ -85,10 +145,15 @@ func (us UserStore) Sync(b map[string]store.UserStats) error {
 		if found {
 			announces = util.StringToUInt32(announcesStr, 0)
 		}
+		bonusStr, found := old["bonus"]
+		if found {
+			bonus = util.StringToFloat64(bonusStr, 0)
+		}
 		us.client.HSet(userKey(passkey), map[string]interface{}{
 			"downloaded": downloaded + stats.Downloaded,
 			"uploaded":   uploaded + stats.Uploaded,
 			"announces":  announces + stats.Announces,
+			"bonus":      bonus + stats.Bonus,
 		})
 	}
 	return nil
@@ -103,6 +168,10 @@ func userMap(u store.User) map[string]interface{} {
 		"downloaded":       u.Downloaded,
 		"uploaded":         u.Uploaded,
 		"announces":        u.Announces,
+		"bonus":            u.Bonus,
+		"class":            u.Class,
+		"multi_up":         u.MultiUp,
+		"multi_dn":         u.MultiDn,
 	}
 }
 
@@ -129,8 +198,15 @@ func (us UserStore) GetByPasskey(user *store.User, passkey string) error {
 	user.Downloaded = util.StringToUInt64(v["downloaded"], 0)
 	user.Uploaded = util.StringToUInt64(v["uploaded"], 0)
 	user.Announces = util.StringToUInt32(v["announces"], 0)
+	user.Bonus = util.StringToFloat64(v["bonus"], 0)
+	user.Class = v["class"]
+	user.MultiUp = util.StringToFloat64(v["multi_up"], 1)
+	user.MultiDn = util.StringToFloat64(v["multi_dn"], 1)
 	user.DownloadEnabled = util.StringToBool(v["download_enabled"], false)
 	user.IsDeleted = util.StringToBool(v["is_deleted"], false)
+	if len(v) == 0 {
+		return consts.ErrInvalidUser
+	}
 	if !user.Valid() {
 		return consts.ErrInvalidState
 	}
@@ -183,6 +259,67 @@ func (us UserStore) Update(user store.User, oldPasskey string) error {
 	return nil
 }
 
+// Count returns the number of users
+func (us UserStore) Count() (int, error) {
+	keys, err := scanKeys(us.client, fmt.Sprintf("%s:*", prefixUser))
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to count users")
+	}
+	return len(keys), nil
+}
+
+// Ping checks the redis server is reachable
+func (us UserStore) Ping() error {
+	if err := us.client.Ping().Err(); err != nil {
+		return errors.Wrap(err, "Failed to ping user store")
+	}
+	return nil
+}
+
+// HNRAdd records a hit and run, replacing any existing record for the user and torrent. The
+// value is stored as seed_time:created_on
+func (us UserStore) HNRAdd(hnr store.HNR) error {
+	value := fmt.Sprintf("%d:%s", hnr.SeedTime, util.TimeToString(hnr.CreatedOn))
+	if err := us.client.HSet(hnrKey(hnr.UserID), hnr.InfoHash.String(), value).Err(); err != nil {
+		return errors.Wrapf(err, "Failed to add hnr: %d", hnr.UserID)
+	}
+	return nil
+}
+
+// HNRDelete clears the hit and run of the user on the torrent
+func (us UserStore) HNRDelete(userID uint32, ih store.InfoHash) error {
+	if err := us.client.HDel(hnrKey(userID), ih.String()).Err(); err != nil {
+		return errors.Wrapf(err, "Failed to delete hnr: %d", userID)
+	}
+	return nil
+}
+
+// HNRGetByUser fetches the hit and runs of the user ordered by info_hash
+func (us UserStore) HNRGetByUser(userID uint32) ([]store.HNR, error) {
+	v, err := us.client.HGetAll(hnrKey(userID)).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to fetch hnrs: %d", userID)
+	}
+	hnrs := make([]store.HNR, 0, len(v))
+	for ihStr, value := range v {
+		pcs := strings.SplitN(value, ":", 2)
+		if len(pcs) != 2 {
+			return nil, errors.Errorf("Invalid hnr: %s", value)
+		}
+		hnr := store.HNR{
+			UserID:    userID,
+			SeedTime:  util.StringToUInt32(pcs[0], 0),
+			CreatedOn: util.StringToTime(pcs[1]),
+		}
+		if err := store.InfoHashFromHex(&hnr.InfoHash, ihStr); err != nil {
+			return nil, errors.Wrapf(err, "Invalid hnr info_hash: %s", ihStr)
+		}
+		hnrs = append(hnrs, hnr)
+	}
+	store.SortHNRs(hnrs)
+	return hnrs, nil
+}
+
 // Close will shutdown the underlying redis connection
 func (us UserStore) Close() error {
 	return us.client.Close()
@@ -200,14 +337,34 @@ func (ts *TorrentStore) Name() string {
 // Update is just a Add call with a check for existing key first as the process
 // is the same for setting both
 func (ts *TorrentStore) Update(torrent store.Torrent) error {
-	val, err := ts.client.Exists(torrentKey(torrent.InfoHash)).Result()
-	if err != nil {
+	key := torrentKey(torrent.InfoHash)
+	err := ts.client.Watch(func(tx *redis.Tx) error {
+		v, err := tx.HGet(key, "version").Result()
+		if err == redis.Nil {
+			val, err := tx.Exists(key).Result()
+			if err != nil {
+				return err
+			}
+			if val == 0 {
+				return errors.Wrapf(consts.ErrInvalidInfoHash, "Won't update non-existent torrent")
+			}
+		} else if err != nil {
+			return err
+		}
+		if util.StringToUInt32(v, 0) != torrent.Version {
+			return consts.ErrConflict
+		}
+		torrent.Version++
+		_, err = tx.TxPipelined(func(pipe redis.Pipeliner) error {
+			pipe.HSet(key, torrentMap(torrent))
+			return nil
+		})
 		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return consts.ErrConflict
 	}
-	if val == 0 {
-		return errors.Wrapf(consts.ErrInvalidInfoHash, "Won't update non-existent torrent")
-	}
-	return ts.Add(torrent)
+	return err
 }
 
 // Sync batch updates the backing store with the new TorrentStats provided
@@ -220,6 +377,9 @@ func (ts *TorrentStore) Sync(batch map[store.InfoHash]store.TorrentStats) error
 		pipe.HIncrBy(torrentKey(ih), "total_uploaded", int64(s.Uploaded))
 		pipe.HIncrBy(torrentKey(ih), "total_downloaded", int64(s.Downloaded))
 		pipe.HIncrBy(torrentKey(ih), "announces", int64(s.Announces))
+		if s.Announces > 0 {
+			pipe.HSet(torrentKey(ih), "announced_on", time.Now().Unix())
+		}
 	}
 	if _, err := pipe.Exec(); err != nil {
 		return err
@@ -249,6 +409,8 @@ func (ts *TorrentStore) WhiteListAdd(client store.WhiteListClient) error {
 	valueMap := map[string]interface{}{
 		"client_prefix": client.ClientPrefix,
 		"client_name":   client.ClientName,
+		"min_version":   client.MinVersion,
+		"match_type":    client.MatchType,
 	}
 	err := ts.client.HSet(whiteListKey(client.ClientPrefix), valueMap).Err()
 	if err != nil {
@@ -264,38 +426,312 @@ func (ts *TorrentStore) WhiteListGetAll() ([]store.WhiteListClient, error) {
 		return nil, errors.Wrap(err, "Failed to fetch whitelist keys")
 	}
 	var wl []store.WhiteListClient
-	for _, prefix := range prefixes {
-		valueMap, err := ts.client.HGetAll(whiteListKey(prefix)).Result()
+	for _, key := range prefixes {
+		valueMap, err := ts.client.HGetAll(key).Result()
 		if err != nil {
-			return nil, errors.Wrapf(err, "Failed to fetch whitelist value for: %s", whiteListKey(prefix))
+			return nil, errors.Wrapf(err, "Failed to fetch whitelist value for: %s", key)
 		}
 		wl = append(wl, store.WhiteListClient{
 			ClientPrefix: valueMap["client_prefix"],
 			ClientName:   valueMap["client_name"],
+			MinVersion:   valueMap["min_version"],
+			MatchType:    valueMap["match_type"],
 		})
 	}
 	return wl, nil
 }
 
+// Count returns the number of torrents not marked as deleted
+func (ts *TorrentStore) Count() (int, error) {
+	keys, err := scanKeys(ts.client, fmt.Sprintf("%s:*", prefixTorrent))
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to count torrents")
+	}
+	pipe := ts.client.Pipeline()
+	deleted := make([]*redis.StringCmd, len(keys))
+	for i, key := range keys {
+		deleted[i] = pipe.HGet(key, "is_deleted")
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return 0, errors.Wrap(err, "Failed to count torrents")
+	}
+	count := 0
+	for _, cmd := range deleted {
+		if v := cmd.Val(); v == "" || !util.StringToBool(v, false) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// List fetches a page of torrents not marked as deleted, ordered by info_hash. Redis has no
+// ordering over keys so every torrent is fetched and sorted.
+func (ts *TorrentStore) List(limit int, offset int) ([]store.Torrent, error) {
+	keys, err := scanKeys(ts.client, fmt.Sprintf("%s:*", prefixTorrent))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list torrents")
+	}
+	// Fetched in a single round trip rather than one per torrent
+	pipe := ts.client.Pipeline()
+	values := make([]*redis.StringStringMapCmd, 0, len(keys))
+	for _, key := range keys {
+		var ih store.InfoHash
+		if err := store.InfoHashFromHex(&ih, strings.TrimPrefix(key, prefixTorrent+":")); err != nil {
+			continue
+		}
+		values = append(values, pipe.HGetAll(key))
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "Failed to fetch torrents")
+	}
+	var torrents []store.Torrent
+	for _, cmd := range values {
+		var t store.Torrent
+		if err := torrentFromMap(&t, cmd.Val(), false); err != nil {
+			if err == consts.ErrInvalidInfoHash {
+				continue
+			}
+			return nil, err
+		}
+		torrents = append(torrents, t)
+	}
+	return store.TorrentPage(torrents, offset, limit), nil
+}
+
+// Ping checks the redis server is reachable
+func (ts *TorrentStore) Ping() error {
+	if err := ts.client.Ping().Err(); err != nil {
+		return errors.Wrap(err, "Failed to ping torrent store")
+	}
+	return nil
+}
+
+// Inactive fetches the info_hashes of auto registered torrents which have not been announced
+// since olderThan
+func (ts *TorrentStore) Inactive(olderThan time.Time) ([]store.InfoHash, error) {
+	keys, err := scanKeys(ts.client, fmt.Sprintf("%s:*", prefixTorrent))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch torrent keys")
+	}
+	pipe := ts.client.Pipeline()
+	values := make([]*redis.SliceCmd, len(keys))
+	for i, key := range keys {
+		values[i] = pipe.HMGet(key, "info_hash", "auto_registered", "announced_on")
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "Failed to fetch torrents")
+	}
+	var inactive []store.InfoHash
+	for _, cmd := range values {
+		v := make([]string, 3)
+		for i, val := range cmd.Val() {
+			if s, ok := val.(string); ok {
+				v[i] = s
+			}
+		}
+		// Torrents stored before the auto registered flag existed are never pruned
+		if v[1] == "" || !util.StringToBool(v[1], false) ||
+			int64(util.StringToUInt64(v[2], 0)) >= olderThan.Unix() {
+			continue
+		}
+		var ih store.InfoHash
+		if err := store.InfoHashFromHex(&ih, v[0]); err != nil {
+			return nil, errors.Wrapf(err, "Invalid torrent info_hash: %s", v[0])
+		}
+		inactive = append(inactive, ih)
+	}
+	return inactive, nil
+}
+
+// WhiteListPage fetches a page of whitelisted clients ordered by prefix. Redis has no
+// ordering of the keys so the whole list is fetched and sorted.
+func (ts *TorrentStore) WhiteListPage(offset int, limit int) ([]store.WhiteListClient, int, error) {
+	wl, err := ts.WhiteListGetAll()
+	if err != nil {
+		return nil, 0, err
+	}
+	page, total := store.WhiteListPage(wl, offset, limit)
+	return page, total, nil
+}
+
+// DenyListAdd will insert a new info_hash into the list of denied torrents
+func (ts *TorrentStore) DenyListAdd(entry store.DenyListInfoHash) error {
+	if err := ts.client.HSet(keyDenyList, entry.InfoHash.String(), entry.Reason).Err(); err != nil {
+		return errors.Wrapf(err, "failed to add denied info_hash: %s", entry.InfoHash.String())
+	}
+	return nil
+}
+
+// DenyListDelete removes a info_hash from the list of denied torrents
+func (ts *TorrentStore) DenyListDelete(ih store.InfoHash) error {
+	res, err := ts.client.HDel(keyDenyList, ih.String()).Result()
+	if err != nil {
+		return errors.Wrap(err, "Failed to remove denied info_hash")
+	}
+	if res != 1 {
+		return consts.ErrInvalidInfoHash
+	}
+	return nil
+}
+
+// DenyListGetAll fetches all denied info_hashes
+func (ts *TorrentStore) DenyListGetAll() ([]store.DenyListInfoHash, error) {
+	valueMap, err := ts.client.HGetAll(keyDenyList).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch denied info_hashes")
+	}
+	var dl []store.DenyListInfoHash
+	for ihStr, reason := range valueMap {
+		var ih store.InfoHash
+		if err := store.InfoHashFromHex(&ih, ihStr); err != nil {
+			return nil, errors.Wrapf(err, "Invalid denied info_hash: %s", ihStr)
+		}
+		dl = append(dl, store.DenyListInfoHash{InfoHash: ih, Reason: reason})
+	}
+	return dl, nil
+}
+
+// DenyListPage fetches a page of denied info_hashes ordered by info_hash. Redis hashes are
+// unordered so the whole list is fetched and sorted.
+func (ts *TorrentStore) DenyListPage(offset int, limit int) ([]store.DenyListInfoHash, int, error) {
+	dl, err := ts.DenyListGetAll()
+	if err != nil {
+		return nil, 0, err
+	}
+	page, total := store.DenyListPage(dl, offset, limit)
+	return page, total, nil
+}
+
+// allowedUserMember returns the member of the allowed users set for the entry
+func allowedUserMember(entry store.TorrentAllowedUser) string {
+	return fmt.Sprintf("%s:%d", entry.InfoHash.String(), entry.UserID)
+}
+
+// AllowedUserAdd grants the user access to the torrent
+func (ts *TorrentStore) AllowedUserAdd(entry store.TorrentAllowedUser) error {
+	if err := ts.client.SAdd(keyAllowedUsers, allowedUserMember(entry)).Err(); err != nil {
+		return errors.Wrapf(err, "failed to add allowed user: %s", entry.InfoHash.String())
+	}
+	return nil
+}
+
+// AllowedUserDelete revokes a users access to the torrent
+func (ts *TorrentStore) AllowedUserDelete(entry store.TorrentAllowedUser) error {
+	res, err := ts.client.SRem(keyAllowedUsers, allowedUserMember(entry)).Result()
+	if err != nil {
+		return errors.Wrap(err, "Failed to remove allowed user")
+	}
+	if res != 1 {
+		return consts.ErrInvalidUser
+	}
+	return nil
+}
+
+// AllowedUsersGetAll fetches the allowed users of every torrent
+func (ts *TorrentStore) AllowedUsersGetAll() ([]store.TorrentAllowedUser, error) {
+	members, err := ts.client.SMembers(keyAllowedUsers).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch allowed users")
+	}
+	var allowed []store.TorrentAllowedUser
+	for _, member := range members {
+		pcs := strings.SplitN(member, ":", 2)
+		if len(pcs) != 2 {
+			return nil, errors.Errorf("Invalid allowed user: %s", member)
+		}
+		var entry store.TorrentAllowedUser
+		if err := store.InfoHashFromHex(&entry.InfoHash, pcs[0]); err != nil {
+			return nil, errors.Wrapf(err, "Invalid allowed user info_hash: %s", member)
+		}
+		userID, err := strconv.ParseUint(pcs[1], 10, 32)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid allowed user id: %s", member)
+		}
+		entry.UserID = uint32(userID)
+		allowed = append(allowed, entry)
+	}
+	return allowed, nil
+}
+
+// ConfigGetAll fetches all persisted runtime config values
+func (ts *TorrentStore) ConfigGetAll() (map[string]string, error) {
+	values, err := ts.client.HGetAll(keyConfig).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch config values")
+	}
+	return values, nil
+}
+
+// ConfigSet persists a runtime config value
+func (ts *TorrentStore) ConfigSet(key string, value string) error {
+	if err := ts.client.HSet(keyConfig, key, value).Err(); err != nil {
+		return errors.Wrapf(err, "Failed to set config value: %s", key)
+	}
+	return nil
+}
+
+// MetricsGetAll fetches the persisted metric counters
+func (ts *TorrentStore) MetricsGetAll() (map[string]int64, error) {
+	res, err := ts.client.HGetAll(keyMetrics).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to fetch metrics")
+	}
+	values := make(map[string]int64, len(res))
+	for k, v := range res {
+		value, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid metric value: %s", k)
+		}
+		values[k] = value
+	}
+	return values, nil
+}
+
+// MetricsSet persists the metric counters
+func (ts *TorrentStore) MetricsSet(values map[string]int64) error {
+	if len(values) == 0 {
+		return nil
+	}
+	fields := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		fields[k] = v
+	}
+	if err := ts.client.HSet(keyMetrics, fields).Err(); err != nil {
+		return errors.Wrap(err, "Failed to set metrics")
+	}
+	return nil
+}
+
 func torrentMap(t store.Torrent) map[string]interface{} {
 	return map[string]interface{}{
 		"total_completed":  t.Snatches,
 		"total_downloaded": t.Downloaded,
 		"total_uploaded":   t.Uploaded,
 		"reason":           t.Reason,
+		"release_name":     t.ReleaseName,
+		"size":             t.Size,
 		"multi_up":         t.MultiUp,
 		"multi_dn":         t.MultiDn,
+		"freeleech":        t.Freeleech,
 		"info_hash":        t.InfoHash.String(),
 		"is_deleted":       t.IsDeleted,
 		"is_enabled":       t.IsEnabled,
 		"announces":        t.Announces,
 		"seeders":          t.Seeders,
 		"leechers":         t.Leechers,
+		"max_peers":        t.MaxPeers,
+		"restricted":       t.Restricted,
+		"auto_registered":  t.AutoRegistered,
+		"announced_on":     t.AnnouncedOn.Unix(),
+		"version":          t.Version,
 	}
 }
 
 // Add adds a new torrent to the redis backing store
 func (ts *TorrentStore) Add(t store.Torrent) error {
+	if t.AnnouncedOn.IsZero() {
+		t.AnnouncedOn = time.Now()
+	}
 	err := ts.client.HSet(torrentKey(t.InfoHash), torrentMap(t)).Err()
 	if err != nil {
 		return err
@@ -324,6 +760,36 @@ func (ts *TorrentStore) Get(t *store.Torrent, hash store.InfoHash, deletedOk boo
 	if err != nil {
 		return err
 	}
+	return torrentFromMap(t, v, deletedOk)
+}
+
+// GetMany returns the torrents matching the infohashes keyed by infohash, fetched in a single
+// round trip
+func (ts *TorrentStore) GetMany(hashes []store.InfoHash, deletedOk bool) (map[store.InfoHash]store.Torrent, error) {
+	pipe := ts.client.Pipeline()
+	values := make([]*redis.StringStringMapCmd, len(hashes))
+	for i, hash := range hashes {
+		values[i] = pipe.HGetAll(torrentKey(hash))
+	}
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		return nil, errors.Wrap(err, "Failed to fetch torrents")
+	}
+	torrents := make(map[store.InfoHash]store.Torrent, len(hashes))
+	for _, cmd := range values {
+		var t store.Torrent
+		if err := torrentFromMap(&t, cmd.Val(), deletedOk); err != nil {
+			if err == consts.ErrInvalidInfoHash {
+				continue
+			}
+			return nil, err
+		}
+		torrents[t.InfoHash] = t
+	}
+	return torrents, nil
+}
+
+// torrentFromMap fills the torrent from the fields of its hash
+func torrentFromMap(t *store.Torrent, v map[string]string, deletedOk bool) error {
 	ihStr, found := v["info_hash"]
 	if !found {
 		return consts.ErrInvalidInfoHash
@@ -343,11 +809,20 @@ func (ts *TorrentStore) Get(t *store.Torrent, hash store.InfoHash, deletedOk boo
 	t.IsDeleted = isDeleted
 	t.IsEnabled = util.StringToBool(v["is_enabled"], false)
 	t.Reason = v["reason"]
+	t.ReleaseName = v["release_name"]
+	t.Size = util.StringToUInt64(v["size"], 0)
 	t.MultiUp = util.StringToFloat64(v["multi_up"], 1.0)
 	t.MultiDn = util.StringToFloat64(v["multi_dn"], 1.0)
+	// Torrents stored before the freeleech flag existed used a multi_dn of 0 for freeleech
+	t.Freeleech = util.StringToBool(v["freeleech"], t.MultiDn == 0)
 	t.Announces = util.StringToUInt64(v["announces"], 0)
 	t.Seeders = util.StringToUInt(v["seeders"], 0)
 	t.Leechers = util.StringToUInt(v["leechers"], 0)
+	t.MaxPeers = util.StringToUInt(v["max_peers"], 0)
+	t.Restricted = util.StringToBool(v["restricted"], false)
+	t.AutoRegistered = util.StringToBool(v["auto_registered"], false)
+	t.AnnouncedOn = time.Unix(int64(util.StringToUInt64(v["announced_on"], 0)), 0)
+	t.Version = util.StringToUInt32(v["version"], 0)
 	return nil
 }
 
@@ -358,8 +833,10 @@ func (ts *TorrentStore) Close() error {
 
 // PeerStore is the redis backed store.PeerStore implementation
 type PeerStore struct {
-	client  *redis.Client
-	pubSub  *redis.PubSub
+	client *redis.Client
+	pubSub *redis.PubSub
+	// peerTTL expires peers which are never reaped, such as while the tracker is stopped. It
+	// is kept well past the reaper expiry so reaped peers are taken off the swarm counts.
 	peerTTL time.Duration
 }
 
@@ -377,6 +854,8 @@ func (ps *PeerStore) Sync(batch map[store.PeerHash]store.PeerStats) error {
 		pipe.HIncrBy(k, "downloaded", int64(sum.TotalDn))
 		pipe.HIncrBy(k, "uploaded", int64(sum.TotalUp))
 		pipe.HSet(k, "last_announce", util.TimeToString(sum.LastAnn))
+		pipe.HSet(k, "total_left", stats.Left)
+		pipe.HSet(k, "paused", stats.Paused)
 		pipe.Expire(k, ps.peerTTL)
 	}
 	if _, err := pipe.Exec(); err != nil {
@@ -385,9 +864,46 @@ func (ps *PeerStore) Sync(batch map[store.PeerHash]store.PeerStats) error {
 	return nil
 }
 
+// reapPeerScript deletes a peer only if it has not announced since it was read, so a peer
+// announcing while being reaped is kept.
+var reapPeerScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "last_announce") ~= ARGV[1] then
+	return 0
+end
+return redis.call("DEL", KEYS[1])
+`)
+
 // Reap will loop through the peers removing any stale entries from active swarms
-func (ps *PeerStore) Reap() []store.PeerHash {
-	return nil
+func (ps *PeerStore) Reap(expiry time.Time, dryRun bool) []store.Peer {
+	var reaped []store.Peer
+	for _, key := range ps.findKeys(fmt.Sprintf("%s:*", prefixPeer)) {
+		v, err := ps.client.HGetAll(key).Result()
+		if err != nil {
+			log.Errorf("Failed to fetch peer to reap: %s", err)
+			continue
+		}
+		var p store.Peer
+		mapPeerValues(&p, v)
+		if !p.Expired(expiry) {
+			continue
+		}
+		parts := strings.Split(key, ":")
+		if len(parts) != 3 || store.InfoHashFromHex(&p.InfoHash, parts[1]) != nil {
+			continue
+		}
+		if !dryRun {
+			deleted, err := reapPeerScript.Run(ps.client, []string{key}, v["last_announce"]).Int()
+			if err != nil {
+				log.Errorf("Failed to reap peer: %s", err)
+				continue
+			}
+			if deleted == 0 {
+				continue
+			}
+		}
+		reaped = append(reaped, p)
+	}
+	return reaped
 }
 
 // Add inserts a peer into the active swarm for the torrent provided
@@ -402,6 +918,7 @@ func (ps *PeerStore) Add(ih store.InfoHash, p store.Peer) error {
 		"downloaded":     p.Downloaded,
 		"total_left":     p.Left,
 		"total_time":     p.TotalTime,
+		"paused":         p.Paused,
 		"ipv6":           ipv6,
 		"addr_ip":        p.IP.String(),
 		"addr_port":      p.Port,
@@ -477,7 +994,7 @@ func mapPeerValues(p *store.Peer, v map[string]string) {
 	p.SpeedDNMax = util.StringToUInt32(v["speed_up_max"], 0)
 	p.Uploaded = util.StringToUInt64(v["uploaded"], 0)
 	p.Downloaded = util.StringToUInt64(v["downloaded"], 0)
-	p.Left = util.StringToUInt32(v["total_left"], 0)
+	p.Left = util.StringToUInt64(v["total_left"], 0)
 	p.Announces = util.StringToUInt32(v["announces"], 0)
 	p.TotalTime = util.StringToUInt32(v["total_time"], 0)
 	p.IPv6 = util.StringToBool(v["ipv6"], false)
@@ -491,6 +1008,7 @@ func mapPeerValues(p *store.Peer, v map[string]string) {
 	p.ASN = util.StringToUInt32(v["asn"], 0)
 	p.AS = v["as_name"]
 	p.CountryCode = v["country_code"]
+	p.Paused = util.StringToBool(v["paused"], false)
 	p.CryptoLevel = consts.CryptoLevel(util.StringToUInt(v["crypto_level"], 0))
 }
 
@@ -512,6 +1030,61 @@ func (ps *PeerStore) GetN(ih store.InfoHash, limit int) (store.Swarm, error) {
 	return swarm, nil
 }
 
+// Count returns the number of peers across all swarms
+func (ps *PeerStore) Count() (int, error) {
+	keys, err := scanKeys(ps.client, fmt.Sprintf("%s:*", prefixPeer))
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to count peers")
+	}
+	return len(keys), nil
+}
+
+// Ping checks the redis server is reachable
+func (ps *PeerStore) Ping() error {
+	if err := ps.client.Ping().Err(); err != nil {
+		return errors.Wrap(err, "Failed to ping peer store")
+	}
+	return nil
+}
+
+// GetActive fetches a page of peers that are active in any swarm. Redis has no ordering of
+// the keys so all peers are fetched and sorted.
+func (ps *PeerStore) GetActive(offset int, limit int) ([]store.Peer, int, error) {
+	return ps.activePage(func(p store.Peer) bool { return true }, offset, limit)
+}
+
+// GetActiveByUser fetches a page of the users peers that are active in any swarm. Peers are
+// not indexed by user so every peer is scanned.
+func (ps *PeerStore) GetActiveByUser(userID uint32, offset int, limit int) ([]store.Peer, int, error) {
+	return ps.activePage(func(p store.Peer) bool { return p.UserID == userID }, offset, limit)
+}
+
+// activePage returns a page of the active peers matching the filter
+func (ps *PeerStore) activePage(filter func(p store.Peer) bool, offset int, limit int) ([]store.Peer, int, error) {
+	var peers []store.Peer
+	for _, key := range ps.findKeys(fmt.Sprintf("%s:*", prefixPeer)) {
+		v, err := ps.client.HGetAll(key).Result()
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "Error trying to fetch active peers")
+		}
+		var p store.Peer
+		mapPeerValues(&p, v)
+		if !filter(p) {
+			continue
+		}
+		parts := strings.Split(key, ":")
+		if len(parts) != 3 {
+			continue
+		}
+		if err := store.InfoHashFromHex(&p.InfoHash, parts[1]); err != nil {
+			continue
+		}
+		peers = append(peers, p)
+	}
+	page, total := store.PeerPage(peers, offset, limit)
+	return page, total, nil
+}
+
 // Close will close the underlying redis client and clear in-memory caches
 func (ps *PeerStore) Close() error {
 	return ps.client.Close()
@@ -570,7 +1143,7 @@ func (pd peerDriver) New(cfg interface{}) (store.PeerStore, error) {
 	ps := &PeerStore{
 		client:  client,
 		pubSub:  client.Subscribe("peer_expired"),
-		peerTTL: time.Minute * 10,
+		peerTTL: time.Hour * 24,
 	}
 	go ps.peerExpireHandler()
 	return ps, nil
@@ -1,13 +1,16 @@
 package store
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/util"
 	"github.com/stretchr/testify/require"
 	"log"
 	"math/rand"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
@@ -22,6 +25,8 @@ func GenerateTestUser() User {
 		Downloaded:      1000,
 		Uploaded:        2000,
 		Announces:       500,
+		MultiUp:         1.0,
+		MultiDn:         1.0,
 	}
 }
 
@@ -66,12 +71,21 @@ func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore, _ UserStore) {
 		p.InfoHash = torrentA.InfoHash
 		swarm.Peers[p.PeerID] = p
 	}
+	require.NoError(t, ps.Ping())
+	peerCount, err0 := ps.Count()
+	require.NoError(t, err0)
 	for _, peer := range swarm.Peers {
 		require.NoError(t, ps.Add(torrentA.InfoHash, peer))
 	}
+	peerCountAdded, err0 := ps.Count()
+	require.NoError(t, err0)
+	require.Equal(t, peerCount+len(swarm.Peers), peerCountAdded, "[%s] Invalid peer count", ps.Name())
 	fetchedPeers, err := ps.GetN(torrentA.InfoHash, 5)
 	require.NoError(t, err)
 	require.Equal(t, len(swarm.Peers), len(fetchedPeers.Peers))
+	limitedPeers, err := ps.GetN(torrentA.InfoHash, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(limitedPeers.Peers), "GetN limit not respected")
 	for _, peer := range swarm.Peers {
 		fp, err := findPeer(swarm, peer)
 		require.NoError(t, err)
@@ -84,11 +98,46 @@ func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore, _ UserStore) {
 	if len(swarm.Peers) < 5 {
 		t.Fatalf("Invalid peer count")
 	}
+	// Walk the active peer pages, the stores may contain other peers so only check that
+	// ours are included in a consistent order
+	var active []Peer
+	_, activeTotal, err := ps.GetActive(0, 1)
+	require.NoError(t, err)
+	for offset := 0; offset < activeTotal; offset += 2 {
+		page, total, err := ps.GetActive(offset, 2)
+		require.NoError(t, err)
+		require.Equal(t, activeTotal, total)
+		active = append(active, page...)
+	}
+	require.Equal(t, activeTotal, len(active))
+	found := 0
+	for i, ap := range active {
+		if i > 0 {
+			prev := NewPeerHash(active[i-1].InfoHash, active[i-1].PeerID)
+			cur := NewPeerHash(ap.InfoHash, ap.PeerID)
+			require.True(t, bytes.Compare(prev[:], cur[:]) < 0)
+		}
+		if _, ok := swarm.Peers[ap.PeerID]; ok && ap.InfoHash == torrentA.InfoHash {
+			found++
+		}
+	}
+	require.Equal(t, len(swarm.Peers), found)
 	var p1 Peer
 	for k := range swarm.Peers {
 		p1 = swarm.Peers[k]
 		break
 	}
+	userPeers, userTotal, err := ps.GetActiveByUser(p1.UserID, 0, 100)
+	require.NoError(t, err)
+	require.Equal(t, len(userPeers), userTotal)
+	userFound := false
+	for _, up := range userPeers {
+		require.Equal(t, p1.UserID, up.UserID, "[%s] Peer of another user returned", ps.Name())
+		if up.PeerID == p1.PeerID && up.InfoHash == torrentA.InfoHash {
+			userFound = true
+		}
+	}
+	require.True(t, userFound, "[%s] Active user peer not returned", ps.Name())
 	var hist []AnnounceHist
 	hist = append(hist, AnnounceHist{
 		Uploaded:   5000,
@@ -110,7 +159,7 @@ func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore, _ UserStore) {
 		ph: {
 			Left:   1000,
 			Hist:   hist,
-			Paused: false,
+			Paused: true,
 		},
 	}))
 	uploaded := uint64(0)
@@ -126,6 +175,31 @@ func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore, _ UserStore) {
 	require.Equal(t, p1.TotalTime, p1Updated.TotalTime)
 	require.Equal(t, downloaded, p1Updated.Downloaded)
 	require.Equal(t, uploaded, p1Updated.Uploaded)
+	require.Equal(t, uint64(1000), p1Updated.Left, "Left not synced")
+	require.True(t, p1Updated.Paused, "Paused state not synced")
+
+	stale := GenerateTestPeer()
+	stale.Left = 500
+	stale.AnnounceLast = time.Now().Add(-time.Hour)
+	require.NoError(t, ps.Add(torrentA.InfoHash, stale))
+	reaped := func(dryRun bool) []Peer {
+		var peers []Peer
+		for _, p := range ps.Reap(time.Now().Add(-time.Minute), dryRun) {
+			if p.InfoHash == torrentA.InfoHash {
+				peers = append(peers, p)
+			}
+		}
+		return peers
+	}
+	require.Len(t, reaped(true), 1, "[%s] Invalid dry-run reap", ps.Name())
+	expired := reaped(false)
+	require.Len(t, expired, 1, "[%s] Invalid reap", ps.Name())
+	require.Equal(t, stale.PeerID, expired[0].PeerID)
+	require.Equal(t, stale.Left, expired[0].Left)
+	require.Empty(t, reaped(false), "[%s] Peer reaped twice", ps.Name())
+	remaining, err := ps.GetN(torrentA.InfoHash, 10)
+	require.NoError(t, err)
+	require.Equal(t, len(swarm.Peers), len(remaining.Peers), "[%s] Active peers reaped", ps.Name())
 	for _, peer := range swarm.Peers {
 		require.NoError(t, ps.Delete(torrentA.InfoHash, peer.PeerID))
 	}
@@ -134,10 +208,22 @@ func TestPeerStore(t *testing.T, ps PeerStore, ts TorrentStore, _ UserStore) {
 // TestTorrentStore tests the interface implementation
 func TestTorrentStore(t *testing.T, ts TorrentStore) {
 	torrentA := GenerateTestTorrent()
+	torrentA.ReleaseName = "Test.Release.Name"
+	torrentA.Size = 5 << 30
+	torrentA.Freeleech = true
+	require.NoError(t, ts.Ping())
+	torrentCount, err0 := ts.Count()
+	require.NoError(t, err0)
 	require.NoError(t, ts.Add(torrentA))
+	torrentCountAdded, err0 := ts.Count()
+	require.NoError(t, err0)
+	require.Equal(t, torrentCount+1, torrentCountAdded, "[%s] Invalid torrent count", ts.Name())
 	var fetchedTorrent Torrent
 	require.NoError(t, ts.Get(&fetchedTorrent, torrentA.InfoHash, false))
 	require.Equal(t, torrentA.InfoHash, fetchedTorrent.InfoHash)
+	require.Equal(t, torrentA.ReleaseName, fetchedTorrent.ReleaseName)
+	require.Equal(t, torrentA.Size, fetchedTorrent.Size)
+	require.Equal(t, torrentA.Freeleech, fetchedTorrent.Freeleech, "[%s] Freeleech not stored", ts.Name())
 	require.Equal(t, torrentA.IsDeleted, fetchedTorrent.IsDeleted)
 	require.Equal(t, torrentA.IsEnabled, fetchedTorrent.IsEnabled)
 	batch := map[InfoHash]TorrentStats{
@@ -160,12 +246,92 @@ func TestTorrentStore(t *testing.T, ts TorrentStore) {
 	require.Equal(t, torrentA.Downloaded+batch[torrentA.InfoHash].Downloaded, updated.Downloaded)
 	require.Equal(t, torrentA.Announces+batch[torrentA.InfoHash].Announces, updated.Announces)
 
+	// Updates using a stale version must be rejected
+	stale := updated
+	updated.Reason = "first"
+	updated.ReleaseName = "Updated.Release.Name"
+	updated.MaxPeers = 25
+	updated.Freeleech = true
+	updated.Restricted = true
+	updated.Size = 6 << 30
+	require.NoError(t, ts.Update(updated))
+	stale.Reason = "second"
+	require.Equal(t, consts.ErrConflict, ts.Update(stale))
+	var versioned Torrent
+	require.NoError(t, ts.Get(&versioned, torrentA.InfoHash, false))
+	require.Equal(t, "first", versioned.Reason)
+	require.Equal(t, updated.ReleaseName, versioned.ReleaseName)
+	require.Equal(t, updated.MaxPeers, versioned.MaxPeers)
+	require.True(t, versioned.Freeleech, "[%s] Freeleech not stored", ts.Name())
+	require.True(t, versioned.Restricted, "[%s] Restricted not stored", ts.Name())
+	require.Equal(t, updated.Size, versioned.Size)
+	require.Equal(t, updated.Version+1, versioned.Version)
+
+	// Only auto registered torrents without recent announces are inactive
+	autoTorrent := GenerateTestTorrent()
+	autoTorrent.AutoRegistered = true
+	require.NoError(t, ts.Add(autoTorrent))
+	inactive, errInactive := ts.Inactive(time.Now().Add(time.Minute))
+	require.NoError(t, errInactive)
+	require.Contains(t, inactive, autoTorrent.InfoHash, "[%s] Inactive torrent not found", ts.Name())
+	require.NotContains(t, inactive, torrentA.InfoHash, "[%s] Manual torrent inactive", ts.Name())
+	recent, _ := ts.Inactive(time.Now().Add(-time.Minute))
+	require.NotContains(t, recent, autoTorrent.InfoHash, "[%s] Recent torrent inactive", ts.Name())
+	require.NoError(t, ts.Sync(map[InfoHash]TorrentStats{autoTorrent.InfoHash: {Announces: 1}}))
+	active, _ := ts.Inactive(time.Now().Add(-time.Second))
+	require.NotContains(t, active, autoTorrent.InfoHash, "[%s] Active torrent inactive", ts.Name())
+
+	// Walking the pages of the torrent list must return every torrent once, in order
+	torrentTotal, err0 := ts.Count()
+	require.NoError(t, err0)
+	var listed []Torrent
+	for offset := 0; offset <= torrentTotal; offset += 2 {
+		page, err := ts.List(2, offset)
+		require.NoError(t, err)
+		require.True(t, len(page) <= 2)
+		listed = append(listed, page...)
+	}
+	require.Equal(t, torrentTotal, len(listed), "[%s] Invalid torrent list", ts.Name())
+	for i := 1; i < len(listed); i++ {
+		require.True(t, bytes.Compare(listed[i-1].InfoHash[:], listed[i].InfoHash[:]) < 0)
+	}
+	var listedA bool
+	for _, lt := range listed {
+		if lt.InfoHash == torrentA.InfoHash {
+			require.Equal(t, versioned.ReleaseName, lt.ReleaseName)
+			listedA = true
+		}
+	}
+	require.True(t, listedA, "[%s] Torrent not listed", ts.Name())
+	require.NoError(t, ts.Delete(autoTorrent.InfoHash, true))
+
+	// Soft deleted torrents are hidden from normal lookups
+	disabledTorrent := GenerateTestTorrent()
+	require.NoError(t, ts.Add(disabledTorrent))
+	require.NoError(t, ts.Delete(disabledTorrent.InfoHash, false), "[%s] Failed to soft delete torrent", ts.Name())
+	var disabled Torrent
+	require.Equal(t, consts.ErrInvalidInfoHash, ts.Get(&disabled, disabledTorrent.InfoHash, false))
+	hashes := []InfoHash{torrentA.InfoHash, disabledTorrent.InfoHash, GenerateTestTorrent().InfoHash}
+	many, errMany := ts.GetMany(hashes, false)
+	require.NoError(t, errMany)
+	require.Len(t, many, 1, "[%s] Invalid torrents fetched", ts.Name())
+	require.Equal(t, versioned.ReleaseName, many[torrentA.InfoHash].ReleaseName)
+	withDeleted, errMany := ts.GetMany(hashes, true)
+	require.NoError(t, errMany)
+	require.Len(t, withDeleted, 2, "[%s] Deleted torrent not fetched", ts.Name())
+	require.True(t, withDeleted[disabledTorrent.InfoHash].IsDeleted)
+	require.NoError(t, ts.Delete(disabledTorrent.InfoHash, true))
+
 	require.NoError(t, ts.Delete(torrentA.InfoHash, true))
 	var deletedTorrent Torrent
 	require.Equal(t, consts.ErrInvalidInfoHash, ts.Get(&deletedTorrent, torrentA.InfoHash, false))
+	torrentCountDeleted, err0 := ts.Count()
+	require.NoError(t, err0)
+	require.Equal(t, torrentCount, torrentCountDeleted, "[%s] Deleted torrent counted", ts.Name())
 	wlClients := []WhiteListClient{
 		{ClientPrefix: "UT", ClientName: "uTorrent"},
-		{ClientPrefix: "qT", ClientName: "QBittorrent"},
+		{ClientPrefix: "qT", ClientName: "QBittorrent", MinVersion: "4.5.0"},
+		{ClientPrefix: "-UT35??-", ClientName: "uTorrent", MatchType: MatchGlob},
 	}
 	for _, c := range wlClients {
 		require.NoError(t, ts.WhiteListAdd(c))
@@ -173,9 +339,86 @@ func TestTorrentStore(t *testing.T, ts TorrentStore) {
 	clients, err3 := ts.WhiteListGetAll()
 	require.NoError(t, err3)
 	require.Equal(t, len(wlClients), len(clients))
+	for _, c := range clients {
+		if c.ClientPrefix == "qT" {
+			require.Equal(t, "4.5.0", c.MinVersion, "[%s] Min version not stored", ts.Name())
+		}
+		if c.ClientPrefix == "-UT35??-" {
+			require.Equal(t, MatchGlob, c.MatchType, "[%s] Match type not stored", ts.Name())
+		}
+	}
 	require.NoError(t, ts.WhiteListDelete(wlClients[0]))
 	clientsUpdated, _ := ts.WhiteListGetAll()
 	require.Equal(t, len(wlClients)-1, len(clientsUpdated))
+
+	denied := DenyListInfoHash{InfoHash: GenerateTestTorrent().InfoHash, Reason: "takedown"}
+	require.NoError(t, ts.DenyListAdd(denied))
+	deniedAll, err4 := ts.DenyListGetAll()
+	require.NoError(t, err4)
+	require.Equal(t, []DenyListInfoHash{denied}, deniedAll)
+	require.NoError(t, ts.DenyListDelete(denied.InfoHash))
+	deniedUpdated, _ := ts.DenyListGetAll()
+	require.Empty(t, deniedUpdated)
+
+	allowed := TorrentAllowedUser{InfoHash: GenerateTestTorrent().InfoHash, UserID: 42}
+	require.NoError(t, ts.AllowedUserAdd(allowed))
+	allowedAll, errAllowed := ts.AllowedUsersGetAll()
+	require.NoError(t, errAllowed)
+	require.Equal(t, []TorrentAllowedUser{allowed}, allowedAll)
+	require.NoError(t, ts.AllowedUserDelete(allowed))
+	require.Equal(t, consts.ErrInvalidUser, ts.AllowedUserDelete(allowed))
+	allowedUpdated, _ := ts.AllowedUsersGetAll()
+	require.Empty(t, allowedUpdated)
+
+	require.NoError(t, ts.ConfigSet("tracker_max_peers", "25"))
+	require.NoError(t, ts.ConfigSet("tracker_max_peers", "75"))
+	require.NoError(t, ts.ConfigSet("tracker_auto_register", "true"))
+	configValues, errCfg := ts.ConfigGetAll()
+	require.NoError(t, errCfg)
+	require.Equal(t, map[string]string{"tracker_max_peers": "75", "tracker_auto_register": "true"}, configValues)
+
+	require.NoError(t, ts.MetricsSet(map[string]int64{"t_ann_delayed": 10, "t_geo_cache_hits": 5}))
+	require.NoError(t, ts.MetricsSet(map[string]int64{"t_ann_delayed": 20}))
+	metricValues, errMetrics := ts.MetricsGetAll()
+	require.NoError(t, errMetrics)
+	require.Equal(t, map[string]int64{"t_ann_delayed": 20, "t_geo_cache_hits": 5}, metricValues)
+
+	// Pages must be stable and ordered so that walking the pages returns every entry once
+	var deniedAdded []DenyListInfoHash
+	for i := 0; i < 7; i++ {
+		entry := DenyListInfoHash{InfoHash: GenerateTestTorrent().InfoHash, Reason: fmt.Sprintf("%d", i)}
+		require.NoError(t, ts.DenyListAdd(entry))
+		deniedAdded = append(deniedAdded, entry)
+		wl := WhiteListClient{ClientPrefix: fmt.Sprintf("-P%d", 7-i), ClientName: "paged"}
+		require.NoError(t, ts.WhiteListAdd(wl))
+	}
+	expectedDenied, _ := DenyListPage(deniedAdded, 0, len(deniedAdded))
+	var deniedPaged []DenyListInfoHash
+	for offset := 0; offset < len(deniedAdded); offset += 3 {
+		page, total, err := ts.DenyListPage(offset, 3)
+		require.NoError(t, err)
+		require.Equal(t, len(deniedAdded), total)
+		deniedPaged = append(deniedPaged, page...)
+	}
+	require.Equal(t, expectedDenied, deniedPaged)
+	emptyPage, totalDenied, err5 := ts.DenyListPage(len(deniedAdded), 3)
+	require.NoError(t, err5)
+	require.Empty(t, emptyPage)
+	require.Equal(t, len(deniedAdded), totalDenied)
+
+	allClients, _ := ts.WhiteListGetAll()
+	expectedClients, _ := WhiteListPage(allClients, 0, len(allClients))
+	var clientsPaged []WhiteListClient
+	for offset := 0; offset < len(allClients); offset += 3 {
+		page, total, err := ts.WhiteListPage(offset, 3)
+		require.NoError(t, err)
+		require.Equal(t, len(allClients), total)
+		clientsPaged = append(clientsPaged, page...)
+	}
+	require.Equal(t, expectedClients, clientsPaged)
+	for i := 1; i < len(clientsPaged); i++ {
+		require.True(t, clientsPaged[i-1].ClientPrefix < clientsPaged[i].ClientPrefix)
+	}
 }
 
 // TestUserStore tests the user store for conformance to our interface
@@ -187,19 +430,34 @@ func TestUserStore(t *testing.T, s UserStore) {
 	if users == nil {
 		t.Fatalf("[%s] Failed to setup users", s.Name())
 	}
+	users[0].Class = "vip"
+	users[0].MultiUp = 1.5
+	users[0].MultiDn = 0.5
+	require.NoError(t, s.Ping())
+	userCount, err0 := s.Count()
+	require.NoError(t, err0)
 	require.NoError(t, s.Add(users[0]))
+	userCountAdded, err0 := s.Count()
+	require.NoError(t, err0)
+	require.Equal(t, userCount+1, userCountAdded, "[%s] Invalid user count", s.Name())
 	var fetchedUserID User
 	var fetchedUserPasskey User
 	require.NoError(t, s.GetByID(&fetchedUserID, users[0].UserID))
 	require.Equal(t, users[0], fetchedUserID)
 	require.NoError(t, s.GetByPasskey(&fetchedUserPasskey, users[0].Passkey))
 	require.Equal(t, users[0], fetchedUserPasskey)
+	var unknown User
+	require.True(t, errors.Is(s.GetByPasskey(&unknown, GenerateTestUser().Passkey), consts.ErrInvalidUser),
+		"[%s] Unknown passkey not reported as invalid user", s.Name())
+	require.True(t, errors.Is(s.GetByID(&unknown, 4000000000), consts.ErrInvalidUser),
+		"[%s] Unknown user_id not reported as invalid user", s.Name())
 
 	batchUpdate := map[string]UserStats{
 		users[0].Passkey: {
 			Uploaded:   1000,
 			Downloaded: 2000,
 			Announces:  10,
+			Bonus:      1.5,
 		},
 	}
 	require.NoError(t, s.Sync(batchUpdate))
@@ -209,6 +467,60 @@ func TestUserStore(t *testing.T, s UserStore) {
 	require.Equal(t, uint64(1000)+users[0].Uploaded, updatedUser.Uploaded)
 	require.Equal(t, uint64(2000)+users[0].Downloaded, updatedUser.Downloaded)
 	require.Equal(t, uint32(10)+users[0].Announces, updatedUser.Announces)
+	require.InDelta(t, 1.5+users[0].Bonus, updatedUser.Bonus, 0.0001)
+
+	// Concurrent adjustments must all be applied
+	var wg sync.WaitGroup
+	adjustErrs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(up int64) {
+			defer wg.Done()
+			adjustErrs <- s.AdjustUser(users[0].UserID, up, -10)
+		}(int64(100 - 150*(i%2)))
+	}
+	wg.Wait()
+	close(adjustErrs)
+	for err := range adjustErrs {
+		require.NoError(t, err, "[%s] Failed to adjust user", s.Name())
+	}
+	var adjustedUser User
+	require.NoError(t, s.GetByID(&adjustedUser, users[0].UserID))
+	require.Equal(t, updatedUser.Uploaded+500, adjustedUser.Uploaded, "[%s] Adjustments lost", s.Name())
+	require.Equal(t, updatedUser.Downloaded-200, adjustedUser.Downloaded, "[%s] Adjustments lost", s.Name())
+	require.NoError(t, s.AdjustUser(users[0].UserID, -int64(adjustedUser.Uploaded)-1000, 0))
+	require.NoError(t, s.GetByID(&adjustedUser, users[0].UserID))
+	require.Equal(t, uint64(0), adjustedUser.Uploaded, "[%s] Total not clamped at zero", s.Name())
+	// Adjustments which leave the totals unchanged still find the user
+	require.NoError(t, s.AdjustUser(users[0].UserID, -1000, 0), "[%s] Unchanged user not found", s.Name())
+	require.Equal(t, consts.ErrInvalidUser, s.AdjustUser(4000000000, 100, 0))
+
+	// Hit and runs are replaced when recorded again and kept per torrent
+	hnrA := HNR{UserID: users[0].UserID, InfoHash: GenerateTestTorrent().InfoHash, SeedTime: 60,
+		CreatedOn: time.Now().Truncate(time.Second)}
+	hnrB := HNR{UserID: users[0].UserID, InfoHash: GenerateTestTorrent().InfoHash, SeedTime: 0,
+		CreatedOn: time.Now().Truncate(time.Second)}
+	require.NoError(t, s.HNRAdd(hnrA))
+	require.NoError(t, s.HNRAdd(hnrB))
+	hnrA.SeedTime = 120
+	require.NoError(t, s.HNRAdd(hnrA))
+	hnrs, err := s.HNRGetByUser(users[0].UserID)
+	require.NoError(t, err)
+	require.Len(t, hnrs, 2, "[%s] Invalid hnr count", s.Name())
+	for _, hnr := range hnrs {
+		expected := hnrB
+		if hnr.InfoHash == hnrA.InfoHash {
+			expected = hnrA
+		}
+		require.Equal(t, expected.SeedTime, hnr.SeedTime)
+		require.True(t, expected.CreatedOn.Equal(hnr.CreatedOn), "[%s] Invalid hnr created_on", s.Name())
+	}
+	require.NoError(t, s.HNRDelete(users[0].UserID, hnrA.InfoHash))
+	require.NoError(t, s.HNRDelete(users[0].UserID, hnrA.InfoHash), "[%s] Deleting missing hnr failed", s.Name())
+	hnrs, err = s.HNRGetByUser(users[0].UserID)
+	require.NoError(t, err)
+	require.Len(t, hnrs, 1)
+	require.Equal(t, hnrB.InfoHash, hnrs[0].InfoHash)
 
 	newUser := GenerateTestUser()
 	require.NoError(t, s.Update(newUser, users[0].Passkey))
@@ -221,6 +533,7 @@ func TestUserStore(t *testing.T, s UserStore) {
 	require.Equal(t, newUser.Downloaded, fetchedNewUser.Downloaded)
 	require.Equal(t, newUser.Uploaded, fetchedNewUser.Uploaded)
 	require.Equal(t, newUser.Announces, fetchedNewUser.Announces)
+	require.Equal(t, newUser.Bonus, fetchedNewUser.Bonus)
 }
 
 func init() {
@@ -0,0 +1,170 @@
+// Package storetest provides a shared conformance and benchmark suite which can be run against
+// any of the store drivers. This lets each backend assert that it behaves identically to the
+// others, and compare their performance using the same set of operations.
+//
+// The driver used by NewStoresFromEnv is selected with the MIKA_TEST_STORE environment
+// variable, eg: MIKA_TEST_STORE=redis go test -bench . ./store/storetest
+package storetest
+
+import (
+	"fmt"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/store"
+	"os"
+	"testing"
+)
+
+// EnvDriver is the environment variable used to select the store driver under test
+const EnvDriver = "MIKA_TEST_STORE"
+
+// Stores is the set of stores the suites are run against
+type Stores struct {
+	Torrents store.TorrentStore
+	Peers    store.PeerStore
+	Users    store.UserStore
+}
+
+// NewStoresFunc returns a new set of stores. It is called for each test or benchmark so
+// implementations should return stores without any existing data in them.
+type NewStoresFunc func(tb testing.TB) Stores
+
+// Driver returns the name of the driver selected via EnvDriver, defaulting to memory
+func Driver() string {
+	if name := os.Getenv(EnvDriver); name != "" {
+		return name
+	}
+	return "memory"
+}
+
+// NewStoresFromEnv opens each store with the driver returned from Driver using the currently
+// loaded store configs. Drivers must be registered by importing their package first.
+func NewStoresFromEnv(tb testing.TB) Stores {
+	driver := Driver()
+	ts, err := store.NewTorrentStore(driver, config.GetStoreConfig(config.Torrent))
+	if err != nil {
+		tb.Fatalf("Failed to open %s torrent store: %s", driver, err)
+	}
+	ps, err := store.NewPeerStore(driver, config.GetStoreConfig(config.Peers))
+	if err != nil {
+		tb.Fatalf("Failed to open %s peer store: %s", driver, err)
+	}
+	us, err := store.NewUserStore(driver, config.GetStoreConfig(config.Users))
+	if err != nil {
+		tb.Fatalf("Failed to open %s user store: %s", driver, err)
+	}
+	return Stores{Torrents: ts, Peers: ps, Users: us}
+}
+
+// RunConformance runs the store conformance tests against the stores returned by newStores
+func RunConformance(t *testing.T, newStores NewStoresFunc) {
+	t.Run("Torrents", func(t *testing.T) {
+		store.TestTorrentStore(t, newStores(t).Torrents)
+	})
+	t.Run("Users", func(t *testing.T) {
+		store.TestUserStore(t, newStores(t).Users)
+	})
+	t.Run("Peers", func(t *testing.T) {
+		s := newStores(t)
+		store.TestPeerStore(t, s.Peers, s.Torrents, s.Users)
+	})
+}
+
+// RunBenchmarks runs the common store operations as sub benchmarks against the stores
+// returned by newStores
+func RunBenchmarks(b *testing.B, newStores NewStoresFunc) {
+	b.Run("TorrentAdd", func(b *testing.B) {
+		ts := newStores(b).Torrents
+		torrents := make([]store.Torrent, b.N)
+		for i := range torrents {
+			torrents[i] = store.GenerateTestTorrent()
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := ts.Add(torrents[i]); err != nil {
+				b.Fatalf("Failed to add torrent: %s", err)
+			}
+		}
+	})
+	b.Run("TorrentGet", func(b *testing.B) {
+		ts := newStores(b).Torrents
+		torrent := store.GenerateTestTorrent()
+		if err := ts.Add(torrent); err != nil {
+			b.Fatalf("Failed to add torrent: %s", err)
+		}
+		var t store.Torrent
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := ts.Get(&t, torrent.InfoHash, false); err != nil {
+				b.Fatalf("Failed to get torrent: %s", err)
+			}
+		}
+	})
+	b.Run("TorrentSync", func(b *testing.B) {
+		ts := newStores(b).Torrents
+		batch := make(map[store.InfoHash]store.TorrentStats)
+		for i := 0; i < 100; i++ {
+			torrent := store.GenerateTestTorrent()
+			if err := ts.Add(torrent); err != nil {
+				b.Fatalf("Failed to add torrent: %s", err)
+			}
+			batch[torrent.InfoHash] = store.TorrentStats{Uploaded: 1000, Downloaded: 1000, Announces: 1}
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := ts.Sync(batch); err != nil {
+				b.Fatalf("Failed to sync torrents: %s", err)
+			}
+		}
+	})
+	b.Run("UserGetByPasskey", func(b *testing.B) {
+		us := newStores(b).Users
+		user := store.GenerateTestUser()
+		if err := us.Add(user); err != nil {
+			b.Fatalf("Failed to add user: %s", err)
+		}
+		var u store.User
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := us.GetByPasskey(&u, user.Passkey); err != nil {
+				b.Fatalf("Failed to get user: %s", err)
+			}
+		}
+	})
+	b.Run("PeerAdd", func(b *testing.B) {
+		s := newStores(b)
+		torrent := store.GenerateTestTorrent()
+		if err := s.Torrents.Add(torrent); err != nil {
+			b.Fatalf("Failed to add torrent: %s", err)
+		}
+		peers := make([]store.Peer, b.N)
+		for i := range peers {
+			peers[i] = store.GenerateTestPeer()
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := s.Peers.Add(torrent.InfoHash, peers[i]); err != nil {
+				b.Fatalf("Failed to add peer: %s", err)
+			}
+		}
+	})
+	for _, swarmSize := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("PeerGetN/%d", swarmSize), func(b *testing.B) {
+			s := newStores(b)
+			torrent := store.GenerateTestTorrent()
+			if err := s.Torrents.Add(torrent); err != nil {
+				b.Fatalf("Failed to add torrent: %s", err)
+			}
+			for i := 0; i < swarmSize; i++ {
+				if err := s.Peers.Add(torrent.InfoHash, store.GenerateTestPeer()); err != nil {
+					b.Fatalf("Failed to add peer: %s", err)
+				}
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.Peers.GetN(torrent.InfoHash, 50); err != nil {
+					b.Fatalf("Failed to get peers: %s", err)
+				}
+			}
+		})
+	}
+}
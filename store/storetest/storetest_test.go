@@ -0,0 +1,31 @@
+package storetest
+
+import (
+	"github.com/leighmacdonald/mika/config"
+	_ "github.com/leighmacdonald/mika/store/memory"
+	_ "github.com/leighmacdonald/mika/store/mysql"
+	_ "github.com/leighmacdonald/mika/store/postgres"
+	_ "github.com/leighmacdonald/mika/store/redis"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"testing"
+)
+
+func TestConformance(t *testing.T) {
+	RunConformance(t, NewStoresFromEnv)
+}
+
+func BenchmarkStores(b *testing.B) {
+	RunBenchmarks(b, NewStoresFromEnv)
+}
+
+func TestMain(m *testing.M) {
+	if driver := Driver(); driver != "memory" {
+		if err := config.Read("mika_testing_" + driver); err != nil {
+			log.Infof("Skipping %s store tests, failed to find config: mika_testing_%s.yaml", driver, driver)
+			os.Exit(0)
+			return
+		}
+	}
+	os.Exit(m.Run())
+}
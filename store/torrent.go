@@ -1,6 +1,7 @@
 package store
 
 import (
+	"bytes"
 	"database/sql/driver"
 	"encoding/hex"
 	"errors"
@@ -8,6 +9,8 @@ import (
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/util"
 	log "github.com/sirupsen/logrus"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -126,7 +129,11 @@ func (ih *InfoHash) RawString() string {
 // Torrent is the core struct for our torrent being tracked
 type Torrent struct {
 	InfoHash InfoHash `db:"info_hash" json:"info_hash"`
-	Snatches uint16   `db:"total_completed" json:"total_completed"`
+	// ReleaseName is the display name of the torrent
+	ReleaseName string `db:"release_name" json:"release_name"`
+	// Size is the total size of the torrents files in bytes, 0 when unknown
+	Size     uint64 `db:"size" json:"size"`
+	Snatches uint16 `db:"total_completed" json:"total_completed"`
 	// This is stored as MB to reduce storage costs
 	Uploaded uint64 `db:"total_uploaded" json:"total_uploaded"`
 	// This is stored as MB to reduce storage costs
@@ -140,21 +147,42 @@ type Torrent struct {
 	// Upload multiplier added to the users totals
 	MultiUp float64 `db:"multi_up" json:"multi_up"`
 	// Download multiplier added to the users totals
-	// 0 denotes freeleech status
-	MultiDn   float64 `db:"multi_dn" json:"multi_dn"`
-	Announces uint64  `db:"announces" json:"announces"`
-	Seeders   int     `db:"seeders" json:"seeders"`
-	Leechers  int     `db:"leechers" json:"leechers"`
+	MultiDn float64 `db:"multi_dn" json:"multi_dn"`
+	// Freeleech torrents do not count downloads towards the users totals regardless of MultiDn
+	Freeleech bool   `db:"freeleech" json:"freeleech"`
+	Announces uint64 `db:"announces" json:"announces"`
+	Seeders   int    `db:"seeders" json:"seeders"`
+	Leechers  int    `db:"leechers" json:"leechers"`
+	// MaxPeers when non-zero overrides the trackers global limit on peers returned in
+	// announces for this torrent
+	MaxPeers int `db:"max_peers" json:"max_peers"`
+	// Restricted torrents only accept announces from their allowed users. A restricted
+	// torrent with no allowed users is closed to everyone
+	Restricted bool `db:"restricted" json:"restricted"`
+	// AutoRegistered is set for torrents added by an announce when auto registration is enabled
+	// rather than by staff
+	AutoRegistered bool `db:"auto_registered" json:"auto_registered"`
+	// AnnouncedOn is the last time announce stats were synced for the torrent, or when it was
+	// added if it has never been announced
+	AnnouncedOn time.Time `db:"announced_on" json:"announced_on"`
+	// Version is incremented on each Update call. Updates made against a stale version
+	// are rejected with consts.ErrConflict
+	Version uint32 `db:"version" json:"version"`
 }
 
 type TorrentUpdate struct {
 	Keys        []string
 	ReleaseName string  `json:"release_name"`
+	Size        uint64  `json:"size"`
 	IsDeleted   bool    `json:"is_deleted"`
 	IsEnabled   bool    `json:"is_enabled"`
 	Reason      string  `json:"reason"`
 	MultiUp     float64 `json:"multi_up"`
 	MultiDn     float64 `json:"multi_dn"`
+	Freeleech   bool    `json:"freeleech"`
+	MaxPeers    int     `json:"max_peers"`
+	Restricted  bool    `json:"restricted"`
+	Version     uint32  `json:"version"`
 }
 
 // TorrentStats is used to relay info stats for a torrent around. It contains rolled up stats
@@ -173,6 +201,7 @@ type UserStats struct {
 	Uploaded   uint64
 	Downloaded uint64
 	Announces  uint32
+	Bonus      float64
 }
 
 type AnnounceHist struct {
@@ -183,7 +212,7 @@ type AnnounceHist struct {
 
 // PeerStats is any info to batch peer updates
 type PeerStats struct {
-	Left   uint32
+	Left   uint64
 	Hist   []AnnounceHist
 	Paused bool
 }
@@ -232,6 +261,15 @@ func NewTorrent(ih InfoHash) Torrent {
 	return torrent
 }
 
+// DownloadMultiplier returns the multiplier applied to downloads before they are added to
+// the users totals
+func (t Torrent) DownloadMultiplier() float64 {
+	if t.Freeleech {
+		return 0
+	}
+	return t.MultiDn
+}
+
 // Torrents is a basic type alias for multiple torrents
 type Torrents []Torrent
 
@@ -241,9 +279,163 @@ type Torrents []Torrent
 type WhiteListClient struct {
 	ClientPrefix string `db:"client_prefix" json:"client_prefix"`
 	ClientName   string `db:"client_name" json:"client_name"`
+	// MinVersion is the oldest allowed client version as a dotted version string. Clients
+	// whose version cannot be read from their peer id are rejected when set.
+	MinVersion string `db:"min_version" json:"min_version"`
+	// MatchType controls how ClientPrefix is compared to peer ids, one of MatchPrefix,
+	// MatchGlob or MatchRegex. Empty values match by prefix.
+	MatchType  string `db:"match_type" json:"match_type"`
+	pattern    *regexp.Regexp
+	minVersion *ClientVersion
+}
+
+// Whitelist match types
+const (
+	// MatchPrefix matches peer ids starting with the client prefix
+	MatchPrefix = "prefix"
+	// MatchGlob matches peer ids starting with the glob pattern, where ? matches any single
+	// character and * any run of characters, eg: -UT35??-
+	MatchGlob = "glob"
+	// MatchRegex matches peer ids against the regular expression, which must match the
+	// whole peer id
+	MatchRegex = "regex"
+)
+
+// Compile validates the match type and minimum version and returns a copy of the entry with
+// its glob or regex pattern compiled and minimum version parsed, so they are not parsed again
+// for every Match and VersionAllowed call
+func (wl WhiteListClient) Compile() (WhiteListClient, error) {
+	if wl.MinVersion != "" {
+		minVersion, err := ParseVersion(wl.MinVersion)
+		if err != nil {
+			return wl, err
+		}
+		wl.minVersion = &minVersion
+	}
+	var expr string
+	switch wl.MatchType {
+	case "", MatchPrefix:
+		return wl, nil
+	case MatchGlob:
+		expr = "^" + strings.NewReplacer(`\?`, ".", `\*`, ".*").Replace(regexp.QuoteMeta(wl.ClientPrefix))
+	case MatchRegex:
+		// Validated on its own first so unbalanced groups cannot escape the anchors
+		if _, err := regexp.Compile(wl.ClientPrefix); err != nil {
+			return wl, err
+		}
+		expr = "^(?:" + wl.ClientPrefix + ")$"
+	default:
+		return wl, fmt.Errorf("unknown match type: %s", wl.MatchType)
+	}
+	pattern, err := regexp.Compile(expr)
+	if err != nil {
+		return wl, err
+	}
+	wl.pattern = pattern
+	return wl, nil
+}
+
+// IsPattern returns true for glob and regex entries, which are not matched by prefix
+func (wl WhiteListClient) IsPattern() bool {
+	return wl.MatchType != "" && wl.MatchType != MatchPrefix
 }
 
-// Match returns true if the client matches this prefix
+// Match returns true if the client matches this prefix, glob or regex
 func (wl WhiteListClient) Match(client string) bool {
-	return strings.HasPrefix(client, wl.ClientPrefix)
+	if !wl.IsPattern() {
+		return strings.HasPrefix(client, wl.ClientPrefix)
+	}
+	if wl.pattern == nil {
+		compiled, err := wl.Compile()
+		if err != nil {
+			return false
+		}
+		wl = compiled
+	}
+	return wl.pattern.MatchString(client)
+}
+
+// VersionAllowed returns true if the client version encoded in the peer id meets the
+// minimum version
+func (wl WhiteListClient) VersionAllowed(pid PeerID) bool {
+	if wl.MinVersion == "" {
+		return true
+	}
+	minVersion := wl.minVersion
+	if minVersion == nil {
+		parsed, err := ParseVersion(wl.MinVersion)
+		if err != nil {
+			return false
+		}
+		minVersion = &parsed
+	}
+	version, ok := ParseClientVersion(pid)
+	return ok && version.Compare(*minVersion) >= 0
+}
+
+// DenyListInfoHash defines a info_hash which is not allowed to be tracked, such as in
+// response to a takedown request. Reason is only used for staff records and is not sent
+// to clients.
+type DenyListInfoHash struct {
+	InfoHash InfoHash `db:"info_hash" json:"info_hash"`
+	Reason   string   `db:"reason" json:"reason"`
+}
+
+// TorrentAllowedUser grants a user access to a torrent. Torrents with allowed users, such as
+// staff only or early access releases, only accept announces from those users while torrents
+// without any are open to everyone.
+type TorrentAllowedUser struct {
+	InfoHash InfoHash `db:"info_hash" json:"info_hash"`
+	UserID   uint32   `db:"user_id" json:"user_id"`
+}
+
+// pageBounds clamps the offset and limit to the total number of entries available
+func pageBounds(offset int, limit int, total int) (int, int) {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if limit >= 0 && offset+limit < total {
+		end = offset + limit
+	}
+	return offset, end
+}
+
+// WhiteListPage sorts the whitelist by client prefix and returns the requested page of entries
+// along with the total number of entries. This is used by stores which cannot paginate natively.
+func WhiteListPage(wl []WhiteListClient, offset int, limit int) ([]WhiteListClient, int) {
+	sorted := make([]WhiteListClient, len(wl))
+	copy(sorted, wl)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ClientPrefix < sorted[j].ClientPrefix
+	})
+	start, end := pageBounds(offset, limit, len(sorted))
+	return sorted[start:end], len(sorted)
+}
+
+// TorrentPage sorts the torrents by info_hash and returns the requested page. This is used by
+// stores which cannot paginate natively.
+func TorrentPage(torrents []Torrent, offset int, limit int) []Torrent {
+	sorted := make([]Torrent, len(torrents))
+	copy(sorted, torrents)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].InfoHash[:], sorted[j].InfoHash[:]) < 0
+	})
+	start, end := pageBounds(offset, limit, len(sorted))
+	return sorted[start:end]
+}
+
+// DenyListPage sorts the denylist by info_hash and returns the requested page of entries
+// along with the total number of entries. This is used by stores which cannot paginate natively.
+func DenyListPage(dl []DenyListInfoHash, offset int, limit int) ([]DenyListInfoHash, int) {
+	sorted := make([]DenyListInfoHash, len(dl))
+	copy(sorted, dl)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].InfoHash[:], sorted[j].InfoHash[:]) < 0
+	})
+	start, end := pageBounds(offset, limit, len(sorted))
+	return sorted[start:end], len(sorted)
 }
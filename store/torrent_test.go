@@ -2,6 +2,7 @@ package store
 
 import (
 	"github.com/stretchr/testify/require"
+	"strings"
 	"testing"
 )
 
@@ -14,4 +15,55 @@ func TestInfoHash(t *testing.T) {
 	require.NoError(t, InfoHashFromHex(&ih1, hexEncoded))
 	require.Equal(t, hexEncoded, ih1.String())
 	require.Equal(t, bytes, ih1.Bytes())
+	// Hex of any case decodes to the same info_hash, which is always formatted as lowercase
+	var ih2 InfoHash
+	require.NoError(t, InfoHashFromHex(&ih2, strings.ToUpper(hexEncoded)))
+	require.Equal(t, ih1, ih2)
+	require.Equal(t, hexEncoded, ih2.String())
+}
+
+func TestTorrent_DownloadMultiplier(t *testing.T) {
+	tor := NewTorrent(InfoHash{})
+	tor.MultiDn = 0.5
+	require.Equal(t, 0.5, tor.DownloadMultiplier())
+	tor.Freeleech = true
+	require.Equal(t, 0.0, tor.DownloadMultiplier())
+	tor.MultiDn = 0
+	tor.Freeleech = false
+	require.Equal(t, 0.0, tor.DownloadMultiplier())
+}
+
+func TestWhiteListClientMatch(t *testing.T) {
+	prefix := WhiteListClient{ClientPrefix: "-UT35"}
+	require.True(t, prefix.Match("-UT3550-abcdefghijkl"))
+	require.False(t, prefix.Match("-UT3450-abcdefghijkl"))
+
+	glob, err := WhiteListClient{ClientPrefix: "-UT35??-", MatchType: MatchGlob}.Compile()
+	require.NoError(t, err)
+	require.True(t, glob.Match("-UT3550-abcdefghijkl"))
+	require.True(t, glob.Match("-UT35B0-abcdefghijkl"))
+	require.False(t, glob.Match("-UT355-abcdefghijklm"))
+	require.False(t, glob.Match("x-UT3550-abcdefghijk"), "Glob not anchored")
+
+	star, err := WhiteListClient{ClientPrefix: "-qB*-", MatchType: MatchGlob}.Compile()
+	require.NoError(t, err)
+	require.True(t, star.Match("-qB4170-abcdefghijkl"))
+
+	re, err := WhiteListClient{ClientPrefix: `-TR(29|30)\d0-.*`, MatchType: MatchRegex}.Compile()
+	require.NoError(t, err)
+	require.True(t, re.Match("-TR2940-abcdefghijkl"))
+	require.False(t, re.Match("-TR2840-abcdefghijkl"))
+	// Uncompiled entries still match, compiling on demand
+	require.True(t, WhiteListClient{ClientPrefix: "-TR29.*", MatchType: MatchRegex}.Match("-TR2940-abcdefghijkl"))
+	require.False(t, WhiteListClient{ClientPrefix: "-TR29", MatchType: MatchRegex}.Match("-TR2940-abcdefghijkl"),
+		"Regex not anchored")
+	require.False(t, WhiteListClient{ClientPrefix: "-TR29.*|", MatchType: MatchRegex}.Match("x-TR2940-abcdefghijk"),
+		"Regex alternation not anchored")
+
+	_, err = WhiteListClient{ClientPrefix: "-TR(", MatchType: MatchRegex}.Compile()
+	require.Error(t, err)
+	_, err = WhiteListClient{ClientPrefix: "-TR)|(.*", MatchType: MatchRegex}.Compile()
+	require.Error(t, err)
+	_, err = WhiteListClient{ClientPrefix: "-TR", MatchType: "suffix"}.Compile()
+	require.Error(t, err)
 }
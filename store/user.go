@@ -1,5 +1,12 @@
 package store
 
+import (
+	"bytes"
+	"math"
+	"sort"
+	"time"
+)
+
 // User defines a basic user known to the tracker
 // All users are considered enabled if they exist. You must remove them from the
 // backing store to ensure they cannot access any resources
@@ -11,6 +18,16 @@ type User struct {
 	Downloaded      uint64 `json:"downloaded"`
 	Uploaded        uint64 `json:"uploaded"`
 	Announces       uint32 `json:"announces"`
+	// Bonus is the accrued seeding bonus point balance
+	Bonus float64 `json:"bonus"`
+	// Class is the user class or role on the site, eg: vip. Classes can be given their own
+	// upload and download multipliers.
+	Class string `db:"class" json:"class"`
+	// MultiUp and MultiDn are the users own upload and download multipliers, eg: 2.0 for
+	// bonus upload credit. They stack with the torrent and class multipliers. 0 is unset and
+	// treated as 1.
+	MultiUp float64 `db:"multi_up" json:"multi_up"`
+	MultiDn float64 `db:"multi_dn" json:"multi_dn"`
 }
 
 // Valid performs basic validation of the user info ensuring we have the minimum required
@@ -19,6 +36,51 @@ func (u User) Valid() bool {
 	return u.Passkey != "" && !u.IsDeleted
 }
 
+// UploadMultiplier returns the users own upload multiplier. Users without one, such as users
+// stored before multipliers existed or public tracker users, earn the normal credit.
+func (u User) UploadMultiplier() float64 {
+	if u.MultiUp == 0 {
+		return 1
+	}
+	return u.MultiUp
+}
+
+// DownloadMultiplier returns the users own download multiplier, treating an unset multiplier
+// as 1 like UploadMultiplier
+func (u User) DownloadMultiplier() float64 {
+	if u.MultiDn == 0 {
+		return 1
+	}
+	return u.MultiDn
+}
+
+// Ratio returns the users upload to download ratio. Users who have not downloaded anything
+// have an infinite ratio.
+func (u User) Ratio() float64 {
+	if u.Downloaded == 0 {
+		return math.Inf(1)
+	}
+	return float64(u.Uploaded) / float64(u.Downloaded)
+}
+
+// HNR is a hit and run, recorded when a user downloads from a torrent then leaves its swarm
+// without having seeded it for the configured threshold
+type HNR struct {
+	UserID   uint32   `db:"user_id" json:"user_id"`
+	InfoHash InfoHash `db:"info_hash" json:"info_hash"`
+	// SeedTime is the number of seconds the torrent was seeded before leaving
+	SeedTime uint32 `db:"seed_time" json:"seed_time"`
+	// CreatedOn is when the user left the swarm
+	CreatedOn time.Time `db:"created_on" json:"created_on"`
+}
+
+// SortHNRs orders hit and runs by info_hash. This is used by stores which cannot sort natively.
+func SortHNRs(hnrs []HNR) {
+	sort.Slice(hnrs, func(i, j int) bool {
+		return bytes.Compare(hnrs[i].InfoHash[:], hnrs[j].InfoHash[:]) < 0
+	})
+}
+
 // Users is a slice of known users
 type Users []User
 
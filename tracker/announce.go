@@ -1,7 +1,6 @@
 package tracker
 
 import (
-	"bytes"
 	"github.com/chihaya/bencode"
 	"github.com/gin-gonic/gin"
 	"github.com/leighmacdonald/mika/consts"
@@ -9,7 +8,10 @@ import (
 	"github.com/leighmacdonald/mika/store"
 	"github.com/leighmacdonald/mika/util"
 	log "github.com/sirupsen/logrus"
+	"math/rand"
 	"net"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 )
@@ -20,27 +22,33 @@ type BitTorrentHandler struct {
 	tracker *Tracker
 }
 
-// Represents an announce received from the bittorrent client
+// defaultNumWant is the number of peers requested by clients which don't send numwant. It is
+// still capped by the max peers of the torrent.
+const defaultNumWant = 50
+
+// AnnounceRequest represents an announce received from the bittorrent client
 //
 // TODO use gin binding func?
-type announceRequest struct {
-	Compact bool // Force compact always?
+type AnnounceRequest struct {
+	// Optional. Setting compact=0 requests the original dictionary model peer list. Compact
+	// peers are sent when it is missing.
+	Compact bool
 
 	// The total amount downloaded (since the client sent the 'started' event to the tracker) in
 	// base ten ASCII. While not explicitly stated in the official specification, the consensus is that
 	// this should be the total number of bytes downloaded.
-	Downloaded uint32
+	Downloaded uint64
 
 	// The number of bytes this peer still has to download, encoded in base ten ascii.
 	// Note that this can't be computed from downloaded and the file length since it
 	// might be a resume, and there's a chance that some of the downloaded data failed an
 	// integrity check and had to be re-downloaded.
-	Left uint32
+	Left uint64
 
 	// The total amount uploaded (since the client sent the 'started' event to the tracker) in base ten
 	// ASCII. While not explicitly stated in the official specification, the consensus is that this should
 	// be the total number of bytes uploaded.
-	Uploaded uint32
+	Uploaded uint64
 
 	Corrupt uint32
 
@@ -97,8 +105,8 @@ type announceRequest struct {
 	CryptoLevel consts.CryptoLevel
 }
 
-// Parse the query string into an announceRequest struct
-func (h *BitTorrentHandler) newAnnounce(c *gin.Context) (*announceRequest, errCode) {
+// Parse the query string into an AnnounceRequest struct
+func (h *BitTorrentHandler) newAnnounce(c *gin.Context) (*AnnounceRequest, errCode) {
 	q, err := queryStringParser(c.Request.URL.RawQuery)
 	if err != nil {
 		return nil, msgMalformedRequest
@@ -108,25 +116,42 @@ func (h *BitTorrentHandler) newAnnounce(c *gin.Context) (*announceRequest, errCo
 		return nil, msgInvalidInfoHash
 	}
 	var infoHash store.InfoHash
-	if err := store.InfoHashFromString(&infoHash, infoHashStr); err != nil {
+	if err := h.tracker.parseInfoHash(&infoHash, infoHashStr); err != nil {
 		log.Warnf("Got malformed info_hash: %s", infoHashStr)
 		return nil, msgInvalidInfoHash
 	}
+	// A missing peer_id is left empty to be matched to a known peer when enabled
 	peerID, exists := q.Params[paramPeerID]
-	if !exists || len(peerID) != 20 {
+	if (exists || h.tracker.PeerIDMatch == peerIDMatchNone) && len(peerID) != 20 {
 		return nil, msgInvalidPeerID
 	}
-	ipAddr, ipv6, err2 := getIP(q, h.tracker.AllowClientIP, c)
+	ipAddr, ipv6, err2 := h.tracker.getIP(q, c)
+	if err2 == errIPMismatch {
+		log.Warnf("Client ip %s does not match connection: %s", ipAddr, c.Request.RemoteAddr)
+		return nil, msgIPMismatch
+	}
 	if err2 != nil {
 		log.Errorf("Failed to parse client ip: %s", c.Request.RemoteAddr)
 		return nil, msgMalformedRequest
 	}
+	if h.tracker.IPv6Only && !ipv6 {
+		return nil, msgIPv6Only
+	}
 	if !h.tracker.AllowNonRoutable && util.IsPrivateIP(ipAddr) {
 		log.Warnf("Attempt to use non-routable IP value: %s", ipAddr.String())
 		return nil, msgMalformedRequest
 	}
-	port := getUint16Key(q, paramPort, 0)
-	if port < 1024 {
+	port, err3 := q.Uint16(paramPort)
+	if err3 != nil && err3 != consts.ErrInvalidMapKey {
+		return nil, msgInvalidPort
+	}
+	if port == 0 {
+		// Peers without a port are not connectable, so they are never sent to other
+		// peers. Optionally let the client know its announce is useless.
+		if h.tracker.RejectMissingPort {
+			return nil, msgMissingPort
+		}
+	} else if port < 1024 {
 		// Don't allow privileged ports which require root to bind to on unix
 		return nil, msgInvalidPort
 	}
@@ -136,60 +161,147 @@ func (h *BitTorrentHandler) newAnnounce(c *gin.Context) (*announceRequest, errCo
 	} else if getBoolKey(q, paramSupportCrypto, false) {
 		cryptoLevel = consts.Supported
 	}
-	return &announceRequest{
-		Compact:     true, // Ignored and always set to true
+	return &AnnounceRequest{
+		Compact:     getBoolKey(q, paramCompact, true),
 		Corrupt:     getUint32Key(q, paramCorrupt, 0),
-		Downloaded:  getUint32Key(q, paramDownloaded, 0),
+		Downloaded:  getUint64Key(q, paramDownloaded, 0),
 		Event:       consts.ParseAnnounceType(q.Params[paramEvent]),
 		IPv6:        ipv6,
 		IP:          ipAddr,
 		InfoHash:    infoHash,
-		Left:        getUint32Key(q, paramLeft, 0),
-		NumWant:     getUintKey(q, paramNumWant, 30),
+		Left:        getUint64Key(q, paramLeft, 0),
+		NumWant:     getUintKey(q, paramNumWant, defaultNumWant),
 		PeerID:      store.PeerIDFromString(peerID),
 		Port:        port,
 		Key:         q.Params[paramKey],
-		Uploaded:    getUint32Key(q, paramUploaded, 0),
+		Uploaded:    getUint64Key(q, paramUploaded, 0),
 		CryptoLevel: cryptoLevel,
 	}, msgOk
 }
 
+// announceDelay returns a random delay between AnnounceJitterMin and AnnounceJitterMax when
+// the passkey and IP have already announced the torrent within the minimum announce interval.
+// Clients announcing many different torrents at once are not delayed.
+func (t *Tracker) announceDelay(pk string, ip net.IP, ih store.InfoHash) time.Duration {
+	if t.AnnounceJitterMax <= 0 {
+		return 0
+	}
+	now := time.Now()
+	rapid := false
+	t.lastAnnounce.Update(pk+"|"+ip.String()+"|"+string(ih[:]), func(value interface{}, found bool) interface{} {
+		rapid = found && now.Sub(value.(time.Time)) < t.AnnIntervalMin
+		return now
+	})
+	if !rapid {
+		return 0
+	}
+	delay := t.AnnounceJitterMin
+	if spread := t.AnnounceJitterMax - t.AnnounceJitterMin; spread > 0 {
+		delay += time.Duration(rand.Int63n(int64(spread) + 1))
+	}
+	return delay
+}
+
 // The meaty bits.
-// NOTE we ONLY support compact response formats (binary format) by design even though its
-// technically breaking the protocol specs.
-// There is no reason to support the older less efficient model for private needs
+// NOTE the dictionary model peer list is only sent to clients which explicitly ask for it
+// with compact=0, everyone else gets the more efficient compact format.
 func (h *BitTorrentHandler) announce(c *gin.Context) {
 	// Check that the user is valid before parsing anything
 	start := time.Now()
 	atomic.AddInt64(&metrics.AnnounceTotal, 1)
-	pk := c.Param("passkey")
+	// Reject oversized requests before doing any work parsing them. The 414 is always sent,
+	// even when FailureStatusOK is enabled, so proxies and clients see a real HTTP error.
+	if h.tracker.MaxURLLength > 0 && len(c.Request.URL.Path)+len(c.Request.URL.RawQuery)+1 > h.tracker.MaxURLLength {
+		log.Debugf("Request URI too long from: %s", h.tracker.clientIP(c))
+		c.Data(int(msgRequestURITooLong), gin.MIMEPlain, responseError(Err(msgRequestURITooLong).Error()))
+		atomic.AddInt64(&metrics.AnnounceStatusMalformed, 1)
+		return
+	}
+	pk := h.tracker.passkey(c)
 	var usr store.User
 	if valid := h.tracker.preFlightChecks(&usr, pk, c); !valid {
-		oops(c, msgInvalidAuth)
+		// The response has already been sent
 		atomic.AddInt64(&metrics.AnnounceStatusUnauthorized, 1)
 		return
 	}
-	// Parse the announce into an announceRequest
+	// Throttle abusive clients. Passkeys are only used once validated so clients can't get a
+	// fresh bucket for each request by making up passkeys.
+	limitKey := pk
+	if h.tracker.Public {
+		limitKey = h.tracker.clientIP(c)
+	}
+	if h.tracker.rateLimited(limitKey) {
+		oops(c, msgClientRequestTooFast)
+		atomic.AddInt64(&metrics.AnnounceStatusRateLimited, 1)
+		return
+	}
+	// Parse the announce into an AnnounceRequest
 	req, code := h.newAnnounce(c)
 	if code != msgOk {
 		oops(c, code)
 		atomic.AddInt64(&metrics.AnnounceStatusMalformed, 1)
 		return
 	}
-	if !h.tracker.ClientWhitelisted(req.PeerID) {
-		oops(c, msgBadClient)
-		return
-	}
 	if pk == "" && h.tracker.Public {
 		// Use client key to track user stats for public mode
 		pk = req.Key
 	}
+	if req.PeerID == (store.PeerID{}) {
+		pid, found := h.tracker.matchPeerID(pk, req)
+		if !found {
+			oops(c, msgInvalidPeerID)
+			atomic.AddInt64(&metrics.AnnounceStatusMalformed, 1)
+			return
+		}
+		req.PeerID = pid
+	}
+	if !h.tracker.ClientWhitelisted(req.PeerID) {
+		deny(c, msgBadClient, h.tracker.ClientReason)
+		return
+	}
+	// Denied info_hashes are checked first so they can never be auto registered
+	if h.tracker.InfoHashDenied(req.InfoHash) {
+		log.Debugf("Announce for denied info_hash: %x", req.InfoHash.Bytes())
+		deny(c, msgInvalidInfoHash, h.tracker.DenyListReason)
+		atomic.AddInt64(&metrics.AnnounceStatusInvalidInfoHash, 1)
+		return
+	}
+	if delay := h.tracker.announceDelay(pk, req.IP, req.InfoHash); delay > 0 {
+		atomic.AddInt64(&metrics.AnnounceDelayed, 1)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-c.Request.Context().Done():
+			timer.Stop()
+			return
+		}
+		// The delay is not counted as processing time
+		start = start.Add(delay)
+	}
+	// Shed load for hot torrents before touching the store
+	if !h.tracker.announceLimiter.acquire(req.InfoHash) {
+		log.Debugf("Concurrent announce limit reached: %x", req.InfoHash.Bytes())
+		c.Data(failureStatus(c, msgTorrentBusy), gin.MIMEPlain, responseRetry(Err(msgTorrentBusy).Error(), 1))
+		atomic.AddInt64(&metrics.AnnounceStatusBusy, 1)
+		return
+	}
+	defer h.tracker.announceLimiter.release(req.InfoHash)
+	if !h.tracker.storeAllowed(c) {
+		h.degradedAnnounce(c, req, pk, usr, store.Torrent{}, errBreakerOpen)
+		return
+	}
 	// Get & Validate the torrent associated with the info_hash supplies
 	var tor store.Torrent
 	if err := h.tracker.TorrentGet(&tor, req.InfoHash, false); err != nil || tor.IsDeleted {
-		if h.tracker.AutoRegister {
+		if h.tracker.storeUnavailable(err) {
+			h.degradedAnnounce(c, req, pk, usr, tor, err)
+			return
+		}
+		// Soft deleted torrents stay deleted until restored instead of being registered again
+		if h.tracker.AutoRegister && !tor.IsDeleted && !h.tracker.torrentDeleted(req.InfoHash) {
 			tor.InfoHash = req.InfoHash
 			tor.IsEnabled = true
+			tor.AutoRegistered = true
 			if err := h.tracker.TorrentAdd(tor); err != nil {
 				log.Errorf("Failed to auto register torrent: %s", err.Error())
 				oops(c, msgGenericError)
@@ -209,105 +321,561 @@ func (h *BitTorrentHandler) announce(c *gin.Context) {
 	// TODO send this as a "warning message" field of a normal announce response instead?
 	if !tor.IsEnabled && tor.Reason != "" {
 		log.Debugf("Torrent found but is disabled: %x", req.InfoHash.Bytes())
-		c.Data(int(msgInvalidInfoHash), gin.MIMEPlain, responseError(tor.Reason))
+		deny(c, msgInvalidInfoHash, tor.Reason)
+		return
+	}
+	if !h.tracker.UserAllowed(tor, usr.UserID) {
+		log.Debugf("User %d not allowed on restricted torrent: %x", usr.UserID, req.InfoHash.Bytes())
+		deny(c, msgAnnounceDenied, h.tracker.AllowedUsersReason)
 		return
 	}
-	var peer store.Peer
-	err := h.tracker.PeerGet(&peer, tor.InfoHash, req.PeerID)
+	// Clients can't have more left to download than the torrent contains
+	if tor.Size > 0 && req.Left > tor.Size {
+		log.Debugf("Clamping left (%d) to torrent size (%d): %x", req.Left, tor.Size, req.InfoHash.Bytes())
+		req.Left = tor.Size
+	}
+	allow, reason, err := h.tracker.runAnnounceHooks(*req, usr, tor)
+	if err != nil {
+		log.Errorf("Announce hook failed: %s", err.Error())
+		oops(c, msgGenericError)
+		return
+	}
+	if !allow {
+		log.Debugf("Announce denied by hook: %x %s", req.InfoHash.Bytes(), reason)
+		deny(c, msgAnnounceDenied, reason)
+		return
+	}
+	if req.Event == consts.COMPLETED && !h.tracker.completedAllowed(req, tor, usr, h.tracker.clientIP(c)) {
+		oops(c, msgImplausibleCompleted)
+		return
+	}
+	// Partial seeds (BEP 21) have all the pieces they want so they are counted as seeders
+	paused := req.Event == consts.PAUSED
+	var (
+		peer      store.Peer
+		joined    bool
+		wasPaused bool
+		prevLeft  uint64
+	)
+	peerID := h.tracker.swarmPeerID(usr.UserID, req.PeerID)
+	err = h.tracker.PeerGet(&peer, tor.InfoHash, peerID)
 	if err != nil {
 		if err == consts.ErrInvalidPeerID {
 			// Create a new peer for the swarm
-			peer = store.NewPeer(usr.UserID, req.PeerID, req.IP, req.Port)
+			peer = store.NewPeer(usr.UserID, peerID, req.IP, req.Port)
 			// Dont add download/upload stats because they would be doubled if applied in the
 			// state update. Left is set because its always a static value being set and a (safe) data race
 			// can occur for counting seeder/leecher states
 			peer.Client = store.ClientString(req.PeerID).String()
 			peer.Left = req.Left
+			peer.Paused = paused
+			joined = true
 			// TODO allow this to be updated in the perm storage when a client changes settings
 			peer.CryptoLevel = req.CryptoLevel
-			l := h.tracker.Geodb.GetLocation(peer.IP)
+			l := h.tracker.GeoLocation(peer.IP)
 			peer.Location = l.LatLong
 			peer.ASN = l.ASN
 			peer.AS = l.AS
 			peer.CountryCode = l.ISOCode
 			if err := h.tracker.PeerAdd(tor.InfoHash, peer); err != nil {
+				if h.tracker.storeUnavailable(err) {
+					h.degradedAnnounce(c, req, pk, usr, tor, err)
+					return
+				}
 				log.Errorf("Failed to insert peer into swarm: %s", err.Error())
 				oops(c, msgGenericError)
 				return
 			}
 		} else {
+			if h.tracker.storeUnavailable(err) {
+				h.degradedAnnounce(c, req, pk, usr, tor, err)
+				return
+			}
 			oops(c, msgGenericError)
 			return
 		}
 	} else {
+		expired := peer.Expired(time.Now().Add(-h.tracker.peerExpiry()))
+		if peer.UserID != usr.UserID && !expired &&
+			!h.tracker.duplicatePeerAllowed(tor.InfoHash, peer, usr, h.tracker.clientIP(c)) {
+			oops(c, msgDuplicatePeerID)
+			return
+		}
+		if req.Event == consts.STARTED && !expired {
+			// The peer is already counted in the swarm, so handling this as a new start would
+			// count it a second time
+			log.Warnf("Repeated started event from active peer: %s (%s)", peer.Client, req.PeerID.String())
+			atomic.AddInt64(&metrics.AnnounceRepeatedStarted, 1)
+			if h.tracker.IgnoreRepeatedStarted {
+				req.Event = consts.ANNOUNCE
+			}
+		}
+		wasPaused = peer.Paused
+		prevLeft = peer.Left
 		peer.AnnounceLast = time.Now()
 	}
-	peers, err2 := h.tracker.PeerGetN(tor.InfoHash, h.tracker.MaxPeers)
-	if err2 != nil {
-		log.Errorf("Could not read peers from swarm: %s", err2.Error())
+	complete, incomplete := tor.Seeders, tor.Leechers
+	// The full swarm, when already fetched for the counts, is reused for the peer list
+	var swarm store.Swarm
+	swarmFetched := false
+	if !h.tracker.StatsEnabled {
+		// Without the stat worker the swarm is updated here and is the only source of counts
+		if err := h.tracker.updateSwarm(tor.InfoHash, peer.PeerID, req.Left, req.Event, paused); err != nil {
+			log.Errorf("Failed to update swarm: %s", err.Error())
+		}
+		if s, err := h.tracker.PeerGetN(tor.InfoHash, 0); err == nil {
+			swarm, swarmFetched = s, true
+			complete, incomplete = swarmCounts(swarm)
+		}
+	}
+	// Partial seeds are still advertised to the swarm, but aren't downloading so there is no
+	// need to send them any peers. Stopping peers are leaving the swarm so they don't get any
+	// either, regardless of the numwant they sent.
+	peers := store.NewSwarm()
+	maxPeers := h.tracker.numWant(req.NumWant, tor)
+	if !paused && req.Event != consts.STOPPED && maxPeers > 0 {
+		preferLocal := h.tracker.PreferLocalPeers && peer.CountryCode != ""
+		// The announcing peer may be fetched, but is never sent back to itself
+		fetchPeers := maxPeers + 1
+		if req.Left == 0 && h.tracker.SeedersGetLeechersOnly {
+			// The seeders are filtered out after fetching, so enough are fetched to still fill
+			// the list with leechers
+			fetchPeers += complete
+		}
+		if preferLocal || swarmFetched {
+			// The whole swarm is needed to choose the local peers before truncating
+			fetchPeers = 0
+		}
+		for {
+			var err2 error
+			if swarmFetched {
+				peers = swarm
+			} else {
+				peers, err2 = h.tracker.PeerGetN(tor.InfoHash, fetchPeers)
+			}
+			if err2 != nil {
+				if h.tracker.storeUnavailable(err2) {
+					h.degradedAnnounce(c, req, pk, usr, tor, err2)
+					return
+				}
+				log.Errorf("Could not read peers from swarm: %s", err2.Error())
+				oops(c, msgGenericError)
+				return
+			}
+			fetched := peers.Len()
+			peers = h.filterPeers(peers, req, usr.UserID, peer.PeerID)
+			// When the filters leave too few peers from a partial swarm the whole swarm
+			// is fetched instead
+			if fetchPeers == 0 || fetched < fetchPeers || peers.Len() >= maxPeers {
+				break
+			}
+			fetchPeers = 0
+		}
+		if preferLocal {
+			peers = preferLocalPeers(peers, peer.CountryCode, maxPeers)
+		} else {
+			peers = limitPeers(peers, maxPeers)
+		}
+	}
+	h.tracker.storeBreaker.success()
+	interval, minInterval := h.tracker.jitterIntervals(h.tracker.announceInterval(usr.Class, complete+incomplete))
+	dict := bencode.Dict{
+		"complete":     complete,
+		"incomplete":   incomplete,
+		"interval":     int(interval.Seconds()),
+		"min interval": int(minInterval.Seconds()),
+	}
+	// Low ratio leechers stay in the swarm so their stats are accounted, but they are not
+	// given any peers to download from until they seed back above the minimum ratio
+	if req.Left > 0 && h.tracker.lowRatio(usr) {
+		peers = store.NewSwarm()
+		dict["warning message"] = h.tracker.LowRatioMessage
+		atomic.AddInt64(&metrics.AnnounceLowRatio, 1)
+	}
+	bufs := getAnnounceBuffers()
+	defer bufs.release()
+	h.tracker.setPeers(dict, bufs, peers, peer.PeerID, req)
+	bufs.out, err = h.tracker.encodeAnnounce(bufs.out, dict)
+	if err != nil {
 		oops(c, msgGenericError)
 		return
 	}
+	c.Data(int(msgOk), gin.MIMEPlain, bufs.out)
+	if h.tracker.PeerIDMatch != peerIDMatchNone {
+		h.tracker.rememberPeerID(pk, req)
+	}
+	if h.tracker.AnnounceHistorySize > 0 {
+		h.tracker.recordAnnounce(pk, req)
+	}
+	if h.tracker.StatsEnabled {
+		// Send state to another go channel for updating outside of the announce request
+		// so that we can respond asap
+		h.tracker.StateUpdateChan <- store.UpdateState{
+			Passkey:    pk,
+			UserID:     usr.UserID,
+			Class:      usr.Class,
+			MultiUp:    usr.UploadMultiplier(),
+			MultiDn:    usr.DownloadMultiplier(),
+			InfoHash:   tor.InfoHash,
+			PeerID:     peer.PeerID,
+			Uploaded:   req.Uploaded,
+			Downloaded: req.Downloaded,
+			Left:       req.Left,
+			Event:      req.Event,
+			Timestamp:  time.Now(),
+			Paused:     paused,
+			WasPaused:  wasPaused,
+			PrevLeft:   prevLeft,
+			Joined:     joined,
+		}
+	}
+	atomic.AddInt64(&metrics.AnnounceStatusOK, 1)
+	metrics.AddAnnounceTime(time.Since(start).Nanoseconds())
+}
+
+// degradedAnnounce responds to an announce made while the backing stores are unavailable. The
+// response is built from whatever cached data exists and uses a longer interval to avoid the
+// swarm immediately re-announcing. When enabled, the stats are still queued so they are
+// applied once the stores recover. Torrents which are not cached are asked to retry later.
+func (h *BitTorrentHandler) degradedAnnounce(c *gin.Context, req *AnnounceRequest, pk string, usr store.User, tor store.Torrent, err error) {
+	log.Warnf("Store unavailable, sending degraded announce response: %s", err.Error())
+	known := tor.InfoHash == req.InfoHash
+	if !known && h.tracker.TorrentsCache != nil {
+		known = h.tracker.TorrentsCache.Get(&tor, req.InfoHash)
+	}
+	if !known {
+		// Unknown torrents can't be validated until the store recovers
+		log.Debugf("Torrent not cached, rejecting degraded announce: %x", req.InfoHash.Bytes())
+		c.Data(failureStatus(c, msgStoreUnavailable), gin.MIMEPlain, responseRetry(Err(msgStoreUnavailable).Error(), 1))
+		return
+	}
+	if tor.IsDeleted {
+		log.Debugf("Cached torrent is deleted: %x", req.InfoHash.Bytes())
+		oops(c, msgInvalidInfoHash)
+		atomic.AddInt64(&metrics.AnnounceStatusInvalidInfoHash, 1)
+		return
+	}
+	if !tor.IsEnabled && tor.Reason != "" {
+		log.Debugf("Torrent found but is disabled: %x", req.InfoHash.Bytes())
+		deny(c, msgInvalidInfoHash, tor.Reason)
+		return
+	}
+	if !h.tracker.UserAllowed(tor, usr.UserID) {
+		log.Debugf("User %d not allowed on restricted torrent: %x", usr.UserID, req.InfoHash.Bytes())
+		deny(c, msgAnnounceDenied, h.tracker.AllowedUsersReason)
+		return
+	}
+	paused := req.Event == consts.PAUSED
+	peerID := h.tracker.swarmPeerID(usr.UserID, req.PeerID)
+	swarm := store.NewSwarm()
+	maxPeers := h.tracker.numWant(req.NumWant, tor)
+	if h.tracker.PeerCache != nil && !paused && req.Event != consts.STOPPED && maxPeers > 0 {
+		if cached, found := h.tracker.PeerCache.Swarm(req.InfoHash); found {
+			swarm = cached
+		}
+		swarm = limitPeers(h.filterPeers(swarm, req, usr.UserID, peerID), maxPeers)
+	}
+	interval := int(h.tracker.DegradedInterval.Seconds())
 	dict := bencode.Dict{
 		"complete":     tor.Seeders,
 		"incomplete":   tor.Leechers,
-		"interval":     int(h.tracker.AnnInterval.Seconds()),
-		"min interval": int(h.tracker.AnnIntervalMin.Seconds()),
-	}
-	// TODO IP.To16() != nil validation for v4 in v6 addresses
-	if !req.IPv6 || (req.IPv6 && !h.tracker.IPv6Only) {
-		dict["peers"] = makeCompactPeers(peers, peer.PeerID, false, req.CryptoLevel)
+		"interval":     interval,
+		"min interval": interval,
 	}
-	if req.IPv6 {
-		dict["peers6"] = makeCompactPeers(peers, peer.PeerID, true, req.CryptoLevel)
+	if req.Left > 0 && h.tracker.lowRatio(usr) {
+		swarm = store.NewSwarm()
+		dict["warning message"] = h.tracker.LowRatioMessage
 	}
-	var outBytes bytes.Buffer
-	if err := bencode.NewEncoder(&outBytes).Encode(dict); err != nil {
+	bufs := getAnnounceBuffers()
+	defer bufs.release()
+	h.tracker.setPeers(dict, bufs, swarm, peerID, req)
+	out, err := h.tracker.encodeAnnounce(bufs.out, dict)
+	if err != nil {
 		oops(c, msgGenericError)
 		return
 	}
-	c.Data(int(msgOk), gin.MIMEPlain, outBytes.Bytes())
-	// Send state to another go channel for updating outside of the announce request
-	// so that we can respond asap
-	h.tracker.StateUpdateChan <- store.UpdateState{
-		Passkey:    pk,
-		InfoHash:   tor.InfoHash,
-		PeerID:     peer.PeerID,
-		Uploaded:   uint64(req.Uploaded),
-		Downloaded: uint64(req.Downloaded),
-		Left:       req.Left,
-		Event:      req.Event,
-		Timestamp:  time.Now(),
-		Paused:     peer.Paused,
+	bufs.out = out
+	c.Data(int(msgOk), gin.MIMEPlain, out)
+	if h.tracker.StatsEnabled {
+		update := store.UpdateState{
+			Passkey:    pk,
+			UserID:     usr.UserID,
+			Class:      usr.Class,
+			MultiUp:    usr.UploadMultiplier(),
+			MultiDn:    usr.DownloadMultiplier(),
+			InfoHash:   req.InfoHash,
+			PeerID:     peerID,
+			Uploaded:   req.Uploaded,
+			Downloaded: req.Downloaded,
+			Left:       req.Left,
+			Event:      req.Event,
+			Timestamp:  time.Now(),
+			Paused:     paused,
+		}
+		// The store can't be asked for the state of the peer, so only a cached peer can be
+		// moved between seeding and leeching. A cached peer is already in the swarm, so it has
+		// not joined with this announce.
+		var peer store.Peer
+		if h.tracker.PeerCache != nil && h.tracker.PeerCache.Get(&peer, req.InfoHash, peerID) {
+			update.WasPaused = peer.Paused
+			update.PrevLeft = peer.Left
+		} else {
+			update.NoPrevState = true
+		}
+		h.tracker.StateUpdateChan <- update
+	}
+	atomic.AddInt64(&metrics.AnnounceStatusDegraded, 1)
+}
+
+// encodeAnnounce appends the bencoded announce response to b. Keys are always written in
+// sorted order. When NormalizeResponses is enabled both peer lists are always present and the
+// response is padded up to a multiple of ResponsePadSize bytes using a padding key, so that
+// responses differ as little as possible between swarms.
+func (t *Tracker) encodeAnnounce(b []byte, dict bencode.Dict) ([]byte, error) {
+	if t.NormalizeResponses {
+		keys := []string{"peers", "peers6"}
+		if t.IPv6Only {
+			keys = keys[1:]
+		}
+		for _, k := range keys {
+			if _, found := dict[k]; !found {
+				dict[k] = []byte{}
+			}
+		}
+		if t.ResponsePadSize > 0 {
+			unpadded, err := appendSortedDict(b, dict)
+			if err != nil {
+				return b, err
+			}
+			dict["padding"] = strings.Repeat(" ", padLength(len(unpadded)-len(b), t.ResponsePadSize))
+			b = unpadded[:len(b)]
+		}
+	}
+	return appendSortedDict(b, dict)
+}
+
+// padLength returns the length of the padding value required for a response of size bytes to
+// become a multiple of blockSize once the padding key and value are added. The length prefix
+// of the value is itself part of the response, so each possible prefix width is tried.
+func padLength(size int, blockSize int) int {
+	const keyLen = len("7:padding")
+	for digits := 1; ; digits++ {
+		padding := (blockSize - (size+keyLen+digits+1)%blockSize) % blockSize
+		for len(strconv.Itoa(padding)) < digits {
+			padding += blockSize
+		}
+		if len(strconv.Itoa(padding)) == digits {
+			return padding
+		}
 	}
-	atomic.AddInt64(&metrics.AnnounceStatusOK, 1)
-	metrics.AddAnnounceTime(time.Since(start).Nanoseconds())
 }
 
-// Generate a compact peer field array containing the byte representations
-// of a peers IP+Port appended to each other
-func makeCompactPeers(swarm store.Swarm, skipID store.PeerID, v6 bool, cl consts.CryptoLevel) []byte {
-	var buf bytes.Buffer
+// filterPeers removes the peers which must not be sent to the announcing peer
+func (h *BitTorrentHandler) filterPeers(swarm store.Swarm, req *AnnounceRequest, userID uint32, peerID store.PeerID) store.Swarm {
+	if req.Left == 0 && h.tracker.SeedersGetLeechersOnly {
+		swarm = leechers(swarm)
+	}
+	// Every user of a public tracker shares the same user id, so there are no own peers
+	if h.tracker.ExcludeOwnPeers && !h.tracker.Public {
+		swarm = withoutUser(swarm, userID)
+	}
+	return withoutPeer(swarm, peerID)
+}
+
+// leechers returns the peers of the swarm which are still downloading. Partial seeds are
+// excluded as they don't want any more pieces.
+func leechers(swarm store.Swarm) store.Swarm {
+	out := store.NewSwarm()
+	swarm.RLock()
+	for id, peer := range swarm.Peers {
+		if peer.Left > 0 && !peer.Paused {
+			out.Peers[id] = peer
+		}
+	}
+	swarm.RUnlock()
+	out.Leechers = len(out.Peers)
+	return out
+}
+
+// withoutUser returns the peers of the swarm which don't belong to the user
+func withoutUser(swarm store.Swarm, userID uint32) store.Swarm {
+	out := store.NewSwarm()
+	swarm.RLock()
+	for id, peer := range swarm.Peers {
+		if peer.UserID != userID {
+			out.Peers[id] = peer
+		}
+	}
+	swarm.RUnlock()
+	return out
+}
+
+// withoutPeer returns the swarm without the peer
+func withoutPeer(swarm store.Swarm, peerID store.PeerID) store.Swarm {
+	out := store.NewSwarm()
+	swarm.RLock()
+	for id, peer := range swarm.Peers {
+		if id != peerID {
+			out.Peers[id] = peer
+		}
+	}
+	swarm.RUnlock()
+	return out
+}
+
+// limitPeers returns up to max peers of the swarm
+func limitPeers(swarm store.Swarm, max int) store.Swarm {
+	swarm.RLock()
+	defer swarm.RUnlock()
+	if max <= 0 || len(swarm.Peers) <= max {
+		return swarm
+	}
+	out := store.NewSwarm()
+	for id, peer := range swarm.Peers {
+		if len(out.Peers) == max {
+			break
+		}
+		out.Peers[id] = peer
+	}
+	return out
+}
+
+// preferLocalPeers returns up to max peers of the swarm, taking the peers in the country
+// first and filling the remainder with peers from elsewhere
+func preferLocalPeers(swarm store.Swarm, country string, max int) store.Swarm {
+	swarm.RLock()
+	defer swarm.RUnlock()
+	if max <= 0 || len(swarm.Peers) <= max {
+		return swarm
+	}
+	out := store.NewSwarm()
+	for id, peer := range swarm.Peers {
+		if len(out.Peers) == max {
+			return out
+		}
+		if peer.CountryCode == country {
+			out.Peers[id] = peer
+		}
+	}
+	for id, peer := range swarm.Peers {
+		if len(out.Peers) == max {
+			break
+		}
+		if peer.CountryCode != country {
+			out.Peers[id] = peer
+		}
+	}
+	return out
+}
+
+// setPeers adds the peers for the client to the response. Clients which ask for compact=0 get
+// the dictionary model in peers, listing both address families they can use.
+func (t *Tracker) setPeers(dict bencode.Dict, bufs *announceBuffers, swarm store.Swarm, skipID store.PeerID, req *AnnounceRequest) {
+	v4 := !req.IPv6 || !t.IPv6Only
+	v6 := req.IPv6 && t.IPv6
+	if !req.Compact {
+		dict["peers"] = makeDictPeers(swarm, skipID, req.CryptoLevel, v4, v6)
+		return
+	}
+	if v4 {
+		bufs.peers = makeCompactPeers(bufs.peers, swarm, skipID, req.CryptoLevel)
+		dict["peers"] = t.compactPeersValue(bufs.peers, false)
+	}
+	if v6 {
+		bufs.peers6 = makeCompactPeers6(bufs.peers6, swarm, skipID, req.CryptoLevel)
+		dict["peers6"] = t.compactPeersValue(bufs.peers6, true)
+	}
+}
+
+// sendablePeer returns true if the peer can be sent to the client announcing as skipID
+// with the crypto level cl
+func sendablePeer(peer store.Peer, skipID store.PeerID, cl consts.CryptoLevel) bool {
+	if cl == consts.Required {
+		if !(peer.CryptoLevel == consts.Required || peer.CryptoLevel == consts.Supported) {
+			return false
+		}
+	}
+	if peer.PeerID == skipID {
+		// Skip the peers own peer_id
+		return false
+	}
+	// Skip peers that are not connectable
+	return peer.Port != 0
+}
+
+// makeDictPeers returns the peers in the original non compact form, a list of dicts with the
+// peer id, ip and port of each peer, limited to the requested address families
+func makeDictPeers(swarm store.Swarm, skipID store.PeerID, cl consts.CryptoLevel, v4 bool, v6 bool) bencode.List {
+	peers := bencode.List{}
 	swarm.RLock()
 	for _, peer := range swarm.Peers {
-		if cl == consts.Required {
-			if !(peer.CryptoLevel == consts.Required || peer.CryptoLevel == consts.Supported) {
+		if !sendablePeer(peer, skipID, cl) || peer.IP.To16() == nil {
+			continue
+		}
+		if isV4 := peer.IP.To4() != nil; (isV4 && !v4) || (!isV4 && !v6) {
+			continue
+		}
+		peers = append(peers, bencode.Dict{
+			"peer id": peer.PeerID.RawString(),
+			"ip":      peer.IP.String(),
+			"port":    peer.Port,
+		})
+	}
+	swarm.RUnlock()
+	return peers
+}
+
+// makeCompactPeers appends the 4 byte IP and 2 byte port of each ipv4 peer to dst
+func makeCompactPeers(dst []byte, swarm store.Swarm, skipID store.PeerID, cl consts.CryptoLevel) []byte {
+	return appendCompactPeers(dst, swarm, skipID, false, cl)
+}
+
+// makeCompactPeers6 appends the 16 byte IP and 2 byte port of each ipv6 peer to dst as
+// defined in BEP 7
+func makeCompactPeers6(dst []byte, swarm store.Swarm, skipID store.PeerID, cl consts.CryptoLevel) []byte {
+	return appendCompactPeers(dst, swarm, skipID, true, cl)
+}
+
+// appendCompactPeers appends the peers of a single address family to dst. The family is
+// taken from the address itself so ipv4 mapped addresses are sent as ipv4 peers.
+func appendCompactPeers(dst []byte, swarm store.Swarm, skipID store.PeerID, v6 bool, cl consts.CryptoLevel) []byte {
+	swarm.RLock()
+	for _, peer := range swarm.Peers {
+		if !sendablePeer(peer, skipID, cl) {
+			continue
+		}
+		ip := peer.IP.To4()
+		if v6 {
+			if ip != nil {
 				continue
 			}
+			ip = peer.IP.To16()
 		}
-		if peer.PeerID == skipID {
-			// Skip the peers own peer_id
+		if ip == nil {
+			// Peers without a valid address of this family
 			continue
 		}
-		if v6 && peer.IPv6 {
-			buf.Write(peer.IP.To16())
-			buf.Write([]byte{byte(peer.Port >> 8), byte(peer.Port & 0xff)})
-		} else if !v6 && !peer.IPv6 {
-			buf.Write(peer.IP.To4())
-			buf.Write([]byte{byte(peer.Port >> 8), byte(peer.Port & 0xff)})
-		}
-
+		dst = append(dst, ip...)
+		dst = append(dst, byte(peer.Port>>8), byte(peer.Port&0xff))
 	}
 	swarm.RUnlock()
-	return buf.Bytes()
+	return dst
+}
+
+// compactPeersValue returns the response value for compact peers. BEP 23 sends them as a
+// single byte string, CompactPeerList instead sends a list with a byte string for each peer
+// for the clients which expect that form.
+func (t *Tracker) compactPeersValue(compact []byte, v6 bool) interface{} {
+	if !t.CompactPeerList {
+		return compact
+	}
+	size := net.IPv4len + 2
+	if v6 {
+		size = net.IPv6len + 2
+	}
+	peers := make(bencode.List, 0, len(compact)/size)
+	for i := 0; i+size <= len(compact); i += size {
+		peers = append(peers, compact[i:i+size])
+	}
+	return peers
 }
@@ -0,0 +1,65 @@
+package tracker
+
+import (
+	"fmt"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newBenchSwarm(peers int) store.Swarm {
+	swarm := store.NewSwarm()
+	for i := 0; i < peers; i++ {
+		p := store.GenerateTestPeer()
+		p.Port = uint16(5000 + i)
+		swarm.Peers[p.PeerID] = p
+	}
+	return swarm
+}
+
+func BenchmarkMakeCompactPeers(b *testing.B) {
+	swarm := newBenchSwarm(50)
+	buf := make([]byte, 0, 512)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = makeCompactPeers(buf[:0], swarm, store.PeerID{}, consts.Supported)
+	}
+}
+
+func BenchmarkAnnounce(b *testing.B) {
+	tkr, err := NewTestTracker()
+	if err != nil {
+		b.Fatal(err)
+	}
+	go tkr.StatWorker()
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	if err := tkr.torrents.Add(torrent0); err != nil {
+		b.Fatal(err)
+	}
+	if err := tkr.users.Add(user0); err != nil {
+		b.Fatal(err)
+	}
+	for _, p := range newBenchSwarm(50).Peers {
+		if err := tkr.peers.Add(torrent0.InfoHash, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+	req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+		Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+	u := fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, _ := http.NewRequest("GET", u, nil)
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, r)
+		if w.Code != int(msgOk) {
+			b.Fatalf("Announce failed: %d", w.Code)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package tracker
 
 import (
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
@@ -11,8 +12,13 @@ import (
 	"github.com/leighmacdonald/mika/store"
 	"github.com/leighmacdonald/mika/util"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -43,6 +49,30 @@ type PingResponse struct {
 	Pong string `json:"pong"`
 }
 
+// HealthResponse reports whether the tracker can reach its backing stores. Failed names the
+// stores which could not be reached.
+type HealthResponse struct {
+	Status string   `json:"status"`
+	Failed []string `json:"failed,omitempty"`
+}
+
+// TrackerStatsResponse holds the number of torrents, users and peers in the stores. The counts
+// are refreshed by the peer reaper so they may be up to one reaper interval old.
+type TrackerStatsResponse struct {
+	Torrents int64 `json:"torrents"`
+	Users    int64 `json:"users"`
+	Peers    int64 `json:"peers"`
+}
+
+// trackerStats responds with the store counts cached on the last reaper tick
+func (a *AdminAPI) trackerStats(c *gin.Context) {
+	c.JSON(http.StatusOK, TrackerStatsResponse{
+		Torrents: atomic.LoadInt64(&metrics.TorrentsTotal),
+		Users:    atomic.LoadInt64(&metrics.UsersTotal),
+		Peers:    atomic.LoadInt64(&metrics.PeersTotal),
+	})
+}
+
 func (a *AdminAPI) whitelistAdd(c *gin.Context) {
 	var wcl store.WhiteListClient
 	if err := c.BindJSON(&wcl); err != nil {
@@ -53,12 +83,24 @@ func (a *AdminAPI) whitelistAdd(c *gin.Context) {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
+	if wcl.MinVersion != "" {
+		if _, err := store.ParseVersion(wcl.MinVersion); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Invalid min_version"})
+			return
+		}
+	}
+	compiled, err := wcl.Compile()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: fmt.Sprintf("Invalid pattern: %s", err)})
+		return
+	}
 	if err := a.t.torrents.WhiteListAdd(wcl); err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 	}
-	a.t.Lock()
-	a.t.Whitelist[wcl.ClientPrefix] = wcl
-	a.t.Unlock()
+	a.t.WhitelistMu.Lock()
+	a.t.Whitelist[wcl.ClientPrefix] = compiled
+	a.t.setWhitelist(a.t.Whitelist)
+	a.t.WhitelistMu.Unlock()
 	c.JSON(http.StatusOK, nil)
 }
 
@@ -68,38 +110,276 @@ func (a *AdminAPI) whitelistDelete(c *gin.Context) {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	a.t.RLock()
-	defer a.t.RUnlock()
+	a.t.WhitelistMu.RLock()
 	wlc := a.t.Whitelist[prefix]
+	a.t.WhitelistMu.RUnlock()
 	if err := a.t.torrents.WhiteListDelete(wlc); err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-	newWL := make(map[string]store.WhiteListClient)
 	wl, err := a.t.torrents.WhiteListGetAll()
 	if err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-	for _, w := range wl {
-		newWL[w.ClientPrefix] = w
-	}
-	a.t.Lock()
-	a.t.Whitelist = newWL
-	a.t.Unlock()
+	newWL := newWhitelist(wl)
+	a.t.WhitelistMu.Lock()
+	a.t.setWhitelist(newWL)
+	a.t.WhitelistMu.Unlock()
 	c.JSON(http.StatusOK, nil)
 }
 
+// WhitelistReloadResponse is returned after reloading the whitelist from the backing store
+type WhitelistReloadResponse struct {
+	Count int `json:"count"`
+}
+
+// whitelistReload rebuilds the in-memory whitelist from the backing store. This is useful
+// when the whitelist has been modified out of band, directly in the store.
+func (a *AdminAPI) whitelistReload(c *gin.Context) {
+	wl, err := a.t.torrents.WhiteListGetAll()
+	if err != nil {
+		log.Errorf("Failed to reload whitelist: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to reload whitelist"})
+		return
+	}
+	newWL := newWhitelist(wl)
+	a.t.WhitelistMu.Lock()
+	a.t.setWhitelist(newWL)
+	a.t.WhitelistMu.Unlock()
+	c.JSON(http.StatusOK, WhitelistReloadResponse{Count: len(newWL)})
+}
+
+const (
+	defaultPageLimit    = 100
+	defaultMaxPageLimit = 1000
+)
+
+// pageFromCtx parses the optional offset & limit query parameters used for paginated
+// list endpoints. Limits over MaxPageLimit are clamped to it, the cap is sent in the
+// X-Max-Limit header.
+func (a *AdminAPI) pageFromCtx(c *gin.Context) (int, int, bool) {
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Invalid offset"})
+		return 0, 0, false
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageLimit)))
+	if err != nil || limit <= 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Invalid limit"})
+		return 0, 0, false
+	}
+	maxLimit := a.t.MaxPageLimit
+	if maxLimit <= 0 {
+		maxLimit = defaultMaxPageLimit
+	}
+	c.Header("X-Max-Limit", strconv.Itoa(maxLimit))
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return offset, limit, true
+}
+
+// whitelistGet responds with a page of whitelisted clients. The response is a plain array
+// as it was before paging was added, with the total number of whitelisted clients sent in
+// the X-Total-Count header.
 func (a *AdminAPI) whitelistGet(c *gin.Context) {
-	var wl []store.WhiteListClient
-	a.t.RLock()
-	defer a.t.RUnlock()
-	for _, c := range a.t.Whitelist {
-		wl = append(wl, c)
+	offset, limit, ok := a.pageFromCtx(c)
+	if !ok {
+		return
 	}
+	wl, total, err := a.t.torrents.WhiteListPage(offset, limit)
+	if err != nil {
+		log.Errorf("Failed to fetch whitelist: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch whitelist"})
+		return
+	}
+	if wl == nil {
+		wl = []store.WhiteListClient{}
+	}
+	c.Header("X-Total-Count", strconv.Itoa(total))
 	c.JSON(http.StatusOK, wl)
 }
 
+// DenyListEntry represents a JSON info_hash denylist entry. The info_hash is hex encoded.
+type DenyListEntry struct {
+	InfoHash string `json:"info_hash"`
+	Reason   string `json:"reason"`
+}
+
+func (a *AdminAPI) denyListAdd(c *gin.Context) {
+	var req DenyListEntry
+	if err := c.BindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Malformed request"})
+		return
+	}
+	var ih store.InfoHash
+	if err := store.InfoHashFromHex(&ih, req.InfoHash); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: err.Error()})
+		return
+	}
+	entry := store.DenyListInfoHash{InfoHash: ih, Reason: req.Reason}
+	if err := a.t.torrents.DenyListAdd(entry); err != nil {
+		log.Errorf("Failed to add denylist entry: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to add denylist entry"})
+		return
+	}
+	a.t.DenyListMu.Lock()
+	a.t.DenyList[ih] = entry
+	a.t.DenyListMu.Unlock()
+	c.JSON(http.StatusOK, StatusResp{Message: "Info hash denied successfully"})
+}
+
+func (a *AdminAPI) denyListDelete(c *gin.Context) {
+	var ih store.InfoHash
+	if !infoHashFromCtx(&ih, c, true) {
+		return
+	}
+	if err := a.t.torrents.DenyListDelete(ih); err != nil {
+		if errors.Is(err, consts.ErrInvalidInfoHash) {
+			c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to delete denylist entry"})
+		return
+	}
+	a.t.DenyListMu.Lock()
+	delete(a.t.DenyList, ih)
+	a.t.DenyListMu.Unlock()
+	c.JSON(http.StatusOK, StatusResp{Message: "Deleted successfully"})
+}
+
+// DenyListPageResponse is a page of denied info_hashes along with the total number of
+// denied info_hashes
+type DenyListPageResponse struct {
+	Total   int             `json:"total"`
+	Results []DenyListEntry `json:"results"`
+}
+
+func (a *AdminAPI) denyListGet(c *gin.Context) {
+	offset, limit, ok := a.pageFromCtx(c)
+	if !ok {
+		return
+	}
+	entries, total, err := a.t.torrents.DenyListPage(offset, limit)
+	if err != nil {
+		log.Errorf("Failed to fetch denylist: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch denylist"})
+		return
+	}
+	dl := make([]DenyListEntry, len(entries))
+	for i, entry := range entries {
+		dl[i] = DenyListEntry{InfoHash: entry.InfoHash.String(), Reason: entry.Reason}
+	}
+	c.JSON(http.StatusOK, DenyListPageResponse{Total: total, Results: dl})
+}
+
+// ActivePeer is the public representation of a peer active in a swarm
+type ActivePeer struct {
+	InfoHash string `json:"info_hash"`
+	PeerID   string `json:"peer_id"`
+	UserID   uint32 `json:"user_id"`
+	// IP is empty when peer IPs are redacted
+	IP           string    `json:"ip,omitempty"`
+	IPv6         bool      `json:"ipv6"`
+	Seeder       bool      `json:"seeder"`
+	SpeedUP      uint32    `json:"speed_up"`
+	SpeedDN      uint32    `json:"speed_dn"`
+	AnnounceLast time.Time `json:"announce_last"`
+}
+
+// ActivePeersResponse is a page of active peers along with the total number of active peers
+type ActivePeersResponse struct {
+	Total   int          `json:"total"`
+	Results []ActivePeer `json:"results"`
+}
+
+func (a *AdminAPI) peersActive(c *gin.Context) {
+	offset, limit, ok := a.pageFromCtx(c)
+	if !ok {
+		return
+	}
+	peers, total, err := a.t.peers.GetActive(offset, limit)
+	if err != nil {
+		log.Errorf("Failed to fetch active peers: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch active peers"})
+		return
+	}
+	results := make([]ActivePeer, len(peers))
+	for i, p := range peers {
+		results[i] = ActivePeer{
+			InfoHash:     p.InfoHash.String(),
+			PeerID:       p.PeerID.String(),
+			UserID:       p.UserID,
+			IPv6:         p.IP.To4() == nil,
+			Seeder:       p.Left == 0,
+			SpeedUP:      p.SpeedUP,
+			SpeedDN:      p.SpeedDN,
+			AnnounceLast: p.AnnounceLast,
+		}
+		if !a.t.RedactPeerIPs {
+			results[i].IP = p.IP.String()
+		}
+	}
+	c.JSON(http.StatusOK, ActivePeersResponse{Total: total, Results: results})
+}
+
+// clientOther is the client name used for peer ids not matching any whitelist prefix
+const clientOther = "other"
+
+// activePeersPageSize is the number of active peers read from the store at a time when
+// building the client breakdown or the top torrents metrics
+const activePeersPageSize = 1000
+
+// ClientStat is the number of active peers using a client and their share of all active peers
+type ClientStat struct {
+	Client string `json:"client"`
+	Count  int    `json:"count"`
+	// Share is the percentage of active peers using the client
+	Share float64 `json:"share"`
+}
+
+// ClientStatsResponse is the breakdown of active peers by client, ordered by count descending
+type ClientStatsResponse struct {
+	Total   int          `json:"total"`
+	Clients []ClientStat `json:"clients"`
+}
+
+func (a *AdminAPI) clientStats(c *gin.Context) {
+	counts := make(map[string]int)
+	total := 0
+	for offset := 0; ; offset += activePeersPageSize {
+		peers, count, err := a.t.peers.GetActive(offset, activePeersPageSize)
+		if err != nil {
+			log.Errorf("Failed to fetch active peers: %s", err.Error())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch active peers"})
+			return
+		}
+		for _, p := range peers {
+			counts[a.t.ClientName(p.PeerID)]++
+		}
+		total += len(peers)
+		if len(peers) == 0 || offset+len(peers) >= count {
+			break
+		}
+	}
+	resp := ClientStatsResponse{Total: total, Clients: []ClientStat{}}
+	for client, count := range counts {
+		resp.Clients = append(resp.Clients, ClientStat{
+			Client: client,
+			Count:  count,
+			Share:  float64(count) / float64(total) * 100,
+		})
+	}
+	sort.Slice(resp.Clients, func(i, j int) bool {
+		if resp.Clients[i].Count == resp.Clients[j].Count {
+			return resp.Clients[i].Client < resp.Clients[j].Client
+		}
+		return resp.Clients[i].Count > resp.Clients[j].Count
+	})
+	c.JSON(http.StatusOK, resp)
+}
+
 func (a *AdminAPI) ping(c *gin.Context) {
 	var r PingRequest
 	if err := c.BindJSON(&r); err != nil {
@@ -109,6 +389,32 @@ func (a *AdminAPI) ping(c *gin.Context) {
 	c.JSON(http.StatusOK, PingResponse{Pong: r.Ping})
 }
 
+// healthz pings the torrent and user stores and the peer store cache, responding with 503
+// when any of them is unreachable so the instance can be taken out of rotation
+func (a *AdminAPI) healthz(c *gin.Context) {
+	checks := []struct {
+		name string
+		ping func() error
+	}{
+		{"torrent_store", a.t.torrents.Ping},
+		{"user_store", a.t.users.Ping},
+		{"peer_store", a.t.peers.Ping},
+	}
+	resp := HealthResponse{Status: "ok"}
+	for _, check := range checks {
+		if err := check.ping(); err != nil {
+			log.Errorf("Health check failed for %s: %s", check.name, err)
+			resp.Failed = append(resp.Failed, check.name)
+		}
+	}
+	if len(resp.Failed) > 0 {
+		resp.Status = "unavailable"
+		c.JSON(http.StatusServiceUnavailable, resp)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
 func infoHashFromCtx(infoHash *store.InfoHash, c *gin.Context, hex bool) bool {
 	ihStr := c.Param("info_hash")
 	if ihStr == "" {
@@ -134,10 +440,13 @@ func infoHashFromCtx(infoHash *store.InfoHash, c *gin.Context, hex bool) bool {
 
 // TorrentAddRequest represents a JSON request for adding a new torrent
 type TorrentAddRequest struct {
-	Name     string  `json:"name"`
-	InfoHash string  `json:"info_hash"`
-	MultiUp  float64 `json:"multi_up"`
-	MultiDn  float64 `json:"multi_dn"`
+	Name      string  `json:"name"`
+	InfoHash  string  `json:"info_hash"`
+	MultiUp   float64 `json:"multi_up"`
+	MultiDn   float64 `json:"multi_dn"`
+	Freeleech bool    `json:"freeleech"`
+	// Size is the total size of the torrent in bytes, optional
+	Size uint64 `json:"size"`
 }
 
 func (a *AdminAPI) torrentAdd(c *gin.Context) {
@@ -153,16 +462,10 @@ func (a *AdminAPI) torrentAdd(c *gin.Context) {
 		return
 	}
 	t.InfoHash = ih
-	if req.MultiUp < 0 {
-		t.MultiUp = 0
-	} else {
-		t.MultiUp = req.MultiUp
-	}
-	if req.MultiDn < 0 {
-		t.MultiDn = 0
-	} else {
-		t.MultiDn = req.MultiDn
-	}
+	t.Size = req.Size
+	t.Freeleech = req.Freeleech
+	t.MultiUp = clampMultiplier(req.MultiUp)
+	t.MultiDn = clampMultiplier(req.MultiDn)
 	if err := a.t.torrents.Add(t); err != nil {
 		if errors.Is(err, consts.ErrDuplicate) {
 			c.AbortWithStatusJSON(http.StatusConflict, StatusResp{
@@ -176,18 +479,117 @@ func (a *AdminAPI) torrentAdd(c *gin.Context) {
 	c.JSON(http.StatusOK, StatusResp{Message: "Torrent added successfully"})
 }
 
+// torrentGet returns the current state of a torrent, including deleted torrents
+func (a *AdminAPI) torrentGet(c *gin.Context) {
+	var ih store.InfoHash
+	if !infoHashFromCtx(&ih, c, true) {
+		return
+	}
+	var tor store.Torrent
+	err := a.t.torrents.Get(&tor, ih, true)
+	if err == consts.ErrInvalidInfoHash {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "Torrent not found"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch torrent"})
+		return
+	}
+	c.JSON(http.StatusOK, tor)
+}
+
+// torrentList returns a page of torrents ordered by info_hash. The number of torrents
+// not marked as deleted is sent in the X-Total-Count header.
+func (a *AdminAPI) torrentList(c *gin.Context) {
+	offset, limit, ok := a.pageFromCtx(c)
+	if !ok {
+		return
+	}
+	total, err := a.t.torrents.Count()
+	if err != nil {
+		log.Errorf("Failed to count torrents: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch torrents"})
+		return
+	}
+	torrents, err := a.t.torrents.List(limit, offset)
+	if err != nil {
+		log.Errorf("Failed to list torrents: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch torrents"})
+		return
+	}
+	if torrents == nil {
+		torrents = []store.Torrent{}
+	}
+	c.Header("X-Total-Count", strconv.Itoa(total))
+	c.JSON(http.StatusOK, torrents)
+}
+
+// torrentDelete soft deletes the torrent, rejecting announces for it while keeping its stats
+// so it can be restored later. Deleted torrents are not auto registered again. Passing hard=1
+// permanently removes the torrent from the store, which cannot be undone. Before restores
+// were supported every delete was a hard delete.
 func (a *AdminAPI) torrentDelete(c *gin.Context) {
 	var infoHash store.InfoHash
 	if !infoHashFromCtx(&infoHash, c, true) {
 		return
 	}
-	if err := a.t.torrents.Delete(infoHash, true); err != nil {
+	hard := c.Query("hard") == "1"
+	if err := a.t.TorrentDelete(infoHash, hard); err != nil {
+		if errors.Is(err, consts.ErrInvalidInfoHash) {
+			c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: err.Error()})
+			return
+		}
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{})
 		return
 	}
+	a.audit(c, auditTorrentDelete, infoHash.String())
 	c.JSON(http.StatusOK, StatusResp{Message: "Deleted successfully"})
 }
 
+// torrentRestore un-deletes a soft deleted torrent so it is announced again. Hard deleted
+// torrents no longer exist and respond with a 404.
+func (a *AdminAPI) torrentRestore(c *gin.Context) {
+	var infoHash store.InfoHash
+	if !infoHashFromCtx(&infoHash, c, true) {
+		return
+	}
+	if err := a.t.TorrentRestore(infoHash); err != nil {
+		if errors.Is(err, consts.ErrInvalidInfoHash) {
+			c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: err.Error()})
+		return
+	}
+	a.audit(c, auditTorrentRestore, infoHash.String())
+	c.JSON(http.StatusOK, StatusResp{Message: "Restored successfully"})
+}
+
+// maxMultiplier is the largest multi_up or multi_dn accepted when updating a torrent or user
+const maxMultiplier = 100
+
+// clampMultiplier treats negative multipliers as 0 so they cannot subtract from user stats
+func clampMultiplier(multi float64) float64 {
+	if multi < 0 {
+		return 0
+	}
+	return multi
+}
+
+// userMultipliers clamps negative user multipliers, returning an error message if either
+// exceeds maxMultiplier
+func userMultipliers(user *store.User) string {
+	if user.MultiUp > maxMultiplier {
+		return fmt.Sprintf("multi_up cannot exceed %d", maxMultiplier)
+	}
+	if user.MultiDn > maxMultiplier {
+		return fmt.Sprintf("multi_dn cannot exceed %d", maxMultiplier)
+	}
+	user.MultiUp = clampMultiplier(user.MultiUp)
+	user.MultiDn = clampMultiplier(user.MultiDn)
+	return ""
+}
+
 // TorrentUpdatePrams defines what parameters we accept for updating a torrent. This is only
 // a subset of the fields as not all should be considered mutable
 type TorrentUpdatePrams struct {
@@ -196,7 +598,6 @@ type TorrentUpdatePrams struct {
 	Reason    string `json:"reason"`
 }
 
-// TODO ability to un-delete a torrent
 func (a *AdminAPI) torrentUpdate(c *gin.Context) {
 	var ih store.InfoHash
 	if !infoHashFromCtx(&ih, c, true) {
@@ -229,39 +630,328 @@ func (a *AdminAPI) torrentUpdate(c *gin.Context) {
 			t.IsEnabled = tup.IsEnabled
 		case "reason":
 			t.Reason = tup.Reason
+		case "release_name":
+			t.ReleaseName = tup.ReleaseName
+		case "size":
+			t.Size = tup.Size
 		case "multi_up":
-			t.MultiUp = tup.MultiUp
+			if tup.MultiUp > maxMultiplier {
+				c.JSON(http.StatusBadRequest, StatusResp{Err: fmt.Sprintf("multi_up cannot exceed %d", maxMultiplier)})
+				return
+			}
+			t.MultiUp = clampMultiplier(tup.MultiUp)
 		case "multi_dn":
-			t.MultiDn = tup.MultiDn
+			if tup.MultiDn > maxMultiplier {
+				c.JSON(http.StatusBadRequest, StatusResp{Err: fmt.Sprintf("multi_dn cannot exceed %d", maxMultiplier)})
+				return
+			}
+			t.MultiDn = clampMultiplier(tup.MultiDn)
+		case "freeleech":
+			t.Freeleech = tup.Freeleech
+		case "max_peers":
+			if tup.MaxPeers < 0 {
+				c.JSON(http.StatusBadRequest, StatusResp{Err: "max_peers cannot be negative"})
+				return
+			}
+			t.MaxPeers = tup.MaxPeers
+		case "restricted":
+			t.Restricted = tup.Restricted
+		case "version":
+			// Only apply the update if the torrent is unchanged since the client fetched it
+			t.Version = tup.Version
 		}
 	}
 	if err := a.t.torrents.Update(t); err != nil {
+		if errors.Is(err, consts.ErrConflict) {
+			c.JSON(http.StatusConflict, StatusResp{Err: err.Error()})
+			return
+		}
 		c.JSON(http.StatusBadRequest, StatusResp{Err: err.Error()})
 	} else {
+		if a.t.TorrentsCache != nil {
+			// Drop the cached copy so announces see the change, such as an un-deleted torrent
+			a.t.TorrentsCache.Delete(ih, true)
+		}
 		c.JSON(http.StatusOK, StatusResp{Message: "Updated successfully"})
 	}
 }
 
+// TorrentImpact describes the current activity on a torrent so the effect of changing its
+// multipliers can be judged before applying it
+type TorrentImpact struct {
+	InfoHash    string  `json:"info_hash"`
+	ReleaseName string  `json:"release_name"`
+	MultiUp     float64 `json:"multi_up"`
+	MultiDn     float64 `json:"multi_dn"`
+	Freeleech   bool    `json:"freeleech"`
+	Seeders     int     `json:"seeders"`
+	Leechers    int     `json:"leechers"`
+	// RecentAnnounces is the number of peers which announced within the last announce interval
+	RecentAnnounces int `json:"recent_announces"`
+	// AnnounceRate is the recent announces per minute
+	AnnounceRate float64 `json:"announce_rate"`
+	Uploaded     uint64  `json:"uploaded"`
+	Downloaded   uint64  `json:"downloaded"`
+	Snatches     uint16  `json:"snatches"`
+}
+
+func (a *AdminAPI) torrentImpact(c *gin.Context) {
+	var ih store.InfoHash
+	if !infoHashFromCtx(&ih, c, true) {
+		return
+	}
+	var tor store.Torrent
+	err := a.t.torrents.Get(&tor, ih, false)
+	if err == consts.ErrInvalidInfoHash {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "Torrent not found"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch torrent"})
+		return
+	}
+	impact := TorrentImpact{
+		InfoHash:    tor.InfoHash.String(),
+		ReleaseName: tor.ReleaseName,
+		MultiUp:     tor.MultiUp,
+		MultiDn:     tor.MultiDn,
+		Freeleech:   tor.Freeleech,
+		Uploaded:    tor.Uploaded,
+		Downloaded:  tor.Downloaded,
+		Snatches:    tor.Snatches,
+	}
+	swarm, err := a.t.PeerGetN(ih, 0)
+	if err != nil && err != consts.ErrInvalidTorrentID {
+		log.Errorf("Failed to fetch swarm: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch swarm"})
+		return
+	}
+	if err == nil {
+		// Counted from the swarm rather than the torrent which is only updated in batches
+		swarm.RLock()
+		window := a.t.announceInterval("", len(swarm.Peers))
+		for _, p := range swarm.Peers {
+			if p.Left == 0 {
+				impact.Seeders++
+			} else {
+				impact.Leechers++
+			}
+			if time.Since(p.AnnounceLast) <= window {
+				impact.RecentAnnounces++
+			}
+		}
+		swarm.RUnlock()
+		if window > 0 {
+			impact.AnnounceRate = float64(impact.RecentAnnounces) / window.Minutes()
+		}
+	}
+	c.JSON(http.StatusOK, impact)
+}
+
+// TorrentPeer is a peer in the swarm of a torrent
+type TorrentPeer struct {
+	PeerID string `json:"peer_id"`
+	UserID uint32 `json:"user_id"`
+	Client string `json:"client"`
+	// IP and Port are empty when peer IPs are redacted. IP is cut down to its network when
+	// masked.
+	IP           string    `json:"ip,omitempty"`
+	Port         uint16    `json:"port,omitempty"`
+	Uploaded     uint64    `json:"uploaded"`
+	Downloaded   uint64    `json:"downloaded"`
+	Left         uint64    `json:"left"`
+	SpeedUP      uint32    `json:"speed_up"`
+	SpeedDN      uint32    `json:"speed_dn"`
+	AnnounceLast time.Time `json:"announce_last"`
+}
+
+// TorrentPeersResponse is the swarm of a torrent, most recently announced peers first
+type TorrentPeersResponse struct {
+	InfoHash string        `json:"info_hash"`
+	Peers    []TorrentPeer `json:"peers"`
+}
+
+// maskIP returns the network of the ip, a /24 for ipv4 and /48 for ipv6, so peers can be told
+// apart by network without revealing their address
+func maskIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+func (a *AdminAPI) torrentPeers(c *gin.Context) {
+	var ih store.InfoHash
+	if !infoHashFromCtx(&ih, c, true) {
+		return
+	}
+	var tor store.Torrent
+	err := a.t.torrents.Get(&tor, ih, false)
+	if err == consts.ErrInvalidInfoHash {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "Torrent not found"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch torrent"})
+		return
+	}
+	mask := c.Query("mask_ips") == "1"
+	resp := TorrentPeersResponse{InfoHash: ih.String(), Peers: []TorrentPeer{}}
+	swarm, err := a.t.PeerGetN(ih, 0)
+	if err != nil && err != consts.ErrInvalidTorrentID {
+		log.Errorf("Failed to fetch swarm: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch swarm"})
+		return
+	}
+	if err == nil {
+		swarm.RLock()
+		for _, p := range swarm.Peers {
+			peer := TorrentPeer{
+				PeerID:       p.PeerID.String(),
+				UserID:       p.UserID,
+				Client:       p.Client,
+				Uploaded:     p.Uploaded,
+				Downloaded:   p.Downloaded,
+				Left:         p.Left,
+				SpeedUP:      p.SpeedUP,
+				SpeedDN:      p.SpeedDN,
+				AnnounceLast: p.AnnounceLast,
+			}
+			if !a.t.RedactPeerIPs {
+				peer.Port = p.Port
+				if mask {
+					peer.IP = maskIP(p.IP)
+				} else {
+					peer.IP = p.IP.String()
+				}
+			}
+			resp.Peers = append(resp.Peers, peer)
+		}
+		swarm.RUnlock()
+	}
+	sort.Slice(resp.Peers, func(i, j int) bool {
+		return resp.Peers[i].AnnounceLast.After(resp.Peers[j].AnnounceLast)
+	})
+	c.JSON(http.StatusOK, resp)
+}
+
+// AllowedUserRequest grants a user access to a torrent restricted to its allowed users
+type AllowedUserRequest struct {
+	UserID uint32 `json:"user_id"`
+}
+
+// AllowedUsersResponse lists the users allowed to announce a torrent. Adding an allowed user
+// restricts the torrent, a restricted torrent with an empty list is closed to all users until
+// it is unrestricted with a torrent update.
+type AllowedUsersResponse struct {
+	InfoHash   string   `json:"info_hash"`
+	Restricted bool     `json:"restricted"`
+	UserIDs    []uint32 `json:"user_ids"`
+}
+
+func (a *AdminAPI) torrentAllowedUsers(c *gin.Context) {
+	var ih store.InfoHash
+	if !infoHashFromCtx(&ih, c, true) {
+		return
+	}
+	var tor store.Torrent
+	if err := a.t.torrents.Get(&tor, ih, true); err != nil {
+		if errors.Is(err, consts.ErrInvalidInfoHash) {
+			c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch torrent"})
+		return
+	}
+	resp := AllowedUsersResponse{InfoHash: ih.String(), Restricted: tor.Restricted, UserIDs: []uint32{}}
+	a.t.AllowedUsersMu.RLock()
+	for userID := range a.t.AllowedUsers[ih] {
+		resp.UserIDs = append(resp.UserIDs, userID)
+	}
+	a.t.AllowedUsersMu.RUnlock()
+	sort.Slice(resp.UserIDs, func(i, j int) bool {
+		return resp.UserIDs[i] < resp.UserIDs[j]
+	})
+	c.JSON(http.StatusOK, resp)
+}
+
+func (a *AdminAPI) torrentAllowedUserAdd(c *gin.Context) {
+	var ih store.InfoHash
+	if !infoHashFromCtx(&ih, c, true) {
+		return
+	}
+	var req AllowedUserRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Malformed request"})
+		return
+	}
+	if err := a.t.restrictTorrent(ih); err != nil {
+		if errors.Is(err, consts.ErrInvalidInfoHash) {
+			c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: err.Error()})
+			return
+		}
+		log.Errorf("Failed to restrict torrent: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to restrict torrent"})
+		return
+	}
+	entry := store.TorrentAllowedUser{InfoHash: ih, UserID: req.UserID}
+	if err := a.t.torrents.AllowedUserAdd(entry); err != nil {
+		log.Errorf("Failed to add allowed user: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to add allowed user"})
+		return
+	}
+	a.t.setUserAllowed(entry, true)
+	c.JSON(http.StatusOK, StatusResp{Message: "User allowed successfully"})
+}
+
+func (a *AdminAPI) torrentAllowedUserDelete(c *gin.Context) {
+	var ih store.InfoHash
+	if !infoHashFromCtx(&ih, c, true) {
+		return
+	}
+	userID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Invalid user_id"})
+		return
+	}
+	entry := store.TorrentAllowedUser{InfoHash: ih, UserID: uint32(userID)}
+	if err := a.t.torrents.AllowedUserDelete(entry); err != nil {
+		if errors.Is(err, consts.ErrInvalidUser) {
+			c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: err.Error()})
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to delete allowed user"})
+		return
+	}
+	a.t.setUserAllowed(entry, false)
+	c.JSON(http.StatusOK, StatusResp{Message: "Deleted successfully"})
+}
+
 func (a *AdminAPI) userUpdate(c *gin.Context) {
 	var user store.User
 	passkey := c.Param("passkey")
-	if len(passkey) != 20 {
+	if !a.t.validPasskey(passkey) {
 		c.AbortWithStatus(http.StatusNotFound)
 		return
 	}
 	if err := a.t.users.GetByPasskey(&user, passkey); err != nil {
-		if errors.Is(consts.ErrUnauthorized, err) {
+		if errors.Is(err, consts.ErrInvalidUser) {
 			c.AbortWithStatus(http.StatusNotFound)
 		} else {
 			c.AbortWithStatus(http.StatusInternalServerError)
 		}
 		return
 	}
-	var update store.User
+	// Multipliers left out of the request keep their current values
+	update := store.User{MultiUp: user.MultiUp, MultiDn: user.MultiDn}
 	if err := c.BindJSON(&update); err != nil {
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
+	if msg := userMultipliers(&update); msg != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: msg})
+		return
+	}
 	if err := a.t.users.Update(update, passkey); err != nil {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -277,6 +967,10 @@ type UserDeleteRequest struct {
 func (a *AdminAPI) userDelete(c *gin.Context) {
 	pk := c.Param("passkey")
 	var user store.User
+	if !a.t.validPasskey(pk) {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+		return
+	}
 	if err := a.t.users.GetByPasskey(&user, pk); err != nil {
 		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
 		return
@@ -285,17 +979,245 @@ func (a *AdminAPI) userDelete(c *gin.Context) {
 		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "Failed to delete user"})
 		return
 	}
+	a.audit(c, auditUserDelete, fmt.Sprintf("user_id=%d passkey=%s", user.UserID, redactPasskeyPrefix(pk)))
 	c.JSON(http.StatusOK, StatusResp{Message: "Deleted user successfully"})
 }
 
-func (a *AdminAPI) userAdd(c *gin.Context) {
+// userGet returns the user including any stats still pending a batch update
+func (a *AdminAPI) userGet(c *gin.Context) {
+	var user store.User
+	if !a.t.validPasskey(c.Param("passkey")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+		return
+	}
+	if err := a.t.users.GetByPasskey(&user, c.Param("passkey")); err != nil {
+		if errors.Is(err, consts.ErrInvalidUser) {
+			c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+		} else {
+			log.Errorf("Failed to fetch user: %s", err.Error())
+			c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch user"})
+		}
+		return
+	}
+	if a.t.UserStatsCache != nil {
+		a.t.UserStatsCache.Merge(&user)
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// UserAnnounce is a recent announce from a user
+type UserAnnounce struct {
+	Time     time.Time `json:"time"`
+	InfoHash string    `json:"info_hash"`
+	Event    string    `json:"event"`
+	// IP and Port are empty when peer IPs are redacted
+	IP   string `json:"ip,omitempty"`
+	Port uint16 `json:"port,omitempty"`
+}
+
+// UserAnnouncesResponse lists the recent announces of a user, newest first
+type UserAnnouncesResponse struct {
+	Results []UserAnnounce `json:"results"`
+}
+
+func (a *AdminAPI) userAnnounces(c *gin.Context) {
+	pk := c.Param("passkey")
+	if !a.t.validPasskey(pk) {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+		return
+	}
+	history := a.t.recentAnnounces(pk)
+	results := make([]UserAnnounce, len(history))
+	for i, e := range history {
+		results[i] = UserAnnounce{
+			Time:     e.Time,
+			InfoHash: e.InfoHash.String(),
+			Event:    string(e.Event),
+		}
+		if !a.t.RedactPeerIPs {
+			results[i].IP = e.IP.String()
+			results[i].Port = e.Port
+		}
+	}
+	c.JSON(http.StatusOK, UserAnnouncesResponse{Results: results})
+}
+
+// UserTorrent is a torrent a user currently has an active peer on
+type UserTorrent struct {
+	InfoHash    string `json:"info_hash"`
+	ReleaseName string `json:"release_name"`
+	// Role is either seeding or leeching
+	Role       string `json:"role"`
+	Uploaded   uint64 `json:"uploaded"`
+	Downloaded uint64 `json:"downloaded"`
+	Left       uint64 `json:"left"`
+}
+
+// UserTorrentsResponse is a page of the torrents a user is active on along with the total
+// number of active peers for the user
+type UserTorrentsResponse struct {
+	Total   int           `json:"total"`
+	Results []UserTorrent `json:"results"`
+}
+
+func (a *AdminAPI) userTorrents(c *gin.Context) {
+	var user store.User
+	if !a.t.validPasskey(c.Param("passkey")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+		return
+	}
+	if err := a.t.users.GetByPasskey(&user, c.Param("passkey")); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+		return
+	}
+	offset, limit, ok := a.pageFromCtx(c)
+	if !ok {
+		return
+	}
+	peers, total, err := a.t.peers.GetActiveByUser(user.UserID, offset, limit)
+	if err != nil {
+		log.Errorf("Failed to fetch active user peers: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch user torrents"})
+		return
+	}
+	hashes := make([]store.InfoHash, len(peers))
+	for i, p := range peers {
+		hashes[i] = p.InfoHash
+	}
+	torrents, err := a.t.TorrentGetMany(hashes, true)
+	if err != nil {
+		log.Errorf("Failed to fetch user torrent names: %s", err.Error())
+	}
+	results := make([]UserTorrent, len(peers))
+	for i, p := range peers {
+		results[i] = UserTorrent{
+			InfoHash:   p.InfoHash.String(),
+			Role:       "leeching",
+			Uploaded:   p.Uploaded,
+			Downloaded: p.Downloaded,
+			Left:       p.Left,
+		}
+		if p.Left == 0 {
+			results[i].Role = "seeding"
+		}
+		results[i].ReleaseName = torrents[p.InfoHash].ReleaseName
+	}
+	c.JSON(http.StatusOK, UserTorrentsResponse{Total: total, Results: results})
+}
+
+// UserHNR is a torrent the user left without seeding it for the hnr threshold
+type UserHNR struct {
+	InfoHash    string `json:"info_hash"`
+	ReleaseName string `json:"release_name"`
+	// SeedTime is the number of seconds the torrent was seeded before leaving
+	SeedTime  uint32    `json:"seed_time"`
+	CreatedOn time.Time `json:"created_on"`
+}
+
+// UserHNRResponse holds the hit and runs of a user ordered by info_hash
+type UserHNRResponse struct {
+	Results []UserHNR `json:"results"`
+}
+
+func (a *AdminAPI) userHNR(c *gin.Context) {
+	var user store.User
+	if !a.t.validPasskey(c.Param("passkey")) {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+		return
+	}
+	if err := a.t.users.GetByPasskey(&user, c.Param("passkey")); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+		return
+	}
+	hnrs, err := a.t.users.HNRGetByUser(user.UserID)
+	if err != nil {
+		log.Errorf("Failed to fetch user hnrs: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to fetch user hnrs"})
+		return
+	}
+	hashes := make([]store.InfoHash, len(hnrs))
+	for i, hnr := range hnrs {
+		hashes[i] = hnr.InfoHash
+	}
+	torrents, err := a.t.TorrentGetMany(hashes, true)
+	if err != nil {
+		log.Errorf("Failed to fetch hnr torrent names: %s", err.Error())
+	}
+	results := make([]UserHNR, len(hnrs))
+	for i, hnr := range hnrs {
+		results[i] = UserHNR{
+			InfoHash:    hnr.InfoHash.String(),
+			ReleaseName: torrents[hnr.InfoHash].ReleaseName,
+			SeedTime:    hnr.SeedTime,
+			CreatedOn:   hnr.CreatedOn,
+		}
+	}
+	c.JSON(http.StatusOK, UserHNRResponse{Results: results})
+}
+
+// UserAdjustRequest holds the signed amounts to add to a users totals. Negative values debit
+// the user, totals never go below zero.
+type UserAdjustRequest struct {
+	UploadedDelta   int64 `json:"uploaded_delta"`
+	DownloadedDelta int64 `json:"downloaded_delta"`
+}
+
+func (a *AdminAPI) userAdjust(c *gin.Context) {
+	pk := c.Param("passkey")
 	var user store.User
+	if !a.t.validPasskey(pk) {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+		return
+	}
+	if err := a.t.users.GetByPasskey(&user, pk); err != nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+		return
+	}
+	var req UserAdjustRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Malformed request"})
+		return
+	}
+	if req.UploadedDelta == 0 && req.DownloadedDelta == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "No adjustment specified"})
+		return
+	}
+	if err := a.t.users.AdjustUser(user.UserID, req.UploadedDelta, req.DownloadedDelta); err != nil {
+		if err == consts.ErrInvalidUser {
+			c.AbortWithStatusJSON(http.StatusNotFound, StatusResp{Err: "User not found"})
+			return
+		}
+		log.Errorf("Failed to adjust user: %s", err.Error())
+		c.AbortWithStatusJSON(http.StatusInternalServerError, StatusResp{Err: "Failed to adjust user"})
+		return
+	}
+	if a.t.UsersCache != nil {
+		// The cached totals are stale, the next announce reloads them
+		a.t.UsersCache.Delete(pk)
+	}
+	if a.t.ratios != nil {
+		a.t.ratios.delete(pk)
+	}
+	a.audit(c, auditUserAdjust, fmt.Sprintf("user_id=%d uploaded=%+d downloaded=%+d",
+		user.UserID, req.UploadedDelta, req.DownloadedDelta))
+	c.JSON(http.StatusOK, StatusResp{Message: "Adjusted user successfully"})
+}
+
+func (a *AdminAPI) userAdd(c *gin.Context) {
+	user := store.User{MultiUp: 1, MultiDn: 1}
 	if err := c.BindJSON(&user); err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Malformed request"})
 		return
 	}
+	if msg := userMultipliers(&user); msg != "" {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: msg})
+		return
+	}
 	if user.Passkey == "" {
 		user.Passkey = util.NewPasskey()
+	} else if !a.t.validPasskey(user.Passkey) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, StatusResp{Err: "Invalid passkey length"})
+		return
 	}
 	if err := a.t.users.Add(user); err != nil {
 		log.Error(err)
@@ -324,6 +1246,9 @@ type ConfigRequest struct {
 	TrackerAutoRegister        bool         `json:"tracker_auto_register"`
 	TrackerAllowNonRoutable    bool         `json:"tracker_allow_non_routable"`
 	GeodbEnabled               bool         `json:"geodb_enabled"`
+	// Persist writes the updated keys back to the config file so they survive a restart.
+	// Other values in the file are kept, its comments are not.
+	Persist bool `json:"persist,omitempty"`
 }
 
 func (a *AdminAPI) configGet(c *gin.Context) {
@@ -335,7 +1260,7 @@ func (a *AdminAPI) configGet(c *gin.Context) {
 		TrackerMaxPeers:            a.t.MaxPeers,
 		TrackerAutoRegister:        a.t.AutoRegister,
 		TrackerAllowNonRoutable:    a.t.AllowNonRoutable,
-		GeodbEnabled:               a.t.GeodbEnabled,
+		GeodbEnabled:               a.t.geodbEnabled(),
 	}
 	c.JSON(200, cfg)
 }
@@ -344,6 +1269,7 @@ func (a *AdminAPI) configUpdate(c *gin.Context) {
 	var configValues ConfigRequest
 	var err error
 	internalErr := false
+	geoFailed := false
 	if err = c.BindJSON(&configValues); err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{})
 		return
@@ -388,7 +1314,8 @@ func (a *AdminAPI) configUpdate(c *gin.Context) {
 		case config.TrackerAllowNonRoutable:
 			a.t.AllowNonRoutable = configValues.TrackerAllowNonRoutable
 		case config.GeodbEnabled:
-			if configValues.GeodbEnabled && !a.t.GeodbEnabled {
+			geodbEnabled := a.t.geodbEnabled()
+			if configValues.GeodbEnabled && !geodbEnabled {
 				size := int64(0)
 				key := config.GetString(config.GeodbAPIKey)
 				outPath := config.GetString(config.GeodbPath)
@@ -412,31 +1339,176 @@ func (a *AdminAPI) configUpdate(c *gin.Context) {
 						break
 					}
 				}
-				newDb, err := geo.New(outPath)
-				if err != nil {
-					internalErr = true
+				newDb, opened := geo.Open(outPath)
+				if !opened {
+					// The rest of the config is still applied, the tracker keeps running
+					// with the dummy provider
+					geoFailed = true
 					break
 				}
-				a.t.Geodb = newDb
-				a.t.GeodbEnabled = true
-			} else if !configValues.GeodbEnabled && a.t.GeodbEnabled {
-				a.t.Geodb = &geo.DummyProvider{}
-				a.t.GeodbEnabled = false
+				a.t.SetGeodb(newDb, true)
+			} else if !configValues.GeodbEnabled && geodbEnabled {
+				a.t.SetGeodb(&geo.DummyProvider{}, false)
 			}
 		}
 	}
+	if err == nil && a.t.PersistConfig {
+		if err := a.persistConfig(configValues, geoFailed); err != nil {
+			log.Errorf("Failed to persist config values: %s", err)
+			c.JSON(http.StatusInternalServerError, StatusResp{Err: "Config values updated but could not be persisted"})
+			return
+		}
+	}
+	if err == nil && configValues.Persist {
+		if err := config.WriteKeys(updatedConfigValues(configValues, geoFailed)); err != nil {
+			log.Errorf("Failed to write config file: %s", err)
+			c.JSON(http.StatusInternalServerError, StatusResp{Err: "Config values updated but could not be written to the config file"})
+			return
+		}
+	}
 	if err != nil {
 		code := http.StatusBadRequest
 		if internalErr {
 			code = http.StatusInternalServerError
 		}
 		c.JSON(code, StatusResp{Err: err.Error()})
+	} else if geoFailed {
+		c.JSON(http.StatusOK, StatusResp{Message: "Config values updated, geo database could not be opened and remains disabled"})
 	} else {
 		c.JSON(http.StatusOK, StatusResp{Message: "Config values updated"})
 	}
 }
 
+// updatedConfigValues returns the updated values keyed by config key in the same format as
+// the config file, so they can be loaded back into viper
+func updatedConfigValues(req ConfigRequest, geoFailed bool) map[config.Key]interface{} {
+	values := make(map[config.Key]interface{})
+	for _, k := range req.UpdateKeys {
+		switch k {
+		case config.TrackerAnnounceInterval:
+			values[k] = fmt.Sprintf("%ds", req.TrackerAnnounceInterval)
+		case config.TrackerAnnounceIntervalMin:
+			values[k] = fmt.Sprintf("%ds", req.TrackerAnnounceIntervalMin)
+		case config.TrackerReaperInterval:
+			values[k] = fmt.Sprintf("%ds", req.TrackerReaperInterval)
+		case config.TrackerBatchUpdateInterval:
+			values[k] = fmt.Sprintf("%ds", req.TrackerBatchUpdateInterval)
+		case config.TrackerMaxPeers:
+			values[k] = req.TrackerMaxPeers
+		case config.TrackerAutoRegister:
+			values[k] = req.TrackerAutoRegister
+		case config.TrackerAllowNonRoutable:
+			values[k] = req.TrackerAllowNonRoutable
+		case config.GeodbEnabled:
+			if geoFailed {
+				// The database stayed disabled so there is no change to keep
+				continue
+			}
+			values[k] = req.GeodbEnabled
+		}
+	}
+	return values
+}
+
+// persistConfig saves the updated values to the torrent store so they can be loaded back
+// into viper at startup
+func (a *AdminAPI) persistConfig(req ConfigRequest, geoFailed bool) error {
+	for k, v := range updatedConfigValues(req, geoFailed) {
+		if err := a.t.torrents.ConfigSet(string(k), fmt.Sprint(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GeodbUpdateResponse is returned after successfully replacing the geo database
+type GeodbUpdateResponse struct {
+	Path string `json:"path"`
+	geo.Metadata
+}
+
+// geodbUpdate downloads the latest geo database, verifies it can be opened and swaps it
+// in as the live provider. The download is made into a temporary directory first so a failed
+// update leaves the current database untouched.
+func (a *AdminAPI) geodbUpdate(c *gin.Context) {
+	metadata, err := a.t.UpdateGeodb()
+	if err != nil {
+		switch {
+		case errors.Is(err, errGeodbNoAPIKey):
+			c.JSON(http.StatusBadRequest, StatusResp{Err: "No geo database api key configured"})
+		case errors.Is(err, errGeodbDownload):
+			c.JSON(http.StatusBadGateway, StatusResp{Err: "Failed to download geo database"})
+		default:
+			log.Errorf("Failed to update geo database: %s", err)
+			c.JSON(http.StatusInternalServerError, StatusResp{Err: "Failed to update geo database"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, GeodbUpdateResponse{Path: config.GetString(config.GeodbPath), Metadata: metadata})
+}
+
+// authenticate rejects requests without the API key sent as a bearer token in the
+// Authorization header. Health checks are always allowed so orchestrators can probe them.
+func (a *AdminAPI) authenticate(c *gin.Context) {
+	if c.FullPath() == "/healthz" {
+		c.Next()
+		return
+	}
+	if a.t.APIKey == "" || (a.t.APIMetricsNoAuth && c.Request.Method == http.MethodGet && c.FullPath() == "/metrics") {
+		c.Next()
+		return
+	}
+	auth := c.GetHeader("Authorization")
+	const scheme = "bearer "
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) ||
+		subtle.ConstantTimeCompare([]byte(auth[len(scheme):]), []byte(a.t.APIKey)) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, StatusResp{Err: "Invalid API key"})
+		return
+	}
+	c.Next()
+}
+
+// audit records a destructive action made by the caller in the audit log
+func (a *AdminAPI) audit(c *gin.Context, action string, target string) {
+	entry := AuditEntry{
+		Time:   time.Now(),
+		Action: action,
+		Target: target,
+		Caller: a.t.clientIP(c),
+	}
+	a.t.AuditLog.Add(entry)
+	log.Infof("Audit: %s %s by %s", entry.Action, entry.Target, entry.Caller)
+}
+
+// AuditPageResponse is a page of audit entries, most recent first, along with the total
+// number of retained entries
+type AuditPageResponse struct {
+	Total   int          `json:"total"`
+	Results []AuditEntry `json:"results"`
+}
+
+func (a *AdminAPI) auditGet(c *gin.Context) {
+	offset, limit, ok := a.pageFromCtx(c)
+	if !ok {
+		return
+	}
+	entries := a.t.AuditLog.Entries()
+	total := len(entries)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	c.JSON(http.StatusOK, AuditPageResponse{Total: total, Results: entries[offset:end]})
+}
+
 func (a *AdminAPI) metrics(c *gin.Context) {
+	if c.Query("format") == "influx" {
+		c.String(200, a.t.influxMetrics())
+		return
+	}
 	stats := metrics.Get()
 	c.String(200, stats.String())
 }
@@ -445,24 +1517,51 @@ func (a *AdminAPI) metrics(c *gin.Context) {
 func NewAPIHandler(tkr *Tracker) *gin.Engine {
 	r := newRouter()
 	h := AdminAPI{t: tkr}
+	r.Use(h.authenticate)
 
 	r.GET("/metrics", h.metrics)
 
 	r.POST("/ping", h.ping)
+	r.GET("/healthz", h.healthz)
+	r.GET("/tracker/stats", h.trackerStats)
 	r.PATCH("/config", h.configUpdate)
 	r.GET("/config", h.configGet)
+	r.POST("/geodb/update", h.geodbUpdate)
+	r.GET("/audit", h.auditGet)
 
+	r.GET("/torrent/:info_hash", h.torrentGet)
 	r.DELETE("/torrent/:info_hash", h.torrentDelete)
 	r.PATCH("/torrent/:info_hash", h.torrentUpdate)
+	r.POST("/torrent/:info_hash/restore", h.torrentRestore)
+	r.GET("/torrent/:info_hash/impact", h.torrentImpact)
+	r.GET("/torrent/:info_hash/peers", h.torrentPeers)
+	r.GET("/torrent/:info_hash/allowed_users", h.torrentAllowedUsers)
+	r.POST("/torrent/:info_hash/allowed_users", h.torrentAllowedUserAdd)
+	r.DELETE("/torrent/:info_hash/allowed_users/:user_id", h.torrentAllowedUserDelete)
 	r.POST("/torrent", h.torrentAdd)
+	r.GET("/torrents", h.torrentList)
 
 	r.POST("/user", h.userAdd)
+	r.GET("/user/pk/:passkey", h.userGet)
 	r.DELETE("/user/pk/:passkey", h.userDelete)
 	r.PATCH("/user/pk/:passkey", h.userUpdate)
+	r.POST("/user/pk/:passkey/adjust", h.userAdjust)
+	r.GET("/user/pk/:passkey/announces", h.userAnnounces)
+	r.GET("/user/pk/:passkey/torrents", h.userTorrents)
+	r.GET("/user/pk/:passkey/hnr", h.userHNR)
 
 	r.POST("/whitelist", h.whitelistAdd)
 	r.DELETE("/whitelist/:prefix", h.whitelistDelete)
+	r.POST("/whitelist/reload", h.whitelistReload)
 	r.GET("/whitelist", h.whitelistGet)
+
+	r.GET("/peers/active", h.peersActive)
+
+	r.GET("/stats/clients", h.clientStats)
+
+	r.POST("/denylist/infohash", h.denyListAdd)
+	r.DELETE("/denylist/infohash/:info_hash", h.denyListDelete)
+	r.GET("/denylist/infohash", h.denyListGet)
 	r.NoRoute(noRoute)
 	return r
 }
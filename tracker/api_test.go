@@ -2,14 +2,26 @@ package tracker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/leighmacdonald/mika/config"
 	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/geo"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/store"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -17,6 +29,12 @@ import (
 func newTestAPI() (*Tracker, http.Handler) {
 	context.Background()
 	opts := NewDefaultOpts()
+	// performRequest connects from 172.16.1.22, trusted so announces can set any ip
+	opts.TrustedProxies = []string{"172.16.0.0/12"}
+	// The tests check the tracker error code sent as the status of failures
+	opts.FailureStatusOK = false
+	// Test peers use random client prefixes
+	opts.AllowEmptyWhitelist = true
 	tkr, err := New(context.Background(), opts)
 	if err != nil {
 		os.Exit(1)
@@ -25,11 +43,125 @@ func newTestAPI() (*Tracker, http.Handler) {
 }
 
 func TestMetrics(t *testing.T) {
-	_, handler := newTestAPI()
+	tkr, handler := newTestAPI()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, tkr.TorrentAdd(store.GenerateTestTorrent()))
+	}
+	// The counts are only refreshed by the reaper
+	tkr.refreshCounts()
+	var stats TrackerStatsResponse
+	require.Equal(t, http.StatusOK, performRequest(handler, "GET", "/tracker/stats", nil, &stats).Code)
+	require.EqualValues(t, 3, stats.Torrents)
 	req, _ := http.NewRequest("GET", "/metrics", nil)
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
 	require.Equal(t, http.StatusOK, w.Code)
+	require.Contains(t, w.Body.String(), "\nt_torrents 3\n", "Torrent count not refreshed")
+
+	req, _ = http.NewRequest("GET", "/metrics?format=influx", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, strings.HasPrefix(w.Body.String(), "mika,host="))
+	require.Contains(t, w.Body.String(), ",t_torrents=3i,")
+}
+
+func TestInfluxPush(t *testing.T) {
+	tkr, _ := newTestAPI()
+	received := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	require.NoError(t, tkr.pushInflux(srv.URL+"/write?db=mika"))
+	require.True(t, strings.HasPrefix(<-received, "mika,host="))
+	srv.Close()
+	require.Error(t, tkr.pushInflux(srv.URL+"/write?db=mika"))
+}
+
+func TestShutdownMetrics(t *testing.T) {
+	tkr, _ := newTestAPI()
+	received := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	tkr.StartInfluxPusher(srv.URL+"/write?db=mika", time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, tkr.ShutdownMetrics(ctx))
+	// The final push is sent before the pusher exits
+	select {
+	case body := <-received:
+		require.True(t, strings.HasPrefix(body, "mika,host="))
+	default:
+		t.Fatalf("No final metrics push received")
+	}
+	buf := make([]byte, 1<<20)
+	require.NotContains(t, string(buf[:runtime.Stack(buf, true)]), "influxPusher")
+	require.NoError(t, tkr.ShutdownMetrics(ctx), "Shutdown should be repeatable")
+}
+
+func TestMetricsPersist(t *testing.T) {
+	tkr, _ := newTestAPI()
+	atomic.StoreInt64(&metrics.AnnounceDelayed, 42)
+	atomic.StoreInt64(&metrics.StoreFailures, 7)
+	atomic.StoreInt64(&metrics.AnnounceTotal, 100)
+	atomic.StoreInt64(&metrics.AnnounceStatusOK, 90)
+	tkr.StartMetricsPersister(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The counters are saved when the persister is shut down
+	require.NoError(t, tkr.ShutdownMetrics(ctx))
+
+	// Simulate a restart with fresh counters using the same store
+	atomic.StoreInt64(&metrics.AnnounceDelayed, 0)
+	atomic.StoreInt64(&metrics.StoreFailures, 0)
+	atomic.StoreInt64(&metrics.AnnounceTotal, 0)
+	atomic.StoreInt64(&metrics.AnnounceStatusOK, 0)
+	opts := NewDefaultOpts()
+	opts.Torrents = tkr.torrents
+	restarted, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	require.NoError(t, restarted.LoadMetrics())
+	require.Equal(t, int64(42), atomic.LoadInt64(&metrics.AnnounceDelayed))
+	require.Equal(t, int64(7), atomic.LoadInt64(&metrics.StoreFailures))
+	require.Equal(t, int64(42), metrics.Get().AnnounceDelayed)
+	require.Equal(t, int64(100), metrics.Get().AnnounceTotal)
+	require.Equal(t, int64(90), metrics.Get().AnnounceStatusOK)
+}
+
+func TestAPIAuth(t *testing.T) {
+	tkr, handler := newTestAPI()
+	tkr.APIKey = "secret-api-key"
+	torrent0 := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	request := func(method string, path string, auth string) int {
+		req, _ := http.NewRequest(method, path, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	deletePath := fmt.Sprintf("/torrent/%s", torrent0.InfoHash.String())
+	for _, auth := range []string{"", "secret-api-key", "Bearer wrong", "Bearer "} {
+		require.Equal(t, http.StatusUnauthorized, request("DELETE", deletePath, auth), auth)
+	}
+	var tor store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor, torrent0.InfoHash, false), "Unauthorized delete applied")
+	require.Equal(t, http.StatusOK, request("GET", "/config", "Bearer secret-api-key"))
+	require.Equal(t, http.StatusOK, request("DELETE", deletePath, "bearer secret-api-key"))
+
+	require.Equal(t, http.StatusUnauthorized, request("GET", "/metrics", ""))
+	tkr.APIMetricsNoAuth = true
+	require.Equal(t, http.StatusOK, request("GET", "/metrics", ""))
+	require.Equal(t, http.StatusUnauthorized, request("GET", "/config", ""), "Exemption applied to other routes")
 }
 
 func TestPing(t *testing.T) {
@@ -51,6 +183,8 @@ func equalUser(t *testing.T, a store.User, b store.User) {
 	require.Equal(t, a.Downloaded, b.Downloaded)
 	require.Equal(t, a.Uploaded, b.Uploaded)
 	require.Equal(t, a.Announces, b.Announces)
+	require.Equal(t, a.MultiUp, b.MultiUp)
+	require.Equal(t, a.MultiDn, b.MultiDn)
 }
 
 func TestUserAdd(t *testing.T) {
@@ -90,6 +224,257 @@ func TestUserUpdate(t *testing.T) {
 	equalUser(t, user1, user2)
 }
 
+func TestUserUpdateMultipliers(t *testing.T) {
+	user0 := store.GenerateTestUser()
+	user0.MultiDn = 0.5
+	tkr, handler := newTestAPI()
+	require.NoError(t, tkr.users.Add(user0))
+	u := fmt.Sprintf("/user/pk/%s", user0.Passkey)
+	w := performRequest(handler, "PATCH", u, map[string]interface{}{
+		"user_id": user0.UserID, "passkey": user0.Passkey, "multi_up": 2.5}, nil)
+	require.Equal(t, 200, w.Code)
+	var updated store.User
+	require.NoError(t, tkr.users.GetByPasskey(&updated, user0.Passkey))
+	require.Equal(t, 2.5, updated.MultiUp)
+	require.Equal(t, 0.5, updated.MultiDn, "Omitted multiplier was not kept")
+
+	w = performRequest(handler, "PATCH", u, map[string]interface{}{
+		"user_id": user0.UserID, "passkey": user0.Passkey, "multi_up": maxMultiplier + 1}, nil)
+	require.Equal(t, 400, w.Code)
+	require.NoError(t, tkr.users.GetByPasskey(&updated, user0.Passkey))
+	require.Equal(t, 2.5, updated.MultiUp)
+}
+
+func TestUserHNR(t *testing.T) {
+	tkr, handler := newTestAPI()
+	user0 := store.GenerateTestUser()
+	torrent0 := store.GenerateTestTorrent()
+	require.NoError(t, tkr.users.Add(user0))
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	u := fmt.Sprintf("/user/pk/%s/hnr", user0.Passkey)
+
+	var resp UserHNRResponse
+	w := performRequest(handler, "GET", u, nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Empty(t, resp.Results)
+
+	require.NoError(t, tkr.users.HNRAdd(store.HNR{UserID: user0.UserID, InfoHash: torrent0.InfoHash,
+		SeedTime: 600, CreatedOn: time.Now()}))
+	w = performRequest(handler, "GET", u, nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, resp.Results, 1)
+	require.Equal(t, torrent0.InfoHash.String(), resp.Results[0].InfoHash)
+	require.Equal(t, torrent0.ReleaseName, resp.Results[0].ReleaseName)
+	require.Equal(t, uint32(600), resp.Results[0].SeedTime)
+
+	w = performRequest(handler, "GET", fmt.Sprintf("/user/pk/%s/hnr", store.GenerateTestUser().Passkey), nil, nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUserLegacyPasskey(t *testing.T) {
+	user0 := store.GenerateTestUser()
+	user0.Passkey = "0123456789abcdef0123456789abcdef"
+	tkr, handler := newTestAPI()
+	u := fmt.Sprintf("/user/pk/%s", user0.Passkey)
+	w := performRequest(handler, "POST", "/user", user0, nil)
+	require.Equal(t, 400, w.Code, "Legacy passkey accepted without being configured")
+
+	tkr.PasskeyLengths = []int{20, 32}
+	w = performRequest(handler, "POST", "/user", user0, nil)
+	require.Equal(t, 200, w.Code)
+	w = performRequest(handler, "GET", u, nil, nil)
+	require.Equal(t, 200, w.Code)
+	update := user0
+	update.Uploaded = 1000
+	w = performRequest(handler, "PATCH", u, update, nil)
+	require.Equal(t, 200, w.Code)
+
+	tkr.AllowClientIP = true
+	torrent0 := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+		Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+	w = performRequest(NewBitTorrentHandler(tkr), "GET",
+		fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code), "Legacy passkey announce rejected")
+
+	tkr.PasskeyLengths = []int{20}
+	w = performRequest(NewBitTorrentHandler(tkr), "GET",
+		fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgInvalidAuth, errCode(w.Code))
+}
+
+func TestUserAnnounces(t *testing.T) {
+	tkr, handler := newTestAPI()
+	tkr.AllowClientIP = true
+	tkr.AnnounceHistorySize = 2
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	torrents := []store.Torrent{store.GenerateTestTorrent(), store.GenerateTestTorrent(), store.GenerateTestTorrent()}
+	for _, tor := range torrents {
+		require.NoError(t, tkr.torrents.Add(tor))
+		req := testReq{Ih: tor.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey, event: "started"}
+		w := performRequest(NewBitTorrentHandler(tkr), "GET",
+			fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+	}
+	u := fmt.Sprintf("/user/pk/%s/announces", user0.Passkey)
+	var resp UserAnnouncesResponse
+	w := performRequest(handler, "GET", u, nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, resp.Results, 2, "Oldest announce not dropped")
+	require.Equal(t, torrents[2].InfoHash.String(), resp.Results[0].InfoHash)
+	require.Equal(t, torrents[1].InfoHash.String(), resp.Results[1].InfoHash)
+	require.Equal(t, "started", resp.Results[0].Event)
+	require.Equal(t, "12.34.56.78", resp.Results[0].IP)
+
+	tkr.RedactPeerIPs = true
+	var redacted UserAnnouncesResponse
+	performRequest(handler, "GET", u, nil, &redacted)
+	require.Len(t, redacted.Results, 2)
+	require.Empty(t, redacted.Results[0].IP)
+
+	tkr.AnnounceHistoryMaxAge = time.Millisecond
+	time.Sleep(time.Millisecond * 5)
+	var expired UserAnnouncesResponse
+	performRequest(handler, "GET", u, nil, &expired)
+	require.Empty(t, expired.Results, "Expired announces returned")
+
+	w = performRequest(handler, "GET", "/user/pk/invalid/announces", nil, nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUserTorrents(t *testing.T) {
+	tkr, handler := newTestAPI()
+	tkr.AllowClientIP = true
+	user0 := store.GenerateTestUser()
+	user1 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	require.NoError(t, tkr.users.Add(user1))
+	seeding := store.GenerateTestTorrent()
+	leeching := store.GenerateTestTorrent()
+	announce := func(tor store.Torrent, usr store.User, left string) {
+		require.NoError(t, tkr.torrents.Add(tor))
+		req := testReq{Ih: tor.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: left, PK: usr.Passkey, event: "started"}
+		w := performRequest(NewBitTorrentHandler(tkr), "GET",
+			fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+	}
+	announce(seeding, user0, "0")
+	announce(leeching, user0, "5000")
+	announce(store.GenerateTestTorrent(), user1, "5000")
+
+	var resp UserTorrentsResponse
+	w := performRequest(handler, "GET", fmt.Sprintf("/user/pk/%s/torrents", user0.Passkey), nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, 2, resp.Total)
+	require.Len(t, resp.Results, 2)
+	roles := map[string]UserTorrent{}
+	for _, ut := range resp.Results {
+		roles[ut.InfoHash] = ut
+	}
+	require.Equal(t, "seeding", roles[seeding.InfoHash.String()].Role)
+	require.Equal(t, "leeching", roles[leeching.InfoHash.String()].Role)
+	require.Equal(t, uint64(5000), roles[leeching.InfoHash.String()].Left)
+	require.Equal(t, leeching.ReleaseName, roles[leeching.InfoHash.String()].ReleaseName)
+
+	var page UserTorrentsResponse
+	performRequest(handler, "GET", fmt.Sprintf("/user/pk/%s/torrents?limit=1", user0.Passkey), nil, &page)
+	require.Equal(t, 2, page.Total)
+	require.Len(t, page.Results, 1)
+
+	w = performRequest(handler, "GET", fmt.Sprintf("/user/pk/%s/torrents", store.GenerateTestUser().Passkey), nil, nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTorrentImpact(t *testing.T) {
+	tkr, handler := newTestAPI()
+	tkr.AllowClientIP = true
+	tor := store.GenerateTestTorrent()
+	tor.MultiUp = 2
+	tor.MultiDn = 0.5
+	require.NoError(t, tkr.torrents.Add(tor))
+	for i, left := range []string{"0", "5000", "5000"} {
+		usr := store.GenerateTestUser()
+		require.NoError(t, tkr.users.Add(usr))
+		req := testReq{Ih: tor.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78",
+			Port: strconv.Itoa(4000 + i), Uploaded: "0", Downloaded: "0", left: left, PK: usr.Passkey, event: "started"}
+		w := performRequest(NewBitTorrentHandler(tkr), "GET",
+			fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+	}
+
+	var impact TorrentImpact
+	w := performRequest(handler, "GET", fmt.Sprintf("/torrent/%s/impact", tor.InfoHash.String()), nil, &impact)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, tor.InfoHash.String(), impact.InfoHash)
+	require.Equal(t, tor.ReleaseName, impact.ReleaseName)
+	require.Equal(t, 2.0, impact.MultiUp)
+	require.Equal(t, 0.5, impact.MultiDn)
+	require.Equal(t, 1, impact.Seeders)
+	require.Equal(t, 2, impact.Leechers)
+	require.Equal(t, 3, impact.RecentAnnounces)
+	require.Greater(t, impact.AnnounceRate, 0.0)
+
+	w = performRequest(handler, "GET", fmt.Sprintf("/torrent/%s/impact", store.GenerateTestTorrent().InfoHash.String()), nil, nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTorrentPeers(t *testing.T) {
+	tkr, handler := newTestAPI()
+	tor := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(tor))
+	older := store.GenerateTestPeer()
+	older.IP = net.ParseIP("12.34.56.78")
+	older.Port = 4000
+	older.Left = 5000
+	older.Uploaded = 100
+	older.AnnounceLast = time.Now().Add(-time.Minute)
+	newer := store.GenerateTestPeer()
+	newer.IP = net.ParseIP("2001:db8:1:2::100")
+	newer.AnnounceLast = time.Now()
+	for _, p := range []store.Peer{older, newer} {
+		require.NoError(t, tkr.peers.Add(tor.InfoHash, p))
+	}
+	u := fmt.Sprintf("/torrent/%s/peers", tor.InfoHash.String())
+
+	var resp TorrentPeersResponse
+	w := performRequest(handler, "GET", u, nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, tor.InfoHash.String(), resp.InfoHash)
+	require.Len(t, resp.Peers, 2)
+	require.Equal(t, newer.PeerID.String(), resp.Peers[0].PeerID, "Peers not ordered by last announce")
+	p := resp.Peers[1]
+	require.Equal(t, "12.34.56.78", p.IP)
+	require.Equal(t, uint16(4000), p.Port)
+	require.Equal(t, uint64(5000), p.Left)
+	require.Equal(t, uint64(100), p.Uploaded)
+
+	var masked TorrentPeersResponse
+	require.Equal(t, http.StatusOK, performRequest(handler, "GET", u+"?mask_ips=1", nil, &masked).Code)
+	require.Equal(t, "2001:db8:1::", masked.Peers[0].IP)
+	require.Equal(t, "12.34.56.0", masked.Peers[1].IP)
+
+	tkr.RedactPeerIPs = true
+	var redacted TorrentPeersResponse
+	require.Equal(t, http.StatusOK, performRequest(handler, "GET", u, nil, &redacted).Code)
+	require.Empty(t, redacted.Peers[1].IP)
+	require.Zero(t, redacted.Peers[1].Port)
+
+	var empty TorrentPeersResponse
+	emptyTor := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(emptyTor))
+	w = performRequest(handler, "GET", fmt.Sprintf("/torrent/%s/peers", emptyTor.InfoHash.String()), nil, &empty)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotNil(t, empty.Peers)
+	require.Empty(t, empty.Peers)
+
+	w = performRequest(handler, "GET", fmt.Sprintf("/torrent/%s/peers", store.GenerateTestTorrent().InfoHash.String()), nil, nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
 func TestTorrentAdd(t *testing.T) {
 	tor0 := store.GenerateTestTorrent()
 	tkr, handler := newTestAPI()
@@ -97,15 +482,99 @@ func TestTorrentAdd(t *testing.T) {
 		InfoHash: tor0.InfoHash.String(),
 		MultiUp:  1.0,
 		MultiDn:  -1,
+		Size:     1 << 30,
 	}
 	w := performRequest(handler, "POST", "/torrent", tadd, nil)
 	require.Equal(t, 200, w.Code)
 	var tor1 store.Torrent
 	require.NoError(t, tkr.torrents.Get(&tor1, tor0.InfoHash, false))
 	require.Equal(t, tadd.MultiUp, tor1.MultiUp)
+	require.Equal(t, tadd.Size, tor1.Size)
 	require.Equal(t, float64(0), tor1.MultiDn)
 }
 
+func TestTorrentAllowedUsers(t *testing.T) {
+	tkr, handler := newTestAPI()
+	tkr.AllowClientIP = true
+	rh := NewBitTorrentHandler(tkr)
+	tor0 := store.GenerateTestTorrent()
+	require.NoError(t, tkr.TorrentAdd(tor0))
+	user0 := store.GenerateTestUser()
+	user1 := store.GenerateTestUser()
+	user1.UserID = user0.UserID + 1
+	require.NoError(t, tkr.users.Add(user0))
+	require.NoError(t, tkr.users.Add(user1))
+	announce := func(usr store.User) *httptest.ResponseRecorder {
+		req := testReq{Ih: tor0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: usr.Passkey}
+		return performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	}
+	u := fmt.Sprintf("/torrent/%s/allowed_users", tor0.InfoHash.String())
+	w := performRequest(handler, "POST", u, AllowedUserRequest{UserID: user0.UserID}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var allowed AllowedUsersResponse
+	w = performRequest(handler, "GET", u, nil, &allowed)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, []uint32{user0.UserID}, allowed.UserIDs)
+	require.True(t, allowed.Restricted)
+
+	require.EqualValues(t, msgOk, errCode(announce(user0).Code))
+	w = announce(user1)
+	require.EqualValues(t, msgAnnounceDenied, errCode(w.Code))
+	require.Contains(t, w.Body.String(), tkr.AllowedUsersReason)
+
+	// Removing the last allowed user leaves the torrent closed to everyone
+	w = performRequest(handler, "DELETE", fmt.Sprintf("%s/%d", u, user0.UserID), nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.EqualValues(t, msgAnnounceDenied, errCode(announce(user0).Code))
+	require.EqualValues(t, msgAnnounceDenied, errCode(announce(user1).Code))
+	w = performRequest(handler, "DELETE", fmt.Sprintf("%s/%d", u, user0.UserID), nil, nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.NoError(t, tkr.LoadAllowedUsers())
+	var tor1 store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor1, tor0.InfoHash, false))
+	require.False(t, tkr.UserAllowed(tor1, user1.UserID))
+
+	// Unrestricting the torrent opens it again
+	w = performRequest(handler, "PATCH", fmt.Sprintf("/torrent/%s", tor0.InfoHash.String()),
+		store.TorrentUpdate{Keys: []string{"restricted"}, Restricted: false}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.EqualValues(t, msgOk, errCode(announce(user1).Code))
+
+	w = performRequest(handler, "POST", fmt.Sprintf("/torrent/%s/allowed_users", store.GenerateTestTorrent().InfoHash.String()),
+		AllowedUserRequest{UserID: user0.UserID}, nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTorrentAddUppercaseHex(t *testing.T) {
+	tor0 := store.GenerateTestTorrent()
+	tkr, handler := newTestAPI()
+	tkr.AllowClientIP = true
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	ihHex := strings.ToUpper(tor0.InfoHash.String())
+	w := performRequest(handler, "POST", "/torrent", TorrentAddRequest{InfoHash: ihHex, MultiUp: 1, MultiDn: 1}, nil)
+	require.Equal(t, 200, w.Code)
+
+	// Announces using the raw bytes match the torrent
+	req := testReq{Ih: tor0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+		Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+	rh := NewBitTorrentHandler(tkr)
+	w = performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+
+	// Hex announces are only understood when enabled
+	req.IhStr = ihHex
+	w = performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgInvalidInfoHash, errCode(w.Code))
+	tkr.AcceptHexInfoHash = true
+	w = performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+	w = performRequest(rh, "GET", fmt.Sprintf("/scrape/%s?info_hash=%s", req.PK, ihHex), nil, nil)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), tor0.InfoHash.String())
+}
+
 func TestTorrentDelete(t *testing.T) {
 	tor0 := store.GenerateTestTorrent()
 	tkr, handler := newTestAPI()
@@ -118,18 +587,186 @@ func TestTorrentDelete(t *testing.T) {
 
 }
 
+func TestTorrentGet(t *testing.T) {
+	tor0 := store.GenerateTestTorrent()
+	tor0.MultiUp = 2
+	tor0.Seeders = 3
+	tkr, handler := newTestAPI()
+	require.NoError(t, tkr.torrents.Add(tor0))
+	u := fmt.Sprintf("/torrent/%s", tor0.InfoHash.String())
+	var tor1 store.Torrent
+	require.Equal(t, http.StatusOK, performRequest(handler, "GET", u, nil, &tor1).Code)
+	require.Equal(t, tor0.InfoHash, tor1.InfoHash)
+	require.Equal(t, tor0.ReleaseName, tor1.ReleaseName)
+	require.Equal(t, tor0.MultiUp, tor1.MultiUp)
+	require.Equal(t, tor0.Seeders, tor1.Seeders)
+	require.True(t, tor1.IsEnabled)
+
+	// Deleted torrents are still returned so their state can be inspected
+	deleted := store.GenerateTestTorrent()
+	deleted.IsDeleted = true
+	require.NoError(t, tkr.torrents.Add(deleted))
+	u = fmt.Sprintf("/torrent/%s", deleted.InfoHash.String())
+	require.Equal(t, http.StatusOK, performRequest(handler, "GET", u, nil, &tor1).Code)
+	require.True(t, tor1.IsDeleted)
+
+	u = fmt.Sprintf("/torrent/%s", store.GenerateTestTorrent().InfoHash.String())
+	require.Equal(t, http.StatusNotFound, performRequest(handler, "GET", u, nil, nil).Code)
+}
+
+func TestTorrentRestore(t *testing.T) {
+	tor0 := store.GenerateTestTorrent()
+	tkr, handler := newTestAPI()
+	tkr.TorrentsCache = store.NewTorrentCache()
+	require.NoError(t, tkr.torrents.Add(tor0))
+	var cached store.Torrent
+	require.NoError(t, tkr.TorrentGet(&cached, tor0.InfoHash, false))
+
+	// Soft deletes keep the torrent in the store but hide it from announces
+	u := fmt.Sprintf("/torrent/%s", tor0.InfoHash.String())
+	require.Equal(t, http.StatusOK, performRequest(handler, "DELETE", u, nil, nil).Code)
+	require.Equal(t, consts.ErrInvalidInfoHash, tkr.TorrentGet(&cached, tor0.InfoHash, false))
+	var deleted store.Torrent
+	require.NoError(t, tkr.torrents.Get(&deleted, tor0.InfoHash, true))
+	require.True(t, deleted.IsDeleted)
+
+	require.Equal(t, http.StatusOK, performRequest(handler, "POST", u+"/restore", nil, nil).Code)
+	var restored store.Torrent
+	require.NoError(t, tkr.TorrentGet(&restored, tor0.InfoHash, false))
+	require.False(t, restored.IsDeleted)
+	// Restoring an active torrent is a no-op
+	require.Equal(t, http.StatusOK, performRequest(handler, "POST", u+"/restore", nil, nil).Code)
+
+	// Hard deleted torrents are gone for good
+	require.Equal(t, http.StatusOK, performRequest(handler, "DELETE", u+"?hard=1", nil, nil).Code)
+	require.Equal(t, consts.ErrInvalidInfoHash, tkr.torrents.Get(&deleted, tor0.InfoHash, true))
+	require.Equal(t, http.StatusNotFound, performRequest(handler, "POST", u+"/restore", nil, nil).Code)
+	require.Equal(t, http.StatusNotFound, performRequest(handler, "DELETE", u, nil, nil).Code)
+}
+
+func TestAudit(t *testing.T) {
+	tor0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	tkr, handler := newTestAPI()
+	tkr.AuditLog = NewAuditLog(2)
+	require.NoError(t, tkr.torrents.Add(tor0))
+	require.NoError(t, tkr.users.Add(user0))
+	w := performRequest(handler, "DELETE", fmt.Sprintf("/torrent/%s", tor0.InfoHash.String()), nil, nil)
+	require.Equal(t, 200, w.Code)
+
+	var resp AuditPageResponse
+	w = performRequest(handler, "GET", "/audit", nil, &resp)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, 1, resp.Total)
+	require.Equal(t, auditTorrentDelete, resp.Results[0].Action)
+	require.Equal(t, tor0.InfoHash.String(), resp.Results[0].Target)
+	require.NotEmpty(t, resp.Results[0].Caller)
+	require.WithinDuration(t, time.Now(), resp.Results[0].Time, time.Minute)
+
+	w = performRequest(handler, "DELETE", fmt.Sprintf("/user/pk/%s", user0.Passkey), nil, nil)
+	require.Equal(t, 200, w.Code)
+	w = performRequest(handler, "GET", "/audit", nil, &resp)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, auditUserDelete, resp.Results[0].Action, "Most recent entry not first")
+	require.Contains(t, resp.Results[0].Target, user0.Passkey[:4])
+	require.NotContains(t, resp.Results[0].Target, user0.Passkey, "Passkey not redacted")
+
+	// Only the configured number of entries are retained
+	tor1 := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(tor1))
+	w = performRequest(handler, "DELETE", fmt.Sprintf("/torrent/%s", tor1.InfoHash.String()), nil, nil)
+	require.Equal(t, 200, w.Code)
+	w = performRequest(handler, "GET", "/audit?limit=1&offset=1", nil, &resp)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, 2, resp.Total)
+	require.Len(t, resp.Results, 1)
+	require.Equal(t, auditUserDelete, resp.Results[0].Action)
+}
+
+func TestAuditCaller(t *testing.T) {
+	tkr, handler := newTestAPI()
+	for i, tc := range []struct {
+		remote string
+		exp    string
+	}{
+		// Forwarded addresses are only used from trusted proxies
+		{"172.16.1.22:9000", "23.45.67.89"},
+		{"12.34.56.78:5000", "12.34.56.78"},
+	} {
+		tor := store.GenerateTestTorrent()
+		require.NoError(t, tkr.torrents.Add(tor))
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("/torrent/%s", tor.InfoHash.String()), nil)
+		req.RemoteAddr = tc.remote
+		req.Header.Set("X-Forwarded-For", "23.45.67.89")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code, "Test %d failed", i)
+		require.Equal(t, tc.exp, tkr.AuditLog.Entries()[0].Caller, "Test %d failed", i)
+	}
+}
+
+func TestUserAdjust(t *testing.T) {
+	tkr, handler := newTestAPI()
+	user0 := store.GenerateTestUser()
+	user0.Uploaded = 10000
+	user0.Downloaded = 10000
+	require.NoError(t, tkr.users.Add(user0))
+	path := fmt.Sprintf("/user/pk/%s/adjust", user0.Passkey)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := UserAdjustRequest{UploadedDelta: 1000, DownloadedDelta: -100}
+			if i%2 == 1 {
+				req.UploadedDelta = -500
+			}
+			codes <- performRequest(handler, "POST", path, req, nil).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		require.Equal(t, http.StatusOK, code)
+	}
+	var usr store.User
+	require.NoError(t, tkr.users.GetByPasskey(&usr, user0.Passkey))
+	require.Equal(t, uint64(10000+25*1000-25*500), usr.Uploaded, "Concurrent adjustments lost")
+	require.Equal(t, uint64(10000-50*100), usr.Downloaded, "Concurrent adjustments lost")
+
+	// Debits larger than the total clamp at zero
+	w := performRequest(handler, "POST", path, UserAdjustRequest{DownloadedDelta: -1000000}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, tkr.users.GetByPasskey(&usr, user0.Passkey))
+	require.Equal(t, uint64(0), usr.Downloaded)
+
+	var resp AuditPageResponse
+	performRequest(handler, "GET", "/audit?limit=1", nil, &resp)
+	require.Equal(t, auditUserAdjust, resp.Results[0].Action)
+	require.Contains(t, resp.Results[0].Target, "downloaded=-1000000")
+
+	w = performRequest(handler, "POST", path, UserAdjustRequest{}, nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	w = performRequest(handler, "POST", fmt.Sprintf("/user/pk/%s/adjust", store.GenerateTestUser().Passkey),
+		UserAdjustRequest{UploadedDelta: 1}, nil)
+	require.Equal(t, http.StatusNotFound, w.Code)
+}
+
 func TestTorrentUpdate(t *testing.T) {
 	tor0 := store.GenerateTestTorrent()
 	tkr, handler := newTestAPI()
 	require.NoError(t, tkr.torrents.Add(tor0))
 	tup := store.TorrentUpdate{
-		Keys:        []string{"release_name", "is_deleted", "is_enabled", "reason", "multi_up", "multi_dn"},
+		Keys:        []string{"release_name", "is_deleted", "is_enabled", "reason", "multi_up", "multi_dn", "max_peers"},
 		ReleaseName: "new_name",
 		IsDeleted:   false,
 		IsEnabled:   false,
 		Reason:      "reason",
 		MultiUp:     2.0,
 		MultiDn:     0.5,
+		MaxPeers:    10,
 	}
 	p := fmt.Sprintf("/torrent/%s", tor0.InfoHash.String())
 	w := performRequest(handler, "PATCH", p, tup, nil)
@@ -141,6 +778,7 @@ func TestTorrentUpdate(t *testing.T) {
 	require.Equal(t, tup.Reason, tor1.Reason)
 	require.Equal(t, tup.MultiUp, tor1.MultiUp)
 	require.Equal(t, tup.MultiDn, tor1.MultiDn)
+	require.Equal(t, tup.MaxPeers, tor1.MaxPeers)
 
 	// Deleted torrents should not be fetchable after update
 	w2 := performRequest(handler, "PATCH", p, store.TorrentUpdate{
@@ -152,6 +790,62 @@ func TestTorrentUpdate(t *testing.T) {
 	require.Equal(t, consts.ErrInvalidInfoHash, tkr.torrents.Get(&tor2, tor0.InfoHash, false))
 }
 
+func TestTorrentUpdateMultipliers(t *testing.T) {
+	tor0 := store.GenerateTestTorrent()
+	tkr, handler := newTestAPI()
+	require.NoError(t, tkr.torrents.Add(tor0))
+	p := fmt.Sprintf("/torrent/%s", tor0.InfoHash.String())
+	w := performRequest(handler, "PATCH", p, store.TorrentUpdate{
+		Keys:    []string{"multi_up", "multi_dn"},
+		MultiUp: -1,
+		MultiDn: -2.5,
+	}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var tor1 store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor1, tor0.InfoHash, false))
+	require.Equal(t, 0.0, tor1.MultiUp)
+	require.Equal(t, 0.0, tor1.MultiDn)
+
+	for _, key := range []string{"multi_up", "multi_dn"} {
+		w = performRequest(handler, "PATCH", p, store.TorrentUpdate{
+			Keys:    []string{key},
+			MultiUp: 101,
+			MultiDn: 101,
+			Version: tor1.Version,
+		}, nil)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Contains(t, w.Body.String(), key)
+	}
+	var tor2 store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor2, tor0.InfoHash, false))
+	require.Equal(t, 0.0, tor2.MultiUp, "Rejected update applied")
+}
+
+func TestTorrentUpdateConflict(t *testing.T) {
+	tor0 := store.GenerateTestTorrent()
+	tkr, handler := newTestAPI()
+	require.NoError(t, tkr.torrents.Add(tor0))
+	p := fmt.Sprintf("/torrent/%s", tor0.InfoHash.String())
+	// Both clients read the same version before updating
+	var fetched store.Torrent
+	require.NoError(t, tkr.torrents.Get(&fetched, tor0.InfoHash, false))
+	w := performRequest(handler, "PATCH", p, store.TorrentUpdate{
+		Keys:    []string{"reason", "version"},
+		Reason:  "first",
+		Version: fetched.Version,
+	}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w2 := performRequest(handler, "PATCH", p, store.TorrentUpdate{
+		Keys:    []string{"reason", "version"},
+		Reason:  "second",
+		Version: fetched.Version,
+	}, nil)
+	require.Equal(t, http.StatusConflict, w2.Code)
+	var tor1 store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor1, tor0.InfoHash, false))
+	require.Equal(t, "first", tor1.Reason)
+}
+
 func TestConfigUpdate(t *testing.T) {
 	toDuration := func(seconds int) time.Duration {
 		d, err := time.ParseDuration(fmt.Sprintf("%ds", seconds))
@@ -192,8 +886,391 @@ func TestConfigUpdate(t *testing.T) {
 	require.Equal(t, args.TrackerAllowNonRoutable, tkr.AllowNonRoutable)
 }
 
+func TestApplyConfig(t *testing.T) {
+	tkr, _ := newTestAPI()
+	for _, k := range []config.Key{config.TrackerMaxPeers, config.TrackerAnnounceInterval, config.TrackerAutoRegister} {
+		defer viper.Set(string(k), viper.Get(string(k)))
+	}
+	config.Set(config.TrackerMaxPeers, 77)
+	config.Set(config.TrackerAnnounceInterval, "95s")
+	config.Set(config.TrackerAutoRegister, !tkr.AutoRegister)
+	autoRegister := !tkr.AutoRegister
+	tkr.applyConfig()
+	require.Equal(t, 77, tkr.MaxPeers)
+	require.Equal(t, 95*time.Second, tkr.AnnInterval)
+	require.Equal(t, autoRegister, tkr.AutoRegister)
+}
+
+func TestConfigPersist(t *testing.T) {
+	tkr, handler := newTestAPI()
+	tkr.PersistConfig = true
+	fileMaxPeers := config.GetInt(config.TrackerMaxPeers)
+	defer viper.Set(string(config.TrackerMaxPeers), fileMaxPeers)
+	defer viper.Set(string(config.TrackerAnnounceInterval), config.GetDuration(config.TrackerAnnounceInterval))
+	args := ConfigRequest{
+		UpdateKeys:              []config.Key{config.TrackerMaxPeers, config.TrackerAnnounceInterval},
+		TrackerMaxPeers:         fileMaxPeers + 25,
+		TrackerAnnounceInterval: 90,
+	}
+	w := performRequest(handler, "PATCH", "/config", args, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// Simulate a restart, reading the file value back before applying the persisted values
+	viper.Set(string(config.TrackerMaxPeers), fileMaxPeers)
+	require.NoError(t, LoadPersistedConfig(tkr.torrents))
+	require.Equal(t, args.TrackerMaxPeers, config.GetInt(config.TrackerMaxPeers))
+	require.Equal(t, 90*time.Second, config.GetDuration(config.TrackerAnnounceInterval))
+
+	opts := NewDefaultOpts()
+	opts.Torrents = tkr.torrents
+	opts.MaxPeers = config.GetInt(config.TrackerMaxPeers)
+	restarted, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	require.Equal(t, args.TrackerMaxPeers, restarted.MaxPeers)
+}
+
+func TestWhitelistReload(t *testing.T) {
+	tkr, handler := newTestAPI()
+	require.NoError(t, tkr.torrents.WhiteListAdd(store.WhiteListClient{ClientPrefix: "-qB4170-", ClientName: "qBittorrent"}))
+	require.NoError(t, tkr.torrents.WhiteListAdd(store.WhiteListClient{ClientPrefix: "-TR2940-", ClientName: "Transmission"}))
+	require.Equal(t, 0, len(tkr.Whitelist))
+	var resp WhitelistReloadResponse
+	w := performRequest(handler, "POST", "/whitelist/reload", nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, 2, resp.Count)
+	require.True(t, tkr.ClientWhitelisted(store.PeerIDFromString("-qB4170-u-rGseINmloG")))
+	require.NoError(t, tkr.torrents.WhiteListDelete(store.WhiteListClient{ClientPrefix: "-qB4170-"}))
+	w2 := performRequest(handler, "POST", "/whitelist/reload", nil, &resp)
+	require.Equal(t, http.StatusOK, w2.Code)
+	require.Equal(t, 1, resp.Count)
+	require.False(t, tkr.ClientWhitelisted(store.PeerIDFromString("-qB4170-u-rGseINmloG")))
+}
+
 func TestMain(m *testing.M) {
 	_ = config.Read("")
 	retVal := m.Run()
 	os.Exit(retVal)
 }
+
+func TestTorrentList(t *testing.T) {
+	tkr, handler := newTestAPI()
+	var added []store.Torrent
+	for i := 0; i < 5; i++ {
+		tor := store.GenerateTestTorrent()
+		require.NoError(t, tkr.torrents.Add(tor))
+		added = append(added, tor)
+	}
+	expected := store.TorrentPage(added, 1, 2)
+	var resp []store.Torrent
+	w := performRequest(handler, "GET", "/torrents?offset=1&limit=2", nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "5", w.Header().Get("X-Total-Count"))
+	require.Len(t, resp, 2)
+	for i := range expected {
+		require.Equal(t, expected[i].InfoHash, resp[i].InfoHash)
+	}
+	w = performRequest(handler, "GET", "/torrents?offset=10", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.JSONEq(t, "[]", w.Body.String())
+	require.Equal(t, http.StatusBadRequest, performRequest(handler, "GET", "/torrents?limit=x", nil, nil).Code)
+}
+
+func TestWhitelistAddPattern(t *testing.T) {
+	tkr, handler := newTestAPI()
+	w := performRequest(handler, "POST", "/whitelist", store.WhiteListClient{
+		ClientPrefix: "-UT35??-", ClientName: "uTorrent", MatchType: store.MatchGlob,
+	}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.True(t, tkr.ClientWhitelisted(store.PeerIDFromString("-UT3550-u-rGseINmloG")))
+	require.Equal(t, "uTorrent", tkr.ClientName(store.PeerIDFromString("-UT35B0-u-rGseINmloG")))
+	require.False(t, tkr.ClientWhitelisted(store.PeerIDFromString("-UT3450-u-rGseINmloG")))
+
+	w = performRequest(handler, "POST", "/whitelist", store.WhiteListClient{
+		ClientPrefix: "-TR(", ClientName: "Transmission", MatchType: store.MatchRegex,
+	}, nil)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Len(t, tkr.Whitelist, 1, "Invalid pattern added")
+}
+
+func TestWhitelistGetPaged(t *testing.T) {
+	tkr, handler := newTestAPI()
+	for i := 0; i < 5; i++ {
+		wl := store.WhiteListClient{ClientPrefix: fmt.Sprintf("-TR29%d0-", 4-i), ClientName: "Transmission"}
+		require.NoError(t, tkr.torrents.WhiteListAdd(wl))
+	}
+	var resp []store.WhiteListClient
+	w := performRequest(handler, "GET", "/whitelist?offset=1&limit=2", nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "5", w.Header().Get("X-Total-Count"))
+	require.Equal(t, []store.WhiteListClient{
+		{ClientPrefix: "-TR2910-", ClientName: "Transmission"},
+		{ClientPrefix: "-TR2920-", ClientName: "Transmission"},
+	}, resp)
+	w2 := performRequest(handler, "GET", "/whitelist?offset=10", nil, &resp)
+	require.Equal(t, http.StatusOK, w2.Code)
+	require.Equal(t, "5", w2.Header().Get("X-Total-Count"))
+	require.Equal(t, "[]", w2.Body.String(), "Empty page not an array")
+	for _, q := range []string{"offset=-1", "limit=0", "limit=x"} {
+		require.Equal(t, http.StatusBadRequest, performRequest(handler, "GET", "/whitelist?"+q, nil, nil).Code, q)
+	}
+
+	// Oversized limits are clamped rather than rejected
+	tkr.MaxPageLimit = 3
+	w3 := performRequest(handler, "GET", "/whitelist?limit=1000000000", nil, &resp)
+	require.Equal(t, http.StatusOK, w3.Code)
+	require.Equal(t, "3", w3.Header().Get("X-Max-Limit"))
+	require.Equal(t, "5", w3.Header().Get("X-Total-Count"))
+	require.Len(t, resp, 3)
+}
+
+func TestPeersActive(t *testing.T) {
+	tkr, handler := newTestAPI()
+	for i := 0; i < 3; i++ {
+		tor := store.GenerateTestTorrent()
+		require.NoError(t, tkr.torrents.Add(tor))
+		for j := 0; j < 2; j++ {
+			require.NoError(t, tkr.peers.Add(tor.InfoHash, store.GenerateTestPeer()))
+		}
+	}
+	var all ActivePeersResponse
+	w := performRequest(handler, "GET", "/peers/active", nil, &all)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, 6, all.Total)
+	require.Len(t, all.Results, 6)
+	for _, p := range all.Results {
+		require.NotEmpty(t, p.IP)
+	}
+	var page ActivePeersResponse
+	w2 := performRequest(handler, "GET", "/peers/active?offset=2&limit=3", nil, &page)
+	require.Equal(t, http.StatusOK, w2.Code)
+	require.Equal(t, 6, page.Total)
+	require.Equal(t, all.Results[2:5], page.Results)
+	require.Equal(t, http.StatusBadRequest, performRequest(handler, "GET", "/peers/active?limit=0", nil, nil).Code)
+
+	tkr.RedactPeerIPs = true
+	var redacted ActivePeersResponse
+	w3 := performRequest(handler, "GET", "/peers/active?limit=1", nil, &redacted)
+	require.Equal(t, http.StatusOK, w3.Code)
+	require.Len(t, redacted.Results, 1)
+	require.Empty(t, redacted.Results[0].IP)
+}
+
+func TestClientStats(t *testing.T) {
+	tkr, handler := newTestAPI()
+	tkr.Whitelist["-qB"] = store.WhiteListClient{ClientPrefix: "-qB", ClientName: "qBittorrent"}
+	tkr.Whitelist["-TR2940-"] = store.WhiteListClient{ClientPrefix: "-TR2940-", ClientName: "Transmission"}
+	tor := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(tor))
+	for i, prefix := range []string{"-qB4170-", "-qB4500-", "-qB4630-", "-qB4170-", "-TR2940-", "-TR2940-", "-XX1000-", "-DE13F0-"} {
+		p := store.GenerateTestPeer()
+		p.PeerID = store.PeerIDFromString(fmt.Sprintf("%s%012d", prefix, i))
+		require.NoError(t, tkr.peers.Add(tor.InfoHash, p))
+	}
+	var resp ClientStatsResponse
+	w := performRequest(handler, "GET", "/stats/clients", nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, 8, resp.Total)
+	require.Equal(t, []ClientStat{
+		{Client: "qBittorrent", Count: 4, Share: 50},
+		{Client: "Transmission", Count: 2, Share: 25},
+		{Client: clientOther, Count: 2, Share: 25},
+	}, resp.Clients)
+}
+
+func TestUserGetWriteBehind(t *testing.T) {
+	tkr, handler := newTestAPI()
+	tkr.UserStatsCache = store.NewUserStatsCache()
+	tkr.BatchInterval = time.Millisecond * 500
+	torrent0 := store.GenerateTestTorrent()
+	torrent0.MultiUp = 1.0
+	torrent0.MultiDn = 1.0
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	go tkr.StatWorker()
+	for _, up := range []uint64{1000, 2000} {
+		tkr.StateUpdateChan <- store.UpdateState{
+			Passkey:    user0.Passkey,
+			MultiUp:    user0.MultiUp,
+			MultiDn:    user0.MultiDn,
+			InfoHash:   torrent0.InfoHash,
+			PeerID:     store.GenerateTestPeer().PeerID,
+			Uploaded:   up,
+			Downloaded: 500,
+			Left:       1000,
+			Timestamp:  time.Now(),
+		}
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// Reads include the pending stats before they are flushed
+	var stored store.User
+	require.NoError(t, tkr.users.GetByPasskey(&stored, user0.Passkey))
+	require.Equal(t, user0.Uploaded, stored.Uploaded, "Stats flushed early")
+	var resp store.User
+	w := performRequest(handler, "GET", "/user/pk/"+user0.Passkey, nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, user0.Uploaded+3000, resp.Uploaded)
+	require.Equal(t, user0.Downloaded+1000, resp.Downloaded)
+	require.Equal(t, user0.Announces+2, resp.Announces)
+
+	// Once flushed the stats are persisted and no longer pending
+	time.Sleep(time.Millisecond * 600)
+	require.NoError(t, tkr.users.GetByPasskey(&stored, user0.Passkey))
+	require.Equal(t, user0.Uploaded+3000, stored.Uploaded)
+	require.Equal(t, user0.Downloaded+1000, stored.Downloaded)
+	_, pending := tkr.UserStatsCache.Pending(user0.Passkey)
+	require.False(t, pending)
+	w2 := performRequest(handler, "GET", "/user/pk/"+user0.Passkey, nil, &resp)
+	require.Equal(t, http.StatusOK, w2.Code)
+	require.Equal(t, stored.Uploaded, resp.Uploaded)
+
+	require.Equal(t, http.StatusNotFound, performRequest(handler, "GET", "/user/pk/xxxxxxxxxxxxxxxxxxxx", nil, nil).Code)
+}
+
+// unavailableUserStore simulates a user store which is temporarily unreachable
+type unavailableUserStore struct {
+	store.UserStore
+}
+
+func (s unavailableUserStore) GetByPasskey(_ *store.User, _ string) error {
+	return errors.New("dial tcp: connection refused")
+}
+
+func (s unavailableUserStore) Ping() error {
+	return errors.New("dial tcp: connection refused")
+}
+
+func TestHealthz(t *testing.T) {
+	tkr, handler := newTestAPI()
+	tkr.APIKey = "secret"
+	defer func() { tkr.APIKey = "" }()
+	var resp HealthResponse
+	w := performRequest(handler, "GET", "/healthz", nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code, "Health check required the api key")
+	require.Equal(t, "ok", resp.Status)
+	require.Empty(t, resp.Failed)
+
+	tkr.users = unavailableUserStore{UserStore: tkr.users}
+	tkr.torrents = unavailableTorrentStore{TorrentStore: tkr.torrents}
+	w = performRequest(handler, "GET", "/healthz", nil, nil)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.JSONEq(t, `{"status":"unavailable","failed":["torrent_store","user_store"]}`, w.Body.String())
+}
+
+func TestUserGetStoreError(t *testing.T) {
+	tkr, handler := newTestAPI()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	tkr.users = unavailableUserStore{UserStore: tkr.users}
+	w := performRequest(handler, "GET", "/user/pk/"+user0.Passkey, nil, nil)
+	require.Equal(t, http.StatusInternalServerError, w.Code, "Store errors reported as unknown user")
+}
+
+type mockGeoProvider struct {
+	geo.DummyProvider
+	metadata geo.Metadata
+	closed   bool
+}
+
+func (m *mockGeoProvider) Metadata() geo.Metadata {
+	return m.metadata
+}
+
+func (m *mockGeoProvider) Close() {
+	m.closed = true
+}
+
+func TestGeodbUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-geodb")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	viper.Set(string(config.GeodbPath), dir)
+	viper.Set(string(config.GeodbAPIKey), "test-key")
+	defer viper.Set(string(config.GeodbAPIKey), "")
+	origDownload, origOpen := geoDownloadDB, geoOpenDB
+	defer func() { geoDownloadDB, geoOpenDB = origDownload, origOpen }()
+
+	buildDate := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	newDb := &mockGeoProvider{metadata: geo.Metadata{BuildDate: buildDate, ASNRecords4: 10, ASNRecords6: 5}}
+	geoDownloadDB = func(outPath string, key string) error {
+		require.Equal(t, "test-key", key)
+		return ioutil.WriteFile(filepath.Join(outPath, "geo.bin"), []byte("new"), 0600)
+	}
+	geoOpenDB = func(path string) (geo.Provider, error) {
+		if _, err := os.Stat(filepath.Join(path, "geo.bin")); err != nil {
+			return nil, err
+		}
+		return newDb, nil
+	}
+	tkr, handler := newTestAPI()
+	oldDb := &mockGeoProvider{}
+	tkr.SetGeodb(oldDb, false)
+
+	var resp GeodbUpdateResponse
+	w := performRequest(handler, "POST", "/geodb/update", nil, &resp)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, dir, resp.Path)
+	require.True(t, buildDate.Equal(resp.BuildDate))
+	require.Equal(t, 10, resp.ASNRecords4)
+	require.Equal(t, 5, resp.ASNRecords6)
+	require.Equal(t, newDb, tkr.Geodb, "Provider not swapped")
+	require.True(t, tkr.geodbEnabled())
+	require.True(t, oldDb.closed, "Previous provider not closed")
+	require.False(t, newDb.closed)
+	require.FileExists(t, filepath.Join(dir, "geo.bin"))
+
+	// A database failing verification leaves the current provider in place
+	geoOpenDB = func(path string) (geo.Provider, error) {
+		return nil, errors.New("corrupt database")
+	}
+	w2 := performRequest(handler, "POST", "/geodb/update", nil, nil)
+	require.Equal(t, http.StatusInternalServerError, w2.Code)
+	require.Equal(t, newDb, tkr.Geodb)
+	require.False(t, newDb.closed)
+}
+
+func TestGeodbUpdater(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mika-geodb")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	viper.Set(string(config.GeodbPath), dir)
+	viper.Set(string(config.GeodbAPIKey), "test-key")
+	defer viper.Set(string(config.GeodbAPIKey), "")
+	origDownload, origOpen := geoDownloadDB, geoOpenDB
+	defer func() { geoDownloadDB, geoOpenDB = origDownload, origOpen }()
+	var downloads int32
+	newDb := &mockGeoProvider{}
+	geoDownloadDB = func(outPath string, key string) error {
+		atomic.AddInt32(&downloads, 1)
+		return ioutil.WriteFile(filepath.Join(outPath, "geo.bin"), []byte("new"), 0600)
+	}
+	geoOpenDB = func(path string) (geo.Provider, error) {
+		return newDb, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := NewDefaultOpts()
+	opts.GeodbUpdateInterval = 50 * time.Millisecond
+	tkr, err := New(ctx, opts)
+	require.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		tkr.GeodbUpdater()
+		close(done)
+	}()
+
+	// Nothing is downloaded while geo lookups are disabled
+	time.Sleep(150 * time.Millisecond)
+	require.Zero(t, atomic.LoadInt32(&downloads))
+
+	oldDb := &mockGeoProvider{}
+	tkr.SetGeodb(oldDb, true)
+	require.Eventually(t, func() bool {
+		tkr.GeodbMu.RLock()
+		defer tkr.GeodbMu.RUnlock()
+		return tkr.Geodb == newDb
+	}, time.Second, 10*time.Millisecond, "Provider not swapped")
+	cancel()
+	<-done
+	require.True(t, oldDb.closed, "Previous provider not closed")
+}
@@ -0,0 +1,77 @@
+package tracker
+
+import (
+	"sync"
+	"time"
+)
+
+// Audit log actions
+const (
+	auditTorrentDelete  = "torrent_delete"
+	auditTorrentRestore = "torrent_restore"
+	auditUserDelete     = "user_delete"
+	auditUserAdjust     = "user_adjust"
+)
+
+// AuditEntry records a single destructive action made over the admin API, or an announce
+// flagged for review
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Target identifies what the action was applied to, eg: the info_hash of a deleted torrent
+	Target string `json:"target"`
+	// Caller is the remote address the request was made from
+	Caller string `json:"caller"`
+}
+
+// AuditLog is a fixed size in-memory ring of the most recent audit entries. Once full the
+// oldest entries are overwritten.
+type AuditLog struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+	next    int
+	full    bool
+}
+
+// NewAuditLog returns an audit log which retains up to size entries
+func NewAuditLog(size int) *AuditLog {
+	if size <= 0 {
+		size = 1
+	}
+	return &AuditLog{entries: make([]AuditEntry, size)}
+}
+
+// Add records a new entry, replacing the oldest entry when full
+func (l *AuditLog) Add(entry AuditEntry) {
+	l.mu.Lock()
+	l.entries[l.next] = entry
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+	l.mu.Unlock()
+}
+
+// Entries returns the retained entries with the most recent first
+func (l *AuditLog) Entries() []AuditEntry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	count := l.next
+	if l.full {
+		count = len(l.entries)
+	}
+	out := make([]AuditEntry, count)
+	for i := 0; i < count; i++ {
+		out[i] = l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+	}
+	return out
+}
+
+// redactPasskeyPrefix keeps only enough of a passkey to identify it when investigating
+func redactPasskeyPrefix(passkey string) string {
+	const keep = 4
+	if len(passkey) <= keep {
+		return "[redacted]"
+	}
+	return passkey[:keep] + "[redacted]"
+}
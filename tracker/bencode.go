@@ -0,0 +1,122 @@
+package tracker
+
+import (
+	"bytes"
+	"github.com/chihaya/bencode"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// maxPooledBufferSize stops unusually large buffers, such as those for huge peer lists, from
+// being kept around in the pool
+const maxPooledBufferSize = 64 << 10
+
+// announceBuffers holds the buffers used to build an announce response. They are pooled so
+// the hot announce path does not allocate them for every request.
+type announceBuffers struct {
+	peers  []byte
+	peers6 []byte
+	out    []byte
+}
+
+var announceBufferPool = sync.Pool{
+	New: func() interface{} {
+		return &announceBuffers{
+			peers: make([]byte, 0, 512),
+			out:   make([]byte, 0, 1024),
+		}
+	},
+}
+
+// getAnnounceBuffers returns a set of empty buffers which must be released once the
+// response has been written
+func getAnnounceBuffers() *announceBuffers {
+	b := announceBufferPool.Get().(*announceBuffers)
+	b.peers, b.peers6, b.out = b.peers[:0], b.peers6[:0], b.out[:0]
+	return b
+}
+
+// release returns the buffers to the pool. Nothing referencing them may be used afterwards.
+func (b *announceBuffers) release() {
+	if cap(b.peers) > maxPooledBufferSize || cap(b.peers6) > maxPooledBufferSize ||
+		cap(b.out) > maxPooledBufferSize {
+		return
+	}
+	announceBufferPool.Put(b)
+}
+
+// appendBencode appends the bencoded value to b. The types used in tracker responses are
+// encoded directly, avoiding the per write allocations of the bencode package which is only
+// used as a fallback for other types. Dict keys are written in sorted order.
+func appendBencode(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		b = strconv.AppendInt(b, int64(len(v)), 10)
+		b = append(b, ':')
+		return append(b, v...), nil
+	case []byte:
+		b = strconv.AppendInt(b, int64(len(v)), 10)
+		b = append(b, ':')
+		return append(b, v...), nil
+	case int:
+		return appendBencodeInt(b, int64(v)), nil
+	case int64:
+		return appendBencodeInt(b, v), nil
+	case int32:
+		return appendBencodeInt(b, int64(v)), nil
+	case uint32:
+		return appendBencodeInt(b, int64(v)), nil
+	case uint16:
+		return appendBencodeInt(b, int64(v)), nil
+	case bencode.List:
+		return appendBencodeList(b, v)
+	case []interface{}:
+		return appendBencodeList(b, v)
+	case bencode.Dict:
+		return appendSortedDict(b, v)
+	default:
+		var buf bytes.Buffer
+		if err := bencode.NewEncoder(&buf).Encode(v); err != nil {
+			return b, err
+		}
+		return append(b, buf.Bytes()...), nil
+	}
+}
+
+func appendBencodeInt(b []byte, v int64) []byte {
+	b = append(b, 'i')
+	b = strconv.AppendInt(b, v, 10)
+	return append(b, 'e')
+}
+
+func appendBencodeList(b []byte, list []interface{}) ([]byte, error) {
+	var err error
+	b = append(b, 'l')
+	for _, v := range list {
+		if b, err = appendBencode(b, v); err != nil {
+			return b, err
+		}
+	}
+	return append(b, 'e'), nil
+}
+
+// appendSortedDict bencodes the dict with its keys in sorted order as the spec requires
+func appendSortedDict(b []byte, dict bencode.Dict) ([]byte, error) {
+	// Responses have few keys so sorting them doesn't need a heap allocation
+	var keyBuf [8]string
+	keys := keyBuf[:0]
+	for k := range dict {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var err error
+	b = append(b, 'd')
+	for _, k := range keys {
+		b, _ = appendBencode(b, k)
+		if b, err = appendBencode(b, dict[k]); err != nil {
+			return b, err
+		}
+	}
+	return append(b, 'e'), nil
+}
@@ -0,0 +1,158 @@
+package tracker
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// breakerState is the state of a storeBreaker, the values are exported as the
+// t_store_breaker_state metric
+type breakerState int64
+
+const (
+	// breakerClosed lets all store calls through
+	breakerClosed breakerState = iota
+	// breakerHalfOpen lets a single probe through to check if the store has recovered
+	breakerHalfOpen
+	// breakerOpen short circuits store calls until the next probe is due
+	breakerOpen
+)
+
+// errBreakerOpen is reported for announces answered without calling the store because the
+// breaker is open
+var errBreakerOpen = errors.New("store circuit breaker open")
+
+// storeBreaker stops announces from calling a failing store. After threshold consecutive
+// failures the breaker opens and announces are answered with degraded responses. Once every
+// probeInterval a single announce is let through as a probe, closing the breaker when it
+// succeeds and reopening it when it fails.
+type storeBreaker struct {
+	mu            sync.Mutex
+	threshold     int
+	probeInterval time.Duration
+	state         breakerState
+	failures      int
+	lastProbe     time.Time
+}
+
+// newStoreBreaker returns a breaker opening after threshold consecutive failures. A threshold
+// of 0 disables the breaker.
+func newStoreBreaker(threshold int, probeInterval time.Duration) *storeBreaker {
+	return &storeBreaker{
+		threshold:     threshold,
+		probeInterval: probeInterval,
+	}
+}
+
+// allow returns true if the announce may call the store. While open, one announce is allowed
+// per probe interval to test the store.
+func (b *storeBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerClosed {
+		return true
+	}
+	// Half open breakers that never saw the result of their probe, such as when the probe
+	// was rejected before reaching the store, probe again after the interval
+	if time.Since(b.lastProbe) < b.probeInterval {
+		return false
+	}
+	b.lastProbe = time.Now()
+	b.setState(breakerHalfOpen)
+	return true
+}
+
+// success records a store call that completed, closing the breaker
+func (b *storeBreaker) success() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	if b.state != breakerClosed {
+		log.Infof("Store recovered, closing circuit breaker")
+		b.setState(breakerClosed)
+	}
+}
+
+// failure records a failed store call, opening the breaker once the threshold is reached or
+// when a probe fails
+func (b *storeBreaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerOpen || (b.state == breakerClosed && b.failures < b.threshold) {
+		return
+	}
+	if b.state == breakerClosed {
+		log.Errorf("Store failed %d consecutive times, opening circuit breaker", b.failures)
+	}
+	b.lastProbe = time.Now()
+	b.setState(breakerOpen)
+	atomic.AddInt64(&metrics.StoreBreakerTrips, 1)
+}
+
+// current returns the state of the breaker
+func (b *storeBreaker) current() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *storeBreaker) setState(state breakerState) {
+	b.state = state
+	atomic.StoreInt64(&metrics.StoreBreakerState, int64(state))
+}
+
+// storeAllowedKey caches the breaker decision on the request context
+const storeAllowedKey = "store_allowed"
+
+// storeAllowed returns true if the breaker lets the request call the store. The breaker is
+// only asked once per request, so the user and torrent lookups of an announce share a probe.
+func (t *Tracker) storeAllowed(c *gin.Context) bool {
+	if allowed, found := c.Get(storeAllowedKey); found {
+		return allowed.(bool)
+	}
+	allowed := t.storeBreaker.allow()
+	c.Set(storeAllowedKey, allowed)
+	return allowed
+}
+
+// requestUser fetches the user of the passkey sent with a request. Users missing from the
+// cache are only looked up while the breaker allows store calls, and failed lookups count
+// towards opening it.
+func (t *Tracker) requestUser(c *gin.Context, usr *store.User, pk string) error {
+	if t.UsersCache != nil && t.UsersCache.Get(usr, pk) {
+		return nil
+	}
+	if !t.storeAllowed(c) {
+		return errBreakerOpen
+	}
+	err := t.UserGet(usr, pk)
+	if userStoreFailed(err) {
+		atomic.AddInt64(&metrics.StoreFailures, 1)
+		t.storeBreaker.failure()
+	}
+	return err
+}
+
+// userStoreFailed returns true if a user lookup failed for a reason other than the passkey
+// being unknown or invalid
+func userStoreFailed(err error) bool {
+	return err != nil && !errors.Is(err, consts.ErrInvalidUser) && !errors.Is(err, consts.ErrUnauthorized) &&
+		!errors.Is(err, consts.ErrInvalidState)
+}
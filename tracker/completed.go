@@ -0,0 +1,64 @@
+package tracker
+
+import (
+	"fmt"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+	"time"
+)
+
+// Policies applied to completed events reporting far less downloaded than the torrent size,
+// which are usually faked to inflate snatch counts
+const (
+	// completedCheckOff counts all completed events
+	completedCheckOff = "off"
+	// completedCheckWarn counts the completed event but records it in the audit log for review
+	completedCheckWarn = "warn"
+	// completedCheckReject turns away the announce so the snatch is not counted
+	completedCheckReject = "reject"
+)
+
+// auditImplausibleCompleted is the audit action recorded for implausible completed events
+const auditImplausibleCompleted = "implausible_completed"
+
+// validCompletedCheck returns true for known completed event policies
+func validCompletedCheck(policy string) bool {
+	switch policy {
+	case completedCheckOff, completedCheckWarn, completedCheckReject:
+		return true
+	}
+	return false
+}
+
+// completedPlausible returns true if the downloaded amount of a completed event is within
+// CompletedTolerance of the torrent size. Torrents without a known size can't be checked.
+func (t *Tracker) completedPlausible(req *AnnounceRequest, tor store.Torrent) bool {
+	if tor.Size == 0 {
+		return true
+	}
+	return float64(req.Downloaded) >= float64(tor.Size)*(1-t.CompletedTolerance)
+}
+
+// completedAllowed applies the completed check policy to a completed event. It returns false
+// if the announce should be rejected.
+func (t *Tracker) completedAllowed(req *AnnounceRequest, tor store.Torrent, usr store.User, ip string) bool {
+	if t.CompletedCheck == completedCheckOff || t.completedPlausible(req, tor) {
+		return true
+	}
+	atomic.AddInt64(&metrics.AnnounceImplausibleCompleted, 1)
+	log.Warnf("Implausible completed event on %s from user %d: downloaded %d of %d",
+		tor.InfoHash.String(), usr.UserID, req.Downloaded, tor.Size)
+	if t.CompletedCheck == completedCheckReject {
+		return false
+	}
+	t.AuditLog.Add(AuditEntry{
+		Time:   time.Now(),
+		Action: auditImplausibleCompleted,
+		Target: fmt.Sprintf("%s user %d downloaded %d/%d", tor.InfoHash.String(), usr.UserID,
+			req.Downloaded, tor.Size),
+		Caller: ip,
+	})
+	return true
+}
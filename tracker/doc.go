@@ -5,23 +5,50 @@
 //	 - /:passkey/announce
 //   - /:passkey/scrape
 //
-// API routes:
+// API routes, which require an Authorization: Bearer <api_key> header when api_key is set:
 //
 //  - General
 //    - POST /ping
+//    - GET /healthz (never requires the api key)
 //    - GET /tracker/stats
 //    - PATCH /config
+//    - POST /geodb/update
+//    - GET /audit?offset=0&limit=100
+//    - GET /metrics (prometheus), GET /metrics?format=influx (influx line protocol)
 //
 //	- Torrents
-//    - DELETE /torrent/:info_hash
+//    - GET /torrent/:info_hash
+//    - DELETE /torrent/:info_hash?hard=1 (soft deletes unless hard=1)
 //    - PATCH /torrent/:info_hash
+//    - POST /torrent/:info_hash/restore
+//    - GET /torrent/:info_hash/impact
+//    - GET /torrent/:info_hash/peers?mask_ips=1
+//    - GET /torrent/:info_hash/allowed_users
+//    - POST /torrent/:info_hash/allowed_users
+//    - DELETE /torrent/:info_hash/allowed_users/:user_id
 //    - POST /torrent
+//    - GET /torrents?offset=0&limit=100
 //    - POST /whitelist
-//    - GET /whitelist
+//    - GET /whitelist?offset=0&limit=100 (total in the X-Total-Count header)
+//    - POST /whitelist/reload
 //    - DELETE/whitelist/:prefix
+//    - POST /denylist/infohash
+//    - GET /denylist/infohash?offset=0&limit=100
+//    - DELETE /denylist/infohash/:info_hash
+//
+//	- Peers
+//    - GET /peers/active?offset=0&limit=100
+//
+//	- Stats
+//    - GET /stats/clients
 //
 //	- Users
 //    - POST /user
+//    - GET /user/pk/:passkey
 //    - DELETE /user/pk/:passkey
+//    - POST /user/pk/:passkey/adjust
+//    - GET /user/pk/:passkey/announces
+//    - GET /user/pk/:passkey/torrents?offset=0&limit=100
+//    - GET /user/pk/:passkey/hnr
 //
 package tracker
@@ -0,0 +1,80 @@
+package tracker
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"github.com/leighmacdonald/mika/metrics"
+	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
+	"sync/atomic"
+	"time"
+)
+
+// Policies applied when a user announces with a peer_id already active in the swarm under
+// another user, such as when a client has been cloned between machines
+const (
+	// duplicatePeerIDAllow lets the announce update the existing peer
+	duplicatePeerIDAllow = "allow"
+	// duplicatePeerIDReject turns away the announce
+	duplicatePeerIDReject = "reject"
+	// duplicatePeerIDFlag allows the announce but records it in the audit log for review
+	duplicatePeerIDFlag = "flag"
+	// duplicatePeerIDSeparate keys peers by user and peer_id so each user has their own peer
+	duplicatePeerIDSeparate = "separate"
+)
+
+// auditDuplicatePeerID is the audit action recorded for flagged duplicate peer_ids
+const auditDuplicatePeerID = "duplicate_peer_id"
+
+// clientPrefixLen is the length of the client and version prefix of a peer_id which is kept
+// as-is in user scoped peer_ids so the client can still be identified
+const clientPrefixLen = 8
+
+// validDuplicatePeerID returns true for known duplicate peer_id policies
+func validDuplicatePeerID(policy string) bool {
+	switch policy {
+	case duplicatePeerIDAllow, duplicatePeerIDReject, duplicatePeerIDFlag, duplicatePeerIDSeparate:
+		return true
+	}
+	return false
+}
+
+// swarmPeerID returns the peer_id used to key the peer within its swarm. With the separate
+// policy the client prefix is kept and the remainder is replaced with a hash of the user and
+// peer_id, so users sharing a peer_id never collide.
+func (t *Tracker) swarmPeerID(userID uint32, pid store.PeerID) store.PeerID {
+	if t.DuplicatePeerID != duplicatePeerIDSeparate {
+		return pid
+	}
+	var uid [4]byte
+	binary.BigEndian.PutUint32(uid[:], userID)
+	h := sha1.New()
+	_, _ = h.Write(uid[:])
+	_, _ = h.Write(pid[:])
+	scoped := pid
+	copy(scoped[clientPrefixLen:], h.Sum(nil))
+	return scoped
+}
+
+// duplicatePeerAllowed applies the duplicate peer_id policy to an announce whose peer_id
+// matched an active peer belonging to another user. It returns false if the announce
+// should be rejected.
+func (t *Tracker) duplicatePeerAllowed(ih store.InfoHash, existing store.Peer, usr store.User, ip string) bool {
+	atomic.AddInt64(&metrics.AnnounceDuplicatePeerID, 1)
+	log.Warnf("Duplicate peer_id %s on %s from users %d and %d",
+		existing.PeerID.String(), ih.String(), existing.UserID, usr.UserID)
+	switch t.DuplicatePeerID {
+	case duplicatePeerIDReject:
+		return false
+	case duplicatePeerIDFlag:
+		t.AuditLog.Add(AuditEntry{
+			Time:   time.Now(),
+			Action: auditDuplicatePeerID,
+			Target: fmt.Sprintf("%s %s users %d,%d", ih.String(), existing.PeerID.String(),
+				existing.UserID, usr.UserID),
+			Caller: ip,
+		})
+	}
+	return true
+}
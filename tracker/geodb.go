@@ -0,0 +1,86 @@
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/leighmacdonald/mika/config"
+	"github.com/leighmacdonald/mika/geo"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var (
+	// errGeodbNoAPIKey is returned when updating the geo database without an api key set
+	errGeodbNoAPIKey = errors.New("no geo database api key configured")
+	// errGeodbDownload is returned when the geo database could not be downloaded
+	errGeodbDownload = errors.New("failed to download geo database")
+)
+
+// These are replaced in tests so that no real database needs to be downloaded
+var (
+	geoDownloadDB = geo.DownloadDB
+	geoOpenDB     = func(path string) (geo.Provider, error) {
+		return geo.New(path)
+	}
+)
+
+// UpdateGeodb downloads the latest geo database, verifies it can be opened and swaps it in as
+// the live provider. The download is made into a temporary directory first so a failed update
+// leaves the current database untouched. Lookups in flight finish on the previous provider.
+func (t *Tracker) UpdateGeodb() (geo.Metadata, error) {
+	key := config.GetString(config.GeodbAPIKey)
+	if key == "" {
+		return geo.Metadata{}, errGeodbNoAPIKey
+	}
+	outPath := config.GetString(config.GeodbPath)
+	if err := os.MkdirAll(outPath, 0755); err != nil {
+		return geo.Metadata{}, fmt.Errorf("failed to create geo database path: %w", err)
+	}
+	tmpPath, err := ioutil.TempDir(outPath, "update")
+	if err != nil {
+		return geo.Metadata{}, fmt.Errorf("failed to create geo database download path: %w", err)
+	}
+	defer func() {
+		if err := os.RemoveAll(tmpPath); err != nil {
+			log.Warnf("Failed to remove geo database download path: %s", err)
+		}
+	}()
+	if err := geoDownloadDB(tmpPath, key); err != nil {
+		log.Errorf("Failed to download geo database: %s", err)
+		return geo.Metadata{}, errGeodbDownload
+	}
+	newDb, err := geoOpenDB(tmpPath)
+	if err != nil {
+		return geo.Metadata{}, fmt.Errorf("downloaded geo database failed verification: %w", err)
+	}
+	// The opened database keeps reading the installed files, so its safe to move them
+	if err := geo.Install(tmpPath, outPath); err != nil {
+		newDb.Close()
+		return geo.Metadata{}, fmt.Errorf("failed to install geo database: %w", err)
+	}
+	t.SetGeodb(newDb, true)
+	log.Infof("Geo database updated")
+	return newDb.Metadata(), nil
+}
+
+// GeodbUpdater periodically refreshes the geo database so it does not go stale. Updates are
+// skipped while geo lookups are disabled.
+func (t *Tracker) GeodbUpdater() {
+	updateTimer := time.NewTimer(t.GeodbUpdateInterval)
+	defer updateTimer.Stop()
+	for {
+		select {
+		case <-updateTimer.C:
+			if t.geodbEnabled() {
+				if _, err := t.UpdateGeodb(); err != nil {
+					log.Errorf("Scheduled geo database update failed: %s", err)
+				}
+			}
+			updateTimer.Reset(t.GeodbUpdateInterval)
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
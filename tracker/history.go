@@ -0,0 +1,60 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	"net"
+	"time"
+)
+
+// announceHistoryEntry is a single announce retained in a users announce history
+type announceHistoryEntry struct {
+	Time     time.Time
+	InfoHash store.InfoHash
+	Event    consts.AnnounceType
+	IP       net.IP
+	Port     uint16
+}
+
+// recordAnnounce appends the announce to the users history, dropping the oldest entries
+// once AnnounceHistorySize is reached. Slices stored in the map are never modified so
+// readers can use them without holding a lock.
+func (t *Tracker) recordAnnounce(pk string, req *AnnounceRequest) {
+	entry := announceHistoryEntry{
+		Time:     time.Now(),
+		InfoHash: req.InfoHash,
+		Event:    req.Event,
+		IP:       req.IP,
+		Port:     req.Port,
+	}
+	t.announceHistory.Update(pk, func(value interface{}, found bool) interface{} {
+		var prev []announceHistoryEntry
+		if found {
+			prev = value.([]announceHistoryEntry)
+		}
+		if len(prev) >= t.AnnounceHistorySize {
+			prev = prev[len(prev)-t.AnnounceHistorySize+1:]
+		}
+		history := make([]announceHistoryEntry, len(prev), len(prev)+1)
+		copy(history, prev)
+		return append(history, entry)
+	})
+}
+
+// recentAnnounces returns the retained announces of a user, newest first. Entries older than
+// AnnounceHistoryMaxAge are skipped.
+func (t *Tracker) recentAnnounces(pk string) []announceHistoryEntry {
+	value, found := t.announceHistory.Get(pk)
+	if !found {
+		return nil
+	}
+	history := value.([]announceHistoryEntry)
+	var recent []announceHistoryEntry
+	for i := len(history) - 1; i >= 0; i-- {
+		if t.AnnounceHistoryMaxAge > 0 && time.Since(history[i].Time) > t.AnnounceHistoryMaxAge {
+			break
+		}
+		recent = append(recent, history[i])
+	}
+	return recent
+}
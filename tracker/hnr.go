@@ -0,0 +1,79 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// seedSession is the seeding time of a peer since it joined the swarm
+type seedSession struct {
+	seeded time.Duration
+	// seeding is true if the peer was seeding as of its last announce
+	seeding bool
+	// started is true if the session began with a started event. Sessions lost to a restart or
+	// eviction are recreated by the next announce without it, and never record a hit and run
+	// as their earlier seeding time is unknown.
+	started bool
+	last    time.Time
+}
+
+// addSeedTime adds the time the peer spent seeding since its previous announce to its session.
+// Partial seeds have not completed the torrent so are not counted as seeding. Once the session
+// reaches HNRThreshold any hit and run of the user on the torrent is cleared.
+func (t *Tracker) addSeedTime(u store.UpdateState, ph store.PeerHash) {
+	if t.HNRThreshold <= 0 {
+		return
+	}
+	var before, after time.Duration
+	t.seedSessions.Update(ph.String(), func(value interface{}, found bool) interface{} {
+		var s seedSession
+		if found {
+			s = value.(seedSession)
+			before = s.seeded
+			if s.seeding && u.Timestamp.After(s.last) {
+				s.seeded += u.Timestamp.Sub(s.last)
+			}
+		} else {
+			s.started = u.Event == consts.STARTED
+		}
+		s.seeding = u.Left == 0 && !u.Paused
+		s.last = u.Timestamp
+		after = s.seeded
+		return s
+	})
+	if before < t.HNRThreshold && after >= t.HNRThreshold {
+		if err := t.users.HNRDelete(u.UserID, u.InfoHash); err != nil {
+			log.Errorf("Failed to clear hnr of user %d: %s", u.UserID, err)
+		}
+	}
+}
+
+// peerLeft ends the seeding session of a peer leaving the swarm, by a stopped event or being
+// reaped. Peers which leave with data still left to download without seeding for HNRThreshold
+// during the session are recorded as a hit and run. Public trackers share a single user so
+// never record them.
+func (t *Tracker) peerLeft(userID uint32, ph store.PeerHash, left uint64) {
+	if t.HNRThreshold <= 0 || !t.StatsEnabled || t.Public {
+		return
+	}
+	value, found := t.seedSessions.Get(ph.String())
+	if !found {
+		return
+	}
+	t.seedSessions.Delete(ph.String())
+	s := value.(seedSession)
+	if !s.started || left == 0 || s.seeded >= t.HNRThreshold {
+		return
+	}
+	hnr := store.HNR{
+		UserID:    userID,
+		InfoHash:  ph.InfoHash(),
+		SeedTime:  uint32(s.seeded.Seconds()),
+		CreatedOn: time.Now(),
+	}
+	if err := t.users.HNRAdd(hnr); err != nil {
+		log.Errorf("Failed to record hnr of user %d: %s", userID, err)
+	}
+}
@@ -0,0 +1,41 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/store"
+)
+
+// AnnounceHook lets custom rules, such as checks against an external ratio system or ban list,
+// decide if an announce is accepted without needing to modify the tracker itself.
+//
+// Hooks are run in the order they were registered once the user and torrent have been
+// validated, and before the peer is added to the swarm.
+type AnnounceHook interface {
+	// BeforeAnnounce returns false to deny the announce. The reason, when set, is sent to the
+	// client as the failure reason. Returning an error fails the announce with a generic error.
+	BeforeAnnounce(req AnnounceRequest, user store.User, torrent store.Torrent) (allow bool, reason string, err error)
+}
+
+// NopAnnounceHook accepts every announce
+type NopAnnounceHook struct{}
+
+// BeforeAnnounce always allows the announce
+func (NopAnnounceHook) BeforeAnnounce(_ AnnounceRequest, _ store.User, _ store.Torrent) (bool, string, error) {
+	return true, "", nil
+}
+
+// AddAnnounceHook registers a hook to be run for every announce. Hooks are not safe to add
+// once the tracker is serving requests so they should be registered at startup.
+func (t *Tracker) AddAnnounceHook(hook AnnounceHook) {
+	t.announceHooks = append(t.announceHooks, hook)
+}
+
+// runAnnounceHooks runs each registered hook, stopping at the first to deny the announce
+func (t *Tracker) runAnnounceHooks(req AnnounceRequest, user store.User, torrent store.Torrent) (bool, string, error) {
+	for _, hook := range t.announceHooks {
+		allow, reason, err := hook.BeforeAnnounce(req, user, torrent)
+		if err != nil || !allow {
+			return false, reason, err
+		}
+	}
+	return true, "", nil
+}
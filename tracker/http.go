@@ -2,16 +2,19 @@ package tracker
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"fmt"
 	"github.com/chihaya/bencode"
 	"github.com/gin-gonic/gin"
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/store"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"github.com/toorop/gin-logrus"
+	"math"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 )
@@ -29,9 +32,18 @@ const (
 	msgInvalidNumWant       errCode = 152
 	msgBadClient            errCode = 153
 	msgOk                   errCode = 200
+	msgRequestURITooLong    errCode = 414
+	msgClientRequestTooFast errCode = 429
 	msgInfoHashNotFound     errCode = 480
 	msgInvalidAuth          errCode = 490
-	msgClientRequestTooFast errCode = 500
+	msgAnnounceDenied       errCode = 491
+	msgIPv6Only             errCode = 492
+	msgTorrentBusy          errCode = 493
+	msgHTTPSRequired        errCode = 494
+	msgDuplicatePeerID      errCode = 495
+	msgImplausibleCompleted errCode = 496
+	msgIPMismatch           errCode = 497
+	msgStoreUnavailable     errCode = 498
 	msgGenericError         errCode = 900
 	msgMalformedRequest     errCode = 901
 	msgQueryParseFail       errCode = 902
@@ -46,11 +58,20 @@ var (
 		msgMissingPort:          errors.New("port missing from request"),
 		msgInvalidPort:          errors.New("Invalid port"),
 		msgInvalidAuth:          errors.New("Invalid passkey"),
+		msgAnnounceDenied:       errors.New("Announce denied"),
+		msgIPv6Only:             errors.New("Only IPv6 announces are accepted"),
+		msgTorrentBusy:          errors.New("Torrent busy, retry shortly"),
+		msgHTTPSRequired:        errors.New("Passkeys must be sent over HTTPS"),
+		msgDuplicatePeerID:      errors.New("peer_id in use by another user"),
+		msgImplausibleCompleted: errors.New("Completed download does not match the torrent size"),
+		msgIPMismatch:           errors.New("IP does not match the connection"),
+		msgStoreUnavailable:     errors.New("Tracker temporarily unavailable, retry shortly"),
 		msgInvalidInfoHash:      errors.New("Invalid info hash"),
 		msgInvalidPeerID:        errors.New("Peer ID invalid"),
 		msgInvalidNumWant:       errors.New("num_want invalid"),
 		msgBadClient:            errors.New("Client not whitelisted"),
 		msgInfoHashNotFound:     errors.New("Unknown infohash"),
+		msgRequestURITooLong:    errors.New("Request URI too long"),
 		msgClientRequestTooFast: errors.New("Slow down there jimmy"),
 		msgMalformedRequest:     errors.New("Malformed request"),
 		msgGenericError:         errors.New("Generic error"),
@@ -64,44 +85,58 @@ func Err(code errCode) error {
 	return responseStringMap[code]
 }
 
+// errIPMismatch is returned by getIP along with the client provided IP when it doesn't match
+// the address the announce was sent from
+var errIPMismatch = errors.New("client ip does not match the connection")
+
 // getIP Parses and returns a IP from a query
-// If a IP header exists, it will be used instead of the client provided query parameter
-// If no query IP is provided, the
-func getIP(q *query, allowClientIP bool, c *gin.Context) (net.IP, bool, error) {
-	if allowClientIP {
+// If AllowClientIP is enabled, the client provided query parameters are used first. They
+// must match the address of the connection unless it was made by a trusted proxy.
+// Otherwise the IP forwarded by a trusted proxy is used, falling back to the address of the
+// connection. Forwarded headers from anyone else are ignored as they can be spoofed.
+func (t *Tracker) getIP(q *query, c *gin.Context) (net.IP, bool, error) {
+	remote := remoteIP(c)
+	if t.AllowClientIP {
 		for i, k := range [3]announceParam{paramIP, paramIPv4, paramIPv6} {
 			// Use client provided IP
 			ipStr, found := q.Params[k]
-			if found {
-				switch i {
-				case 0:
-					return net.ParseIP(ipStr), false, nil
-				case 1:
-					return net.ParseIP(ipStr), false, nil
-				case 2:
-					return net.ParseIP(ipStr), true, nil
-				}
-
+			if !found {
+				continue
+			}
+			ip := net.ParseIP(ipStr)
+			if ip == nil {
+				return nil, false, consts.ErrInvalidClient
+			}
+			if !t.trustedProxy(remote) && !ip.Equal(remote) {
+				return ip, false, errIPMismatch
+			}
+			switch i {
+			case 0:
+				// The ip param can be either family
+				return ip, ip.To4() == nil, nil
+			case 1:
+				return ip, false, nil
+			default:
+				return ip, true, nil
 			}
 		}
 	}
-	// Look for forwarded ip in headers
-	for _, header := range []string{"X-Real-IP", "X-Forwarded-For"} {
-		if headerIP := c.Request.Header.Get(header); headerIP != "" {
-			addr := net.ParseIP(headerIP)
-			return addr, strings.Count(headerIP, ":") > 1, nil
-		}
+	if forwarded := t.forwardedIP(c); forwarded != nil {
+		return forwarded, forwarded.To4() == nil, nil
 	}
-	httpAddr, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
-	for i := 0; i < len(httpAddr); i++ {
-		switch httpAddr[i] {
-		case '.':
-			return net.ParseIP(httpAddr), false, nil
-		case ':':
-			return net.ParseIP(httpAddr), true, nil
-		}
+	if remote == nil {
+		return net.IP{}, false, consts.ErrInvalidClient
 	}
-	return net.IP{}, false, consts.ErrInvalidClient
+	return remote, remote.To4() == nil, nil
+}
+
+// remoteIP returns the address the request was sent from, or nil if it can't be parsed
+func remoteIP(c *gin.Context) net.IP {
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
 }
 
 // oops will output a bencoded error code to the torrent client using
@@ -111,8 +146,47 @@ func oops(ctx *gin.Context, errCode errCode) {
 	if !exists {
 		msg = responseStringMap[msgGenericError]
 	}
-	ctx.Data(int(errCode), gin.MIMEPlain, responseError(msg.Error()))
-	log.Errorf("Error in request from: %s (%d : %s)", ctx.Request.RequestURI, errCode, msg.Error())
+	ctx.Data(failureStatus(ctx, errCode), gin.MIMEPlain, responseError(msg.Error()))
+	log.Errorf("Error in request from: %s (%d : %s)", redactPasskey(ctx), errCode, msg.Error())
+}
+
+// redactPasskey returns the request URI with any passkey path segment removed so that
+// passkeys are not leaked into the logs.
+func redactPasskey(ctx *gin.Context) string {
+	uri := ctx.Request.RequestURI
+	if uri == "" {
+		uri = ctx.Request.URL.RequestURI()
+	}
+	pk := ctx.Param("passkey")
+	if pk == "" {
+		return uri
+	}
+	return strings.Replace(uri, pk, "[redacted]", -1)
+}
+
+// passkey returns the passkey used to authenticate the request. The URL path is checked
+// first, falling back to the configured passkey header if enabled.
+func (t *Tracker) passkey(ctx *gin.Context) string {
+	if pk := ctx.Param("passkey"); pk != "" {
+		return pk
+	}
+	if t.PasskeyHeader != "" {
+		return ctx.GetHeader(t.PasskeyHeader)
+	}
+	return ""
+}
+
+// validPasskey checks the passkey has one of the configured lengths
+func (t *Tracker) validPasskey(pk string) bool {
+	if len(t.PasskeyLengths) == 0 {
+		return true
+	}
+	for _, l := range t.PasskeyLengths {
+		if len(pk) == l {
+			return true
+		}
+	}
+	return false
 }
 
 // preFlightChecks ensures our user meets the requirements to make an authorized request
@@ -125,19 +199,69 @@ func (t *Tracker) preFlightChecks(usr *store.User, pk string, c *gin.Context) bo
 		usr.UserID = 1
 		return true
 	} else {
-		if pk == "" {
-			oops(c, msgInvalidAuth)
+		if pk == "" || !t.validPasskey(pk) {
+			t.unauthorized(c)
+			return false
+		}
+		if !t.checkPasskeyTransport(pk, c) {
 			return false
 		}
-		if err := t.UserGet(usr, pk); err != nil {
+		if err := t.requestUser(c, usr, pk); err != nil {
+			if errors.Is(err, errBreakerOpen) || userStoreFailed(err) {
+				// The passkey can't be checked until the store recovers
+				log.Warnf("Store unavailable, rejecting uncached passkey: %s", err.Error())
+				c.Data(failureStatus(c, msgStoreUnavailable), gin.MIMEPlain,
+					responseRetry(Err(msgStoreUnavailable).Error(), 1))
+				return false
+			}
 			log.Debugf("Got invalid passkey")
-			oops(c, msgInvalidAuth)
+			t.unauthorized(c)
+			return false
+		}
+		if !usr.Valid() {
+			t.unauthorized(c)
 			return false
 		}
-		return usr.Valid()
+		return true
 	}
 }
 
+// unauthorized rejects a request without a valid passkey made to a private tracker
+func (t *Tracker) unauthorized(c *gin.Context) {
+	deny(c, msgInvalidAuth, t.UnauthorizedReason)
+}
+
+// deny rejects a request with a bencoded failure reason. All the configurable block reasons
+// are sent through here, falling back to the default message of the code when empty.
+func deny(c *gin.Context, code errCode, reason string) {
+	if reason == "" {
+		oops(c, code)
+		return
+	}
+	c.Data(failureStatus(c, code), gin.MIMEPlain, responseError(reason))
+}
+
+// failureStatusOKKey is set on the request context when failures are sent with a 200 status
+const failureStatusOKKey = "failure_status_ok"
+
+// failureStatusOK marks tracker requests to send their failures with a 200 status when
+// FailureStatusOK is enabled. Some clients discard the body of other responses, so the
+// failure reason is never shown to the user.
+func (t *Tracker) failureStatusOK(c *gin.Context) {
+	if t.FailureStatusOK {
+		c.Set(failureStatusOKKey, true)
+	}
+	c.Next()
+}
+
+// failureStatus returns the HTTP status a failure response with the error code is sent with
+func failureStatus(c *gin.Context, code errCode) int {
+	if c.GetBool(failureStatusOKKey) {
+		return http.StatusOK
+	}
+	return int(code)
+}
+
 // handleTrackerErrors is used as the default error handler for tracker requests
 // the error is returned to the client as a bencoded error string as defined in the
 // bittorrent specs.
@@ -172,11 +296,72 @@ func responseError(message string) []byte {
 	return buf.Bytes()
 }
 
+// responseRetry generates a bencoded error response which asks BEP31 aware clients to
+// wait retryIn minutes before announcing again
+func responseRetry(message string, retryIn int) []byte {
+	var buf bytes.Buffer
+	if err := bencode.NewEncoder(&buf).Encode(bencode.Dict{
+		"failure reason": message,
+		"retry in":       retryIn,
+	}); err != nil {
+		log.Errorf("Failed to encode error response: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// accessLog is the logger used for the per request access log lines
+var accessLog = log.New()
+
+// accessLogger logs each request once it has been handled. The request URI is redacted
+// so passkeys sent in the path are never written to the access log.
+func accessLogger(logger log.FieldLogger) gin.HandlerFunc {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		latency := int(math.Ceil(float64(time.Since(start).Nanoseconds()) / 1000000.0))
+		statusCode := c.Writer.Status()
+		clientIP := c.ClientIP()
+		path := redactPasskey(c)
+		dataLength := c.Writer.Size()
+		if dataLength < 0 {
+			dataLength = 0
+		}
+		entry := logger.WithFields(log.Fields{
+			"hostname":   hostname,
+			"statusCode": statusCode,
+			"latency":    latency,
+			"clientIP":   clientIP,
+			"method":     c.Request.Method,
+			"path":       path,
+			"referer":    c.Request.Referer(),
+			"dataLength": dataLength,
+			"userAgent":  c.Request.UserAgent(),
+		})
+		if len(c.Errors) > 0 {
+			entry.Error(c.Errors.ByType(gin.ErrorTypePrivate).String())
+			return
+		}
+		msg := fmt.Sprintf("%s - %s \"%s %s\" %d %d \"%s\" \"%s\" (%dms)", clientIP, hostname,
+			c.Request.Method, path, statusCode, dataLength, c.Request.Referer(), c.Request.UserAgent(), latency)
+		if statusCode > 499 {
+			entry.Error(msg)
+		} else if statusCode > 399 {
+			entry.Warn(msg)
+		} else {
+			entry.Info(msg)
+		}
+	}
+}
+
 // newRouter creates and returns a newly configured router instance using
 // the default middleware handlers.
 func newRouter() *gin.Engine {
 	router := gin.New()
-	router.Use(ginlogrus.Logger(log.New()), gin.Recovery())
+	router.Use(accessLogger(accessLog), gin.Recovery())
 	return router
 }
 
@@ -187,7 +372,7 @@ func noRoute(c *gin.Context) {
 // NewBitTorrentHandler configures a router to handle tracker announce/scrape requests
 func NewBitTorrentHandler(tkr *Tracker) *gin.Engine {
 	r := newRouter()
-	r.Use(handleTrackerErrors)
+	r.Use(tkr.failureStatusOK, handleTrackerErrors)
 	h := BitTorrentHandler{
 		tracker: tkr,
 	}
@@ -253,3 +438,27 @@ func NewHTTPServer(opts *HTTPOpts) *http.Server {
 	}
 	return srv
 }
+
+// ShutdownHTTPServers stops the servers from accepting new connections and waits for in-flight
+// requests to finish. Servers still busy when the context ends are closed forcibly and the
+// context error is returned.
+func ShutdownHTTPServers(ctx context.Context, servers ...*http.Server) error {
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			err := srv.Shutdown(ctx)
+			if err != nil {
+				// Drop any connections which did not finish in time
+				_ = srv.Close()
+			}
+			errs <- err
+		}(srv)
+	}
+	var err error
+	for range servers {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+	return err
+}
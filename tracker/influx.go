@@ -0,0 +1,65 @@
+package tracker
+
+import (
+	"fmt"
+	"github.com/leighmacdonald/mika/metrics"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// influxMeasurement is the measurement name all metrics are written under
+const influxMeasurement = "mika"
+
+var influxClient = &http.Client{Timeout: 10 * time.Second}
+
+// influxMetrics returns the current metrics snapshot in InfluxDB line protocol, tagged
+// with the host so multiple trackers can write to the same database
+func (t *Tracker) influxMetrics() string {
+	host, _ := os.Hostname()
+	return metrics.Get().Influx(influxMeasurement, map[string]string{"host": host}, time.Now())
+}
+
+// StartInfluxPusher periodically writes the metrics to an InfluxDB write endpoint such as
+// http://localhost:8086/write?db=mika until ShutdownMetrics is called
+func (t *Tracker) StartInfluxPusher(url string, interval time.Duration) {
+	t.goMetrics(func() {
+		t.influxPusher(url, interval)
+	})
+}
+
+func (t *Tracker) influxPusher(url string, interval time.Duration) {
+	pushTimer := time.NewTimer(interval)
+	defer pushTimer.Stop()
+	for {
+		select {
+		case <-pushTimer.C:
+			if err := t.pushInflux(url); err != nil {
+				log.Errorf("Failed to push metrics to influxdb: %s", err)
+			}
+			pushTimer.Reset(interval)
+		case <-t.metricsStop:
+			// Send the metrics collected since the last push
+			if err := t.pushInflux(url); err != nil {
+				log.Errorf("Failed to push final metrics to influxdb: %s", err)
+			}
+			return
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *Tracker) pushInflux(url string) error {
+	resp, err := influxClient.Post(url, "text/plain; charset=utf-8", strings.NewReader(t.influxMetrics()))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
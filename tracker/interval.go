@@ -0,0 +1,114 @@
+package tracker
+
+import (
+	log "github.com/sirupsen/logrus"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Curves used to scale the announce interval by swarm size
+const (
+	// intervalScaleNone always returns the base announce interval
+	intervalScaleNone = "none"
+	// intervalScaleLinear adds one base interval for every AnnIntervalScalePeers peers
+	intervalScaleLinear = "linear"
+	// intervalScaleLog adds one base interval each time the swarm doubles in size past
+	// AnnIntervalScalePeers, so growth slows as swarms get larger
+	intervalScaleLog = "log"
+)
+
+// maxScaledInterval is the longest interval that can be handed out. Peers which announce
+// less often than the peer expiry are reaped so some slack is left for late clients.
+func (t *Tracker) maxScaledInterval() time.Duration {
+	return t.peerExpiry() * 4 / 5
+}
+
+// validIntervalScale returns true for known interval scaling curves
+func validIntervalScale(curve string) bool {
+	switch curve {
+	case intervalScaleNone, intervalScaleLinear, intervalScaleLog:
+		return true
+	}
+	return false
+}
+
+// classInterval returns the base announce interval for users of the class, falling back to
+// AnnInterval for classes without their own interval
+func (t *Tracker) classInterval(class string) time.Duration {
+	if class == "" {
+		return t.AnnInterval
+	}
+	interval, found := t.ClassAnnIntervals[strings.ToLower(class)]
+	if !found || interval <= 0 {
+		return t.AnnInterval
+	}
+	if max := t.maxScaledInterval(); interval > max {
+		return max
+	}
+	return interval
+}
+
+// announceInterval returns the interval sent to a user of the class in a swarm with swarmSize
+// peers. The result is never below AnnIntervalMin and scaled intervals never exceed
+// AnnIntervalMax.
+func (t *Tracker) announceInterval(class string, swarmSize int) time.Duration {
+	base := t.classInterval(class)
+	interval := base
+	if t.AnnIntervalScale != intervalScaleNone && t.AnnIntervalScalePeers > 0 && swarmSize > 0 {
+		ratio := float64(swarmSize) / float64(t.AnnIntervalScalePeers)
+		if t.AnnIntervalScale == intervalScaleLog {
+			ratio = math.Log2(1 + ratio)
+		}
+		interval = time.Duration(float64(base) * (1 + ratio))
+		// Scaling only ever raises the interval, even if the max is below the base interval
+		if t.AnnIntervalMax > base && interval > t.AnnIntervalMax {
+			interval = t.AnnIntervalMax
+		} else if t.AnnIntervalMax <= base {
+			interval = base
+		}
+	}
+	if interval < t.AnnIntervalMin {
+		interval = t.AnnIntervalMin
+	}
+	return interval
+}
+
+// validJitter keeps the jitter percentage between 0 and 100
+func validJitter(percent float64) float64 {
+	if percent < 0 || percent > 100 {
+		log.Warnf("Announce interval jitter %g%% out of range, using 0-100%%", percent)
+		return math.Max(0, math.Min(percent, 100))
+	}
+	return percent
+}
+
+// jitterIntervals spreads the interval and min interval sent in an announce response by a
+// random amount of up to AnnIntervalJitter percent, the same for both so they stay ordered.
+// The interval is kept at or above AnnIntervalMin and the min interval is only ever raised.
+func (t *Tracker) jitterIntervals(interval time.Duration) (time.Duration, time.Duration) {
+	minInterval := t.AnnIntervalMin
+	if t.AnnIntervalJitter <= 0 {
+		return interval, minInterval
+	}
+	factor := 1 + (rand.Float64()*2-1)*t.AnnIntervalJitter/100
+	jittered := time.Duration(float64(interval) * factor)
+	if max := t.maxScaledInterval(); jittered > max && jittered > interval {
+		// Never push peers past their expiry because of the jitter
+		jittered = interval
+		if max > interval {
+			jittered = max
+		}
+	}
+	if jittered < t.AnnIntervalMin {
+		jittered = t.AnnIntervalMin
+	}
+	if factor > 1 {
+		minInterval = time.Duration(float64(minInterval) * factor)
+		if minInterval > jittered {
+			minInterval = jittered
+		}
+	}
+	return jittered, minInterval
+}
@@ -0,0 +1,53 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/store"
+	"sync"
+)
+
+// infoHashLimiter caps the number of announces being processed at once for any single
+// info_hash so that a hot torrent cannot tie up the store with contention on one key.
+// Entries are removed once no announces are active so its size is bounded by concurrency.
+type infoHashLimiter struct {
+	mu     sync.Mutex
+	max    int
+	active map[store.InfoHash]int
+}
+
+// newInfoHashLimiter returns a limiter allowing max simultaneous announces per info_hash.
+// A max of 0 disables the limit.
+func newInfoHashLimiter(max int) *infoHashLimiter {
+	return &infoHashLimiter{
+		max:    max,
+		active: make(map[store.InfoHash]int),
+	}
+}
+
+// acquire reserves a slot for the info_hash, returning false when all slots are in use.
+// Every successful acquire must be followed by a release.
+func (l *infoHashLimiter) acquire(ih store.InfoHash) bool {
+	if l.max <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ih] >= l.max {
+		return false
+	}
+	l.active[ih]++
+	return true
+}
+
+// release frees a slot previously reserved with acquire
+func (l *infoHashLimiter) release(ih store.InfoHash) {
+	if l.max <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.active[ih] <= 1 {
+		delete(l.active, ih)
+	} else {
+		l.active[ih]--
+	}
+	l.mu.Unlock()
+}
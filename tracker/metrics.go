@@ -0,0 +1,83 @@
+package tracker
+
+import (
+	"context"
+	"github.com/leighmacdonald/mika/metrics"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// goMetrics runs a background metrics job which is stopped by ShutdownMetrics. Jobs must
+// return once metricsStop is closed.
+func (t *Tracker) goMetrics(job func()) {
+	t.metricsWG.Add(1)
+	go func() {
+		defer t.metricsWG.Done()
+		job()
+	}()
+}
+
+// ShutdownMetrics stops all background metrics jobs, letting them flush any final push, and
+// waits for them to exit. An error is returned if the context ends before they are all done.
+func (t *Tracker) ShutdownMetrics(ctx context.Context) error {
+	t.metricsStopOnce.Do(func() {
+		close(t.metricsStop)
+	})
+	done := make(chan struct{})
+	go func() {
+		t.metricsWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// LoadMetrics restores the metric counters persisted by the metrics persister before the
+// last shutdown
+func (t *Tracker) LoadMetrics() error {
+	values, err := t.torrents.MetricsGetAll()
+	if err != nil {
+		return err
+	}
+	metrics.RestoreCounters(values)
+	log.Debugf("Loaded %d persisted metric counters", len(values))
+	return nil
+}
+
+// StartMetricsPersister periodically saves the metric counters to the torrent store so they
+// can be restored with LoadMetrics after a restart. The counters are saved a final time when
+// ShutdownMetrics is called.
+func (t *Tracker) StartMetricsPersister(interval time.Duration) {
+	t.goMetrics(func() {
+		t.metricsPersister(interval)
+	})
+}
+
+func (t *Tracker) metricsPersister(interval time.Duration) {
+	persistTimer := time.NewTimer(interval)
+	defer persistTimer.Stop()
+	for {
+		select {
+		case <-persistTimer.C:
+			if err := t.persistMetrics(); err != nil {
+				log.Errorf("Failed to persist metrics: %s", err)
+			}
+			persistTimer.Reset(interval)
+		case <-t.metricsStop:
+			if err := t.persistMetrics(); err != nil {
+				log.Errorf("Failed to persist final metrics: %s", err)
+			}
+			return
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *Tracker) persistMetrics() error {
+	return t.torrents.MetricsSet(metrics.Counters())
+}
@@ -0,0 +1,8 @@
+//go:build !race
+// +build !race
+
+package tracker
+
+// raceEnabled is true when the tests are run with the race detector, which adds its own
+// allocations
+const raceEnabled = false
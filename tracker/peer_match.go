@@ -0,0 +1,63 @@
+package tracker
+
+import (
+	"fmt"
+	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/store"
+)
+
+// Strategies used to find the peer_id of a client which re-announces without one
+const (
+	// peerIDMatchNone rejects announces without a peer_id
+	peerIDMatchNone = "none"
+	// peerIDMatchKey matches on the key param sent by the client
+	peerIDMatchKey = "key"
+	// peerIDMatchIPPort matches on the IP and port of the client
+	peerIDMatchIPPort = "ip_port"
+	// peerIDMatchAny tries the key first, then the IP and port
+	peerIDMatchAny = "any"
+)
+
+// validPeerIDMatch returns true for known peer_id match strategies
+func validPeerIDMatch(strategy string) bool {
+	switch strategy {
+	case peerIDMatchNone, peerIDMatchKey, peerIDMatchIPPort, peerIDMatchAny:
+		return true
+	}
+	return false
+}
+
+// peerIDKeys returns the knownPeerIDs keys for the announce using the configured strategy.
+// Keys are scoped to the passkey and info_hash so clients can only ever match their own peers.
+func (t *Tracker) peerIDKeys(pk string, req *AnnounceRequest) []string {
+	var keys []string
+	if req.Key != "" && (t.PeerIDMatch == peerIDMatchKey || t.PeerIDMatch == peerIDMatchAny) {
+		keys = append(keys, fmt.Sprintf("key|%s|%s|%s", pk, req.InfoHash.String(), req.Key))
+	}
+	if t.PeerIDMatch == peerIDMatchIPPort || t.PeerIDMatch == peerIDMatchAny {
+		keys = append(keys, fmt.Sprintf("addr|%s|%s|%s:%d", pk, req.InfoHash.String(), req.IP.String(), req.Port))
+	}
+	return keys
+}
+
+// matchPeerID looks up the peer_id last announced by the client for announces which omit it
+func (t *Tracker) matchPeerID(pk string, req *AnnounceRequest) (store.PeerID, bool) {
+	for _, k := range t.peerIDKeys(pk, req) {
+		if pid, found := t.knownPeerIDs.Get(k); found {
+			return pid.(store.PeerID), true
+		}
+	}
+	return store.PeerID{}, false
+}
+
+// rememberPeerID records the peer_id of an announce so later announces without one can be
+// matched to it. Stopped peers are forgotten.
+func (t *Tracker) rememberPeerID(pk string, req *AnnounceRequest) {
+	for _, k := range t.peerIDKeys(pk, req) {
+		if req.Event == consts.STOPPED {
+			t.knownPeerIDs.Delete(k)
+		} else {
+			t.knownPeerIDs.Set(k, req.PeerID)
+		}
+	}
+}
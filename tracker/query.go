@@ -54,6 +54,7 @@ const (
 	paramNumWant       announceParam = "numwant"
 	paramEvent         announceParam = "event"
 	paramKey           announceParam = "key"
+	paramCompact       announceParam = "compact"
 	paramSupportCrypto announceParam = "supportcrypto"
 	// libtorrent based clients (qbt/deluge) will only send supportcrypto=1 even when
 	// requirecrypto is set in the client interfaces.
@@ -98,15 +99,14 @@ func queryStringParser(qStr string) (*query, error) {
 			if err != nil {
 				return nil, err
 			}
-			// The start can be greater than the end when the query contains an invalid
-			// empty query value
-			if valStart > valEnd {
-				return nil, consts.ErrMalformedRequest
-			}
-
-			valStr, err := url.QueryUnescape(qStr[valStart : valEnd+1])
-			if err != nil {
-				return nil, err
+			// The start is past the end for empty values such as event=, which some
+			// clients send for periodic announces
+			var valStr string
+			if valStart <= valEnd {
+				valStr, err = url.QueryUnescape(qStr[valStart : valEnd+1])
+				if err != nil {
+					return nil, err
+				}
 			}
 			q.Params[announceParam(strings.ToLower(keyStr))] = valStr
 
@@ -146,6 +146,14 @@ func getUint32Key(q *query, key announceParam, def uint32) uint32 {
 	return util.UMax32(0, left)
 }
 
+func getUint64Key(q *query, key announceParam, def uint64) uint64 {
+	v, err := q.Uint64(key)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
 func getBoolKey(q *query, key announceParam, def bool) bool {
 	v, err := q.Uint(key)
 	if err != nil {
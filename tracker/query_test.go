@@ -16,3 +16,15 @@ func benchmarkQuery(b *testing.B) {
 func BenchmarkQuery1000(b *testing.B) {
 	benchmarkQuery(b)
 }
+
+func TestQueryEmptyValue(t *testing.T) {
+	for _, qs := range []string{"event=&port=6881", "port=6881&event=&left=0", "port=6881&event="} {
+		q, err := queryStringParser(qs)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", qs, err)
+		}
+		if q.Params[paramEvent] != "" || q.Params[paramPort] != "6881" {
+			t.Fatalf("Invalid params parsed from %s: %v", qs, q.Params)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package tracker
+
+import (
+	"time"
+)
+
+// tokenBucket holds the announces a client may still make, refilled at the configured
+// rate up to the burst size
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitBurst returns the bucket capacity, always letting through at least one announce
+func (t *Tracker) rateLimitBurst() float64 {
+	if t.RateLimitBurst < 1 {
+		return 1
+	}
+	return float64(t.RateLimitBurst)
+}
+
+// rateLimitTTL is how long an idle bucket takes to refill. Buckets untouched for longer are
+// full, so they can be forgotten.
+func rateLimitTTL(rate float64, burst int) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return time.Duration(float64(burst) / rate * float64(time.Minute))
+}
+
+// rateLimited takes a token from the bucket of the validated passkey, or client IP for public
+// trackers, and returns true if the bucket was empty and the announce should be rejected
+func (t *Tracker) rateLimited(key string) bool {
+	if t.RateLimitRate <= 0 {
+		return false
+	}
+	now := time.Now()
+	burst := t.rateLimitBurst()
+	limited := false
+	t.rateLimits.Update(key, func(value interface{}, found bool) interface{} {
+		b := tokenBucket{tokens: burst, updated: now}
+		if found {
+			b = value.(tokenBucket)
+			b.tokens += now.Sub(b.updated).Minutes() * t.RateLimitRate
+			if b.tokens > burst {
+				b.tokens = burst
+			}
+			b.updated = now
+		}
+		if b.tokens < 1 {
+			limited = true
+			return b
+		}
+		b.tokens--
+		return b
+	})
+	return limited
+}
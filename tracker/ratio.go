@@ -0,0 +1,112 @@
+package tracker
+
+import (
+	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// ratioCache holds the ratio of users keyed by passkey so ratio checks on the announce path
+// don't recompute it. Entries are marked stale when the users stats are flushed and are
+// recomputed by the RatioRefresher. The least recently used ratios are evicted once the
+// cache is full.
+type ratioCache struct {
+	ratios *store.BoundedMap
+	// staleMu guards stale
+	staleMu sync.Mutex
+	stale   map[string]bool
+}
+
+func newRatioCache(maxSize int) *ratioCache {
+	return &ratioCache{
+		ratios: store.NewBoundedMap(maxSize, 0),
+		stale:  make(map[string]bool),
+	}
+}
+
+func (rc *ratioCache) get(passkey string) (float64, bool) {
+	ratio, found := rc.ratios.Get(passkey)
+	if !found {
+		return 0, false
+	}
+	return ratio.(float64), true
+}
+
+func (rc *ratioCache) set(passkey string, ratio float64) {
+	rc.ratios.Set(passkey, ratio)
+}
+
+func (rc *ratioCache) delete(passkey string) {
+	rc.ratios.Delete(passkey)
+}
+
+// markStale flags the cached ratios of the users as needing a refresh. Users without a cached
+// ratio are ignored as it will be computed on their next ratio check.
+func (rc *ratioCache) markStale(batch map[string]store.UserStats) {
+	rc.staleMu.Lock()
+	defer rc.staleMu.Unlock()
+	for passkey := range batch {
+		if _, found := rc.ratios.Get(passkey); found {
+			rc.stale[passkey] = true
+		}
+	}
+}
+
+// takeStale returns and clears the passkeys of the stale ratios
+func (rc *ratioCache) takeStale() []string {
+	rc.staleMu.Lock()
+	defer rc.staleMu.Unlock()
+	passkeys := make([]string, 0, len(rc.stale))
+	for passkey := range rc.stale {
+		passkeys = append(passkeys, passkey)
+		delete(rc.stale, passkey)
+	}
+	return passkeys
+}
+
+// userRatio returns the ratio of the user, using the cached ratio when ratio caching is
+// enabled. Users who have not downloaded anything have an infinite ratio.
+func (t *Tracker) userRatio(usr store.User) float64 {
+	if t.ratios == nil {
+		return usr.Ratio()
+	}
+	if ratio, found := t.ratios.get(usr.Passkey); found {
+		return ratio
+	}
+	ratio := usr.Ratio()
+	t.ratios.set(usr.Passkey, ratio)
+	return ratio
+}
+
+// RatioRefresher periodically recomputes the cached ratios of users whose stats have been
+// flushed since the last refresh
+func (t *Tracker) RatioRefresher() {
+	refreshTimer := time.NewTimer(t.RatioRefreshInterval)
+	for {
+		select {
+		case <-refreshTimer.C:
+			t.refreshRatios()
+			refreshTimer.Reset(t.RatioRefreshInterval)
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshRatios recomputes the stale cached ratios, dropping those of users which no longer
+// exist
+func (t *Tracker) refreshRatios() {
+	if t.ratios == nil {
+		return
+	}
+	for _, passkey := range t.ratios.takeStale() {
+		var usr store.User
+		if err := t.UserGet(&usr, passkey); err != nil {
+			log.Debugf("Dropping cached ratio of unknown user: %s", err)
+			t.ratios.delete(passkey)
+			continue
+		}
+		t.ratios.set(passkey, usr.Ratio())
+	}
+}
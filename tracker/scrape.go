@@ -1,18 +1,100 @@
 package tracker
 
 import (
+	"bufio"
 	"bytes"
-	"github.com/chihaya/bencode"
+	"encoding/hex"
 	"github.com/gin-gonic/gin"
 	"github.com/leighmacdonald/mika/store"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net/http"
+	"sort"
+	"strconv"
 )
 
+// scrapeWriter incrementally bencodes a scrape response directly to the underlying writer
+// so that large scrapes do not need to build the entire response in memory first.
+//
+// Bencoded dictionaries must have their keys in sorted order, so entries must be added in
+// ascending info_hash order. Adding an out of order or duplicate info_hash will return
+// an error instead of producing an invalid response.
+type scrapeWriter struct {
+	w       *bufio.Writer
+	buf     []byte
+	last    store.InfoHash
+	started bool
+	count   int
+	// names adds the optional name extension key using the torrents release name
+	names bool
+}
+
+func newScrapeWriter(w io.Writer, names bool) *scrapeWriter {
+	return &scrapeWriter{
+		w:     bufio.NewWriter(w),
+		buf:   make([]byte, 0, 128),
+		names: names,
+	}
+}
+
+// Add encodes the stats for a single torrent into the files dict
+func (sw *scrapeWriter) Add(torrent store.Torrent) error {
+	if sw.count > 0 && bytes.Compare(torrent.InfoHash[:], sw.last[:]) <= 0 {
+		return errors.Errorf("Scrape entry out of order: %s", torrent.InfoHash.String())
+	}
+	if !sw.started {
+		if _, err := sw.w.WriteString("d5:filesd"); err != nil {
+			return err
+		}
+		sw.started = true
+	}
+	b := sw.buf[:0]
+	b = strconv.AppendInt(b, int64(hex.EncodedLen(len(torrent.InfoHash))), 10)
+	b = append(b, ':')
+	n := len(b)
+	b = append(b, make([]byte, hex.EncodedLen(len(torrent.InfoHash)))...)
+	hex.Encode(b[n:], torrent.InfoHash[:])
+	b = append(b, "d8:completei"...)
+	b = strconv.AppendInt(b, int64(torrent.Seeders), 10)
+	b = append(b, "e10:downloadedi"...)
+	b = strconv.AppendUint(b, uint64(torrent.Snatches), 10)
+	b = append(b, "e10:incompletei"...)
+	b = strconv.AppendInt(b, int64(torrent.Leechers), 10)
+	b = append(b, 'e')
+	if sw.names && torrent.ReleaseName != "" {
+		b = append(b, "4:name"...)
+		b = strconv.AppendInt(b, int64(len(torrent.ReleaseName)), 10)
+		b = append(b, ':')
+		b = append(b, torrent.ReleaseName...)
+	}
+	b = append(b, 'e')
+	sw.buf = b
+	if _, err := sw.w.Write(b); err != nil {
+		return err
+	}
+	sw.last = torrent.InfoHash
+	sw.count++
+	return nil
+}
+
+// Close terminates the open dicts and flushes any remaining buffered data
+func (sw *scrapeWriter) Close() error {
+	if !sw.started {
+		if _, err := sw.w.WriteString("d5:filesd"); err != nil {
+			return err
+		}
+	}
+	if _, err := sw.w.WriteString("ee"); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
 // scrape handles the bittorrent scrape protocol for
 func (h *BitTorrentHandler) scrape(c *gin.Context) {
 	var user store.User
-	if !h.tracker.preFlightChecks(&user, c.Param("passkey"), c) {
+	if !h.tracker.preFlightChecks(&user, h.tracker.passkey(c), c) {
 		return
 	}
 	q, err := queryStringParser(c.Request.URL.RawQuery)
@@ -31,28 +113,49 @@ func (h *BitTorrentHandler) scrape(c *gin.Context) {
 		return
 	}
 	// Todo limit scrape to N torrents
-	resp := make(bencode.Dict, len(q.InfoHashes))
-	var ih store.InfoHash
+	infoHashes := make([]store.InfoHash, 0, len(q.InfoHashes))
 	for _, ihStr := range q.InfoHashes {
-		if err := store.InfoHashFromString(&ih, ihStr); err != nil {
+		var ih store.InfoHash
+		if err := h.tracker.parseInfoHash(&ih, ihStr); err != nil {
 			log.Errorf("Failed to decode info hash in scrape: %s", ihStr)
 			continue
 		}
+		infoHashes = append(infoHashes, ih)
+	}
+	// Sorted so the streamed dict keys are in the order bencode requires
+	sort.Slice(infoHashes, func(i, j int) bool {
+		return bytes.Compare(infoHashes[i][:], infoHashes[j][:]) < 0
+	})
+	c.Header("Content-Type", gin.MIMEPlain)
+	c.Status(http.StatusOK)
+	// Names are never sent by public trackers so that they can't be used to discover what
+	// content is being tracked
+	sw := newScrapeWriter(c.Writer, h.tracker.ScrapeIncludeName && !h.tracker.Public)
+	for i, ih := range infoHashes {
+		if i > 0 && ih == infoHashes[i-1] {
+			continue
+		}
 		var torrent store.Torrent
 		if err := h.tracker.TorrentGet(&torrent, ih, false); err != nil {
 			log.Debugf("Scrape request for invalid torrent: %s", ih)
 			continue
 		}
-		resp[ih.String()] = bencode.Dict{
-			"complete":   torrent.Seeders,
-			"downloaded": torrent.Snatches,
-			"incomplete": torrent.Leechers,
+		// Restricted torrents are hidden from users who can't announce them
+		if !h.tracker.UserAllowed(torrent, user.UserID) {
+			continue
+		}
+		if !h.tracker.StatsEnabled {
+			// The stored counts are only maintained by the stat worker
+			if swarm, err := h.tracker.PeerGetN(ih, 0); err == nil {
+				torrent.Seeders, torrent.Leechers = swarmCounts(swarm)
+			}
+		}
+		if err := sw.Add(torrent); err != nil {
+			log.Errorf("Failed to encode scrape response: %s", err)
+			return
 		}
 	}
-	var buf bytes.Buffer
-	if err := bencode.NewEncoder(&buf).Encode(resp); err != nil {
-		log.Errorf("Failed to encode scrape response")
-		return
+	if err := sw.Close(); err != nil {
+		log.Errorf("Failed to write scrape response: %s", err)
 	}
-	c.Data(http.StatusOK, gin.MIMEPlain, buf.Bytes())
 }
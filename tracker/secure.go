@@ -0,0 +1,150 @@
+package tracker
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+// How passkeys sent over plain HTTP are handled
+const (
+	// passkeyHTTPSOff allows passkeys over plain HTTP
+	passkeyHTTPSOff = "off"
+	// passkeyHTTPSWarn allows passkeys over plain HTTP but logs a warning
+	passkeyHTTPSWarn = "warn"
+	// passkeyHTTPSEnforce rejects requests sending a passkey over plain HTTP
+	passkeyHTTPSEnforce = "enforce"
+)
+
+// insecureWarnInterval is how often the plain HTTP warning is repeated for the same passkey
+const insecureWarnInterval = time.Hour
+
+// validPasskeyHTTPS returns true for known passkey HTTPS modes
+func validPasskeyHTTPS(mode string) bool {
+	switch mode {
+	case passkeyHTTPSOff, passkeyHTTPSWarn, passkeyHTTPSEnforce:
+		return true
+	}
+	return false
+}
+
+// parseTrustedProxies parses a list of proxy IP addresses and CIDR ranges
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy: %s", p)
+			}
+			if ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %s", p)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// fromTrustedProxy returns true when the connection was made by a trusted proxy. Only the
+// connecting address is checked as forwarded headers can be set by anyone.
+func (t *Tracker) fromTrustedProxy(c *gin.Context) bool {
+	return t.trustedProxy(remoteIP(c))
+}
+
+// trustedProxy returns true if the ip is within one of the trusted proxy ranges
+func (t *Tracker) trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range t.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedIP returns the client IP reported by a trusted proxy in the X-Real-IP or
+// X-Forwarded-For headers, or nil if the request didn't come from a trusted proxy or has no
+// usable header. Chained proxies each append to X-Forwarded-For, so it is read from the right
+// and the first address which isn't a trusted proxy is the client.
+func (t *Tracker) forwardedIP(c *gin.Context) net.IP {
+	if !t.fromTrustedProxy(c) {
+		return nil
+	}
+	if ip := net.ParseIP(strings.TrimSpace(c.GetHeader("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	hops := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			return nil
+		}
+		if !t.trustedProxy(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+// clientIP returns the IP forwarded by a trusted proxy, falling back to the address of the
+// connection. Unlike gin's ClientIP, forwarded headers set by anyone else are ignored.
+func (t *Tracker) clientIP(c *gin.Context) string {
+	if ip := t.forwardedIP(c); ip != nil {
+		return ip.String()
+	}
+	if ip := remoteIP(c); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// secureRequest returns true when the client connected over HTTPS, either directly or through
+// a trusted proxy which terminated TLS and set X-Forwarded-Proto
+func (t *Tracker) secureRequest(c *gin.Context) bool {
+	if c.Request.TLS != nil {
+		return true
+	}
+	if !t.fromTrustedProxy(c) {
+		return false
+	}
+	// Chained proxies append to the header. Only the last value was added by the trusted proxy,
+	// anything before it may have been sent by the client.
+	values := strings.Split(c.GetHeader("X-Forwarded-Proto"), ",")
+	return strings.EqualFold(strings.TrimSpace(values[len(values)-1]), "https")
+}
+
+// checkPasskeyTransport applies the PasskeyHTTPS policy to a request sending a passkey,
+// returning false if the request was rejected
+func (t *Tracker) checkPasskeyTransport(pk string, c *gin.Context) bool {
+	if t.PasskeyHTTPS == passkeyHTTPSOff || t.secureRequest(c) {
+		return true
+	}
+	if t.PasskeyHTTPS == passkeyHTTPSEnforce {
+		oops(c, msgHTTPSRequired)
+		return false
+	}
+	warn := false
+	t.insecureWarned.Update(pk, func(value interface{}, found bool) interface{} {
+		if !found || time.Since(value.(time.Time)) > insecureWarnInterval {
+			warn = true
+			return time.Now()
+		}
+		return value
+	})
+	if warn {
+		log.Warnf("Passkey sent over plain HTTP from %s: %s", c.Request.RemoteAddr, redactPasskey(c))
+	}
+	return true
+}
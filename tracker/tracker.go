@@ -2,7 +2,10 @@ package tracker
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"github.com/leighmacdonald/mika/config"
 	"github.com/leighmacdonald/mika/consts"
 	"github.com/leighmacdonald/mika/geo"
 	"github.com/leighmacdonald/mika/metrics"
@@ -10,6 +13,9 @@ import (
 	"github.com/leighmacdonald/mika/store/memory"
 	"github.com/leighmacdonald/mika/util"
 	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -24,37 +30,217 @@ type Tracker struct {
 	// ctx is the master context used in the tracker, children contexts must use
 	// this for their parent
 	ctx context.Context
+	// metricsStop is closed by ShutdownMetrics to stop the metrics jobs tracked by metricsWG
+	metricsStop     chan struct{}
+	metricsStopOnce sync.Once
+	metricsWG       sync.WaitGroup
 
 	torrents      store.TorrentStore
 	TorrentsCache *store.TorrentCache
 
 	users      store.UserStore
 	UsersCache *store.UserCache
+	// UserStatsCache holds user stats pending a batch update when write-behind is enabled
+	UserStatsCache *store.UserStatsCache
 
 	peers     store.PeerStore
 	PeerCache *store.PeerCache
 
-	Geodb geo.Provider
+	// Geodb and geodb lock, the provider must only be replaced using SetGeodb
+	Geodb   geo.Provider
+	GeodbMu *sync.RWMutex
 	// GeodbEnabled will enable the lookup of location data for peers
 	GeodbEnabled bool
+	// GeodbUpdateInterval is how often GeodbUpdater downloads a fresh geo database
+	GeodbUpdateInterval time.Duration
+	// geoCache holds recent IP locations, nil when caching is disabled. It is cleared
+	// whenever the provider is replaced.
+	geoCache *store.BoundedMap
 	// Public if true means we dont require a passkey / authorized user
 	Public bool
 	// If Public is true, this will allow unknown info_hashes to be automatically tracked
 	AutoRegister     bool
 	AllowNonRoutable bool
 	AllowClientIP    bool
+	// RejectMissingPort will reject announces with a missing or 0 port value
+	RejectMissingPort bool
 	// ReaperInterval is how often we can for dead peers in swarms
 	ReaperInterval time.Duration
-	AnnInterval    time.Duration
-	AnnIntervalMin time.Duration
-	BatchInterval  time.Duration
-	IPv6Only       bool
+	// ReaperMultiplier is how many reaper intervals a peer can go without announcing before
+	// it is reaped
+	ReaperMultiplier int
+	// ReaperDryRun will only log and count expired peers instead of removing them
+	ReaperDryRun bool
+	// TorrentPruneInterval is how often auto registered torrents without any activity are
+	// pruned, 0 disables pruning
+	TorrentPruneInterval time.Duration
+	// TorrentPruneAge is how long an auto registered torrent must go without peers or
+	// announces before it is pruned
+	TorrentPruneAge time.Duration
+	// TorrentPruneDryRun will only log and count the torrents that would be pruned
+	TorrentPruneDryRun bool
+	// IgnoreRepeatedStarted handles a started event from an already active peer as a
+	// regular announce
+	IgnoreRepeatedStarted bool
+	AnnInterval           time.Duration
+	AnnIntervalMin        time.Duration
+	// AnnIntervalScale is the curve used to raise the interval of large swarms, none|linear|log.
+	// AnnIntervalScalePeers sets how quickly it grows and AnnIntervalMax caps it.
+	AnnIntervalScale      string
+	AnnIntervalScalePeers int
+	AnnIntervalMax        time.Duration
+	BatchInterval         time.Duration
+	// AnnIntervalJitter randomly spreads the intervals sent by up to this percentage either way
+	AnnIntervalJitter float64
+	// IPv6 sends ipv6 peers to ipv6 clients in the peers6 key
+	IPv6 bool
+	// IPv6Only rejects ipv4 announces and only sends ipv6 peers
+	IPv6Only bool
 	// MaxPeers is the max number of peers we send in an announce
-	MaxPeers        int
-	StateUpdateChan chan store.UpdateState
+	MaxPeers int
+	// StatsEnabled enables traffic accounting. When false only swarm membership is tracked
+	StatsEnabled bool
+	// BonusEnabled enables accrual of seeding bonus points for users
+	BonusEnabled bool
+	// BonusRate is the amount of bonus points awarded per hour of seeding
+	BonusRate float64
+	// HNRThreshold is how long a peer must seed a torrent it downloaded from before leaving
+	// the swarm to avoid a hit and run. 0 disables hit and run tracking.
+	HNRThreshold time.Duration
+	// ClassMultiUp and ClassMultiDn are the upload and download multipliers for user classes
+	ClassMultiUp map[string]float64
+	ClassMultiDn map[string]float64
+	// ClassAnnIntervals overrides AnnInterval for user classes, keyed by lowercase class
+	ClassAnnIntervals map[string]time.Duration
+	StateUpdateChan   chan store.UpdateState
 	// Whitelist and whitelist lock
 	Whitelist   map[string]store.WhiteListClient
 	WhitelistMu *sync.RWMutex
+	// whitelistPatterns holds the glob and regex entries of the whitelist, which can't be
+	// looked up by prefix
+	whitelistPatterns []store.WhiteListClient
+	// DenyList and denylist lock
+	DenyList   map[store.InfoHash]store.DenyListInfoHash
+	DenyListMu *sync.RWMutex
+	// DenyListReason is the failure reason sent to clients announcing a denied info_hash
+	DenyListReason string
+	// AllowedUsers holds the only users allowed to announce each restricted torrent
+	AllowedUsers   map[store.InfoHash]map[uint32]bool
+	AllowedUsersMu *sync.RWMutex
+	// AllowedUsersReason is the failure reason sent to users announcing a restricted torrent
+	// they are not allowed on
+	AllowedUsersReason string
+	// UnauthorizedReason is the failure reason sent to requests without a valid passkey to
+	// private trackers
+	UnauthorizedReason string
+	// ClientReason is the failure reason sent to clients missing from the whitelist
+	ClientReason string
+	// AllowEmptyWhitelist allows every client while the whitelist is empty
+	AllowEmptyWhitelist bool
+	// FailureStatusOK sends failure responses with a 200 status instead of the tracker error code
+	FailureStatusOK bool
+	// MinRatio is the ratio users must keep to be sent peers while leeching. Announces from
+	// users below it are still accounted so they can seed back up. 0 disables the check.
+	MinRatio float64
+	// LowRatioMessage is the warning message sent to leechers below MinRatio
+	LowRatioMessage string
+	// RatioRefreshInterval is how often cached user ratios are recomputed after their stats
+	// are flushed. 0 disables caching ratios.
+	RatioRefreshInterval time.Duration
+	// ratios caches user ratios when RatioRefreshInterval is set
+	ratios *ratioCache
+	// PasskeyHeader is an optional header name clients can send their passkey in
+	PasskeyHeader string
+	// PasskeyHTTPS sets how passkeys sent over plain HTTP are handled, off|warn|enforce
+	PasskeyHTTPS string
+	// TrustedProxies are the proxies whose forwarded client IP and protocol headers are believed
+	TrustedProxies []*net.IPNet
+	// insecureWarned holds the last time a plain HTTP warning was logged for a passkey
+	insecureWarned *store.BoundedMap
+	// PasskeyLengths are the accepted passkey lengths, empty accepts any length
+	PasskeyLengths []int
+	// StoreDegradedMode will send minimal announce responses built from cached data when
+	// the backing stores return errors, instead of failing the announce
+	StoreDegradedMode bool
+	// DegradedInterval is the announce interval sent in degraded responses
+	DegradedInterval time.Duration
+	// BreakerThreshold is the count of consecutive store failures which opens the store
+	// circuit breaker, 0 disables the breaker
+	BreakerThreshold int
+	// BreakerProbeInterval is how often an announce is let through to an open breaker
+	// to check if the store has recovered
+	BreakerProbeInterval time.Duration
+	// NormalizeResponses sends announce responses with a fixed, sorted set of keys
+	NormalizeResponses bool
+	// ResponsePadSize pads normalized responses to a multiple of this many bytes
+	ResponsePadSize int
+	// ScrapeIncludeName adds the release name to scrape responses of private trackers
+	ScrapeIncludeName bool
+	// MaxURLLength is the longest announce URL accepted, 0 for no limit
+	MaxURLLength int
+	// AcceptHexInfoHash accepts hex encoded info_hashes in announces and scrapes
+	AcceptHexInfoHash bool
+	// MemoryMapMaxSize caps the entries held by each in-memory per passkey or per peer map
+	MemoryMapMaxSize int
+	// announceLimiter caps the simultaneous announces processed per info_hash
+	announceLimiter *infoHashLimiter
+	// storeBreaker answers announces in degraded mode without calling a failing store
+	storeBreaker *storeBreaker
+	// AnnounceJitterMin and AnnounceJitterMax bound the delay added to rapid re-announces
+	AnnounceJitterMin time.Duration
+	AnnounceJitterMax time.Duration
+	// RateLimitRate is the announces per minute allowed for each passkey, or client IP on public
+	// trackers, once the burst is used up. 0 disables rate limiting.
+	RateLimitRate float64
+	// RateLimitBurst is the number of announces allowed in quick succession
+	RateLimitBurst int
+	// lastAnnounce holds the time of the last announce for each passkey, IP and info_hash
+	lastAnnounce *store.BoundedMap
+	// rateLimits holds the token bucket of each rate limited passkey or IP
+	rateLimits *store.BoundedMap
+	// PeerIDMatch is the strategy used to match announces without a peer_id to a peer
+	PeerIDMatch string
+	// DuplicatePeerID is the policy for peer_ids shared between users on a torrent
+	DuplicatePeerID string
+	// CompletedCheck is the policy for completed events reporting much less downloaded than
+	// the torrent size, off|warn|reject
+	CompletedCheck string
+	// CompletedTolerance is the fraction of the torrent size a completed event may be short by
+	CompletedTolerance float64
+	// knownPeerIDs maps the key or address of clients to their last announced peer_id
+	knownPeerIDs *store.BoundedMap
+	// seedSessions holds the seeding time of each peer since it joined the swarm
+	seedSessions *store.BoundedMap
+	// AnnounceHistorySize is the number of recent announces kept per user, 0 disables the history
+	AnnounceHistorySize int
+	// AnnounceHistoryMaxAge hides retained announces older than this from the history
+	AnnounceHistoryMaxAge time.Duration
+	// announceHistory holds the recent announces of each passkey
+	announceHistory *store.BoundedMap
+	// SeedersGetLeechersOnly excludes seeders from the peers sent to seeders
+	SeedersGetLeechersOnly bool
+	// ExcludeOwnPeers excludes all peers of the announcing user from their peer list
+	ExcludeOwnPeers bool
+	// PreferLocalPeers fills the peer list with peers in the announcing peer's country first
+	PreferLocalPeers bool
+	// CompactPeerList sends compact peers as a list of per peer strings instead of one string
+	CompactPeerList bool
+	// RedactPeerIPs hides peer IP addresses from admin API responses
+	RedactPeerIPs bool
+	// APIKey is the bearer token required by the admin API. Empty disables authentication.
+	APIKey string
+	// APIMetricsNoAuth allows GET /metrics without the APIKey so it can be scraped
+	APIMetricsNoAuth bool
+	// APIMetricsTopTorrents is the number of the largest swarms given per torrent metrics
+	APIMetricsTopTorrents int
+	// PersistConfig saves config changes made through the admin API to the torrent store
+	PersistConfig bool
+	// MaxPageLimit caps the number of results returned by paginated API endpoints
+	MaxPageLimit int
+	// AuditLog records deletions made over the admin API
+	AuditLog *AuditLog
+	// announceHooks are run before each announce is accepted, see AddAnnounceHook
+	announceHooks []AnnounceHook
 }
 
 // Opts is used to configure tracker instances
@@ -65,66 +251,304 @@ type Opts struct {
 	TorrentCacheEnabled bool
 	UserCacheEnabled    bool
 	PeerCacheEnabled    bool
-	Geodb               geo.Provider
+	// UserStatsWriteBehind accumulates user stats in memory between batch updates
+	UserStatsWriteBehind bool
+	Geodb                geo.Provider
 	// GeodbEnabled will enable the lookup of location data for peers
 	// TODO the dummy provider is probably sufficient
 	GeodbEnabled bool
+	// GeodbCacheSize is the maximum number of cached IP locations, 0 disables the cache
+	GeodbCacheSize int
+	// GeodbCacheTTL is how long a cached IP location is used for
+	GeodbCacheTTL time.Duration
+	// GeodbUpdateInterval is how often the geo database is downloaded again, 0 disables updates
+	GeodbUpdateInterval time.Duration
 	// Public if true means we dont require a passkey / authorized user
 	Public bool
 	// If Public is true, this will allow unknown info_hashes to be automatically tracked
 	AutoRegister     bool
 	AllowNonRoutable bool
 	AllowClientIP    bool
-	// Dont enable dual-stack replies in ipv6 mode
+	// RejectMissingPort will reject announces with a missing or 0 port value
+	RejectMissingPort bool
+	// IPv6 sends ipv6 peers to ipv6 clients in the peers6 key
+	IPv6 bool
+	// IPv6Only rejects ipv4 announces and only sends ipv6 peers
 	IPv6Only bool
 	// ReaperInterval is how often we can for dead peers in swarms
 	ReaperInterval time.Duration
-	AnnInterval    time.Duration
-	AnnIntervalMin time.Duration
+	// ReaperMultiplier is how many reaper intervals a peer can go without announcing before
+	// it is reaped
+	ReaperMultiplier int
+	// ReaperDryRun will only log and count expired peers instead of removing them
+	ReaperDryRun bool
+	// TorrentPruneInterval is how often auto registered torrents without any activity are
+	// pruned, 0 disables pruning
+	TorrentPruneInterval time.Duration
+	// TorrentPruneAge is how long an auto registered torrent must go without peers or
+	// announces before it is pruned
+	TorrentPruneAge time.Duration
+	// TorrentPruneDryRun will only log and count the torrents that would be pruned
+	TorrentPruneDryRun bool
+	// IgnoreRepeatedStarted handles a started event from an already active peer as a
+	// regular announce
+	IgnoreRepeatedStarted bool
+	AnnInterval           time.Duration
+	AnnIntervalMin        time.Duration
+	// AnnIntervalScale is the curve used to raise the interval of large swarms, none|linear|log.
+	// AnnIntervalScalePeers sets how quickly it grows and AnnIntervalMax caps it.
+	AnnIntervalScale      string
+	AnnIntervalScalePeers int
+	AnnIntervalMax        time.Duration
+	// AnnIntervalJitter randomly spreads the intervals sent by up to this percentage either way
+	AnnIntervalJitter float64
 	// How often we sync batch updates to backing stores
 	BatchInterval time.Duration
 	// MaxPeers is the max number of peers we send in an announce
 	MaxPeers int
+	// StatsEnabled enables traffic accounting. When false only swarm membership is tracked
+	StatsEnabled bool
+	// BonusEnabled enables accrual of seeding bonus points for users
+	BonusEnabled bool
+	// BonusRate is the amount of bonus points awarded per hour of seeding
+	BonusRate float64
+	// HNRThreshold is how long a peer must seed a torrent it downloaded from before leaving
+	// the swarm to avoid a hit and run. 0 disables hit and run tracking.
+	HNRThreshold time.Duration
+	// ClassMultiUp and ClassMultiDn are the upload and download multipliers for user classes
+	ClassMultiUp map[string]float64
+	ClassMultiDn map[string]float64
+	// ClassAnnIntervals overrides AnnInterval for user classes, keyed by lowercase class
+	ClassAnnIntervals map[string]time.Duration
+	// DenyListReason is the failure reason sent to clients announcing a denied info_hash
+	DenyListReason string
+	// AllowedUsersReason is the failure reason sent to users announcing a restricted torrent
+	// they are not allowed on
+	AllowedUsersReason string
+	// UnauthorizedReason is the failure reason sent to requests without a valid passkey to
+	// private trackers
+	UnauthorizedReason string
+	// ClientReason is the failure reason sent to clients missing from the whitelist
+	ClientReason string
+	// AllowEmptyWhitelist allows every client while the whitelist is empty
+	AllowEmptyWhitelist bool
+	// FailureStatusOK sends failure responses with a 200 status instead of the tracker error code
+	FailureStatusOK bool
+	// MinRatio is the ratio users must keep to be sent peers while leeching. Announces from
+	// users below it are still accounted so they can seed back up. 0 disables the check.
+	MinRatio float64
+	// LowRatioMessage is the warning message sent to leechers below MinRatio
+	LowRatioMessage string
+	// RatioRefreshInterval is how often cached user ratios are recomputed after their stats
+	// are flushed. 0 disables caching ratios.
+	RatioRefreshInterval time.Duration
+	// PasskeyHeader is an optional header name clients can send their passkey in
+	PasskeyHeader string
+	// PasskeyHTTPS sets how passkeys sent over plain HTTP are handled, off|warn|enforce
+	PasskeyHTTPS string
+	// TrustedProxies are the IPs and CIDR ranges of proxies whose forwarded client IP and
+	// X-Forwarded-Proto headers are believed
+	TrustedProxies []string
+	// PasskeyLengths are the accepted passkey lengths, empty accepts any length
+	PasskeyLengths []int
+	// StoreDegradedMode will send minimal announce responses built from cached data when
+	// the backing stores return errors, instead of failing the announce
+	StoreDegradedMode bool
+	// DegradedInterval is the announce interval sent in degraded responses
+	DegradedInterval time.Duration
+	// BreakerThreshold is the count of consecutive store failures which opens the store
+	// circuit breaker, 0 disables the breaker
+	BreakerThreshold int
+	// BreakerProbeInterval is how often an announce is let through to an open breaker
+	// to check if the store has recovered
+	BreakerProbeInterval time.Duration
+	// NormalizeResponses sends announce responses with a fixed, sorted set of keys
+	NormalizeResponses bool
+	// ResponsePadSize pads normalized responses to a multiple of this many bytes
+	ResponsePadSize int
+	// ScrapeIncludeName adds the release name to scrape responses of private trackers
+	ScrapeIncludeName bool
+	// MaxURLLength is the longest announce URL accepted, 0 for no limit
+	MaxURLLength int
+	// AcceptHexInfoHash accepts hex encoded info_hashes in announces and scrapes
+	AcceptHexInfoHash bool
+	// MemoryMapMaxSize caps the entries held by each in-memory per passkey or per peer map
+	MemoryMapMaxSize int
+	// MaxAnnouncesPerInfoHash limits simultaneous announces per torrent, 0 for no limit
+	MaxAnnouncesPerInfoHash int
+	// PeerIDMatch is the strategy used to match announces without a peer_id to a peer
+	PeerIDMatch string
+	// DuplicatePeerID is the policy for peer_ids shared between users on a torrent
+	DuplicatePeerID string
+	// CompletedCheck is the policy for completed events reporting much less downloaded than
+	// the torrent size, off|warn|reject
+	CompletedCheck string
+	// CompletedTolerance is the fraction of the torrent size a completed event may be short by
+	CompletedTolerance float64
+	// AnnounceHistorySize is the number of recent announces kept per user, 0 disables the history
+	AnnounceHistorySize int
+	// AnnounceHistoryMaxAge hides retained announces older than this from the history
+	AnnounceHistoryMaxAge time.Duration
+	// AnnounceJitterMin and AnnounceJitterMax bound the delay added to rapid re-announces
+	AnnounceJitterMin time.Duration
+	AnnounceJitterMax time.Duration
+	// RateLimitRate is the announces per minute allowed for each passkey, or client IP on public
+	// trackers, once the burst is used up. 0 disables rate limiting.
+	RateLimitRate float64
+	// RateLimitBurst is the number of announces allowed in quick succession
+	RateLimitBurst int
+	// SeedersGetLeechersOnly excludes seeders from the peers sent to seeders
+	SeedersGetLeechersOnly bool
+	// ExcludeOwnPeers excludes all peers of the announcing user from their peer list
+	ExcludeOwnPeers bool
+	// PreferLocalPeers fills the peer list with peers in the announcing peer's country first
+	PreferLocalPeers bool
+	// CompactPeerList sends compact peers as a list of per peer strings instead of one string
+	CompactPeerList bool
+	// RedactPeerIPs hides peer IP addresses from admin API responses
+	RedactPeerIPs bool
+	// APIKey is the bearer token required by the admin API. Empty disables authentication.
+	APIKey string
+	// APIMetricsNoAuth allows GET /metrics without the APIKey so it can be scraped
+	APIMetricsNoAuth bool
+	// APIMetricsTopTorrents is the number of the largest swarms given per torrent metrics
+	APIMetricsTopTorrents int
+	// PersistConfig saves config changes made through the admin API to the torrent store
+	PersistConfig bool
+	// AuditLogSize is the number of deletions retained by the audit log
+	AuditLogSize int
+	// MaxPageLimit caps the number of results returned by paginated API endpoints
+	MaxPageLimit int
+	// AnnounceHooks are custom rules run before each announce is accepted
+	AnnounceHooks []AnnounceHook
 }
 
 // NewDefaultOpts returns a new tracker configuration using in-memory
 // stores and default interval values
 func NewDefaultOpts() *Opts {
 	return &Opts{
-		Torrents:            memory.NewTorrentStore(),
-		Peers:               memory.NewPeerStore(),
-		Users:               memory.NewUserStore(),
-		UserCacheEnabled:    false,
-		TorrentCacheEnabled: false,
-		PeerCacheEnabled:    false,
-		Geodb:               &geo.DummyProvider{},
-		GeodbEnabled:        false,
-		Public:              false,
-		AutoRegister:        false,
-		AllowNonRoutable:    false,
-		AllowClientIP:       false,
-		IPv6Only:            false,
-		ReaperInterval:      time.Second * 300,
-		AnnInterval:         time.Second * 60,
-		AnnIntervalMin:      time.Second * 30,
-		BatchInterval:       time.Second * 60,
-		MaxPeers:            100,
+		Torrents:              memory.NewTorrentStore(),
+		Peers:                 memory.NewPeerStore(),
+		Users:                 memory.NewUserStore(),
+		UserCacheEnabled:      false,
+		TorrentCacheEnabled:   false,
+		PeerCacheEnabled:      false,
+		Geodb:                 &geo.DummyProvider{},
+		GeodbEnabled:          false,
+		GeodbCacheSize:        10000,
+		GeodbCacheTTL:         time.Hour,
+		Public:                false,
+		AutoRegister:          false,
+		AllowNonRoutable:      false,
+		AllowClientIP:         false,
+		RejectMissingPort:     false,
+		IPv6:                  true,
+		IPv6Only:              false,
+		ReaperInterval:        time.Second * 300,
+		ReaperMultiplier:      4,
+		TorrentPruneAge:       time.Hour * 24 * 30,
+		IgnoreRepeatedStarted: true,
+		AnnInterval:           time.Second * 60,
+		AnnIntervalMin:        time.Second * 30,
+		AnnIntervalScale:      intervalScaleNone,
+		BatchInterval:         time.Second * 60,
+		MaxPeers:              100,
+		StatsEnabled:          true,
+		BonusEnabled:          false,
+		BonusRate:             1.0,
+		HNRThreshold:          0,
+		DenyListReason:        "Torrent has been removed",
+		AllowedUsersReason:    "You are not allowed to access this torrent",
+		UnauthorizedReason:    "Invalid passkey",
+		ClientReason:          "Client not whitelisted",
+		AllowEmptyWhitelist:   false,
+		FailureStatusOK:       true,
+		LowRatioMessage:       "Your ratio is too low to download, seed your torrents to restore access",
+		RatioRefreshInterval:  time.Minute,
+		StoreDegradedMode:     false,
+		DegradedInterval:      time.Second * 300,
+		BreakerProbeInterval:  time.Second * 30,
+		MaxURLLength:          2048,
+		MemoryMapMaxSize:      100000,
+		RateLimitBurst:        10,
+		PasskeyLengths:        []int{20},
+		AuditLogSize:          1000,
+		PeerIDMatch:           peerIDMatchNone,
+		DuplicatePeerID:       duplicatePeerIDAllow,
+		CompletedCheck:        completedCheckOff,
+		CompletedTolerance:    0.1,
+		PasskeyHTTPS:          passkeyHTTPSOff,
+		MaxPageLimit:          defaultMaxPageLimit,
+	}
+}
+
+// LoadPersistedConfig applies config values saved by the admin API on top of those read from
+// the config file and environment. It must be called before the tracker options are read
+// from the config.
+func LoadPersistedConfig(ts store.TorrentStore) error {
+	values, err := ts.ConfigGetAll()
+	if err != nil {
+		return err
+	}
+	for k, v := range values {
+		config.Set(config.Key(k), v)
+	}
+	log.Debugf("Loaded %d persisted config values", len(values))
+	return nil
+}
+
+// ReloadConfig re-reads the config file and applies the values which can be changed without
+// a restart, the same ones accepted by the config admin endpoint
+func (t *Tracker) ReloadConfig() error {
+	if err := config.Reload(); err != nil {
+		return err
+	}
+	t.applyConfig()
+	log.Infof("Reloaded config")
+	return nil
+}
+
+// applyConfig copies the runtime tunable config values into the running tracker. Like at
+// startup, an enabled geo database is only opened and never downloaded.
+func (t *Tracker) applyConfig() {
+	t.Lock()
+	defer t.Unlock()
+	t.AnnInterval = config.GetDuration(config.TrackerAnnounceInterval)
+	t.AnnIntervalMin = config.GetDuration(config.TrackerAnnounceIntervalMin)
+	t.AnnIntervalJitter = validJitter(config.GetFloat64(config.TrackerAnnounceIntervalJitter))
+	t.ReaperInterval = config.GetDuration(config.TrackerReaperInterval)
+	t.ReaperMultiplier = config.GetInt(config.TrackerReaperMultiplier)
+	t.BatchInterval = config.GetDuration(config.TrackerBatchUpdateInterval)
+	t.MaxPeers = config.GetInt(config.TrackerMaxPeers)
+	t.AutoRegister = config.GetBool(config.TrackerAutoRegister)
+	t.AllowNonRoutable = config.GetBool(config.TrackerAllowNonRoutable)
+	enabled := config.GetBool(config.GeodbEnabled)
+	current := t.geodbEnabled()
+	if enabled && !current {
+		newDb, opened := geo.Open(config.GetString(config.GeodbPath))
+		if !opened {
+			log.Errorf("Failed to open geo database, it remains disabled")
+			return
+		}
+		t.SetGeodb(newDb, true)
+	} else if !enabled && current {
+		t.SetGeodb(&geo.DummyProvider{}, false)
 	}
 }
 
 // PeerReaper will call the store.PeerStore.Reap() function periodically. This is
 // used to clean peers that have not announced in a while from the swarm.
 func (t *Tracker) PeerReaper() {
+	// The counts are otherwise unset until the first tick
+	t.refreshCounts()
 	peerTimer := time.NewTimer(t.ReaperInterval)
 	for {
 		select {
 		case <-peerTimer.C:
-			expired := t.peers.Reap()
-			if t.PeerCache != nil {
-				for _, ph := range expired {
-					t.PeerCache.Delete(ph.InfoHash(), ph.PeerID())
-				}
-			}
+			t.reapPeers()
+			t.refreshCounts()
+			t.refreshTopTorrents()
+			t.pruneMaps()
 			// We use a timer here so that config updates for the interval get applied
 			// on the next tick
 			peerTimer.Reset(t.ReaperInterval)
@@ -134,10 +558,261 @@ func (t *Tracker) PeerReaper() {
 	}
 }
 
+// boundedMaps returns the in-memory tracking maps keyed by the name used to label their metrics
+func (t *Tracker) boundedMaps() map[string]*store.BoundedMap {
+	maps := map[string]*store.BoundedMap{
+		"insecure_warned":  t.insecureWarned,
+		"last_announce":    t.lastAnnounce,
+		"rate_limits":      t.rateLimits,
+		"known_peer_ids":   t.knownPeerIDs,
+		"seed_sessions":    t.seedSessions,
+		"announce_history": t.announceHistory,
+	}
+	if t.geoCache != nil {
+		maps["geo_cache"] = t.geoCache
+	}
+	if t.ratios != nil {
+		maps["ratios"] = t.ratios.ratios
+	}
+	return maps
+}
+
+// pruneMaps removes the expired entries from the in-memory tracking maps, which otherwise
+// only drop them when full, and publishes the number of entries left in each
+func (t *Tracker) pruneMaps() {
+	entries := make(map[string]int64)
+	for name, m := range t.boundedMaps() {
+		m.Prune()
+		entries[name] = int64(m.Len())
+	}
+	metrics.SetBoundedMapEntries(entries)
+}
+
+// peerExpiry is how long a peer can go without announcing before it is reaped
+func (t *Tracker) peerExpiry() time.Duration {
+	multiplier := t.ReaperMultiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	return t.ReaperInterval * time.Duration(multiplier)
+}
+
+// reapPeers removes any expired peers from the swarms and local peer cache, taking them off
+// the seeder and leecher counts of their torrents. When ReaperDryRun is enabled the expired
+// peers are only logged and counted.
+func (t *Tracker) reapPeers() []store.PeerHash {
+	// The store returns the peers as they were when removed, so they are counted by their
+	// latest state and peers which announced in the meantime are left alone
+	expired := t.peers.Reap(time.Now().Add(-t.peerExpiry()), t.ReaperDryRun)
+	var reaped []store.PeerHash
+	for _, peer := range expired {
+		reaped = append(reaped, store.NewPeerHash(peer.InfoHash, peer.PeerID))
+	}
+	if t.ReaperDryRun {
+		for _, peer := range expired {
+			log.Infof("Reaper dry-run, would reap peer: %s (%s)", peer.PeerID.String(), peer.InfoHash.String())
+		}
+		atomic.AddInt64(&metrics.ReaperDryRunPeers, int64(len(expired)))
+		return reaped
+	}
+	counts := make(map[store.InfoHash]store.TorrentStats)
+	for i, peer := range expired {
+		if t.PeerCache != nil {
+			t.PeerCache.Delete(peer.InfoHash, peer.PeerID)
+		}
+		t.peerLeft(peer.UserID, reaped[i], peer.Left)
+		tb := counts[peer.InfoHash]
+		if peer.Left == 0 || peer.Paused {
+			tb.Seeders--
+		} else {
+			tb.Leechers--
+		}
+		counts[peer.InfoHash] = tb
+	}
+	atomic.AddInt64(&metrics.PeersReaped, int64(len(reaped)))
+	// The counts are only kept by the stat worker, otherwise they are taken from the swarm
+	if t.StatsEnabled && len(counts) > 0 {
+		if err := t.TorrentSync(counts); err != nil {
+			log.Errorf("Failed to update swarm counts of reaped peers: %s", err)
+		}
+	}
+	return reaped
+}
+
+// TorrentPruner periodically removes auto registered torrents which have had no peers or
+// announces for TorrentPruneAge
+func (t *Tracker) TorrentPruner() {
+	pruneTimer := time.NewTimer(t.TorrentPruneInterval)
+	for {
+		select {
+		case <-pruneTimer.C:
+			t.pruneTorrents()
+			pruneTimer.Reset(t.TorrentPruneInterval)
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// pruneTorrents deletes the inactive auto registered torrents, returning the info_hashes
+// pruned. Denied info_hashes are kept so they remain denied if announced again. When
+// TorrentPruneDryRun is enabled the torrents are only logged and counted.
+func (t *Tracker) pruneTorrents() []store.InfoHash {
+	olderThan := time.Now().Add(-t.TorrentPruneAge)
+	inactive, err := t.torrents.Inactive(olderThan)
+	if err != nil {
+		log.Errorf("Failed to fetch inactive torrents: %s", err)
+		return nil
+	}
+	var pruned []store.InfoHash
+	for _, ih := range inactive {
+		if t.InfoHashDenied(ih) {
+			continue
+		}
+		// The torrent stats are not updated when stats are disabled, so the swarm decides
+		// whether the torrent is still in use
+		swarm, err := t.peers.GetN(ih, 0)
+		if errors.Is(err, consts.ErrInvalidTorrentID) {
+			swarm, err = store.NewSwarm(), nil
+		}
+		if err != nil {
+			log.Errorf("Failed to fetch swarm of inactive torrent %s: %s", ih.String(), err)
+			continue
+		}
+		peerIDs, active := swarmActive(swarm, olderThan)
+		if active {
+			continue
+		}
+		if t.TorrentPruneDryRun {
+			log.Infof("Pruner dry-run, would prune torrent: %s", ih.String())
+			atomic.AddInt64(&metrics.PrunerDryRunTorrents, 1)
+			pruned = append(pruned, ih)
+			continue
+		}
+		if err := t.torrents.Delete(ih, true); err != nil {
+			log.Errorf("Failed to prune torrent %s: %s", ih.String(), err)
+			continue
+		}
+		if t.TorrentsCache != nil {
+			t.TorrentsCache.Delete(ih, true)
+		}
+		// Stale peers are removed with the torrent rather than waiting for the reaper
+		for _, peerID := range peerIDs {
+			if err := t.peerDelete(ih, peerID); err != nil {
+				log.Errorf("Failed to delete peer of pruned torrent %s: %s", ih.String(), err)
+			}
+		}
+		atomic.AddInt64(&metrics.PrunedTorrents, 1)
+		pruned = append(pruned, ih)
+	}
+	return pruned
+}
+
+// swarmActive returns the peer ids of the swarm and true if any of them announced since olderThan
+func swarmActive(swarm store.Swarm, olderThan time.Time) ([]store.PeerID, bool) {
+	swarm.RLock()
+	defer swarm.RUnlock()
+	var peerIDs []store.PeerID
+	for id, peer := range swarm.Peers {
+		if !peer.Expired(olderThan) {
+			return nil, true
+		}
+		peerIDs = append(peerIDs, id)
+	}
+	return peerIDs, false
+}
+
+// refreshCounts updates the total count metrics using the stores. Unlike the cache counters
+// these are read from the stores so they can't drift. Counting can be slow on large stores so
+// this only runs on the reaper tick and the metrics and stats endpoints use the cached values.
+func (t *Tracker) refreshCounts() {
+	if count, err := t.CountTorrents(); err != nil {
+		log.Errorf("Failed to count torrents: %s", err)
+	} else {
+		atomic.StoreInt64(&metrics.TorrentsTotal, int64(count))
+	}
+	if count, err := t.CountUsers(); err != nil {
+		log.Errorf("Failed to count users: %s", err)
+	} else {
+		atomic.StoreInt64(&metrics.UsersTotal, int64(count))
+	}
+	if count, err := t.CountPeers(); err != nil {
+		log.Errorf("Failed to count peers: %s", err)
+	} else {
+		atomic.StoreInt64(&metrics.PeersTotal, int64(count))
+	}
+}
+
+// torrentsPageSize is the number of torrents read from the store at a time when walking
+// every torrent
+const torrentsPageSize = 1000
+
+// refreshTopTorrents publishes the APIMetricsTopTorrents largest swarms as the per torrent
+// metrics, using the seeder and leecher counts of the torrents. The counts are only kept
+// while StatsEnabled is set.
+func (t *Tracker) refreshTopTorrents() {
+	if t.APIMetricsTopTorrents <= 0 || !t.StatsEnabled {
+		return
+	}
+	var top []metrics.TorrentSwarm
+	for offset := 0; ; offset += torrentsPageSize {
+		torrents, err := t.torrents.List(torrentsPageSize, offset)
+		if err != nil {
+			log.Errorf("Failed to fetch torrents: %s", err)
+			return
+		}
+		for _, tor := range torrents {
+			if tor.Seeders+tor.Leechers == 0 {
+				continue
+			}
+			top = append(top, metrics.TorrentSwarm{
+				InfoHash: tor.InfoHash.String(),
+				Seeders:  int64(tor.Seeders),
+				Leechers: int64(tor.Leechers),
+			})
+		}
+		sort.Slice(top, func(i, j int) bool {
+			a, b := top[i].Seeders+top[i].Leechers, top[j].Seeders+top[j].Leechers
+			if a == b {
+				return top[i].InfoHash < top[j].InfoHash
+			}
+			return a > b
+		})
+		// Only the largest swarms seen so far are kept between pages
+		if len(top) > t.APIMetricsTopTorrents {
+			top = top[:t.APIMetricsTopTorrents]
+		}
+		if len(torrents) < torrentsPageSize {
+			break
+		}
+	}
+	metrics.SetTopTorrents(top)
+}
+
+// classMultipliers returns the upload and download multipliers for the user class
+func (t *Tracker) classMultipliers(class string) (float64, float64) {
+	up, dn := 1.0, 1.0
+	if class == "" {
+		return up, dn
+	}
+	class = strings.ToLower(class)
+	if m, found := t.ClassMultiUp[class]; found {
+		up = m
+	}
+	if m, found := t.ClassMultiDn[class]; found {
+		dn = m
+	}
+	return up, dn
+}
+
 // StatWorker handles summing up stats for users/peers/torrents to be sent to the
-// backing stores for long term storage.
+// backing stores for long term storage. It returns immediately when stats are disabled.
 // No locking required for these data sets
 func (t *Tracker) StatWorker() {
+	if !t.StatsEnabled {
+		log.Infof("Stats disabled, not starting stat worker")
+		return
+	}
 	syncTimer := time.NewTimer(t.BatchInterval)
 	userBatch := make(map[string]store.UserStats)
 	peerBatch := make(map[store.PeerHash]store.PeerStats)
@@ -147,10 +822,15 @@ func (t *Tracker) StatWorker() {
 		case <-syncTimer.C:
 			// Copy the maps to pass into the go routine call. At the same time deleting
 			// the existing values
-			userBatchCopy := make(map[string]store.UserStats)
-			for k, v := range userBatch {
-				userBatchCopy[k] = v
-				delete(userBatch, k)
+			var userBatchCopy map[string]store.UserStats
+			if t.UserStatsCache != nil {
+				userBatchCopy = t.UserStatsCache.Flush()
+			} else {
+				userBatchCopy = make(map[string]store.UserStats)
+				for k, v := range userBatch {
+					userBatchCopy[k] = v
+					delete(userBatch, k)
+				}
 			}
 
 			peerBatchCopy := make(map[store.PeerHash]store.PeerStats)
@@ -164,25 +844,9 @@ func (t *Tracker) StatWorker() {
 				torrentBatchCopy[k] = v
 				delete(torrentBatch, k)
 			}
-			// Send current copies of data to stores
-			log.Debugf("Calling Sync() on %d users", len(userBatchCopy))
-			if err := t.UserSync(userBatchCopy); err != nil {
-				log.Errorf(err.Error())
-			}
-			log.Debugf("Calling Sync() on %d peers", len(userBatchCopy))
-			if err := t.PeerSync(peerBatchCopy); err != nil {
-				log.Errorf(err.Error())
-			}
-			log.Debugf("Calling Sync() on %d torrents", len(userBatchCopy))
-			if err := t.TorrentSync(torrentBatchCopy); err != nil {
-				log.Errorf(err.Error())
-			}
+			t.flushStats(userBatchCopy, peerBatchCopy, torrentBatchCopy)
 			syncTimer.Reset(t.BatchInterval)
 		case u := <-t.StateUpdateChan:
-			ub, found := userBatch[u.Passkey]
-			if !found {
-				ub = store.UserStats{}
-			}
 			tb, found := torrentBatch[u.InfoHash]
 			if !found {
 				tb = store.TorrentStats{}
@@ -200,9 +864,35 @@ func (t *Tracker) StatWorker() {
 				continue
 			}
 			// Global user stats
-			ub.Uploaded += uint64(float64(u.Uploaded) * torrent.MultiUp)
-			ub.Downloaded += uint64(float64(u.Downloaded) * torrent.MultiDn)
-			ub.Announces++
+			classUp, classDn := t.classMultipliers(u.Class)
+			us := store.UserStats{
+				Uploaded:   uint64(float64(u.Uploaded) * torrent.MultiUp * classUp * u.MultiUp),
+				Downloaded: uint64(float64(u.Downloaded) * torrent.DownloadMultiplier() * classDn * u.MultiDn),
+				Announces:  1,
+			}
+			if t.BonusEnabled {
+				us.Bonus = t.seedBonus(u, pb)
+			}
+			t.addSeedTime(u, pHash)
+			if t.UserStatsCache != nil {
+				t.UserStatsCache.Add(u.Passkey, us)
+			} else {
+				ub := userBatch[u.Passkey]
+				ub.Uploaded += us.Uploaded
+				ub.Downloaded += us.Downloaded
+				ub.Announces += us.Announces
+				ub.Bonus += us.Bonus
+				userBatch[u.Passkey] = ub
+			}
+
+			// The state of the peer before this announce, preferring any pending batched state
+			// over the state read from the store by the announce
+			wasPaused, prevLeft := u.WasPaused, u.PrevLeft
+			knownState := !u.NoPrevState
+			if peerFound {
+				wasPaused, prevLeft = pb.Paused, pb.Left
+				knownState = true
+			}
 
 			// Peer stats
 			pb.Hist = append(pb.Hist, store.AnnounceHist{
@@ -211,6 +901,7 @@ func (t *Tracker) StatWorker() {
 				Timestamp:  u.Timestamp,
 			})
 			pb.Left = u.Left
+			pb.Paused = u.Paused
 
 			// Global torrent stats
 			tb.Announces++
@@ -219,22 +910,40 @@ func (t *Tracker) StatWorker() {
 
 			switch u.Event {
 			case consts.PAUSED:
-				if !pb.Paused {
+				// Partial seeds are counted as seeders
+				if u.Joined {
+					tb.Seeders++
+				} else if knownState && !wasPaused && prevLeft > 0 {
+					tb.Leechers--
 					tb.Seeders++
 				}
 			case consts.STARTED:
+				if !knownState {
+					// Degraded announces don't add the peer to the swarm
+					break
+				}
 				if u.Left == 0 {
 					tb.Seeders++
 				} else {
 					tb.Leechers++
 				}
 			case consts.COMPLETED:
+				if knownState && !u.Joined && !wasPaused && prevLeft == 0 {
+					// Already counted as a seeder and snatch by an earlier completed event
+					log.Warnf("Repeated completed event from seeder: %s (%s)", u.PeerID.String(), u.InfoHash.String())
+					atomic.AddInt64(&metrics.AnnounceRepeatedCompleted, 1)
+					break
+				}
 				tb.Snatches++
-				tb.Seeders++
-				tb.Leechers--
+				if knownState && !wasPaused {
+					tb.Seeders++
+					tb.Leechers--
+				}
 			case consts.STOPPED:
 				// Paused considered a seeder
-				if u.Paused || u.Left == 0 {
+				if !knownState {
+					log.Debugf("Stopped peer with unknown state, swarm counts unchanged: %s", u.PeerID.String())
+				} else if wasPaused || u.Left == 0 {
 					tb.Seeders--
 				} else {
 					tb.Leechers--
@@ -242,8 +951,14 @@ func (t *Tracker) StatWorker() {
 				if err := t.peerDelete(u.InfoHash, u.PeerID); err != nil {
 					log.Errorf("Could not remove peer from swarm: %s", err.Error())
 				}
+				t.peerLeft(u.UserID, pHash, u.Left)
+			default:
+				// A partial seed resuming its download becomes a leecher again
+				if knownState && wasPaused && u.Left > 0 {
+					tb.Seeders--
+					tb.Leechers++
+				}
 			}
-			userBatch[u.Passkey] = ub
 			torrentBatch[u.InfoHash] = tb
 			peerBatch[pHash] = pb
 		case <-t.ctx.Done():
@@ -253,29 +968,230 @@ func (t *Tracker) StatWorker() {
 	}
 }
 
+// flushStats writes the accumulated stats to the stores with a single batched Sync() call per
+// store. Idle trackers skip the stores entirely rather than writing empty batches.
+func (t *Tracker) flushStats(users map[string]store.UserStats, peers map[store.PeerHash]store.PeerStats,
+	torrents map[store.InfoHash]store.TorrentStats) {
+	if len(users) > 0 {
+		log.Debugf("Calling Sync() on %d users", len(users))
+		if err := t.UserSync(users); err != nil {
+			log.Errorf(err.Error())
+			if t.UserStatsCache != nil {
+				// Keep the stats pending so they are retried on the next sync
+				for passkey, stats := range users {
+					t.UserStatsCache.Add(passkey, stats)
+				}
+			}
+		}
+	}
+	if len(peers) > 0 {
+		log.Debugf("Calling Sync() on %d peers", len(peers))
+		if err := t.PeerSync(peers); err != nil {
+			log.Errorf(err.Error())
+		}
+	}
+	if len(torrents) > 0 {
+		log.Debugf("Calling Sync() on %d torrents", len(torrents))
+		if err := t.TorrentSync(torrents); err != nil {
+			log.Errorf(err.Error())
+		}
+	}
+}
+
+// updateSwarm applies an announce to the swarm directly when stats are disabled. Stopped peers
+// are removed and other peers have their state and last announce time refreshed so they are
+// not reaped. No traffic is recorded.
+func (t *Tracker) updateSwarm(ih store.InfoHash, peerID store.PeerID, left uint64, event consts.AnnounceType, paused bool) error {
+	if event == consts.STOPPED {
+		return t.peerDelete(ih, peerID)
+	}
+	return t.PeerSync(map[store.PeerHash]store.PeerStats{
+		store.NewPeerHash(ih, peerID): {
+			Left:   left,
+			Paused: paused,
+			Hist:   []store.AnnounceHist{{Timestamp: time.Now()}},
+		},
+	})
+}
+
+// swarmCounts returns the number of seeders and leechers in the swarm. Partial seeds are
+// counted as seeders.
+func swarmCounts(swarm store.Swarm) (seeders int, leechers int) {
+	swarm.RLock()
+	for _, p := range swarm.Peers {
+		if p.Left == 0 || p.Paused {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	swarm.RUnlock()
+	return seeders, leechers
+}
+
+// seedBonus calculates the bonus points earned by a seeding peer since its previous
+// announce. The previous announce time is taken from the pending batch if one exists
+// otherwise the last synced announce time of the peer is used.
+func (t *Tracker) seedBonus(u store.UpdateState, pb store.PeerStats) float64 {
+	if u.Left > 0 || u.Paused {
+		return 0
+	}
+	var last time.Time
+	if len(pb.Hist) > 0 {
+		last = pb.Hist[len(pb.Hist)-1].Timestamp
+	} else {
+		var peer store.Peer
+		if err := t.PeerGet(&peer, u.InfoHash, u.PeerID); err != nil {
+			return 0
+		}
+		last = peer.AnnounceLast
+	}
+	elapsed := u.Timestamp.Sub(last)
+	if elapsed <= 0 {
+		return 0
+	}
+	return elapsed.Hours() * t.BonusRate
+}
+
 // New creates a new Tracker instance with configured backend stores
 func New(ctx context.Context, opts *Opts) (*Tracker, error) {
 	t := &Tracker{
-		RWMutex:          &sync.RWMutex{},
-		ctx:              ctx,
-		torrents:         opts.Torrents,
-		peers:            opts.Peers,
-		users:            opts.Users,
-		Geodb:            opts.Geodb,
-		GeodbEnabled:     opts.GeodbEnabled,
-		Public:           opts.Public,
-		AllowNonRoutable: opts.AllowNonRoutable,
-		AllowClientIP:    opts.AllowClientIP,
-		IPv6Only:         opts.IPv6Only,
-		AutoRegister:     opts.AutoRegister,
-		ReaperInterval:   opts.ReaperInterval,
-		AnnInterval:      opts.AnnInterval,
-		AnnIntervalMin:   opts.AnnIntervalMin,
-		BatchInterval:    opts.BatchInterval,
-		MaxPeers:         opts.MaxPeers,
-		StateUpdateChan:  make(chan store.UpdateState, 1000),
-		Whitelist:        make(map[string]store.WhiteListClient),
-		WhitelistMu:      &sync.RWMutex{},
+		RWMutex:                &sync.RWMutex{},
+		ctx:                    ctx,
+		metricsStop:            make(chan struct{}),
+		torrents:               opts.Torrents,
+		peers:                  opts.Peers,
+		users:                  opts.Users,
+		Geodb:                  opts.Geodb,
+		GeodbMu:                &sync.RWMutex{},
+		GeodbEnabled:           opts.GeodbEnabled,
+		GeodbUpdateInterval:    opts.GeodbUpdateInterval,
+		Public:                 opts.Public,
+		AllowNonRoutable:       opts.AllowNonRoutable,
+		AllowClientIP:          opts.AllowClientIP,
+		RejectMissingPort:      opts.RejectMissingPort,
+		IPv6:                   opts.IPv6,
+		IPv6Only:               opts.IPv6Only,
+		AutoRegister:           opts.AutoRegister,
+		ReaperInterval:         opts.ReaperInterval,
+		ReaperMultiplier:       opts.ReaperMultiplier,
+		ReaperDryRun:           opts.ReaperDryRun,
+		TorrentPruneInterval:   opts.TorrentPruneInterval,
+		TorrentPruneAge:        opts.TorrentPruneAge,
+		TorrentPruneDryRun:     opts.TorrentPruneDryRun,
+		IgnoreRepeatedStarted:  opts.IgnoreRepeatedStarted,
+		AnnInterval:            opts.AnnInterval,
+		AnnIntervalMin:         opts.AnnIntervalMin,
+		AnnIntervalScale:       opts.AnnIntervalScale,
+		AnnIntervalScalePeers:  opts.AnnIntervalScalePeers,
+		AnnIntervalMax:         opts.AnnIntervalMax,
+		AnnIntervalJitter:      opts.AnnIntervalJitter,
+		BatchInterval:          opts.BatchInterval,
+		MaxPeers:               opts.MaxPeers,
+		StatsEnabled:           opts.StatsEnabled,
+		BonusEnabled:           opts.BonusEnabled,
+		BonusRate:              opts.BonusRate,
+		HNRThreshold:           opts.HNRThreshold,
+		ClassMultiUp:           opts.ClassMultiUp,
+		ClassMultiDn:           opts.ClassMultiDn,
+		ClassAnnIntervals:      opts.ClassAnnIntervals,
+		StateUpdateChan:        make(chan store.UpdateState, 1000),
+		Whitelist:              make(map[string]store.WhiteListClient),
+		WhitelistMu:            &sync.RWMutex{},
+		DenyList:               make(map[store.InfoHash]store.DenyListInfoHash),
+		DenyListMu:             &sync.RWMutex{},
+		DenyListReason:         opts.DenyListReason,
+		AllowedUsers:           make(map[store.InfoHash]map[uint32]bool),
+		AllowedUsersMu:         &sync.RWMutex{},
+		AllowedUsersReason:     opts.AllowedUsersReason,
+		UnauthorizedReason:     opts.UnauthorizedReason,
+		ClientReason:           opts.ClientReason,
+		AllowEmptyWhitelist:    opts.AllowEmptyWhitelist,
+		FailureStatusOK:        opts.FailureStatusOK,
+		MinRatio:               opts.MinRatio,
+		LowRatioMessage:        opts.LowRatioMessage,
+		RatioRefreshInterval:   opts.RatioRefreshInterval,
+		PasskeyHeader:          opts.PasskeyHeader,
+		PasskeyHTTPS:           opts.PasskeyHTTPS,
+		insecureWarned:         store.NewBoundedMap(opts.MemoryMapMaxSize, insecureWarnInterval),
+		PasskeyLengths:         opts.PasskeyLengths,
+		StoreDegradedMode:      opts.StoreDegradedMode,
+		DegradedInterval:       opts.DegradedInterval,
+		BreakerThreshold:       opts.BreakerThreshold,
+		BreakerProbeInterval:   opts.BreakerProbeInterval,
+		NormalizeResponses:     opts.NormalizeResponses,
+		ResponsePadSize:        opts.ResponsePadSize,
+		ScrapeIncludeName:      opts.ScrapeIncludeName,
+		MaxURLLength:           opts.MaxURLLength,
+		AcceptHexInfoHash:      opts.AcceptHexInfoHash,
+		MemoryMapMaxSize:       opts.MemoryMapMaxSize,
+		announceLimiter:        newInfoHashLimiter(opts.MaxAnnouncesPerInfoHash),
+		storeBreaker:           newStoreBreaker(0, opts.BreakerProbeInterval),
+		AnnounceJitterMin:      opts.AnnounceJitterMin,
+		AnnounceJitterMax:      opts.AnnounceJitterMax,
+		lastAnnounce:           store.NewBoundedMap(opts.MemoryMapMaxSize, 0),
+		RateLimitRate:          opts.RateLimitRate,
+		RateLimitBurst:         opts.RateLimitBurst,
+		rateLimits:             store.NewBoundedMap(opts.MemoryMapMaxSize, rateLimitTTL(opts.RateLimitRate, opts.RateLimitBurst)),
+		PeerIDMatch:            opts.PeerIDMatch,
+		DuplicatePeerID:        opts.DuplicatePeerID,
+		CompletedCheck:         opts.CompletedCheck,
+		CompletedTolerance:     opts.CompletedTolerance,
+		knownPeerIDs:           store.NewBoundedMap(opts.MemoryMapMaxSize, 0),
+		seedSessions:           store.NewBoundedMap(opts.MemoryMapMaxSize, 0),
+		AnnounceHistorySize:    opts.AnnounceHistorySize,
+		AnnounceHistoryMaxAge:  opts.AnnounceHistoryMaxAge,
+		announceHistory:        store.NewBoundedMap(opts.MemoryMapMaxSize, opts.AnnounceHistoryMaxAge),
+		SeedersGetLeechersOnly: opts.SeedersGetLeechersOnly,
+		ExcludeOwnPeers:        opts.ExcludeOwnPeers,
+		PreferLocalPeers:       opts.PreferLocalPeers,
+		CompactPeerList:        opts.CompactPeerList,
+		RedactPeerIPs:          opts.RedactPeerIPs,
+		APIKey:                 opts.APIKey,
+		APIMetricsNoAuth:       opts.APIMetricsNoAuth,
+		APIMetricsTopTorrents:  opts.APIMetricsTopTorrents,
+		PersistConfig:          opts.PersistConfig,
+		MaxPageLimit:           opts.MaxPageLimit,
+		AuditLog:               NewAuditLog(opts.AuditLogSize),
+	}
+	if t.StoreDegradedMode {
+		// Open breakers rely on degraded responses, so it is only used in degraded mode
+		t.storeBreaker = newStoreBreaker(t.BreakerThreshold, t.BreakerProbeInterval)
+	}
+	if !validIntervalScale(t.AnnIntervalScale) {
+		log.Warnf("Unknown announce interval scale %q, intervals are not scaled", t.AnnIntervalScale)
+		t.AnnIntervalScale = intervalScaleNone
+	}
+	if t.AnnIntervalMax <= 0 || t.AnnIntervalMax > t.maxScaledInterval() {
+		t.AnnIntervalMax = t.maxScaledInterval()
+	}
+	t.AnnIntervalJitter = validJitter(t.AnnIntervalJitter)
+	if !validPasskeyHTTPS(t.PasskeyHTTPS) {
+		log.Warnf("Unknown passkey HTTPS mode %q, passkeys are allowed over plain HTTP", t.PasskeyHTTPS)
+		t.PasskeyHTTPS = passkeyHTTPSOff
+	}
+	trusted, err := parseTrustedProxies(opts.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	t.TrustedProxies = trusted
+	if !validPeerIDMatch(t.PeerIDMatch) {
+		log.Warnf("Unknown peer_id match strategy %q, announces without a peer_id are rejected", t.PeerIDMatch)
+		t.PeerIDMatch = peerIDMatchNone
+	}
+	if !validDuplicatePeerID(t.DuplicatePeerID) {
+		log.Warnf("Unknown duplicate peer_id policy %q, duplicates are allowed", t.DuplicatePeerID)
+		t.DuplicatePeerID = duplicatePeerIDAllow
+	}
+	if t.RatioRefreshInterval > 0 {
+		t.ratios = newRatioCache(opts.MemoryMapMaxSize)
+	}
+	if !validCompletedCheck(t.CompletedCheck) {
+		log.Warnf("Unknown completed check policy %q, completed events are not checked", t.CompletedCheck)
+		t.CompletedCheck = completedCheckOff
+	}
+	if opts.GeodbCacheSize > 0 {
+		t.geoCache = store.NewBoundedMap(opts.GeodbCacheSize, opts.GeodbCacheTTL)
 	}
 	// Don't enable caching if we are already configured for a memory store.
 	if opts.TorrentCacheEnabled {
@@ -294,6 +1210,12 @@ func New(ctx context.Context, opts *Opts) (*Tracker, error) {
 			t.UsersCache = store.NewUserCache()
 		}
 	}
+	if opts.UserStatsWriteBehind {
+		t.UserStatsCache = store.NewUserStatsCache()
+	}
+	for _, hook := range opts.AnnounceHooks {
+		t.AddAnnounceHook(hook)
+	}
 	if opts.PeerCacheEnabled {
 		switch t.peers.(type) {
 		case *memory.PeerStore:
@@ -320,6 +1242,12 @@ func NewTestTracker() (*Tracker, error) {
 	opts.MaxPeers = 50
 	opts.AllowNonRoutable = false
 	opts.AllowClientIP = true
+	// Test requests are made from this range, acting as a proxy so they can announce any ip
+	opts.TrustedProxies = []string{"172.16.0.0/12"}
+	// The tests check the tracker error code sent as the status of failures
+	opts.FailureStatusOK = false
+	// Test peers use random client prefixes
+	opts.AllowEmptyWhitelist = true
 	tracker, err := New(ctx, opts)
 	if err != nil {
 		return nil, err
@@ -327,8 +1255,16 @@ func NewTestTracker() (*Tracker, error) {
 	if err := tracker.LoadWhitelist(); err != nil {
 		return nil, err
 	}
+	if err := tracker.LoadDenyList(); err != nil {
+		return nil, err
+	}
+	if err := tracker.LoadAllowedUsers(); err != nil {
+		return nil, err
+	}
 	for i := 0; i < userCount; i++ {
 		usr := store.GenerateTestUser()
+		// Use ids outside of the randomly generated range so tests can add their own users
+		usr.UserID = uint32(10000 + i)
 		usr.Passkey = fmt.Sprintf("1234567890123456789%d", i)
 		if err := tracker.users.Add(usr); err != nil {
 			return nil, err
@@ -342,34 +1278,314 @@ func NewTestTracker() (*Tracker, error) {
 	return tracker, nil
 }
 
+// ClientWhitelisted checks if the peer id prefix exists in the client whitelist and that
+// the client meets the entries minimum version, if any. If the whitelist is empty all
+// clients are allowed only when AllowEmptyWhitelist is set.
 func (t *Tracker) ClientWhitelisted(peerID store.PeerID) bool {
 	t.WhitelistMu.RLock()
-	_, found := t.Whitelist[string(peerID[0:8])]
-	t.WhitelistMu.RUnlock()
-	return found
+	defer t.WhitelistMu.RUnlock()
+	if len(t.Whitelist) == 0 && t.AllowEmptyWhitelist {
+		return true
+	}
+	wl, found := t.whitelistEntry(peerID)
+	return found && wl.VersionAllowed(peerID)
+}
+
+// lowRatio returns true if the user is below the minimum ratio required to receive peers
+func (t *Tracker) lowRatio(usr store.User) bool {
+	return t.MinRatio > 0 && t.userRatio(usr) < t.MinRatio
+}
+
+// ClientName returns the name of the whitelist entry matching the peer id prefix, or
+// clientOther for unknown clients
+func (t *Tracker) ClientName(peerID store.PeerID) string {
+	t.WhitelistMu.RLock()
+	defer t.WhitelistMu.RUnlock()
+	wl, found := t.whitelistEntry(peerID)
+	if !found {
+		return clientOther
+	}
+	return wl.ClientName
+}
+
+// whitelistEntry finds the whitelist entry with the longest prefix or pattern matching the
+// peer id, eg: -qB4170- before -qB to allow any qBittorrent version. WhitelistMu must be held.
+func (t *Tracker) whitelistEntry(peerID store.PeerID) (store.WhiteListClient, bool) {
+	var wl store.WhiteListClient
+	found := false
+	for n := len(peerID); n > 0; n-- {
+		// Glob and regex entries are keyed by their pattern rather than a literal prefix
+		if entry, ok := t.Whitelist[string(peerID[:n])]; ok && !entry.IsPattern() {
+			wl, found = entry, true
+			break
+		}
+	}
+	for _, entry := range t.whitelistPatterns {
+		if len(entry.ClientPrefix) > len(wl.ClientPrefix) && entry.Match(string(peerID[:])) {
+			wl, found = entry, true
+		}
+	}
+	return wl, found
+}
+
+// setWhitelist replaces the whitelist, collecting the glob and regex entries which are
+// matched separately from the prefixes. WhitelistMu must be held.
+func (t *Tracker) setWhitelist(whitelist map[string]store.WhiteListClient) {
+	var patterns []store.WhiteListClient
+	for _, entry := range whitelist {
+		if entry.IsPattern() {
+			patterns = append(patterns, entry)
+		}
+	}
+	t.Whitelist = whitelist
+	t.whitelistPatterns = patterns
+}
+
+// newWhitelist indexes the whitelist entries by their prefix, compiling their glob and regex
+// patterns and parsing their minimum versions. Invalid entries are skipped.
+func newWhitelist(entries []store.WhiteListClient) map[string]store.WhiteListClient {
+	whitelist := make(map[string]store.WhiteListClient)
+	for _, entry := range entries {
+		compiled, err := entry.Compile()
+		if err != nil {
+			log.Errorf("Skipping invalid whitelist entry %s: %s", entry.ClientPrefix, err)
+			continue
+		}
+		whitelist[entry.ClientPrefix] = compiled
+	}
+	return whitelist
 }
 
 // LoadWhitelist will read the client white list from the tracker store and
 // load it into memory for quick lookups.
 func (t *Tracker) LoadWhitelist() error {
-	whitelist := make(map[string]store.WhiteListClient)
 	wl, err4 := t.torrents.WhiteListGetAll()
 	if err4 != nil {
-		log.Warnf("Whitelist empty, all clients are allowed")
-	} else {
-		for _, cw := range wl {
-			whitelist[cw.ClientPrefix] = cw
+		log.Warnf("Failed to load whitelist, it is empty: %s", err4)
+	}
+	whitelist := newWhitelist(wl)
+	t.WhitelistMu.Lock()
+	t.setWhitelist(whitelist)
+	t.WhitelistMu.Unlock()
+	return nil
+}
+
+// storeUnavailable returns true when degraded mode is enabled and the error returned
+// from a store is something other than a missing torrent or peer. Failures are counted
+// towards opening the store circuit breaker.
+func (t *Tracker) storeUnavailable(err error) bool {
+	if err == nil || errors.Is(err, consts.ErrInvalidInfoHash) || errors.Is(err, consts.ErrInvalidPeerID) {
+		return false
+	}
+	atomic.AddInt64(&metrics.StoreFailures, 1)
+	t.storeBreaker.failure()
+	return t.StoreDegradedMode
+}
+
+// parseInfoHash decodes an info_hash sent by a client. Hex encoded info_hashes of either case
+// are decoded to the same binary form as the raw bytes when AcceptHexInfoHash is enabled.
+func (t *Tracker) parseInfoHash(ih *store.InfoHash, s string) error {
+	if t.AcceptHexInfoHash && len(s) == hex.EncodedLen(len(ih)) {
+		return store.InfoHashFromHex(ih, s)
+	}
+	return store.InfoHashFromString(ih, s)
+}
+
+// InfoHashDenied checks if the info_hash exists in the denylist
+func (t *Tracker) InfoHashDenied(ih store.InfoHash) bool {
+	t.DenyListMu.RLock()
+	defer t.DenyListMu.RUnlock()
+	_, found := t.DenyList[ih]
+	return found
+}
+
+// LoadDenyList will read the info_hash denylist from the tracker store and
+// load it into memory for quick lookups.
+func (t *Tracker) LoadDenyList() error {
+	dl, err := t.torrents.DenyListGetAll()
+	if err != nil {
+		return err
+	}
+	denylist := make(map[store.InfoHash]store.DenyListInfoHash)
+	for _, entry := range dl {
+		denylist[entry.InfoHash] = entry
+	}
+	t.DenyListMu.Lock()
+	t.DenyList = denylist
+	t.DenyListMu.Unlock()
+	return nil
+}
+
+// UserAllowed returns true if the user may announce the torrent. Only restricted torrents
+// check the allowed users, a restricted torrent without any is closed to all users. Torrents
+// with allowed users in memory are treated as restricted even when the flag is missing, such
+// as a torrent that could not be fetched while the store is unavailable.
+func (t *Tracker) UserAllowed(tor store.Torrent, userID uint32) bool {
+	t.AllowedUsersMu.RLock()
+	defer t.AllowedUsersMu.RUnlock()
+	users, found := t.AllowedUsers[tor.InfoHash]
+	if !tor.Restricted && !found {
+		return true
+	}
+	return users[userID]
+}
+
+// restrictTorrent marks the torrent as only accepting announces from its allowed users
+func (t *Tracker) restrictTorrent(ih store.InfoHash) error {
+	var tor store.Torrent
+	if err := t.torrents.Get(&tor, ih, true); err != nil {
+		return err
+	}
+	if tor.Restricted {
+		return nil
+	}
+	tor.Restricted = true
+	if err := t.torrents.Update(tor); err != nil {
+		return err
+	}
+	if t.TorrentsCache != nil {
+		t.TorrentsCache.Delete(ih, true)
+	}
+	return nil
+}
+
+// setUserAllowed adds or removes the user from the in-memory allowed users of the torrent
+func (t *Tracker) setUserAllowed(entry store.TorrentAllowedUser, allowed bool) {
+	t.AllowedUsersMu.Lock()
+	defer t.AllowedUsersMu.Unlock()
+	users, found := t.AllowedUsers[entry.InfoHash]
+	if allowed {
+		if !found {
+			users = make(map[uint32]bool)
+			t.AllowedUsers[entry.InfoHash] = users
 		}
+		users[entry.UserID] = true
+		return
 	}
-	t.Lock()
-	t.Whitelist = whitelist
-	t.Unlock()
+	// The emptied set is kept so the torrent stays closed until it is unrestricted
+	delete(users, entry.UserID)
+}
+
+// LoadAllowedUsers will read the allowed users of restricted torrents from the tracker store
+// and load them into memory for quick lookups.
+func (t *Tracker) LoadAllowedUsers() error {
+	entries, err := t.torrents.AllowedUsersGetAll()
+	if err != nil {
+		return err
+	}
+	allowed := make(map[store.InfoHash]map[uint32]bool)
+	for _, entry := range entries {
+		if allowed[entry.InfoHash] == nil {
+			allowed[entry.InfoHash] = make(map[uint32]bool)
+		}
+		allowed[entry.InfoHash][entry.UserID] = true
+	}
+	t.AllowedUsersMu.Lock()
+	t.AllowedUsers = allowed
+	t.AllowedUsersMu.Unlock()
 	return nil
 }
+
+// GeoLocation looks up the location of the ip using the current geo provider
+func (t *Tracker) GeoLocation(ip net.IP) geo.Location {
+	t.GeodbMu.RLock()
+	defer t.GeodbMu.RUnlock()
+	if t.geoCache == nil || !t.GeodbEnabled {
+		return t.Geodb.GetLocation(ip)
+	}
+	key := ip.String()
+	if l, found := t.geoCache.Get(key); found {
+		atomic.AddInt64(&metrics.GeoCacheHits, 1)
+		return l.(geo.Location)
+	}
+	atomic.AddInt64(&metrics.GeoCacheMisses, 1)
+	l := t.Geodb.GetLocation(ip)
+	t.geoCache.Set(key, l)
+	return l
+}
+
+// SetGeodb replaces the current geo provider. The previous provider is closed once any
+// in-flight lookups using it have completed.
+func (t *Tracker) SetGeodb(provider geo.Provider, enabled bool) {
+	t.GeodbMu.Lock()
+	prev := t.Geodb
+	t.Geodb = provider
+	t.GeodbEnabled = enabled
+	if t.geoCache != nil {
+		t.geoCache.Clear()
+	}
+	t.GeodbMu.Unlock()
+	if prev != nil && prev != provider {
+		prev.Close()
+	}
+}
+
+// geodbEnabled returns true if peer location lookups are enabled
+func (t *Tracker) geodbEnabled() bool {
+	t.GeodbMu.RLock()
+	defer t.GeodbMu.RUnlock()
+	return t.GeodbEnabled
+}
+
 func (t *Tracker) TorrentAdd(torrent store.Torrent) error {
 	return t.torrents.Add(torrent)
 }
 
+// TorrentDelete marks the torrent as deleted so it is no longer announced. Soft deleted
+// torrents keep their stats and can be brought back with TorrentRestore. If dropRow is
+// true the torrent is permanently removed from the store instead.
+func (t *Tracker) TorrentDelete(hash store.InfoHash, dropRow bool) error {
+	if err := t.torrents.Delete(hash, dropRow); err != nil {
+		return err
+	}
+	if t.TorrentsCache != nil {
+		t.TorrentsCache.Delete(hash, dropRow)
+	}
+	return nil
+}
+
+// torrentDeleted returns true if the torrent exists in the store but is soft deleted
+func (t *Tracker) torrentDeleted(hash store.InfoHash) bool {
+	var torrent store.Torrent
+	return t.torrents.Get(&torrent, hash, true) == nil && torrent.IsDeleted
+}
+
+// TorrentRestore clears the deleted flag of a soft deleted torrent so it is announced again.
+// Restoring a torrent which is not deleted does nothing.
+func (t *Tracker) TorrentRestore(hash store.InfoHash) error {
+	var torrent store.Torrent
+	if err := t.torrents.Get(&torrent, hash, true); err != nil {
+		return err
+	}
+	if !torrent.IsDeleted {
+		return nil
+	}
+	torrent.IsDeleted = false
+	if err := t.torrents.Update(torrent); err != nil {
+		return err
+	}
+	if t.TorrentsCache != nil {
+		// Drop the cached copy so the next announce reads the restored torrent
+		t.TorrentsCache.Delete(hash, true)
+	}
+	return nil
+}
+
+// CountTorrents returns the number of torrents in the store, excluding deleted torrents
+func (t *Tracker) CountTorrents() (int, error) {
+	return t.torrents.Count()
+}
+
+// CountUsers returns the number of users in the store
+func (t *Tracker) CountUsers() (int, error) {
+	return t.users.Count()
+}
+
+// CountPeers returns the number of peers across all swarms in the store
+func (t *Tracker) CountPeers() (int, error) {
+	return t.peers.Count()
+}
+
 func (t *Tracker) TorrentGet(torrent *store.Torrent, hash store.InfoHash, deletedOk bool) error {
 	cached := false
 	if t.TorrentsCache != nil {
@@ -390,6 +1606,37 @@ func (t *Tracker) TorrentGet(torrent *store.Torrent, hash store.InfoHash, delete
 	return nil
 }
 
+// TorrentGetMany returns the torrents matching the infohashes keyed by infohash. Torrents
+// missing from the cache are fetched from the store in a single call.
+func (t *Tracker) TorrentGetMany(hashes []store.InfoHash, deletedOk bool) (map[store.InfoHash]store.Torrent, error) {
+	torrents := make(map[store.InfoHash]store.Torrent, len(hashes))
+	var missing []store.InfoHash
+	for _, hash := range hashes {
+		var tor store.Torrent
+		if t.TorrentsCache != nil && t.TorrentsCache.Get(&tor, hash) {
+			if !tor.IsDeleted || deletedOk {
+				torrents[hash] = tor
+			}
+			continue
+		}
+		missing = append(missing, hash)
+	}
+	if len(missing) == 0 {
+		return torrents, nil
+	}
+	fetched, err := t.torrents.GetMany(missing, deletedOk)
+	if err != nil {
+		return nil, err
+	}
+	for hash, tor := range fetched {
+		if t.TorrentsCache != nil {
+			t.TorrentsCache.Set(tor)
+		}
+		torrents[hash] = tor
+	}
+	return torrents, nil
+}
+
 func (t *Tracker) UserGet(user *store.User, passkey string) error {
 	cached := false
 	if t.UsersCache != nil {
@@ -427,6 +1674,24 @@ func (t *Tracker) PeerGet(peer *store.Peer, infoHash store.InfoHash, peerID stor
 	return nil
 }
 
+// maxPeers returns the max number of peers to send for the torrent, preferring the torrents
+// own limit over the global one when set
+func (t *Tracker) maxPeers(torrent store.Torrent) int {
+	if torrent.MaxPeers > 0 {
+		return torrent.MaxPeers
+	}
+	return t.MaxPeers
+}
+
+// numWant returns the number of peers to send a client asking for numWant of them, capped
+// at the max peers of the torrent
+func (t *Tracker) numWant(numWant uint, torrent store.Torrent) int {
+	if max := t.maxPeers(torrent); max > 0 && numWant > uint(max) {
+		return max
+	}
+	return int(numWant)
+}
+
 func (t *Tracker) PeerGetN(infoHash store.InfoHash, max int) (store.Swarm, error) {
 	swarm, err := t.peers.GetN(infoHash, max)
 	if err != nil {
@@ -446,7 +1711,9 @@ func (t *Tracker) PeerAdd(infoHash store.InfoHash, peer store.Peer) error {
 	return nil
 }
 func (t *Tracker) peerDelete(infoHash store.InfoHash, peerID store.PeerID) error {
-	t.PeerCache.Delete(infoHash, peerID)
+	if t.PeerCache != nil {
+		t.PeerCache.Delete(infoHash, peerID)
+	}
 	return t.peers.Delete(infoHash, peerID)
 }
 
@@ -461,10 +1728,14 @@ func (t *Tracker) UserSync(batch map[string]store.UserStats) error {
 				usr.Downloaded += stats.Downloaded
 				usr.Uploaded += stats.Uploaded
 				usr.Announces += stats.Announces
+				usr.Bonus += stats.Bonus
 				t.UsersCache.Set(usr)
 			}
 		}
 	}
+	if t.ratios != nil {
+		t.ratios.markStale(batch)
+	}
 	return nil
 }
 
@@ -483,6 +1754,9 @@ func (t *Tracker) PeerSync(batch map[store.PeerHash]store.PeerStats) error {
 				peer.SpeedUP = uint32(sum.SpeedUp)
 				peer.SpeedDNMax = util.UMax32(peer.SpeedDNMax, uint32(sum.SpeedDn))
 				peer.SpeedUPMax = util.UMax32(peer.SpeedUPMax, uint32(sum.SpeedUp))
+				peer.AnnounceLast = sum.LastAnn
+				peer.Left = stats.Left
+				peer.Paused = stats.Paused
 				t.PeerCache.Set(ph.InfoHash(), peer)
 			}
 		}
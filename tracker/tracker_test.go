@@ -1,16 +1,33 @@
 package tracker
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/chihaya/bencode"
+	"github.com/gin-gonic/gin"
 	"github.com/leighmacdonald/mika/consts"
+	"github.com/leighmacdonald/mika/geo"
+	"github.com/leighmacdonald/mika/metrics"
 	"github.com/leighmacdonald/mika/store"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -144,13 +161,147 @@ func TestBitTorrentHandler_Scrape(t *testing.T) {
 
 		v, err := bencode.NewDecoder(w.Body).Decode()
 		require.NoError(t, err, "Failed to decode scrape: (%d)", i)
-		d := v.(bencode.Dict)
+		d := v.(bencode.Dict)["files"].(bencode.Dict)
 		require.Equal(t, int64(1), d[torrent0.InfoHash.String()].(bencode.Dict)["complete"].(int64))
 		require.Equal(t, int64(1), d[torrent0.InfoHash.String()].(bencode.Dict)["incomplete"].(int64))
 		require.Equal(t, int64(2), d[torrent0.InfoHash.String()].(bencode.Dict)["downloaded"].(int64))
 	}
 }
 
+func TestBitTorrentHandler_ScrapeMany(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	req := scrapeReq{PK: user0.Passkey}
+	expected := make(map[string]store.Torrent)
+	for i := 0; i < 1000; i++ {
+		torrent := store.GenerateTestTorrent()
+		torrent.Seeders = i
+		torrent.Leechers = i * 2
+		require.NoError(t, tkr.torrents.Add(torrent))
+		req.InfoHashes = append(req.InfoHashes, torrent.InfoHash)
+		expected[torrent.InfoHash.String()] = torrent
+	}
+	deleted := store.GenerateTestTorrent()
+	deleted.IsDeleted = true
+	require.NoError(t, tkr.torrents.Add(deleted))
+	// Duplicates, deleted and unknown hashes must not produce duplicate or empty keys
+	req.InfoHashes = append(req.InfoHashes, req.InfoHashes[0], deleted.InfoHash, store.GenerateTestTorrent().InfoHash)
+	u := fmt.Sprintf("/scrape/%s?%s", req.PK, req.ToValues().Encode())
+	w := performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+	// The decoder does not handle strings spanning its read buffer, so give it the whole body
+	v, err := bencode.NewDecoder(bufio.NewReaderSize(w.Body, w.Body.Len())).Decode()
+	require.NoError(t, err, "Failed to decode streamed scrape")
+	files := v.(bencode.Dict)["files"].(bencode.Dict)
+	require.Equal(t, len(expected), len(files))
+	for k, torrent := range expected {
+		stats := files[k].(bencode.Dict)
+		require.Equal(t, int64(torrent.Seeders), stats["complete"].(int64))
+		require.Equal(t, int64(torrent.Leechers), stats["incomplete"].(int64))
+	}
+}
+
+func TestBitTorrentHandler_ScrapeRestricted(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	open := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(open))
+	restricted := store.GenerateTestTorrent()
+	restricted.Restricted = true
+	require.NoError(t, tkr.torrents.Add(restricted))
+	scrape := func() bencode.Dict {
+		req := scrapeReq{PK: user0.Passkey, InfoHashes: []store.InfoHash{open.InfoHash, restricted.InfoHash}}
+		w := performRequest(rh, "GET", fmt.Sprintf("/scrape/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(w.Body).Decode()
+		require.NoError(t, err)
+		return v.(bencode.Dict)["files"].(bencode.Dict)
+	}
+	files := scrape()
+	require.Contains(t, files, open.InfoHash.String())
+	require.NotContains(t, files, restricted.InfoHash.String())
+
+	tkr.setUserAllowed(store.TorrentAllowedUser{InfoHash: restricted.InfoHash, UserID: user0.UserID}, true)
+	require.Contains(t, scrape(), restricted.InfoHash.String())
+}
+
+func TestBitTorrentHandler_ScrapeName(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	named := store.GenerateTestTorrent()
+	named.ReleaseName = "Some.Release.2020.1080p"
+	unnamed := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(named))
+	require.NoError(t, tkr.torrents.Add(unnamed))
+	req := scrapeReq{PK: user0.Passkey, InfoHashes: []store.InfoHash{named.InfoHash, unnamed.InfoHash}}
+	u := fmt.Sprintf("/scrape/%s?%s", req.PK, req.ToValues().Encode())
+	scrape := func() bencode.Dict {
+		w := performRequest(rh, "GET", u, nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(w.Body).Decode()
+		require.NoError(t, err, "Failed to decode scrape")
+		return v.(bencode.Dict)["files"].(bencode.Dict)
+	}
+	for _, tc := range []struct {
+		enabled bool
+		public  bool
+	}{{false, false}, {true, true}} {
+		tkr.ScrapeIncludeName = tc.enabled
+		tkr.Public = tc.public
+		for _, stats := range scrape() {
+			_, found := stats.(bencode.Dict)["name"]
+			require.False(t, found, "Name sent (enabled: %v public: %v)", tc.enabled, tc.public)
+		}
+	}
+	tkr.ScrapeIncludeName = true
+	tkr.Public = false
+	files := scrape()
+	require.Equal(t, named.ReleaseName, files[named.InfoHash.String()].(bencode.Dict)["name"].(string))
+	_, found := files[unnamed.InfoHash.String()].(bencode.Dict)["name"]
+	require.False(t, found, "Empty name sent")
+}
+
+func TestScrapeWriter(t *testing.T) {
+	torrents := make([]store.Torrent, 1000)
+	for i := range torrents {
+		torrents[i] = store.GenerateTestTorrent()
+	}
+	sort.Slice(torrents, func(i, j int) bool {
+		return bytes.Compare(torrents[i].InfoHash[:], torrents[j].InfoHash[:]) < 0
+	})
+	var buf bytes.Buffer
+	sw := newScrapeWriter(&buf, false)
+	require.NoError(t, sw.Add(torrents[1]))
+	require.Error(t, sw.Add(torrents[0]), "Out of order key accepted")
+	require.Error(t, sw.Add(torrents[1]), "Duplicate key accepted")
+	require.NoError(t, sw.Close())
+	v, err := bencode.NewDecoder(&buf).Decode()
+	require.NoError(t, err)
+	require.Equal(t, 1, len(v.(bencode.Dict)["files"].(bencode.Dict)))
+
+	// Memory use should not grow with the number of torrents in the response
+	if raceEnabled {
+		t.Skip("Allocations are not counted accurately with the race detector")
+	}
+	allocs := testing.AllocsPerRun(10, func() {
+		w := newScrapeWriter(ioutil.Discard, true)
+		for _, torrent := range torrents {
+			_ = w.Add(torrent)
+		}
+		_ = w.Close()
+	})
+	require.LessOrEqual(t, allocs/float64(len(torrents)), 1.0, "Too many allocations per scrape entry")
+}
+
 func TestBitTorrentHandler_Announce(t *testing.T) {
 	torrent0 := store.GenerateTestTorrent()
 	leecher0 := store.GenerateTestPeer()
@@ -162,6 +313,8 @@ func TestBitTorrentHandler_Announce(t *testing.T) {
 
 	tkr, err := NewTestTracker()
 	require.NoError(t, err, "Failed to init tracker")
+	// leecher0 announces before sending its started event below, which should still be counted
+	tkr.IgnoreRepeatedStarted = false
 	time.Sleep(time.Millisecond * 200)
 	go tkr.StatWorker()
 	go tkr.PeerReaper()
@@ -175,7 +328,7 @@ func TestBitTorrentHandler_Announce(t *testing.T) {
 	type stateExpected struct {
 		Uploaded   uint64
 		Downloaded uint64
-		Left       uint32
+		Left       uint64
 		Seeders    int
 		Leechers   int
 		Port       uint16
@@ -312,3 +465,2507 @@ func TestBitTorrentHandler_Announce(t *testing.T) {
 		}
 	}
 }
+
+func TestHNR(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.HNRThreshold = time.Hour
+	go tkr.StatWorker()
+
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	leecher := store.GenerateTestPeer()
+	seeder := store.GenerateTestPeer()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	require.NoError(t, tkr.peers.Add(torrent0.InfoHash, leecher))
+	require.NoError(t, tkr.peers.Add(torrent0.InfoHash, seeder))
+	start := time.Now().Add(-time.Hour * 4)
+	send := func(pid store.PeerID, event consts.AnnounceType, left uint64, downloaded uint64, offset time.Duration) {
+		tkr.StateUpdateChan <- store.UpdateState{
+			InfoHash:   torrent0.InfoHash,
+			PeerID:     pid,
+			Passkey:    user0.Passkey,
+			UserID:     user0.UserID,
+			Event:      event,
+			Left:       left,
+			Downloaded: downloaded,
+			Timestamp:  start.Add(offset),
+		}
+	}
+	hnrs := func() []store.HNR {
+		time.Sleep(time.Millisecond * 100)
+		h, err := tkr.users.HNRGetByUser(user0.UserID)
+		require.NoError(t, err)
+		return h
+	}
+
+	// Leaving with the download complete is never a hit and run
+	send(seeder.PeerID, consts.STARTED, 0, 0, 0)
+	send(seeder.PeerID, consts.STOPPED, 0, 0, time.Minute)
+	send(leecher.PeerID, consts.STARTED, 5000, 0, 0)
+	send(leecher.PeerID, consts.COMPLETED, 0, 5000, time.Minute)
+	send(leecher.PeerID, consts.STOPPED, 0, 5000, time.Minute*31)
+	require.Empty(t, hnrs())
+
+	// Leaving before finishing the download
+	send(leecher.PeerID, consts.STARTED, 5000, 0, 0)
+	send(leecher.PeerID, consts.ANNOUNCE, 3000, 2000, time.Minute*30)
+	send(leecher.PeerID, consts.STOPPED, 3000, 2000, time.Minute*31)
+	h := hnrs()
+	require.Len(t, h, 1)
+	require.Equal(t, torrent0.InfoHash, h[0].InfoHash)
+	require.Equal(t, uint32(0), h[0].SeedTime)
+
+	// Seeding for the threshold clears it
+	send(seeder.PeerID, consts.STARTED, 0, 0, time.Hour)
+	send(seeder.PeerID, consts.ANNOUNCE, 0, 0, time.Hour+time.Minute*30)
+	require.Len(t, hnrs(), 1, "Cleared before reaching the threshold")
+	send(seeder.PeerID, consts.ANNOUNCE, 0, 0, time.Hour*2)
+	require.Empty(t, hnrs(), "Not cleared after seeding for the threshold")
+
+	// Peers without a session, such as after a restart, are not recorded as their seeding
+	// time is unknown
+	stale := store.GenerateTestPeer()
+	stale.UserID = user0.UserID
+	stale.Downloaded = 1000
+	stale.Left = 4000
+	stale.AnnounceLast = time.Now().Add(-time.Hour)
+	require.NoError(t, tkr.peers.Add(torrent0.InfoHash, stale))
+	require.Len(t, tkr.reapPeers(), 1)
+	require.Empty(t, hnrs())
+
+	// Reaped peers which started a session are hit and runs too
+	require.NoError(t, tkr.peers.Add(torrent0.InfoHash, stale))
+	send(stale.PeerID, consts.STARTED, 4000, 0, 0)
+	hnrs()
+	require.Len(t, tkr.reapPeers(), 1)
+	require.Len(t, hnrs(), 1)
+
+	// Public trackers share a single user so never record hit and runs
+	tkr.Public = true
+	require.NoError(t, tkr.users.HNRDelete(user0.UserID, torrent0.InfoHash))
+	send(leecher.PeerID, consts.STARTED, 5000, 0, time.Hour*3)
+	send(leecher.PeerID, consts.STOPPED, 5000, 0, time.Hour*3+time.Minute)
+	require.Empty(t, hnrs())
+}
+
+func TestSeederBonus(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.BonusEnabled = true
+	tkr.BonusRate = 2.0
+	go tkr.StatWorker()
+
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	seeder0 := store.GenerateTestPeer()
+	start := time.Now().Add(-time.Hour * 4)
+	seeder0.AnnounceLast = start
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	require.NoError(t, tkr.peers.Add(torrent0.InfoHash, seeder0))
+
+	updates := []struct {
+		left     uint64
+		offset   time.Duration
+		expected float64
+	}{
+		{0, time.Hour, 2.0},
+		{0, time.Hour * 2, 4.0},
+		// Leeching does not accrue any bonus
+		{1000, time.Hour * 3, 4.0},
+		{0, time.Hour*3 + time.Minute*30, 5.0},
+	}
+	for i, u := range updates {
+		tkr.StateUpdateChan <- store.UpdateState{
+			InfoHash:  torrent0.InfoHash,
+			PeerID:    seeder0.PeerID,
+			Passkey:   user0.Passkey,
+			Left:      u.left,
+			Timestamp: start.Add(u.offset),
+		}
+		time.Sleep(time.Millisecond * 200) // Wait for batch update call (100ms)
+		var usr store.User
+		require.NoError(t, tkr.users.GetByPasskey(&usr, user0.Passkey))
+		require.InDelta(t, u.expected, usr.Bonus, 0.0001, "Invalid bonus (%d)", i)
+	}
+}
+
+func TestUserClassMultipliers(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.ClassMultiUp = map[string]float64{"vip": 1.5}
+	tkr.ClassMultiDn = map[string]float64{"vip": 0.5}
+	go tkr.StatWorker()
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	regular := store.GenerateTestUser()
+	vip := store.GenerateTestUser()
+	vip.Class = "VIP"
+	bonus := store.GenerateTestUser()
+	bonus.Class = "vip"
+	bonus.MultiUp = 2.0
+	bonus.MultiDn = 0.5
+	unset := store.GenerateTestUser()
+	unset.MultiUp, unset.MultiDn = 0, 0
+	require.NoError(t, tkr.users.Add(regular))
+	require.NoError(t, tkr.users.Add(vip))
+	require.NoError(t, tkr.users.Add(bonus))
+	require.NoError(t, tkr.users.Add(unset))
+	for _, u := range []store.User{regular, vip, bonus, unset} {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "1000", Downloaded: "1000", left: "5000", PK: u.Passkey}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+	}
+	time.Sleep(time.Millisecond * 200) // Wait for batch update call (100ms)
+	var usr store.User
+	require.NoError(t, tkr.users.GetByPasskey(&usr, regular.Passkey))
+	require.Equal(t, regular.Uploaded+1000, usr.Uploaded)
+	require.Equal(t, regular.Downloaded+1000, usr.Downloaded)
+	require.NoError(t, tkr.users.GetByPasskey(&usr, vip.Passkey))
+	require.Equal(t, "VIP", usr.Class)
+	require.Equal(t, vip.Uploaded+1500, usr.Uploaded, "Class upload multiplier not applied")
+	require.Equal(t, vip.Downloaded+500, usr.Downloaded, "Class download multiplier not applied")
+	require.NoError(t, tkr.users.GetByPasskey(&usr, bonus.Passkey))
+	require.Equal(t, bonus.Uploaded+3000, usr.Uploaded, "User upload multiplier not applied")
+	require.Equal(t, bonus.Downloaded+250, usr.Downloaded, "User download multiplier not applied")
+	require.NoError(t, tkr.users.GetByPasskey(&usr, unset.Passkey))
+	require.Equal(t, unset.Uploaded+1000, usr.Uploaded, "Unset upload multiplier not treated as 1")
+	require.Equal(t, unset.Downloaded+1000, usr.Downloaded, "Unset download multiplier not treated as 1")
+}
+
+func TestFreeleech(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	go tkr.StatWorker()
+	rh := NewBitTorrentHandler(tkr)
+	freeleech := store.GenerateTestTorrent()
+	freeleech.Freeleech = true
+	freeleech.MultiDn = 2.0
+	halfleech := store.GenerateTestTorrent()
+	halfleech.MultiDn = 0.5
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	for _, tor := range []store.Torrent{freeleech, halfleech} {
+		require.NoError(t, tkr.torrents.Add(tor))
+		req := testReq{Ih: tor.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "1000", Downloaded: "1000", left: "5000", PK: user0.Passkey}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+	}
+	time.Sleep(time.Millisecond * 200) // Wait for batch update call (100ms)
+	var usr store.User
+	require.NoError(t, tkr.users.GetByPasskey(&usr, user0.Passkey))
+	require.Equal(t, user0.Uploaded+2000, usr.Uploaded, "Freeleech changed upload accounting")
+	require.Equal(t, user0.Downloaded+500, usr.Downloaded, "Freeleech download counted")
+	var tor store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor, freeleech.InfoHash, false))
+	require.Equal(t, 2.0, tor.MultiDn, "Freeleech changed the stored multiplier")
+}
+
+func TestBitTorrentHandler_AnnounceMissingPort(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+
+	for i, reject := range []bool{false, true} {
+		tkr.RejectMissingPort = reject
+		peer := store.GenerateTestPeer()
+		req := testReq{Ih: torrent0.InfoHash, PID: peer.PeerID, IP: "12.34.56.78",
+			Port: "0", Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		u := fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode())
+		w := performRequest(rh, "GET", u, nil, nil)
+		var p store.Peer
+		if reject {
+			require.EqualValues(t, msgMissingPort, errCode(w.Code), "Invalid status (%d)", i)
+			require.Error(t, tkr.peers.Get(&p, torrent0.InfoHash, peer.PeerID), "Got peer when we shouldn't (%d)", i)
+		} else {
+			require.EqualValues(t, msgOk, errCode(w.Code), "Invalid status (%d)", i)
+			require.NoError(t, tkr.peers.Get(&p, torrent0.InfoHash, peer.PeerID), "Failed to get peer (%d)", i)
+			require.Equal(t, uint16(0), p.Port)
+		}
+	}
+	swarm, err := tkr.peers.GetN(torrent0.InfoHash, 10)
+	require.NoError(t, err)
+	require.Empty(t, makeCompactPeers(nil, swarm, store.PeerID{}, 0), "Unconnectable peer returned")
+}
+
+func TestBitTorrentHandler_AnnounceDenied(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.AutoRegister = true
+	rh := NewBitTorrentHandler(tkr)
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	ih := store.GenerateTestTorrent().InfoHash
+	api := NewAPIHandler(tkr)
+	w := performRequest(api, "POST", "/denylist/infohash", DenyListEntry{InfoHash: ih.String(), Reason: "dmca"}, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	peer := store.GenerateTestPeer()
+	req := testReq{Ih: ih, PID: peer.PeerID, IP: "12.34.56.78",
+		Port: "4000", Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+	u := fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode())
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgInvalidInfoHash, errCode(w.Code))
+	var tor store.Torrent
+	require.Equal(t, consts.ErrInvalidInfoHash, tkr.torrents.Get(&tor, ih, true), "Denied torrent was registered")
+
+	var dl DenyListPageResponse
+	require.Equal(t, http.StatusOK, performRequest(api, "GET", "/denylist/infohash", nil, &dl).Code)
+	require.Equal(t, []DenyListEntry{{InfoHash: ih.String(), Reason: "dmca"}}, dl.Results)
+
+	// Once removed from the denylist the torrent is auto registered as usual
+	w = performRequest(api, "DELETE", fmt.Sprintf("/denylist/infohash/%s", ih.String()), nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+	require.NoError(t, tkr.torrents.Get(&tor, ih, false))
+}
+
+func TestBitTorrentHandler_AnnounceDeletedAutoRegister(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.AutoRegister = true
+	rh := NewBitTorrentHandler(tkr)
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	torrent0 := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.TorrentDelete(torrent0.InfoHash, false))
+
+	peer := store.GenerateTestPeer()
+	req := testReq{Ih: torrent0.InfoHash, PID: peer.PeerID, IP: "12.34.56.78",
+		Port: "4000", Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+	u := fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode())
+	w := performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgInvalidInfoHash, errCode(w.Code), "Deleted torrent was auto registered")
+	var tor store.Torrent
+	require.Equal(t, consts.ErrInvalidInfoHash, tkr.torrents.Get(&tor, torrent0.InfoHash, false))
+
+	require.NoError(t, tkr.TorrentRestore(torrent0.InfoHash))
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+}
+
+func TestBitTorrentHandler_AnnounceFailureStatusOK(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.FailureStatusOK = true
+	tkr.UnauthorizedReason = "passkey reset required"
+	tkr.ClientReason = "update your client"
+	tkr.DenyListReason = "dmca"
+	tkr.AllowedUsersReason = "staff only"
+	require.NoError(t, tkr.torrents.WhiteListAdd(store.WhiteListClient{
+		ClientPrefix: "-TR2940-", ClientName: "Transmission"}))
+	require.NoError(t, tkr.LoadWhitelist())
+	rh := NewBitTorrentHandler(tkr)
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	denied := store.GenerateTestTorrent()
+	tkr.DenyList[denied.InfoHash] = store.DenyListInfoHash{InfoHash: denied.InfoHash}
+	disabled := store.GenerateTestTorrent()
+	disabled.IsEnabled = false
+	disabled.Reason = "trumped"
+	require.NoError(t, tkr.torrents.Add(disabled))
+	restricted := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(restricted))
+	tkr.setUserAllowed(store.TorrentAllowedUser{InfoHash: restricted.InfoHash, UserID: user0.UserID + 1}, true)
+
+	for _, tc := range []struct {
+		ih     store.InfoHash
+		pk     string
+		peerID string
+		reason string
+	}{
+		{restricted.InfoHash, "invalidinvalidinvalid", "-TR2940-u-rGseINmloG", tkr.UnauthorizedReason},
+		{restricted.InfoHash, user0.Passkey, "-qB4170-u-rGseINmloG", tkr.ClientReason},
+		{denied.InfoHash, user0.Passkey, "-TR2940-u-rGseINmloG", tkr.DenyListReason},
+		{disabled.InfoHash, user0.Passkey, "-TR2940-u-rGseINmloG", disabled.Reason},
+		{restricted.InfoHash, user0.Passkey, "-TR2940-u-rGseINmloG", tkr.AllowedUsersReason},
+	} {
+		req := testReq{Ih: tc.ih, PID: store.PeerIDFromString(tc.peerID), IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: tc.pk}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.Equal(t, http.StatusOK, w.Code, tc.reason)
+		v, err := bencode.NewDecoder(w.Body).Decode()
+		require.NoError(t, err)
+		require.Equal(t, tc.reason, v.(bencode.Dict)["failure reason"], tc.reason)
+	}
+}
+
+func TestBitTorrentHandler_AnnouncePasskeyHeader(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.PasskeyHeader = "X-Passkey"
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	invalidPK := "invalid_passkey_value"
+
+	for i, tc := range []struct {
+		path   string
+		header string
+		exp    errCode
+	}{
+		{path: "", header: user0.Passkey, exp: msgOk},
+		{path: user0.Passkey, header: "", exp: msgOk},
+		{path: user0.Passkey, header: invalidPK, exp: msgOk},
+		{path: invalidPK, header: user0.Passkey, exp: msgInvalidAuth},
+		{path: "", header: "", exp: msgInvalidAuth},
+	} {
+		peer := store.GenerateTestPeer()
+		req := testReq{Ih: torrent0.InfoHash, PID: peer.PeerID, IP: "12.34.56.78",
+			Port: "4000", Uploaded: "0", Downloaded: "0", left: "5000"}
+		u := fmt.Sprintf("/announce?%s", req.ToValues().Encode())
+		if tc.path != "" {
+			u = fmt.Sprintf("/announce/%s?%s", tc.path, req.ToValues().Encode())
+		}
+		r, _ := http.NewRequest("GET", u, nil)
+		r.RemoteAddr = "172.16.1.22:9000"
+		if tc.header != "" {
+			r.Header.Set("X-Passkey", tc.header)
+		}
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, r)
+		require.EqualValues(t, tc.exp, errCode(w.Code), "Invalid status (%d)", i)
+	}
+	// Header auth is ignored unless enabled
+	tkr.PasskeyHeader = ""
+	r, _ := http.NewRequest("GET", "/announce?info_hash=x", nil)
+	r.Header.Set("X-Passkey", user0.Passkey)
+	w := httptest.NewRecorder()
+	rh.ServeHTTP(w, r)
+	require.EqualValues(t, msgInvalidAuth, errCode(w.Code))
+}
+
+func TestBitTorrentHandler_AnnouncePasskeyHTTPS(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.PasskeyHTTPS = passkeyHTTPSEnforce
+	tkr.TrustedProxies, err = parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16", "172.16.0.0/12"})
+	require.NoError(t, err)
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	for i, tc := range []struct {
+		remote string
+		proto  string
+		tls    bool
+		exp    errCode
+	}{
+		{"10.0.0.1:5000", "https", false, msgOk},
+		{"192.168.1.10:5000", "HTTPS", false, msgOk},
+		{"192.168.1.10:5000", "http, https", false, msgOk},
+		// Earlier values may have been sent by the client
+		{"192.168.1.10:5000", "https, http", false, msgHTTPSRequired},
+		{"10.0.0.1:5000", "http", false, msgHTTPSRequired},
+		{"10.0.0.1:5000", "", false, msgHTTPSRequired},
+		// Untrusted clients can't claim to be using https
+		{"12.34.56.78:5000", "https", false, msgHTTPSRequired},
+		{"12.34.56.78:5000", "", true, msgOk},
+	} {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		r, _ := http.NewRequest("GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil)
+		r.RemoteAddr = tc.remote
+		if tc.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		if tc.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, r)
+		require.EqualValues(t, tc.exp, errCode(w.Code), "Test %d failed", i)
+	}
+	tkr.PasskeyHTTPS = passkeyHTTPSWarn
+	req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+		Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+	w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code), "Insecure passkey rejected in warn mode")
+	_, warned := tkr.insecureWarned.Get(user0.Passkey)
+	require.True(t, warned, "Insecure passkey not warned")
+
+	_, err = parseTrustedProxies([]string{"not-an-ip"})
+	require.Error(t, err)
+}
+
+func TestGetIPTrustedProxies(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.AllowClientIP = false
+	tkr.TrustedProxies, err = parseTrustedProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	require.NoError(t, err)
+	for i, tc := range []struct {
+		remote  string
+		headers map[string]string
+		exp     string
+	}{
+		{"12.34.56.78:5000", nil, "12.34.56.78"},
+		{"[2001:db8::1]:5000", nil, "2001:db8::1"},
+		{"10.0.0.1:5000", map[string]string{"X-Real-IP": "23.45.67.89"}, "23.45.67.89"},
+		{"10.0.0.1:5000", map[string]string{"X-Forwarded-For": "23.45.67.89"}, "23.45.67.89"},
+		{"10.0.0.1:5000", map[string]string{"X-Forwarded-For": "2001:db8::2"}, "2001:db8::2"},
+		// The client can prepend anything, only the hops added by trusted proxies are skipped
+		{"10.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.1.1.1, 23.45.67.89, 192.168.1.5"}, "23.45.67.89"},
+		{"10.0.0.1:5000", map[string]string{"X-Real-IP": "23.45.67.89", "X-Forwarded-For": "1.1.1.1"}, "23.45.67.89"},
+		{"10.0.0.1:5000", map[string]string{"X-Forwarded-For": "garbage"}, "10.0.0.1"},
+		// Headers from untrusted addresses are spoofable and ignored
+		{"12.34.56.78:5000", map[string]string{"X-Real-IP": "23.45.67.89"}, "12.34.56.78"},
+		{"12.34.56.78:5000", map[string]string{"X-Forwarded-For": "23.45.67.89"}, "12.34.56.78"},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/announce", nil)
+		c.Request.RemoteAddr = tc.remote
+		for k, v := range tc.headers {
+			c.Request.Header.Set(k, v)
+		}
+		ip, ipv6, err := tkr.getIP(&query{Params: map[announceParam]string{}}, c)
+		require.NoError(t, err, "Test %d failed", i)
+		require.Equal(t, tc.exp, ip.String(), "Test %d failed", i)
+		require.Equal(t, ip.To4() == nil, ipv6, "Test %d failed", i)
+		// Audit records use the same address
+		require.Equal(t, tc.exp, tkr.clientIP(c), "Test %d failed", i)
+	}
+}
+
+func TestGetIPClientParam(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.TrustedProxies, err = parseTrustedProxies([]string{"10.0.0.1"})
+	require.NoError(t, err)
+	for i, tc := range []struct {
+		remote string
+		param  announceParam
+		value  string
+		exp    string
+		ipv6   bool
+		err    error
+	}{
+		{"12.34.56.78:5000", paramIP, "12.34.56.78", "12.34.56.78", false, nil},
+		{"[2001:db8::1]:5000", paramIP, "2001:db8::1", "2001:db8::1", true, nil},
+		{"[2001:db8::1]:5000", paramIPv6, "2001:db8::1", "2001:db8::1", true, nil},
+		{"12.34.56.78:5000", paramIPv4, "23.45.67.89", "23.45.67.89", false, errIPMismatch},
+		{"12.34.56.78:5000", paramIP, "not-an-ip", "<nil>", false, consts.ErrInvalidClient},
+		// Trusted proxies may announce on behalf of their clients
+		{"10.0.0.1:5000", paramIPv4, "23.45.67.89", "23.45.67.89", false, nil},
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/announce", nil)
+		c.Request.RemoteAddr = tc.remote
+		ip, ipv6, err := tkr.getIP(&query{Params: map[announceParam]string{tc.param: tc.value}}, c)
+		require.Equal(t, tc.err, err, "Test %d failed", i)
+		require.Equal(t, tc.exp, ip.String(), "Test %d failed", i)
+		require.Equal(t, tc.ipv6, ipv6, "Test %d failed", i)
+	}
+
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	for i, tc := range []struct {
+		remote string
+		ip     string
+		exp    errCode
+	}{
+		{"12.34.56.78:5000", "12.34.56.78", msgOk},
+		{"12.34.56.78:5000", "23.45.67.89", msgIPMismatch},
+		// Matching addresses must still be routable
+		{"192.168.1.10:5000", "192.168.1.10", msgMalformedRequest},
+	} {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: tc.ip, Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		r, _ := http.NewRequest("GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil)
+		r.RemoteAddr = tc.remote
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, r)
+		require.EqualValues(t, tc.exp, errCode(w.Code), "Announce %d failed", i)
+	}
+}
+
+func TestRedactPasskey(t *testing.T) {
+	pk := "12345678901234567890"
+	r := gin.New()
+	var redacted string
+	r.GET("/announce/:passkey", func(c *gin.Context) {
+		redacted = redactPasskey(c)
+	})
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/announce/%s?port=1234", pk), nil)
+	req.RequestURI = req.URL.RequestURI()
+	r.ServeHTTP(httptest.NewRecorder(), req)
+	require.NotContains(t, redacted, pk)
+	require.Equal(t, "/announce/[redacted]?port=1234", redacted)
+}
+
+func TestPasskeyNotLogged(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.PasskeyHeader = "X-Passkey"
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+
+	var buf bytes.Buffer
+	origOut, origLevel := log.StandardLogger().Out, log.GetLevel()
+	defer func() {
+		accessLog.SetOutput(os.Stderr)
+		log.SetOutput(origOut)
+		log.SetLevel(origLevel)
+	}()
+	accessLog.SetOutput(&buf)
+	log.SetOutput(&buf)
+	log.SetLevel(log.DebugLevel)
+
+	for i, tc := range []struct {
+		path   string
+		header string
+		ih     store.InfoHash
+	}{
+		{path: "/announce/%s?%s", ih: torrent0.InfoHash},
+		{path: "/announce?%.0s%s", header: user0.Passkey, ih: torrent0.InfoHash},
+		{path: "/scrape/%s?%s", ih: torrent0.InfoHash},
+		{path: "/scrape?%.0s%s", header: user0.Passkey, ih: torrent0.InfoHash},
+		// Failed requests are logged with the request uri as well
+		{path: "/announce/%s?%s", ih: store.GenerateTestTorrent().InfoHash},
+		{path: "/announce?%.0s%s", header: user0.Passkey, ih: store.GenerateTestTorrent().InfoHash},
+	} {
+		buf.Reset()
+		req := testReq{Ih: tc.ih, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78",
+			Port: "4000", Uploaded: "0", Downloaded: "0", left: "5000"}
+		r, _ := http.NewRequest("GET", fmt.Sprintf(tc.path, user0.Passkey, req.ToValues().Encode()), nil)
+		r.RemoteAddr = "172.16.1.22:9000"
+		if tc.header != "" {
+			r.Header.Set("X-Passkey", tc.header)
+		}
+		rh.ServeHTTP(httptest.NewRecorder(), r)
+		require.NotEmpty(t, buf.String(), "Request not logged (%d)", i)
+		require.NotContains(t, buf.String(), user0.Passkey, "Passkey logged (%d)", i)
+	}
+}
+
+func TestWhitelistEntry(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.setWhitelist(newWhitelist([]store.WhiteListClient{
+		{ClientPrefix: "-qB", ClientName: "qBittorrent"},
+		{ClientPrefix: "-qB4170-", ClientName: "qBittorrent 4.1.7"},
+		{ClientPrefix: "-qB42*", ClientName: "qBittorrent 4.2", MatchType: store.MatchGlob},
+		{ClientPrefix: "-TR", ClientName: "Transmission", MinVersion: "x"},
+	}))
+	require.Len(t, tkr.Whitelist, 3, "Invalid min_version not skipped")
+	require.Len(t, tkr.whitelistPatterns, 1)
+	require.Equal(t, "qBittorrent 4.1.7", tkr.ClientName(store.PeerIDFromString("-qB4170-u-rGseINmloG")))
+	require.Equal(t, "qBittorrent 4.2", tkr.ClientName(store.PeerIDFromString("-qB4250-u-rGseINmloG")))
+	require.Equal(t, "qBittorrent", tkr.ClientName(store.PeerIDFromString("-qB3250-u-rGseINmloG")))
+	require.False(t, tkr.ClientWhitelisted(store.PeerIDFromString("-TR2940-u-rGseINmloG")))
+}
+
+func TestTorrentGetMany(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.TorrentsCache = store.NewTorrentCache()
+	cached := store.GenerateTestTorrent()
+	tkr.TorrentsCache.Set(cached)
+	stored := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(stored))
+	deleted := store.GenerateTestTorrent()
+	deleted.IsDeleted = true
+	require.NoError(t, tkr.torrents.Add(deleted))
+
+	hashes := []store.InfoHash{cached.InfoHash, stored.InfoHash, deleted.InfoHash}
+	torrents, err := tkr.TorrentGetMany(hashes, false)
+	require.NoError(t, err)
+	require.Len(t, torrents, 2)
+	require.Equal(t, cached.ReleaseName, torrents[cached.InfoHash].ReleaseName)
+	require.Equal(t, stored.ReleaseName, torrents[stored.InfoHash].ReleaseName)
+	var fetched store.Torrent
+	require.True(t, tkr.TorrentsCache.Get(&fetched, stored.InfoHash), "Fetched torrent not cached")
+
+	torrents, err = tkr.TorrentGetMany(hashes, true)
+	require.NoError(t, err)
+	require.Len(t, torrents, 3)
+}
+
+func TestClientWhitelistedEmpty(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	pid := store.PeerIDFromString("-qB4170-u-rGseINmloG")
+	require.True(t, tkr.ClientWhitelisted(pid))
+	tkr.AllowEmptyWhitelist = false
+	require.False(t, tkr.ClientWhitelisted(pid), "Empty whitelist allowed client")
+}
+
+func TestRefreshTopTorrents(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	defer metrics.SetTopTorrents(nil)
+	var torrents []store.Torrent
+	for size := 1; size <= 3; size++ {
+		tor := store.GenerateTestTorrent()
+		// The swarms have a leecher and the rest are seeders
+		tor.Seeders, tor.Leechers = size-1, 1
+		require.NoError(t, tkr.torrents.Add(tor))
+		torrents = append(torrents, tor)
+	}
+	tkr.refreshTopTorrents()
+	require.Empty(t, metrics.Get().TopTorrents, "Top torrents counted while disabled")
+
+	tkr.APIMetricsTopTorrents = 2
+	tkr.StatsEnabled = false
+	tkr.refreshTopTorrents()
+	require.Empty(t, metrics.Get().TopTorrents, "Top torrents counted without stats")
+
+	tkr.StatsEnabled = true
+	tkr.refreshTopTorrents()
+	require.Equal(t, []metrics.TorrentSwarm{
+		{InfoHash: torrents[2].InfoHash.String(), Seeders: 2, Leechers: 1},
+		{InfoHash: torrents[1].InfoHash.String(), Seeders: 1, Leechers: 1},
+	}, metrics.Get().TopTorrents)
+}
+
+func TestPeerReaperDryRun(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	torrent0 := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	stale := store.GenerateTestPeer()
+	stale.AnnounceLast = time.Now().Add(-time.Hour)
+	active := store.GenerateTestPeer()
+	active.AnnounceLast = time.Now()
+	require.NoError(t, tkr.peers.Add(torrent0.InfoHash, stale))
+	require.NoError(t, tkr.peers.Add(torrent0.InfoHash, active))
+
+	tkr.ReaperDryRun = true
+	before := atomic.LoadInt64(&metrics.ReaperDryRunPeers)
+	expired := tkr.reapPeers()
+	require.Equal(t, []store.PeerHash{store.NewPeerHash(torrent0.InfoHash, stale.PeerID)}, expired)
+	require.Equal(t, before+1, atomic.LoadInt64(&metrics.ReaperDryRunPeers))
+	var p store.Peer
+	require.NoError(t, tkr.peers.Get(&p, torrent0.InfoHash, stale.PeerID), "Peer removed in dry-run")
+
+	tkr.ReaperDryRun = false
+	require.Equal(t, 1, len(tkr.reapPeers()))
+	require.Error(t, tkr.peers.Get(&p, torrent0.InfoHash, stale.PeerID), "Peer not removed")
+	require.NoError(t, tkr.peers.Get(&p, torrent0.InfoHash, active.PeerID))
+	require.Equal(t, before+1, atomic.LoadInt64(&metrics.ReaperDryRunPeers))
+}
+
+func TestPeerReaperCounts(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	torrent0 := store.GenerateTestTorrent()
+	torrent0.Seeders, torrent0.Leechers = 5, 5
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	seeder := store.GenerateTestPeer()
+	seeder.Left = 0
+	leecher := store.GenerateTestPeer()
+	leecher.Left = 1000
+	active := store.GenerateTestPeer()
+	active.Left = 1000
+	active.AnnounceLast = time.Now()
+	for _, p := range []store.Peer{seeder, leecher} {
+		p.AnnounceLast = time.Now().Add(-time.Hour)
+		require.NoError(t, tkr.peers.Add(torrent0.InfoHash, p))
+	}
+	require.NoError(t, tkr.peers.Add(torrent0.InfoHash, active))
+
+	before := atomic.LoadInt64(&metrics.PeersReaped)
+	require.ElementsMatch(t, []store.PeerHash{
+		store.NewPeerHash(torrent0.InfoHash, seeder.PeerID),
+		store.NewPeerHash(torrent0.InfoHash, leecher.PeerID),
+	}, tkr.reapPeers())
+	require.Equal(t, before+2, atomic.LoadInt64(&metrics.PeersReaped))
+	var tor store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor, torrent0.InfoHash, false))
+	require.Equal(t, 4, tor.Seeders)
+	require.Equal(t, 4, tor.Leechers)
+	require.Empty(t, tkr.reapPeers(), "Peers reaped twice")
+}
+
+func TestPruneMaps(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.insecureWarned = store.NewBoundedMap(0, time.Millisecond)
+	tkr.insecureWarned.Set("expired", time.Now())
+	tkr.knownPeerIDs.Set("active", store.GenerateTestPeer().PeerID)
+	time.Sleep(5 * time.Millisecond)
+
+	tkr.pruneMaps()
+	require.Equal(t, 0, tkr.insecureWarned.Len(), "Expired entry not pruned")
+	entries := metrics.Get().BoundedMapEntries
+	require.Equal(t, int64(0), entries["insecure_warned"])
+	require.Equal(t, int64(1), entries["known_peer_ids"])
+	require.Contains(t, metrics.Get().String(), `t_bounded_map_entries{map="known_peer_ids"} 1`)
+}
+
+func TestPruneTorrents(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.TorrentPruneAge = time.Hour
+	old := time.Now().Add(-2 * time.Hour)
+
+	inactive := store.GenerateTestTorrent()
+	inactive.AutoRegistered = true
+	inactive.AnnouncedOn = old
+	recent := store.GenerateTestTorrent()
+	recent.AutoRegistered = true
+	manual := store.GenerateTestTorrent()
+	manual.AnnouncedOn = old
+	seeded := store.GenerateTestTorrent()
+	seeded.AutoRegistered = true
+	seeded.AnnouncedOn = old
+	denied := store.GenerateTestTorrent()
+	denied.AutoRegistered = true
+	denied.AnnouncedOn = old
+	for _, tor := range []store.Torrent{inactive, recent, manual, seeded, denied} {
+		require.NoError(t, tkr.torrents.Add(tor))
+	}
+	// Activity comes from the swarm as the stat counters aren't updated with stats disabled
+	require.NoError(t, tkr.peers.Add(seeded.InfoHash, store.GenerateTestPeer()))
+	stale := store.GenerateTestPeer()
+	stale.AnnounceLast = old
+	require.NoError(t, tkr.peers.Add(inactive.InfoHash, stale))
+	tkr.DenyList[denied.InfoHash] = store.DenyListInfoHash{InfoHash: denied.InfoHash}
+
+	tkr.TorrentPruneDryRun = true
+	before := atomic.LoadInt64(&metrics.PrunerDryRunTorrents)
+	require.Equal(t, []store.InfoHash{inactive.InfoHash}, tkr.pruneTorrents())
+	require.Equal(t, before+1, atomic.LoadInt64(&metrics.PrunerDryRunTorrents))
+	var tor store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor, inactive.InfoHash, false), "Torrent pruned in dry-run")
+
+	tkr.TorrentPruneDryRun = false
+	require.Equal(t, []store.InfoHash{inactive.InfoHash}, tkr.pruneTorrents())
+	require.Error(t, tkr.torrents.Get(&tor, inactive.InfoHash, true), "Torrent not pruned")
+	var peer store.Peer
+	require.Error(t, tkr.peers.Get(&peer, inactive.InfoHash, stale.PeerID), "Peer of pruned torrent not deleted")
+	for _, ih := range []store.InfoHash{recent.InfoHash, manual.InfoHash, seeded.InfoHash, denied.InfoHash} {
+		require.NoError(t, tkr.torrents.Get(&tor, ih, false), "Active or flagged torrent pruned")
+	}
+}
+
+// unavailableTorrentStore simulates a backing store which is temporarily unreachable
+type unavailableTorrentStore struct {
+	store.TorrentStore
+}
+
+func (s unavailableTorrentStore) Get(_ *store.Torrent, _ store.InfoHash, _ bool) error {
+	return errors.New("dial tcp: connection refused")
+}
+
+func (s unavailableTorrentStore) Ping() error {
+	return errors.New("dial tcp: connection refused")
+}
+
+func TestBitTorrentHandler_AnnounceDegraded(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	tkr.torrents = unavailableTorrentStore{tkr.torrents}
+	tkr.DegradedInterval = time.Minute * 15
+	tkr.TorrentsCache = store.NewTorrentCache()
+
+	peer := store.GenerateTestPeer()
+	req := testReq{Ih: torrent0.InfoHash, PID: peer.PeerID, IP: "12.34.56.78",
+		Port: "4000", Uploaded: "1000", Downloaded: "0", left: "5000", PK: user0.Passkey}
+	u := fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode())
+
+	// Strict mode fails the request
+	tkr.StoreDegradedMode = false
+	w := performRequest(rh, "GET", u, nil, nil)
+	require.NotEqual(t, int(msgOk), w.Code)
+	require.Equal(t, 0, len(tkr.StateUpdateChan))
+
+	tkr.StoreDegradedMode = true
+	// Torrents missing from the cache can't be validated
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgStoreUnavailable, errCode(w.Code))
+	require.Equal(t, 0, len(tkr.StateUpdateChan))
+	// Cached torrents are read without calling the store, so the breaker is opened to
+	// keep the announces degraded
+	tkr.TorrentsCache.Set(torrent0)
+	tkr.storeBreaker = newStoreBreaker(1, time.Hour)
+	tkr.storeBreaker.failure()
+	tkr.UsersCache = store.NewUserCache()
+	tkr.UsersCache.Set(user0)
+
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+	v, err := bencode.NewDecoder(w.Body).Decode()
+	require.NoError(t, err, "Invalid degraded response")
+	d := v.(bencode.Dict)
+	require.Equal(t, int64(tkr.DegradedInterval.Seconds()), d["interval"].(int64))
+	require.Equal(t, "", d["peers"].(string))
+	select {
+	case update := <-tkr.StateUpdateChan:
+		require.Equal(t, torrent0.InfoHash, update.InfoHash)
+		require.Equal(t, uint64(1000), update.Uploaded)
+	default:
+		t.Fatalf("Stats were not queued in degraded mode")
+	}
+
+	// Disabled and deleted torrents are still rejected from the cache
+	disabled := torrent0
+	disabled.IsEnabled = false
+	disabled.Reason = "Trumped"
+	tkr.TorrentsCache.Set(disabled)
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgInvalidInfoHash, errCode(w.Code))
+	deleted := torrent0
+	deleted.IsDeleted = true
+	tkr.TorrentsCache.Set(deleted)
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgInvalidInfoHash, errCode(w.Code))
+	require.Equal(t, 0, len(tkr.StateUpdateChan))
+	tkr.TorrentsCache.Set(torrent0)
+
+	// Restricted torrents are still enforced without the store
+	tkr.setUserAllowed(store.TorrentAllowedUser{InfoHash: torrent0.InfoHash, UserID: user0.UserID + 1}, true)
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgAnnounceDenied, errCode(w.Code))
+}
+
+func TestBitTorrentHandler_AnnounceDegradedPrevState(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	tkr.torrents = unavailableTorrentStore{tkr.torrents}
+	tkr.StoreDegradedMode = true
+	tkr.TorrentsCache = store.NewTorrentCache()
+	tkr.TorrentsCache.Set(torrent0)
+	tkr.storeBreaker = newStoreBreaker(1, time.Hour)
+	tkr.storeBreaker.failure()
+	tkr.UsersCache = store.NewUserCache()
+	tkr.UsersCache.Set(user0)
+	tkr.PeerCache = store.NewPeerCache()
+	cached := store.GenerateTestPeer()
+	cached.UserID = user0.UserID
+	cached.Left = 5000
+	cached.Paused = true
+	tkr.PeerCache.Set(torrent0.InfoHash, cached)
+
+	for i, tc := range []struct {
+		peerID      store.PeerID
+		wasPaused   bool
+		prevLeft    uint64
+		noPrevState bool
+	}{
+		{peerID: cached.PeerID, wasPaused: true, prevLeft: 5000},
+		{peerID: store.GenerateTestPeer().PeerID, noPrevState: true},
+	} {
+		req := testReq{Ih: torrent0.InfoHash, PID: tc.peerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "0", PK: user0.Passkey, event: string(consts.COMPLETED)}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code), "Invalid status (%d)", i)
+		update := <-tkr.StateUpdateChan
+		require.Equal(t, tc.wasPaused, update.WasPaused, "Invalid paused state (%d)", i)
+		require.Equal(t, tc.prevLeft, update.PrevLeft, "Invalid left (%d)", i)
+		require.False(t, update.Joined, "Invalid joined state (%d)", i)
+		require.Equal(t, tc.noPrevState, update.NoPrevState, "Invalid state (%d)", i)
+	}
+}
+
+func TestStatWorkerNoPrevState(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	go tkr.StatWorker()
+	torrent0 := store.GenerateTestTorrent()
+	torrent0.Seeders = 0
+	torrent0.Leechers = 3
+	torrent0.Snatches = 0
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	user0 := store.GenerateTestUser()
+	update := func(event consts.AnnounceType, noPrevState bool) store.UpdateState {
+		peer := store.GenerateTestPeer()
+		require.NoError(t, tkr.peers.Add(torrent0.InfoHash, peer))
+		return store.UpdateState{
+			InfoHash:    torrent0.InfoHash,
+			PeerID:      peer.PeerID,
+			Passkey:     user0.Passkey,
+			Event:       event,
+			PrevLeft:    5000,
+			Timestamp:   time.Now(),
+			NoPrevState: noPrevState,
+		}
+	}
+	// A leecher with a known state completing becomes a seeder
+	tkr.StateUpdateChan <- update(consts.COMPLETED, false)
+	// Without the prior state the snatch is counted, the swarm counts are not changed
+	tkr.StateUpdateChan <- update(consts.COMPLETED, true)
+	tkr.StateUpdateChan <- update(consts.PAUSED, true)
+	tkr.StateUpdateChan <- update(consts.STOPPED, true)
+	time.Sleep(time.Millisecond * 300) // Wait for batch update call (100ms)
+	var tor store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor, torrent0.InfoHash, false))
+	require.Equal(t, uint16(2), tor.Snatches)
+	require.Equal(t, 1, tor.Seeders)
+	require.Equal(t, 2, tor.Leechers)
+}
+
+func TestBitTorrentHandler_AnnounceRepeatedStarted(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	go tkr.StatWorker()
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	torrent0.MultiUp = 1.0
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	repeated := atomic.LoadInt64(&metrics.AnnounceRepeatedStarted)
+
+	peer := store.GenerateTestPeer()
+	for _, uploaded := range []string{"1000", "2000", "3000"} {
+		req := testReq{Ih: torrent0.InfoHash, PID: peer.PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: uploaded, Downloaded: "0", left: "5000", PK: user0.Passkey, event: string(consts.STARTED)}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+	}
+	time.Sleep(time.Millisecond * 300) // Wait for batch update call (100ms)
+	require.Equal(t, repeated+2, atomic.LoadInt64(&metrics.AnnounceRepeatedStarted))
+	var usr store.User
+	require.NoError(t, tkr.users.GetByPasskey(&usr, user0.Passkey))
+	require.Equal(t, user0.Uploaded+6000, usr.Uploaded, "Traffic not credited")
+	var tor store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor, torrent0.InfoHash, false))
+	require.Equal(t, 1, tor.Leechers, "Peer counted more than once")
+}
+
+func TestBitTorrentHandler_AnnounceNormalized(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.NormalizeResponses = true
+	tkr.ResponsePadSize = 256
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+
+	var keys []string
+	for i, ip := range []string{"12.34.56.78", "12.34.56.79", "12.34.56.80"} {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: ip,
+			Port: "4000", Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		body := w.Body.Bytes()
+		require.Equal(t, 0, len(body)%tkr.ResponsePadSize, "Response not padded (%d)", i)
+		v, err := bencode.NewDecoder(bytes.NewReader(body)).Decode()
+		require.NoError(t, err, "Invalid normalized response (%d)", i)
+		d := v.(bencode.Dict)
+		require.Len(t, d["peers"].(string), i*6)
+		require.Equal(t, "", d["peers6"].(string))
+		var respKeys []string
+		for k := range d {
+			respKeys = append(respKeys, k)
+		}
+		sort.Strings(respKeys)
+		if keys == nil {
+			keys = respKeys
+		}
+		require.Equal(t, keys, respKeys, "Inconsistent keys (%d)", i)
+		// Re-encoding with sorted keys must produce the exact same bytes
+		canonical, err := appendSortedDict(nil, d)
+		require.NoError(t, err)
+		require.Equal(t, body, canonical, "Keys not sorted (%d)", i)
+	}
+	require.Equal(t, []string{"complete", "incomplete", "interval", "min interval", "padding", "peers", "peers6"}, keys)
+}
+
+func TestPadLength(t *testing.T) {
+	for _, blockSize := range []int{1, 7, 64, 256, 1000} {
+		for size := 0; size < 2500; size++ {
+			padding := padLength(size, blockSize)
+			total := size + len("7:padding") + len(strconv.Itoa(padding)) + 1 + padding
+			require.Equal(t, 0, total%blockSize, "size %d block %d", size, blockSize)
+			require.True(t, padding < blockSize*2, "size %d block %d", size, blockSize)
+		}
+	}
+}
+
+func TestBitTorrentHandler_AnnounceURLTooLong(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+
+	// A dual-stack announce fits comfortably within the default
+	peer := store.GenerateTestPeer()
+	v := testReq{Ih: torrent0.InfoHash, PID: peer.PeerID, IP: "12.34.56.78",
+		Port: "4000", Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}.ToValues()
+	v.Set("ipv4", "12.34.56.78")
+	v.Set("ipv6", "2600:3c00::f03c:91ff:fe93:dcd4")
+	v.Set("key", "ABCDEF0123456789")
+	w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", user0.Passkey, v.Encode()), nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+
+	longPeer := store.GenerateTestPeer()
+	v = testReq{Ih: torrent0.InfoHash, PID: longPeer.PeerID, IP: "12.34.56.79",
+		Port: "4000", Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}.ToValues()
+	v.Set("junk", strings.Repeat("x", tkr.MaxURLLength))
+	u := fmt.Sprintf("/announce/%s?%s", user0.Passkey, v.Encode())
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.Equal(t, http.StatusRequestURITooLong, w.Code)
+	var p store.Peer
+	require.Error(t, tkr.peers.Get(&p, torrent0.InfoHash, longPeer.PeerID), "Over-length announce was processed")
+	// Failures sent with a 200 status don't apply to over-length requests
+	tkr.FailureStatusOK = true
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.Equal(t, http.StatusRequestURITooLong, w.Code)
+	require.Equal(t, string(responseError(Err(msgRequestURITooLong).Error())), w.Body.String())
+	tkr.FailureStatusOK = false
+
+	tkr.MaxURLLength = 0
+	w = performRequest(rh, "GET", u, nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+}
+
+func TestBitTorrentHandler_AnnounceTorrentMaxPeers(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.MaxPeers = 5
+	rh := NewBitTorrentHandler(tkr)
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	limited := store.GenerateTestTorrent()
+	limited.MaxPeers = 2
+	global := store.GenerateTestTorrent()
+	for _, torrent := range []store.Torrent{limited, global} {
+		require.NoError(t, tkr.torrents.Add(torrent))
+		for i := 0; i < 8; i++ {
+			require.NoError(t, tkr.PeerAdd(torrent.InfoHash, store.GenerateTestPeer()))
+		}
+	}
+	announcePeers := func(ih store.InfoHash) int {
+		req := testReq{Ih: ih, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		return len(v.(bencode.Dict)["peers"].(string)) / 6
+	}
+	// The announcing peer is excluded from the response so it may contain one less than the limit
+	require.Equal(t, limited.MaxPeers, tkr.maxPeers(limited))
+	n := announcePeers(limited.InfoHash)
+	require.True(t, n >= limited.MaxPeers-1 && n <= limited.MaxPeers, "Torrent limit not respected: %d", n)
+
+	require.Equal(t, tkr.MaxPeers, tkr.maxPeers(global))
+	n = announcePeers(global.InfoHash)
+	require.True(t, n >= tkr.MaxPeers-1 && n <= tkr.MaxPeers, "Global limit not used: %d", n)
+}
+
+type denyUsersHook struct {
+	denied map[uint32]bool
+}
+
+func (h denyUsersHook) BeforeAnnounce(_ AnnounceRequest, user store.User, _ store.Torrent) (bool, string, error) {
+	if h.denied[user.UserID] {
+		return false, "Ratio too low", nil
+	}
+	return true, "", nil
+}
+
+func TestBitTorrentHandler_AnnounceHook(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	allowed := store.GenerateTestUser()
+	denied := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(allowed))
+	require.NoError(t, tkr.users.Add(denied))
+	tkr.AddAnnounceHook(NopAnnounceHook{})
+	tkr.AddAnnounceHook(denyUsersHook{denied: map[uint32]bool{denied.UserID: true}})
+
+	announce := func(user store.User) *httptest.ResponseRecorder {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78",
+			Port: "4000", Uploaded: "0", Downloaded: "0", left: "5000", PK: user.Passkey}
+		return performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	}
+	w := announce(denied)
+	require.EqualValues(t, msgAnnounceDenied, errCode(w.Code))
+	v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+	require.NoError(t, err)
+	require.Equal(t, "Ratio too low", v.(bencode.Dict)["failure reason"])
+	swarm, err := tkr.PeerGetN(torrent0.InfoHash, 10)
+	require.True(t, err != nil || len(swarm.Peers) == 0, "Denied peer added to swarm")
+
+	require.EqualValues(t, msgOk, errCode(announce(allowed).Code))
+}
+
+func TestBitTorrentHandler_AnnounceLeftClamped(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	sized := store.GenerateTestTorrent()
+	sized.Size = 5000
+	unknown := store.GenerateTestTorrent()
+	// Sizes, left and uploaded amounts above 4GB don't fit in 32 bits
+	large := store.GenerateTestTorrent()
+	large.Size = 10 << 30
+	for _, torrent := range []store.Torrent{sized, unknown, large} {
+		require.NoError(t, tkr.torrents.Add(torrent))
+	}
+	for i, tc := range []struct {
+		torrent store.Torrent
+		sent    uint64
+		left    uint64
+	}{
+		{sized, 9000, 5000},
+		// Torrents of unknown size are never clamped
+		{unknown, 9000, 9000},
+		{large, 12 << 30, 10 << 30},
+		{large, 6 << 30, 6 << 30},
+	} {
+		pid := store.GenerateTestPeer().PeerID
+		req := testReq{Ih: tc.torrent.InfoHash, PID: pid, IP: "12.34.56.78", Port: "4000",
+			Uploaded: strconv.FormatUint(5<<30, 10), Downloaded: "0", left: strconv.FormatUint(tc.sent, 10),
+			PK: user0.Passkey}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		var peer store.Peer
+		require.NoError(t, tkr.PeerGet(&peer, tc.torrent.InfoHash, pid))
+		require.Equal(t, tc.left, peer.Left, "Invalid peer left (%d)", i)
+		update := <-tkr.StateUpdateChan
+		require.Equal(t, tc.left, update.Left, "Invalid queued left (%d)", i)
+		require.Equal(t, uint64(5<<30), update.Uploaded, "Invalid queued uploaded (%d)", i)
+	}
+}
+
+func TestBitTorrentHandler_AnnounceIPv6Only(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.IPv6Only = true
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	announce := func(ip string) *httptest.ResponseRecorder {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: ip, Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		return performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	}
+
+	w := announce("12.34.56.78")
+	require.EqualValues(t, msgIPv6Only, errCode(w.Code))
+	v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+	require.NoError(t, err)
+	require.Equal(t, Err(msgIPv6Only).Error(), v.(bencode.Dict)["failure reason"])
+
+	for i, ip := range []string{"2001:db8:1::1", "2001:db8:1::2", "2001:db8:1::3"} {
+		w := announce(ip)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		d := v.(bencode.Dict)
+		_, hasPeers := d["peers"]
+		require.False(t, hasPeers, "IPv4 peers returned in ipv6 only mode")
+		require.Len(t, d["peers6"].(string), i*18)
+	}
+}
+
+func TestMakeCompactPeers6(t *testing.T) {
+	swarm := store.NewSwarm()
+	for i, addr := range []struct {
+		ip   string
+		ipv6 bool
+	}{
+		{"12.34.56.78", false},
+		{"2001:db8::1", true},
+		// The family comes from the address rather than the flag
+		{"2001:db8::2", false},
+		{"::ffff:12.34.56.79", true},
+	} {
+		p := store.GenerateTestPeer()
+		p.IP = net.ParseIP(addr.ip)
+		p.IPv6 = addr.ipv6
+		p.Port = uint16(5000 + i)
+		swarm.Peers[p.PeerID] = p
+	}
+	require.Len(t, makeCompactPeers(nil, swarm, store.PeerID{}, 0), 2*6)
+	peers6 := makeCompactPeers6(nil, swarm, store.PeerID{}, 0)
+	require.Len(t, peers6, 2*18)
+	for i := 0; i < len(peers6); i += 18 {
+		ip := net.IP(peers6[i : i+16])
+		require.Nil(t, ip.To4(), "IPv4 peer sent in peers6")
+		require.True(t, strings.HasPrefix(ip.String(), "2001:db8::"))
+	}
+}
+
+func TestBitTorrentHandler_AnnounceDictPeers(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	announce := func(ip string, compact string) bencode.Dict {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: ip, Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		values := req.ToValues()
+		if compact != "" {
+			values.Set("compact", compact)
+		}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, values.Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		return v.(bencode.Dict)
+	}
+	announce("12.34.56.78", "")
+	announce("2001:db8:1::1", "")
+
+	d := announce("12.34.56.79", "1")
+	require.Len(t, d["peers"].(string), 6, "Compact peers not sent")
+
+	d = announce("12.34.56.80", "0")
+	peers := d["peers"].(bencode.List)
+	require.Len(t, peers, 2, "IPv6 peer sent to ipv4 client")
+	var ips []string
+	for _, p := range peers {
+		peer := p.(bencode.Dict)
+		require.Len(t, peer["peer id"].(string), 20)
+		require.EqualValues(t, 4000, peer["port"])
+		ips = append(ips, peer["ip"].(string))
+	}
+	require.ElementsMatch(t, []string{"12.34.56.78", "12.34.56.79"}, ips)
+	_, hasPeers6 := d["peers6"]
+	require.False(t, hasPeers6, "peers6 sent in dictionary mode")
+
+	d = announce("2001:db8:1::2", "0")
+	require.Len(t, d["peers"].(bencode.List), 4, "Dual stack client not sent both families")
+}
+
+func TestBitTorrentHandler_AnnounceIPv6Disabled(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.IPv6 = false
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "2001:db8:1::1", Port: "4000",
+		Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+	w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+	v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+	require.NoError(t, err)
+	_, hasPeers6 := v.(bencode.Dict)["peers6"]
+	require.False(t, hasPeers6, "peers6 sent with ipv6 disabled")
+}
+
+func TestBitTorrentHandler_AnnouncePaused(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	go tkr.StatWorker()
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	leecher := store.GenerateTestPeer()
+	partial := store.GenerateTestPeer()
+
+	announce := func(pid store.PeerID, port string, event consts.AnnounceType) int {
+		req := testReq{Ih: torrent0.InfoHash, PID: pid, IP: "12.34.56.78", Port: port,
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey, event: string(event)}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		return len(v.(bencode.Dict)["peers"].(string)) / 6
+	}
+	counts := func() (int, int) {
+		time.Sleep(time.Millisecond * 300) // Wait for batch update call (100ms)
+		var tor store.Torrent
+		require.NoError(t, tkr.torrents.Get(&tor, torrent0.InfoHash, false))
+		return tor.Seeders, tor.Leechers
+	}
+	announce(leecher.PeerID, "4000", consts.STARTED)
+	announce(partial.PeerID, "4001", consts.STARTED)
+	seeders, leechers := counts()
+	require.Equal(t, 0, seeders)
+	require.Equal(t, 2, leechers)
+
+	// Partial seeds get no peers but are still given to leechers
+	require.Equal(t, 0, announce(partial.PeerID, "4001", consts.PAUSED), "Peers sent to partial seed")
+	require.Equal(t, 1, announce(leecher.PeerID, "4000", consts.ANNOUNCE), "Partial seed not sent to leecher")
+	seeders, leechers = counts()
+	require.Equal(t, 1, seeders, "Partial seed not counted as seeder")
+	require.Equal(t, 1, leechers)
+
+	// Resuming the download makes it a leecher again
+	require.Equal(t, 1, announce(partial.PeerID, "4001", consts.ANNOUNCE))
+	seeders, leechers = counts()
+	require.Equal(t, 0, seeders)
+	require.Equal(t, 2, leechers)
+}
+
+func TestBitTorrentHandler_AnnounceEvents(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	go tkr.StatWorker()
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	peer := store.GenerateTestPeer()
+	announce := func(left string, event consts.AnnounceType) {
+		req := testReq{Ih: torrent0.InfoHash, PID: peer.PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: left, PK: user0.Passkey, event: string(event)}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+	}
+	current := func() store.Torrent {
+		time.Sleep(time.Millisecond * 300) // Wait for batch update call (100ms)
+		var tor store.Torrent
+		require.NoError(t, tkr.torrents.Get(&tor, torrent0.InfoHash, false))
+		return tor
+	}
+	announce("5000", consts.STARTED)
+	tor := current()
+	require.Equal(t, 1, tor.Leechers)
+	require.Equal(t, torrent0.Snatches, tor.Snatches)
+
+	announce("0", consts.COMPLETED)
+	tor = current()
+	require.Equal(t, 1, tor.Seeders)
+	require.Equal(t, 0, tor.Leechers)
+	require.Equal(t, torrent0.Snatches+1, tor.Snatches)
+
+	repeated := atomic.LoadInt64(&metrics.AnnounceRepeatedCompleted)
+	announce("0", consts.COMPLETED)
+	tor = current()
+	require.Equal(t, 1, tor.Seeders)
+	require.Equal(t, 0, tor.Leechers)
+	require.Equal(t, torrent0.Snatches+1, tor.Snatches, "Repeated completed counted twice")
+	require.Equal(t, repeated+1, atomic.LoadInt64(&metrics.AnnounceRepeatedCompleted))
+
+	announce("0", consts.STOPPED)
+	tor = current()
+	require.Equal(t, 0, tor.Seeders)
+	var p store.Peer
+	require.Error(t, tkr.peers.Get(&p, torrent0.InfoHash, peer.PeerID), "Stopped peer not removed")
+}
+
+func TestBitTorrentHandler_AnnounceSeedersGetLeechersOnly(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user0))
+	// newSwarm creates a torrent with 3 peers which all have the same amount left
+	newSwarm := func(left uint64) store.InfoHash {
+		torrent := store.GenerateTestTorrent()
+		require.NoError(t, tkr.torrents.Add(torrent))
+		for i := 0; i < 3; i++ {
+			p := store.GenerateTestPeer()
+			p.Port = uint16(5000 + i)
+			p.Left = left
+			require.NoError(t, tkr.PeerAdd(torrent.InfoHash, p))
+		}
+		return torrent.InfoHash
+	}
+	announcePeers := func(ih store.InfoHash, left string) int {
+		req := testReq{Ih: ih, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: left, PK: user0.Passkey, event: string(consts.STARTED)}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		return len(v.(bencode.Dict)["peers"].(string)) / 6
+	}
+	for _, enabled := range []bool{false, true} {
+		tkr.SeedersGetLeechersOnly = enabled
+		// Leechers are always sent every peer, regardless of the swarm make up
+		require.Equal(t, 3, announcePeers(newSwarm(0), "5000"), "Seeders not sent to leecher (%v)", enabled)
+		require.Equal(t, 3, announcePeers(newSwarm(5000), "5000"), "Leechers not sent to leecher (%v)", enabled)
+		require.Equal(t, 3, announcePeers(newSwarm(5000), "0"), "Leechers not sent to seeder (%v)", enabled)
+	}
+	tkr.SeedersGetLeechersOnly = false
+	require.Equal(t, 3, announcePeers(newSwarm(0), "0"))
+	tkr.SeedersGetLeechersOnly = true
+	require.Equal(t, 0, announcePeers(newSwarm(0), "0"), "Seeders sent to seeder")
+
+	// A leecher in a mostly seeded swarm is still found when fewer peers are wanted
+	mostlySeeded := newSwarm(0)
+	leecher := store.GenerateTestPeer()
+	leecher.Left = 5000
+	require.NoError(t, tkr.PeerAdd(mostlySeeded, leecher))
+	for i := 0; i < 10; i++ {
+		req := testReq{Ih: mostlySeeded, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "0", PK: user0.Passkey}
+		q := req.ToValues()
+		q.Set("numwant", "1")
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, q.Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		require.Equal(t, 6, len(v.(bencode.Dict)["peers"].(string)), "Leecher not sent to seeder")
+	}
+}
+
+func TestBitTorrentHandler_AnnounceStoppedNumWant(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	go tkr.StatWorker()
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, tkr.PeerAdd(torrent0.InfoHash, store.GenerateTestPeer()))
+	}
+	peer := store.GenerateTestPeer()
+	announcePeers := func(event consts.AnnounceType) int {
+		req := testReq{Ih: torrent0.InfoHash, PID: peer.PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey, event: string(event)}
+		v := req.ToValues()
+		v.Set("numwant", "50")
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, v.Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		d, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		return len(d.(bencode.Dict)["peers"].(string)) / 6
+	}
+	require.Equal(t, 3, announcePeers(consts.STARTED))
+	time.Sleep(time.Millisecond * 300) // Wait for batch update call (100ms)
+	require.Equal(t, 0, announcePeers(consts.STOPPED), "Peers sent to stopping peer")
+	time.Sleep(time.Millisecond * 300)
+	var p store.Peer
+	require.Equal(t, consts.ErrInvalidPeerID, tkr.PeerGet(&p, torrent0.InfoHash, peer.PeerID), "Stopped peer not removed")
+}
+
+func TestBitTorrentHandler_AnnounceNumWant(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.MaxPeers = 5
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	for i := 0; i < 8; i++ {
+		require.NoError(t, tkr.PeerAdd(torrent0.InfoHash, store.GenerateTestPeer()))
+	}
+	announcePeers := func(numWant string) int {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		v := req.ToValues()
+		if numWant != "" {
+			v.Set("numwant", numWant)
+		}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, v.Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		d, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		return len(d.(bencode.Dict)["peers"].(string)) / 6
+	}
+	require.Equal(t, 0, announcePeers("0"), "Peers sent for numwant=0")
+	require.Equal(t, 3, announcePeers("3"))
+	require.Equal(t, 5, announcePeers("100"), "numwant not capped by max peers")
+	require.Equal(t, 5, announcePeers(""), "Default numwant not capped by max peers")
+
+	// The peers of the previous announces have joined the swarm
+	tkr.MaxPeers = 100
+	require.Equal(t, 12, announcePeers(""))
+	require.Equal(t, defaultNumWant, tkr.numWant(defaultNumWant, torrent0))
+	torrent0.MaxPeers = 2
+	require.Equal(t, 2, tkr.numWant(10, torrent0), "Torrent max peers ignored")
+}
+
+func TestBitTorrentHandler_AnnounceInfoHashLimit(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.announceLimiter = newInfoHashLimiter(2)
+	rh := NewBitTorrentHandler(tkr)
+	hot := store.GenerateTestTorrent()
+	cold := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(hot))
+	require.NoError(t, tkr.torrents.Add(cold))
+	require.NoError(t, tkr.users.Add(user0))
+	announce := func(ih store.InfoHash) *httptest.ResponseRecorder {
+		req := testReq{Ih: ih, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		return performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	}
+
+	// Hold every slot as if two announces for the hot torrent were still in flight
+	require.True(t, tkr.announceLimiter.acquire(hot.InfoHash))
+	require.True(t, tkr.announceLimiter.acquire(hot.InfoHash))
+	w := announce(hot.InfoHash)
+	require.EqualValues(t, msgTorrentBusy, errCode(w.Code))
+	v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+	require.NoError(t, err)
+	require.Equal(t, Err(msgTorrentBusy).Error(), v.(bencode.Dict)["failure reason"])
+	require.EqualValues(t, 1, v.(bencode.Dict)["retry in"])
+
+	for i := 0; i < 3; i++ {
+		require.EqualValues(t, msgOk, errCode(announce(cold.InfoHash).Code), "Other torrent limited")
+	}
+
+	// Completed announces free their slot
+	tkr.announceLimiter.release(hot.InfoHash)
+	require.EqualValues(t, msgOk, errCode(announce(hot.InfoHash).Code))
+	require.EqualValues(t, msgOk, errCode(announce(hot.InfoHash).Code))
+	tkr.announceLimiter.release(hot.InfoHash)
+	require.Empty(t, tkr.announceLimiter.active)
+}
+
+func TestBitTorrentHandler_AnnounceWhitelistMinVersion(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	require.NoError(t, tkr.torrents.WhiteListAdd(store.WhiteListClient{
+		ClientPrefix: "-qB", ClientName: "qBittorrent", MinVersion: "4.5"}))
+	require.NoError(t, tkr.torrents.WhiteListAdd(store.WhiteListClient{
+		ClientPrefix: "-TR2940-", ClientName: "Transmission"}))
+	require.NoError(t, tkr.LoadWhitelist())
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	announce := func(peerID string) errCode {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.PeerIDFromString(peerID), IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		return errCode(performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil).Code)
+	}
+	require.EqualValues(t, msgBadClient, announce("-qB4170-u-rGseINmloG"), "Outdated client allowed")
+	require.EqualValues(t, msgOk, announce("-qB4500-u-rGseINmloG"))
+	require.EqualValues(t, msgOk, announce("-TR2940-u-rGseINmloG"))
+	require.EqualValues(t, msgBadClient, announce("-TR3000-u-rGseINmloG"), "Unlisted client allowed")
+}
+
+func TestBitTorrentHandler_AnnounceJitter(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.AnnounceJitterMin = 150 * time.Millisecond
+	tkr.AnnounceJitterMax = 200 * time.Millisecond
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	torrent1 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.torrents.Add(torrent1))
+	require.NoError(t, tkr.users.Add(user0))
+	pid := store.GenerateTestPeer().PeerID
+	announce := func(ip string, ih store.InfoHash) time.Duration {
+		req := testReq{Ih: ih, PID: pid, IP: ip, Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		start := time.Now()
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code), "Delayed announce rejected")
+		return time.Since(start)
+	}
+	delayed := atomic.LoadInt64(&metrics.AnnounceDelayed)
+	require.Less(t, int64(announce("12.34.56.78", torrent0.InfoHash)), int64(tkr.AnnounceJitterMin), "First announce delayed")
+	require.GreaterOrEqual(t, int64(announce("12.34.56.78", torrent0.InfoHash)), int64(tkr.AnnounceJitterMin), "Rapid re-announce not delayed")
+	require.Less(t, int64(announce("12.34.56.79", torrent0.InfoHash)), int64(tkr.AnnounceJitterMin), "Other IP delayed")
+	require.Less(t, int64(announce("12.34.56.78", torrent1.InfoHash)), int64(tkr.AnnounceJitterMin), "Other torrent delayed")
+	require.Equal(t, delayed+1, atomic.LoadInt64(&metrics.AnnounceDelayed))
+}
+
+func TestBitTorrentHandler_AnnounceMissingPeerID(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	go tkr.StatWorker()
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	announce := func(pid store.PeerID, port string, key string, uploaded string) errCode {
+		req := testReq{Ih: torrent0.InfoHash, PID: pid, IP: "12.34.56.78", Port: port,
+			Uploaded: uploaded, Downloaded: "0", left: "5000", PK: user0.Passkey}
+		v := req.ToValues()
+		if pid == (store.PeerID{}) {
+			v.Del("peer_id")
+		}
+		if key != "" {
+			v.Set("key", key)
+		}
+		return errCode(performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, v.Encode()), nil, nil).Code)
+	}
+	peer0 := store.GenerateTestPeer().PeerID
+	require.EqualValues(t, msgOk, announce(peer0, "4000", "abc123", "0"))
+	require.EqualValues(t, msgInvalidPeerID, announce(store.PeerID{}, "4000", "abc123", "1000"),
+		"Missing peer_id accepted when matching disabled")
+
+	tkr.PeerIDMatch = peerIDMatchKey
+	require.EqualValues(t, msgOk, announce(peer0, "4000", "abc123", "0"))
+	// The client changed port, but the key still identifies it
+	require.EqualValues(t, msgOk, announce(store.PeerID{}, "5000", "abc123", "1000"))
+	require.EqualValues(t, msgInvalidPeerID, announce(store.PeerID{}, "4000", "other", "1000"))
+
+	tkr.PeerIDMatch = peerIDMatchIPPort
+	peer1 := store.GenerateTestPeer().PeerID
+	require.EqualValues(t, msgOk, announce(peer1, "6000", "", "0"))
+	require.EqualValues(t, msgOk, announce(store.PeerID{}, "6000", "", "2000"))
+	require.EqualValues(t, msgInvalidPeerID, announce(store.PeerID{}, "6001", "", "2000"))
+
+	time.Sleep(time.Millisecond * 200) // Wait for batch update call (100ms)
+	swarm, err := tkr.PeerGetN(torrent0.InfoHash, 10)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(swarm.Peers), "New peer created for announce without a peer_id")
+	var p0, p1 store.Peer
+	require.NoError(t, tkr.PeerGet(&p0, torrent0.InfoHash, peer0))
+	require.NoError(t, tkr.PeerGet(&p1, torrent0.InfoHash, peer1))
+	require.Equal(t, uint64(1000), p0.Uploaded)
+	require.Equal(t, uint64(2000), p1.Uploaded)
+}
+
+func TestShutdownHTTPServers(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	opts := DefaultHTTPOpts()
+	opts.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := NewHTTPServer(opts)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = srv.Serve(ln) }()
+	base := "http://" + ln.Addr().String()
+
+	inFlight := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(base + "/slow")
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- ShutdownHTTPServers(ctx, srv) }()
+	// Wait for the listener to be closed by Shutdown
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return true
+		}
+		_ = conn.Close()
+		return false
+	}, time.Second, 10*time.Millisecond, "New connections accepted while draining")
+	close(release)
+	require.Equal(t, http.StatusOK, <-inFlight, "In-flight request not completed")
+	require.NoError(t, <-shutdown)
+}
+
+func TestShutdownHTTPServersTimeout(t *testing.T) {
+	started := make(chan struct{})
+	opts := DefaultHTTPOpts()
+	opts.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+	srv := NewHTTPServer(opts)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = srv.Serve(ln) }()
+	inFlight := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		inFlight <- err
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, ShutdownHTTPServers(ctx, srv))
+	require.Error(t, <-inFlight, "Connection not closed after the drain timeout")
+}
+
+func TestAnnounceInterval(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.AnnInterval = time.Second * 30
+	tkr.AnnIntervalMin = time.Second * 10
+	tkr.AnnIntervalMax = time.Second * 120
+	tkr.AnnIntervalScalePeers = 100
+	require.Equal(t, tkr.AnnInterval, tkr.announceInterval("", 100000), "Interval scaled while disabled")
+
+	tkr.AnnIntervalScale = intervalScaleLinear
+	require.Equal(t, time.Second*30, tkr.announceInterval("", 0))
+	require.Equal(t, time.Second*60, tkr.announceInterval("", 100))
+	require.Equal(t, time.Second*90, tkr.announceInterval("", 200))
+	require.Equal(t, time.Second*120, tkr.announceInterval("", 100000), "Max interval exceeded")
+
+	tkr.AnnIntervalScale = intervalScaleLog
+	require.Equal(t, time.Second*60, tkr.announceInterval("", 100))
+	require.Equal(t, time.Second*90, tkr.announceInterval("", 300))
+	require.Equal(t, time.Second*120, tkr.announceInterval("", 100000), "Max interval exceeded")
+	prev := time.Duration(0)
+	for size := 0; size < 2000; size += 50 {
+		interval := tkr.announceInterval("", size)
+		require.True(t, interval >= prev, "Interval shrank as the swarm grew")
+		prev = interval
+	}
+
+	tkr.AnnInterval = time.Second
+	require.Equal(t, tkr.AnnIntervalMin, tkr.announceInterval("", 0), "Interval below the minimum")
+}
+
+func TestJitterIntervals(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.AnnIntervalMin = time.Second * 30
+	interval, minInterval := tkr.jitterIntervals(time.Second * 60)
+	require.Equal(t, time.Second*60, interval, "Interval jittered while disabled")
+	require.Equal(t, tkr.AnnIntervalMin, minInterval)
+
+	tkr.AnnIntervalJitter = 10
+	varied := false
+	for i := 0; i < 1000; i++ {
+		interval, minInterval = tkr.jitterIntervals(time.Second * 60)
+		require.True(t, interval >= time.Second*54 && interval <= time.Second*66, "Interval outside the jitter band")
+		require.True(t, minInterval >= tkr.AnnIntervalMin && minInterval <= interval)
+		varied = varied || interval != time.Second*60
+	}
+	require.True(t, varied, "Interval never jittered")
+
+	tkr.AnnIntervalJitter = 50
+	for i := 0; i < 1000; i++ {
+		interval, minInterval = tkr.jitterIntervals(time.Second * 40)
+		require.True(t, interval >= tkr.AnnIntervalMin, "Interval below the minimum")
+		require.True(t, minInterval <= interval)
+	}
+	require.Equal(t, 100.0, validJitter(250))
+	require.Equal(t, 0.0, validJitter(-5))
+}
+
+func TestBitTorrentHandler_AnnounceCompactPeerList(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	for i := 0; i < 2; i++ {
+		p := store.GenerateTestPeer()
+		p.Port = uint16(5000 + i)
+		require.NoError(t, tkr.peers.Add(torrent0.InfoHash, p))
+	}
+	announce := func() interface{} {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(w.Body).Decode()
+		require.NoError(t, err)
+		return v.(bencode.Dict)["peers"]
+	}
+	peers, isString := announce().(string)
+	require.True(t, isString, "Compact peers not sent as a string")
+	require.Len(t, peers, 12)
+
+	tkr.CompactPeerList = true
+	list, isList := announce().(bencode.List)
+	require.True(t, isList, "Compact peers not sent as a list")
+	// The peer from the first announce is now in the swarm too
+	require.Len(t, list, 3)
+	for _, p := range list {
+		require.Len(t, p.(string), 6)
+	}
+}
+
+type countingGeoProvider struct {
+	geo.DummyProvider
+	lookups int
+}
+
+func (p *countingGeoProvider) GetLocation(ip net.IP) geo.Location {
+	p.lookups++
+	return p.DummyProvider.GetLocation(ip)
+}
+
+func TestGeoLocationCache(t *testing.T) {
+	opts := NewDefaultOpts()
+	opts.GeodbCacheSize = 2
+	provider := &countingGeoProvider{}
+	opts.Geodb = provider
+	opts.GeodbEnabled = true
+	tkr, err := New(context.Background(), opts)
+	require.NoError(t, err)
+	hits, misses := atomic.LoadInt64(&metrics.GeoCacheHits), atomic.LoadInt64(&metrics.GeoCacheMisses)
+
+	ipA, ipB, ipC := net.ParseIP("1.1.1.1"), net.ParseIP("2.2.2.2"), net.ParseIP("3.3.3.3")
+	tkr.GeoLocation(ipA)
+	tkr.GeoLocation(ipA)
+	require.Equal(t, 1, provider.lookups, "Repeated lookup not cached")
+	require.Equal(t, hits+1, atomic.LoadInt64(&metrics.GeoCacheHits))
+	require.Equal(t, misses+1, atomic.LoadInt64(&metrics.GeoCacheMisses))
+
+	// ipA is the least recently used entry once the cache is full so it is evicted
+	tkr.GeoLocation(ipB)
+	tkr.GeoLocation(ipC)
+	require.Equal(t, 2, tkr.geoCache.Len())
+	tkr.GeoLocation(ipA)
+	require.Equal(t, 4, provider.lookups, "Cache not bounded")
+
+	// Replacing the provider drops locations from the previous one
+	newProvider := &countingGeoProvider{}
+	tkr.SetGeodb(newProvider, true)
+	require.Equal(t, 0, tkr.geoCache.Len())
+	tkr.GeoLocation(ipA)
+	require.Equal(t, 1, newProvider.lookups)
+}
+
+func TestBitTorrentHandler_AnnounceDuplicatePeerID(t *testing.T) {
+	for _, policy := range []string{duplicatePeerIDAllow, duplicatePeerIDReject, duplicatePeerIDFlag, duplicatePeerIDSeparate} {
+		tkr, err := NewTestTracker()
+		require.NoError(t, err, "Failed to init tracker")
+		tkr.DuplicatePeerID = policy
+		rh := NewBitTorrentHandler(tkr)
+		torrent0 := store.GenerateTestTorrent()
+		user0 := store.GenerateTestUser()
+		user1 := store.GenerateTestUser()
+		require.NoError(t, tkr.torrents.Add(torrent0))
+		require.NoError(t, tkr.users.Add(user0))
+		require.NoError(t, tkr.users.Add(user1))
+		pid := store.GenerateTestPeer().PeerID
+		announce := func(usr store.User, port string) errCode {
+			req := testReq{Ih: torrent0.InfoHash, PID: pid, IP: "12.34.56.78", Port: port,
+				Uploaded: "0", Downloaded: "0", left: "5000", PK: usr.Passkey, event: string(consts.STARTED)}
+			w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+			return errCode(w.Code)
+		}
+		require.EqualValues(t, msgOk, announce(user0, "4000"), policy)
+		code := announce(user1, "4001")
+		swarm, err := tkr.peers.GetN(torrent0.InfoHash, 0)
+		require.NoError(t, err)
+		users := map[uint32]store.PeerID{}
+		for _, p := range swarm.Peers {
+			users[p.UserID] = p.PeerID
+		}
+		switch policy {
+		case duplicatePeerIDAllow:
+			require.EqualValues(t, msgOk, code)
+			require.Len(t, users, 1)
+		case duplicatePeerIDReject:
+			require.EqualValues(t, msgDuplicatePeerID, code)
+			require.Len(t, users, 1)
+			require.Contains(t, users, user0.UserID)
+		case duplicatePeerIDFlag:
+			require.EqualValues(t, msgOk, code)
+			require.Len(t, users, 1)
+			entries := tkr.AuditLog.Entries()
+			require.Len(t, entries, 1)
+			require.Equal(t, auditDuplicatePeerID, entries[0].Action)
+		case duplicatePeerIDSeparate:
+			require.EqualValues(t, msgOk, code)
+			require.Len(t, users, 2, "Peers collapsed")
+			require.NotEqual(t, users[user0.UserID], users[user1.UserID])
+			scoped := users[user1.UserID]
+			require.Equal(t, pid[:clientPrefixLen], scoped[:clientPrefixLen], "Client prefix not kept")
+		}
+	}
+}
+
+func TestBitTorrentHandler_AnnounceStatsDisabled(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.StatsEnabled = false
+	go tkr.StatWorker()
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	user1 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	require.NoError(t, tkr.users.Add(user1))
+	pid0, pid1 := store.GenerateTestPeer().PeerID, store.GenerateTestPeer().PeerID
+	announce := func(usr store.User, pid store.PeerID, port string, left string, event consts.AnnounceType) bencode.Dict {
+		req := testReq{Ih: torrent0.InfoHash, PID: pid, IP: "12.34.56.78", Port: port,
+			Uploaded: "1000", Downloaded: "1000", left: left, PK: usr.Passkey, event: string(event)}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		return v.(bencode.Dict)
+	}
+	announce(user0, pid0, "4000", "0", consts.STARTED)
+	resp := announce(user1, pid1, "4001", "5000", consts.STARTED)
+	require.Equal(t, 6, len(resp["peers"].(string)), "Peer list not sent")
+	require.EqualValues(t, 1, resp["complete"])
+	require.EqualValues(t, 1, resp["incomplete"])
+	// Completing moves the peer to the seeders straight away
+	resp = announce(user1, pid1, "4001", "0", consts.COMPLETED)
+	require.EqualValues(t, 2, resp["complete"])
+	require.EqualValues(t, 0, resp["incomplete"])
+	announce(user0, pid0, "4000", "0", consts.STOPPED)
+	var peer store.Peer
+	require.Equal(t, consts.ErrInvalidPeerID, tkr.PeerGet(&peer, torrent0.InfoHash, pid0), "Stopped peer not removed")
+	// Scrapes count the swarm too as the stored counters are never updated
+	sr := scrapeReq{PK: user0.Passkey, InfoHashes: []store.InfoHash{torrent0.InfoHash}}
+	w := performRequest(rh, "GET", fmt.Sprintf("/scrape/%s?%s", sr.PK, sr.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+	v, err := bencode.NewDecoder(w.Body).Decode()
+	require.NoError(t, err)
+	files := v.(bencode.Dict)["files"].(bencode.Dict)
+	require.EqualValues(t, 1, files[torrent0.InfoHash.String()].(bencode.Dict)["complete"])
+	require.EqualValues(t, 0, files[torrent0.InfoHash.String()].(bencode.Dict)["incomplete"])
+
+	time.Sleep(time.Millisecond * 300) // Longer than the batch interval (100ms)
+	require.Empty(t, tkr.StateUpdateChan, "Stats queued")
+	for _, u := range []store.User{user0, user1} {
+		var usr store.User
+		require.NoError(t, tkr.users.GetByPasskey(&usr, u.Passkey))
+		require.Equal(t, u.Uploaded, usr.Uploaded, "User stats written")
+		require.Equal(t, u.Downloaded, usr.Downloaded, "User stats written")
+	}
+	var tor store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor, torrent0.InfoHash, false))
+	require.Equal(t, torrent0.Announces, tor.Announces, "Torrent stats written")
+	require.Equal(t, torrent0.Uploaded, tor.Uploaded, "Torrent stats written")
+}
+
+func TestBitTorrentHandler_AnnounceClassInterval(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.AnnInterval = time.Second * 30
+	tkr.AnnIntervalMin = time.Second * 10
+	tkr.ClassAnnIntervals = map[string]time.Duration{"vip": time.Second * 15, "staff": time.Second}
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	interval := func(class string) int64 {
+		usr := store.GenerateTestUser()
+		usr.Class = class
+		require.NoError(t, tkr.users.Add(usr))
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: usr.Passkey, event: string(consts.STARTED)}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		return v.(bencode.Dict)["interval"].(int64)
+	}
+	require.EqualValues(t, 15, interval("VIP"), "Class interval not used")
+	require.EqualValues(t, 30, interval("user"), "Standard interval not used")
+	require.EqualValues(t, 30, interval(""))
+	require.EqualValues(t, 10, interval("staff"), "Class interval below the minimum")
+}
+
+func TestBitTorrentHandler_AnnounceExcludeOwnPeers(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	// user0 has 2 other clients in the swarm alongside a peer from another user
+	for i := 0; i < 3; i++ {
+		p := store.GenerateTestPeer()
+		p.Port = uint16(5000 + i)
+		if i < 2 {
+			p.UserID = user0.UserID
+		} else {
+			p.UserID = user0.UserID + 1
+		}
+		require.NoError(t, tkr.PeerAdd(torrent0.InfoHash, p))
+	}
+	announcePeers := func(numWant string) int {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey, event: string(consts.STARTED)}
+		q := req.ToValues()
+		q.Set("numwant", numWant)
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, q.Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		return len(v.(bencode.Dict)["peers"].(string)) / 6
+	}
+	require.Equal(t, 3, announcePeers("50"), "Other peers not sent")
+	tkr.ExcludeOwnPeers = true
+	// The previous announce added a third peer for user0, none of them are sent
+	require.Equal(t, 1, announcePeers("50"), "Users own peers sent")
+	// A partial fetch of only the users own peers still finds the other peer
+	for i := 0; i < 10; i++ {
+		require.Equal(t, 1, announcePeers("1"), "Other peer not found after filtering")
+	}
+
+	// Public tracker users all share a user id so nothing is excluded
+	tkr.Public = true
+	swarm, err := tkr.PeerGetN(torrent0.InfoHash, 0)
+	require.NoError(t, err)
+	require.Equal(t, swarm.Len(), (&BitTorrentHandler{tracker: tkr}).filterPeers(swarm, &AnnounceRequest{Left: 5000}, user0.UserID, store.PeerID{}).Len())
+}
+
+// countryGeoProvider locates every IP in the country
+type countryGeoProvider struct {
+	geo.DummyProvider
+	country string
+}
+
+func (p *countryGeoProvider) GetLocation(_ net.IP) geo.Location {
+	return geo.Location{ISOCode: p.country}
+}
+
+func TestPreferLocalPeers(t *testing.T) {
+	swarm := store.NewSwarm()
+	for i, country := range []string{"CA", "US", "CA", "US", "US"} {
+		p := store.GenerateTestPeer()
+		p.CountryCode = country
+		p.Port = uint16(5000 + i)
+		swarm.Peers[p.PeerID] = p
+	}
+	countries := func(s store.Swarm) map[string]int {
+		counts := map[string]int{}
+		for _, p := range s.Peers {
+			counts[p.CountryCode]++
+		}
+		return counts
+	}
+	require.Equal(t, map[string]int{"CA": 2, "US": 1}, countries(preferLocalPeers(swarm, "CA", 3)))
+	require.Equal(t, map[string]int{"CA": 1}, countries(preferLocalPeers(swarm, "CA", 1)))
+	require.Equal(t, map[string]int{"US": 3}, countries(preferLocalPeers(swarm, "US", 3)))
+	require.Len(t, preferLocalPeers(swarm, "CA", 10).Peers, 5)
+	require.Len(t, preferLocalPeers(swarm, "CA", 0).Peers, 5)
+}
+
+func TestBitTorrentHandler_AnnouncePreferLocalPeers(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.SetGeodb(&countryGeoProvider{country: "CA"}, true)
+	tkr.PreferLocalPeers = true
+	tkr.MaxPeers = 3
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	local := map[uint16]bool{}
+	for i := 0; i < 8; i++ {
+		p := store.GenerateTestPeer()
+		p.Port = uint16(5000 + i)
+		p.CountryCode = "US"
+		if i%2 == 0 {
+			p.CountryCode = "CA"
+			local[p.Port] = true
+		}
+		require.NoError(t, tkr.PeerAdd(torrent0.InfoHash, p))
+	}
+	req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+		Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey, event: string(consts.STARTED)}
+	w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+	v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+	require.NoError(t, err)
+	peers := v.(bencode.Dict)["peers"].(string)
+	require.Equal(t, 3, len(peers)/6)
+	for i := 0; i < len(peers); i += 6 {
+		port := binary.BigEndian.Uint16([]byte(peers[i+4 : i+6]))
+		require.True(t, local[port], "Remote peer %d sent before local peers", port)
+	}
+}
+
+func TestBitTorrentHandler_AnnounceLowRatio(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	user0.Uploaded = 100
+	user0.Downloaded = 1000
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	for i := 0; i < 2; i++ {
+		p := store.GenerateTestPeer()
+		p.Port = uint16(5000 + i)
+		p.Left = uint64(i * 1000)
+		require.NoError(t, tkr.PeerAdd(torrent0.InfoHash, p))
+	}
+	tkr.MinRatio = 0.5
+	announce := func(left string) bencode.Dict {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "1000", Downloaded: "0", left: left, PK: user0.Passkey}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code))
+		v, err := bencode.NewDecoder(bytes.NewReader(w.Body.Bytes())).Decode()
+		require.NoError(t, err)
+		return v.(bencode.Dict)
+	}
+	leech := announce("5000")
+	require.Equal(t, "", leech["peers"].(string), "Low ratio leecher sent peers")
+	require.Equal(t, tkr.LowRatioMessage, leech["warning message"].(string))
+	update := <-tkr.StateUpdateChan
+	require.Equal(t, uint64(1000), update.Uploaded, "Low ratio stats not accounted")
+
+	seed := announce("0")
+	require.NotEmpty(t, seed["peers"].(string), "Low ratio seeder not sent peers")
+	require.Nil(t, seed["warning message"])
+	<-tkr.StateUpdateChan
+
+	tkr.MinRatio = 0.1
+	require.NotEmpty(t, announce("5000")["peers"].(string), "Recovered user not sent peers")
+}
+
+func TestRatioCache(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	require.NotNil(t, tkr.ratios, "Ratio cache not enabled")
+	tkr.MinRatio = 0.6
+	user0 := store.GenerateTestUser()
+	user0.Uploaded = 500
+	user0.Downloaded = 0
+	require.NoError(t, tkr.users.Add(user0))
+
+	// Nothing downloaded is an infinite ratio which is always allowed
+	require.True(t, math.IsInf(tkr.userRatio(user0), 1))
+	require.False(t, tkr.lowRatio(user0))
+
+	require.NoError(t, tkr.UserSync(map[string]store.UserStats{user0.Passkey: {Downloaded: 1000}}))
+	require.True(t, math.IsInf(tkr.userRatio(user0), 1), "Cached ratio changed before refresh")
+	tkr.refreshRatios()
+	require.Equal(t, 0.5, tkr.userRatio(user0))
+	require.True(t, tkr.lowRatio(user0))
+
+	require.NoError(t, tkr.UserSync(map[string]store.UserStats{user0.Passkey: {Uploaded: 500}}))
+	tkr.refreshRatios()
+	require.Equal(t, 1.0, tkr.userRatio(user0))
+	require.False(t, tkr.lowRatio(user0))
+
+	// The least recently used ratio is evicted once full
+	bounded := newRatioCache(1)
+	bounded.set("a", 1)
+	bounded.set("b", 2)
+	_, found := bounded.get("a")
+	require.False(t, found, "Ratio cache not bounded")
+}
+
+func TestBitTorrentHandler_AnnounceEventNone(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+		Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+	query := req.ToValues().Encode()
+	for _, q := range []string{query, "event=&" + query, query + "&event=", query + "&event=none", query + "&event=NONE"} {
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, q), nil, nil)
+		require.EqualValues(t, msgOk, errCode(w.Code), q)
+		update := <-tkr.StateUpdateChan
+		require.Equal(t, consts.ANNOUNCE, update.Event, q)
+	}
+}
+
+func TestBitTorrentHandler_AnnounceCompletedCheck(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	torrent0.Size = 10000
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	ih := torrent0.InfoHash
+	// completed returns the response code and whether the snatch was queued to be counted
+	completed := func(downloaded string) (errCode, bool) {
+		req := testReq{Ih: ih, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: downloaded, left: "0", PK: user0.Passkey, event: string(consts.COMPLETED)}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		select {
+		case update := <-tkr.StateUpdateChan:
+			return errCode(w.Code), update.Event == consts.COMPLETED
+		default:
+			return errCode(w.Code), false
+		}
+	}
+	code, counted := completed("100")
+	require.EqualValues(t, msgOk, code, "Unchecked completed rejected")
+	require.True(t, counted)
+
+	tkr.CompletedCheck = completedCheckWarn
+	before := atomic.LoadInt64(&metrics.AnnounceImplausibleCompleted)
+	code, counted = completed("100")
+	require.EqualValues(t, msgOk, code, "Warned completed rejected")
+	require.True(t, counted)
+	require.Equal(t, before+1, atomic.LoadInt64(&metrics.AnnounceImplausibleCompleted))
+	entries := tkr.AuditLog.Entries()
+	require.Equal(t, auditImplausibleCompleted, entries[len(entries)-1].Action)
+
+	tkr.CompletedCheck = completedCheckReject
+	code, counted = completed("100")
+	require.EqualValues(t, msgImplausibleCompleted, code)
+	require.False(t, counted, "Rejected completed counted")
+	code, counted = completed("9500")
+	require.EqualValues(t, msgOk, code, "Completed within tolerance rejected")
+	require.True(t, counted)
+
+	// Torrents larger than 4GB are checked too
+	large := store.GenerateTestTorrent()
+	large.Size = 10 << 30
+	require.NoError(t, tkr.torrents.Add(large))
+	ih = large.InfoHash
+	code, _ = completed("100")
+	require.EqualValues(t, msgImplausibleCompleted, code, "Large torrent not checked")
+	code, counted = completed(strconv.FormatUint(large.Size, 10))
+	require.EqualValues(t, msgOk, code, "Large completed rejected")
+	require.True(t, counted)
+}
+
+func TestBitTorrentHandler_AnnounceRateLimit(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.RateLimitRate = 1
+	tkr.RateLimitBurst = 2
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	user1 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	require.NoError(t, tkr.users.Add(user1))
+	announce := func(pk string) errCode {
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78", Port: "4000",
+			Uploaded: "0", Downloaded: "0", left: "0", PK: pk}
+		w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode()), nil, nil)
+		return errCode(w.Code)
+	}
+	before := atomic.LoadInt64(&metrics.AnnounceStatusRateLimited)
+	require.EqualValues(t, msgOk, announce(user0.Passkey))
+	require.EqualValues(t, msgOk, announce(user0.Passkey))
+	require.EqualValues(t, msgClientRequestTooFast, announce(user0.Passkey), "Announce over burst allowed")
+	require.Equal(t, before+1, atomic.LoadInt64(&metrics.AnnounceStatusRateLimited))
+	require.EqualValues(t, msgOk, announce(user1.Passkey), "Other passkey limited")
+
+	// A minute later the bucket has refilled a single token
+	tkr.rateLimits.Set(user0.Passkey, tokenBucket{tokens: 0, updated: time.Now().Add(-time.Minute)})
+	require.EqualValues(t, msgOk, announce(user0.Passkey), "Bucket not refilled")
+	require.EqualValues(t, msgClientRequestTooFast, announce(user0.Passkey))
+
+	tkr.RateLimitRate = 0
+	require.EqualValues(t, msgOk, announce(user0.Passkey), "Disabled rate limit applied")
+}
+
+func TestBitTorrentHandler_AnnounceRateLimitPublic(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	tkr.Public = true
+	tkr.AutoRegister = true
+	tkr.RateLimitRate = 1
+	tkr.RateLimitBurst = 1
+	rh := NewBitTorrentHandler(tkr)
+	announce := func(forwarded string) errCode {
+		req := testReq{Ih: store.GenerateTestTorrent().InfoHash, PID: store.GenerateTestPeer().PeerID,
+			IP: "192.0.2.1", Port: "4000", Uploaded: "0", Downloaded: "0", left: "0"}
+		r := httptest.NewRequest("GET", "/announce?"+req.ToValues().Encode(), nil)
+		r.Header.Set("X-Forwarded-For", forwarded)
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, r)
+		return errCode(w.Code)
+	}
+	require.EqualValues(t, msgOk, announce("1.2.3.4"))
+	// Forwarded headers from untrusted clients must not give them a new bucket
+	require.EqualValues(t, msgClientRequestTooFast, announce("5.6.7.8"), "Spoofed header bypassed limit")
+}
+
+// flakyTorrentStore fails all torrent lookups while failing is set, counting the lookups made
+type flakyTorrentStore struct {
+	store.TorrentStore
+	failing int32
+	calls   int32
+}
+
+func (s *flakyTorrentStore) Get(t *store.Torrent, ih store.InfoHash, deletedOk bool) error {
+	atomic.AddInt32(&s.calls, 1)
+	if atomic.LoadInt32(&s.failing) == 1 {
+		return errors.New("dial tcp: connection refused")
+	}
+	return s.TorrentStore.Get(t, ih, deletedOk)
+}
+
+// syncCountingTorrentStore counts the batches written to the store
+type syncCountingTorrentStore struct {
+	store.TorrentStore
+	syncs int32
+}
+
+func (s *syncCountingTorrentStore) Sync(b map[store.InfoHash]store.TorrentStats) error {
+	atomic.AddInt32(&s.syncs, 1)
+	return s.TorrentStore.Sync(b)
+}
+
+func TestFlushStats(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	counting := &syncCountingTorrentStore{TorrentStore: tkr.torrents}
+	tkr.torrents = counting
+	torrent0 := store.GenerateTestTorrent()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+
+	tkr.flushStats(map[string]store.UserStats{}, map[store.PeerHash]store.PeerStats{},
+		map[store.InfoHash]store.TorrentStats{})
+	require.Equal(t, int32(0), atomic.LoadInt32(&counting.syncs), "Empty batch written")
+
+	tkr.flushStats(nil, nil, map[store.InfoHash]store.TorrentStats{
+		torrent0.InfoHash: {Announces: 2, Uploaded: 100},
+	})
+	require.Equal(t, int32(1), atomic.LoadInt32(&counting.syncs))
+	var tor store.Torrent
+	require.NoError(t, tkr.torrents.Get(&tor, torrent0.InfoHash, false))
+	require.Equal(t, torrent0.Announces+2, tor.Announces)
+	require.Equal(t, torrent0.Uploaded+100, tor.Uploaded)
+}
+
+func TestBitTorrentHandler_AnnounceStoreBreaker(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	flaky := &flakyTorrentStore{TorrentStore: tkr.torrents, failing: 1}
+	tkr.torrents = flaky
+	tkr.StoreDegradedMode = true
+	tkr.DegradedInterval = time.Minute * 15
+	tkr.storeBreaker = newStoreBreaker(3, time.Millisecond*50)
+	// Cached users keep receiving degraded responses while the breaker is open
+	tkr.UsersCache = store.NewUserCache()
+	tkr.TorrentsCache = store.NewTorrentCache()
+	trips := atomic.LoadInt64(&metrics.StoreBreakerTrips)
+
+	peer := store.GenerateTestPeer()
+	req := testReq{Ih: torrent0.InfoHash, PID: peer.PeerID, IP: "12.34.56.78",
+		Port: "4000", Uploaded: "0", Downloaded: "0", left: "5000", PK: user0.Passkey}
+	u := fmt.Sprintf("/announce/%s?%s", req.PK, req.ToValues().Encode())
+	// The torrent is not cached, so it can only be announced while the store is up
+	announce := func() errCode {
+		return errCode(performRequest(rh, "GET", u, nil, nil).Code)
+	}
+	for i := 0; i < 3; i++ {
+		require.Equal(t, msgStoreUnavailable, announce())
+	}
+	require.Equal(t, breakerOpen, tkr.storeBreaker.current())
+	require.Equal(t, trips+1, atomic.LoadInt64(&metrics.StoreBreakerTrips))
+	// The store is not called while the breaker is open
+	for i := 0; i < 5; i++ {
+		require.Equal(t, msgStoreUnavailable, announce())
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&flaky.calls))
+
+	// Cached torrents are announced in degraded mode, but passkeys missing from the cache
+	// can't be checked until the store recovers
+	torrent1 := store.GenerateTestTorrent()
+	tkr.TorrentsCache.Set(torrent1)
+	cachedReq := req
+	cachedReq.Ih = torrent1.InfoHash
+	w := performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", user0.Passkey, cachedReq.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgOk, errCode(w.Code))
+	v, err := bencode.NewDecoder(w.Body).Decode()
+	require.NoError(t, err)
+	require.EqualValues(t, tkr.DegradedInterval.Seconds(), v.(bencode.Dict)["interval"])
+	user1 := store.GenerateTestUser()
+	require.NoError(t, tkr.users.Add(user1))
+	w = performRequest(rh, "GET", fmt.Sprintf("/announce/%s?%s", user1.Passkey, cachedReq.ToValues().Encode()), nil, nil)
+	require.EqualValues(t, msgStoreUnavailable, errCode(w.Code))
+	v, err = bencode.NewDecoder(w.Body).Decode()
+	require.NoError(t, err)
+	require.Equal(t, Err(msgStoreUnavailable).Error(), v.(bencode.Dict)["failure reason"])
+	require.EqualValues(t, 1, v.(bencode.Dict)["retry in"])
+
+	// A failed probe reopens the breaker
+	time.Sleep(time.Millisecond * 60)
+	require.Equal(t, msgStoreUnavailable, announce())
+	require.Equal(t, int32(4), atomic.LoadInt32(&flaky.calls))
+	require.Equal(t, breakerOpen, tkr.storeBreaker.current())
+
+	// Once the store recovers the next probe closes the breaker
+	atomic.StoreInt32(&flaky.failing, 0)
+	require.Equal(t, msgStoreUnavailable, announce())
+	time.Sleep(time.Millisecond * 60)
+	require.Equal(t, msgOk, announce())
+	require.Equal(t, breakerClosed, tkr.storeBreaker.current())
+	require.Equal(t, msgOk, announce())
+}
+
+func TestBitTorrentHandler_AnnouncePublicPrivate(t *testing.T) {
+	tkr, err := NewTestTracker()
+	require.NoError(t, err, "Failed to init tracker")
+	rh := NewBitTorrentHandler(tkr)
+	torrent0 := store.GenerateTestTorrent()
+	user0 := store.GenerateTestUser()
+	require.NoError(t, tkr.torrents.Add(torrent0))
+	require.NoError(t, tkr.users.Add(user0))
+	tkr.UnauthorizedReason = "Passkey required"
+
+	for i, tc := range []struct {
+		public bool
+		pk     string
+		exp    errCode
+	}{
+		{public: true, pk: "", exp: msgOk},
+		{public: false, pk: "", exp: msgInvalidAuth},
+		{public: false, pk: "01234567890123456789", exp: msgInvalidAuth},
+		{public: false, pk: user0.Passkey, exp: msgOk},
+	} {
+		tkr.Public = tc.public
+		unauthorized := atomic.LoadInt64(&metrics.AnnounceStatusUnauthorized)
+		req := testReq{Ih: torrent0.InfoHash, PID: store.GenerateTestPeer().PeerID, IP: "12.34.56.78",
+			Port: "4000", Uploaded: "0", Downloaded: "0", left: "5000"}
+		u := fmt.Sprintf("/announce?%s", req.ToValues().Encode())
+		if tc.pk != "" {
+			u = fmt.Sprintf("/announce/%s?%s", tc.pk, req.ToValues().Encode())
+		}
+		w := performRequest(rh, "GET", u, nil, nil)
+		require.EqualValues(t, tc.exp, errCode(w.Code), "Invalid status (%d)", i)
+		if tc.exp == msgInvalidAuth {
+			// A single failure response must be sent
+			require.Equal(t, string(responseError(tkr.UnauthorizedReason)), w.Body.String(), "Invalid body (%d)", i)
+			require.Equal(t, unauthorized+1, atomic.LoadInt64(&metrics.AnnounceStatusUnauthorized))
+		}
+	}
+}
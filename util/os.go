@@ -13,18 +13,38 @@ import (
 )
 
 // WaitForSignal will execute a function when a matching os.Signal is received
-// This is mostly designed to shutdown & cleanup services
+// This is mostly designed to shutdown & cleanup services. SIGHUP is left for WaitForReload.
 func WaitForSignal(ctx context.Context, f func(ctx context.Context) error) {
+	WaitForSignalTimeout(ctx, time.Second*5, f)
+}
+
+// WaitForSignalTimeout is WaitForSignal with the deadline given to f set to timeout
+func WaitForSignalTimeout(ctx context.Context, timeout time.Duration, f func(ctx context.Context) error) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	<-sigChan
-	c, cancel := context.WithDeadline(ctx, time.Now().Add(time.Second*5))
+	c, cancel := context.WithDeadline(ctx, time.Now().Add(timeout))
 	defer cancel()
 	if err := f(c); err != nil {
 		log.Errorf("Error closing servers gracefully; %s", err)
 	}
 }
 
+// WaitForReload executes f each time a SIGHUP is received until the context is cancelled
+func WaitForReload(ctx context.Context, f func()) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+	for {
+		select {
+		case <-sigChan:
+			f()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 // Exists checks for the existence of a file path
 func Exists(path string) bool {
 	if _, err := os.Stat(path); err != nil {